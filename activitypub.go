@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ActivityPub publishing: the list is a single actor (named after the local
+// part of ListAddress) whose outbox contains one Note per archived post. Remote
+// users can Follow the actor, and new posts are delivered to followers' inboxes.
+// This requires the archive and the HTTP server, and a PublicURL at which the
+// HTTP server can be reached from the internet.
+
+const activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+
+var (
+	// ErrActivityPubDeliveryFailed - Returned when a remote inbox rejects an activity.
+	ErrActivityPubDeliveryFailed = errors.New("Remote ActivityPub inbox rejected delivery")
+	// ErrActivityPubBadActor - Returned when a remote actor document lacks an inbox.
+	ErrActivityPubBadActor = errors.New("Remote ActivityPub actor has no inbox")
+	// ErrActivityPubBadSignature - Returned when an inbox POST isn't validly signed by its actor.
+	ErrActivityPubBadSignature = errors.New("ActivityPub request is not validly signed by its actor")
+	// ErrActivityPubPrivateAddress - Returned instead of contacting a remote actor or
+	// inbox on a private, loopback or link-local address.
+	ErrActivityPubPrivateAddress = errors.New("Refusing to contact a private, loopback or link-local address")
+
+	activityPubKeyName = []byte("privatekey")
+	followersBucket    = []byte("followers")
+)
+
+// apMaxDocumentBytes limits what is read of inbox POSTs and remote actors.
+const apMaxDocumentBytes = 1 << 20
+
+// apSignatureMaxAge is how far a signed request's Date may be from now, as
+// Mastodon allows.
+const apSignatureMaxAge = 12 * time.Hour
+
+// apClient fetches remote actors and delivers to inboxes. Strangers choose
+// both URLs, so it only connects to public addresses, checked after DNS
+// resolution so that no name can point it inward.
+var apClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: refuseNonPublic}).DialContext,
+	},
+}
+
+func refuseNonPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return ErrActivityPubPrivateAddress
+	}
+	return nil
+}
+
+// publicIP reports whether ip is neither private, loopback, link-local nor
+// otherwise special.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// apActorName is the preferredUsername of the list actor.
+func (eng *Engine) apActorName() string {
+	return strings.SplitN(eng.Config.ListAddress, "@", 2)[0]
+}
+
+// apURL joins a path onto the public base URL of the HTTP server.
+func (eng *Engine) apURL(path string) string {
+	return strings.TrimRight(eng.Config.PublicURL, "/") + path
+}
+
+func (eng *Engine) apActorID() string {
+	return eng.apURL("/ap/actor")
+}
+
+// activityPubKey fetches, or creates and stores, the list actor's signing key.
+// NewEngine calls it once; use Engine.apKey after that.
+func (db *ListlessDB) activityPubKey() (*rsa.PrivateKey, error) {
+	var key *rsa.PrivateKey
+	err := db.Update(func(tx *bolt.Tx) error {
+		apBucket := tx.Bucket([]byte(activityPubBucketName))
+		if apBucket == nil {
+			return ErrActivityPubBucketNotFound
+		}
+		if keyPEM := apBucket.Get(activityPubKeyName); keyPEM != nil {
+			block, _ := pem.Decode(keyPEM)
+			if block == nil {
+				return errors.New("Stored ActivityPub key is not PEM encoded")
+			}
+			var err error
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			return err
+		}
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		return apBucket.Put(activityPubKeyName, keyPEM)
+	})
+	return key, err
+}
+
+// putFollower records (or, if inbox is empty, removes) a follower's inbox.
+func (db *ListlessDB) putFollower(actorID, inbox string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		apBucket := tx.Bucket([]byte(activityPubBucketName))
+		if apBucket == nil {
+			return ErrActivityPubBucketNotFound
+		}
+		followers, err := apBucket.CreateBucketIfNotExists(followersBucket)
+		if err != nil {
+			return err
+		}
+		if inbox == "" {
+			return followers.Delete([]byte(actorID))
+		}
+		return followers.Put([]byte(actorID), []byte(inbox))
+	})
+}
+
+// followerInboxes returns the distinct inboxes of all followers.
+func (db *ListlessDB) followerInboxes() ([]string, error) {
+	seen := make(map[string]struct{})
+	var inboxes []string
+	err := db.View(func(tx *bolt.Tx) error {
+		apBucket := tx.Bucket([]byte(activityPubBucketName))
+		if apBucket == nil {
+			return ErrActivityPubBucketNotFound
+		}
+		followers := apBucket.Bucket(followersBucket)
+		if followers == nil {
+			return nil
+		}
+		return followers.ForEach(func(actor, inbox []byte) error {
+			if _, ok := seen[string(inbox)]; !ok {
+				seen[string(inbox)] = struct{}{}
+				inboxes = append(inboxes, string(inbox))
+			}
+			return nil
+		})
+	})
+	return inboxes, err
+}
+
+func (eng *Engine) serveWebfinger(w http.ResponseWriter, r *http.Request) {
+	domain := strings.SplitN(eng.Config.ListAddress, "@", 2)
+	if r.URL.Query().Get("resource") != "acct:"+eng.apActorName()+"@"+domain[len(domain)-1] {
+		http.NotFound(w, r)
+		return
+	}
+	writeActivityJSON(w, "application/jrd+json", map[string]interface{}{
+		"subject": r.URL.Query().Get("resource"),
+		"links": []map[string]string{
+			{"rel": "self", "type": "application/activity+json", "href": eng.apActorID()},
+		},
+	})
+}
+
+func (eng *Engine) serveActor(w http.ResponseWriter, r *http.Request) {
+	pubDER, err := x509.MarshalPKIXPublicKey(&eng.apKey.PublicKey)
+	if err != nil {
+		http.Error(w, "Error loading actor", http.StatusInternalServerError)
+		return
+	}
+	writeActivityJSON(w, "application/activity+json", map[string]interface{}{
+		"@context":          []string{activityStreamsContext, "https://w3id.org/security/v1"},
+		"id":                eng.apActorID(),
+		"type":              "Group",
+		"preferredUsername": eng.apActorName(),
+		"name":              eng.Config.ListAddress,
+		"summary":           "Posts to the mailing list " + eng.Config.ListAddress,
+		"inbox":             eng.apURL("/ap/inbox"),
+		"outbox":            eng.apURL("/ap/outbox"),
+		"publicKey": map[string]string{
+			"id":           eng.apActorID() + "#main-key",
+			"owner":        eng.apActorID(),
+			"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})),
+		},
+	})
+}
+
+// apNote renders an archived message as an ActivityPub Note.
+func (eng *Engine) apNote(entry *ArchivedMessage) map[string]interface{} {
+	entry = eng.publicEntry(entry)
+	content := "<p><strong>" + html.EscapeString(entry.Subject) + "</strong></p><p>" +
+		strings.Replace(html.EscapeString(strings.TrimSpace(entry.Text)), "\n", "<br>", -1) + "</p>"
+	note := map[string]interface{}{
+		"id":           eng.apURL("/ap/notes/" + entry.ID),
+		"type":         "Note",
+		"attributedTo": eng.apActorID(),
+		"published":    entry.Date.Format(time.RFC3339),
+		"to":           []string{activityStreamsContext + "#Public"},
+		"cc":           []string{eng.apURL("/ap/followers")},
+		"summary":      entry.Subject,
+		"content":      content,
+	}
+	if permalink := eng.ArchivePermalink(entry); permalink != "" {
+		note["url"] = permalink
+	}
+	return note
+}
+
+// apCreate wraps a Note in a Create activity.
+func (eng *Engine) apCreate(entry *ArchivedMessage) map[string]interface{} {
+	note := eng.apNote(entry)
+	return map[string]interface{}{
+		"@context":  activityStreamsContext,
+		"id":        eng.apURL("/ap/notes/" + entry.ID + "/activity"),
+		"type":      "Create",
+		"actor":     eng.apActorID(),
+		"published": note["published"],
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"object":    note,
+	}
+}
+
+func (eng *Engine) serveOutbox(w http.ResponseWriter, r *http.Request) {
+	entries := eng.feedEntries(w)
+	if entries == nil {
+		return
+	}
+	items := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, eng.apCreate(entry))
+	}
+	writeActivityJSON(w, "application/activity+json", map[string]interface{}{
+		"@context":     activityStreamsContext,
+		"id":           eng.apURL("/ap/outbox"),
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	})
+}
+
+func (eng *Engine) serveFollowers(w http.ResponseWriter, r *http.Request) {
+	inboxes, err := eng.DB.followerInboxes()
+	if err != nil {
+		http.Error(w, "Error fetching followers", http.StatusInternalServerError)
+		return
+	}
+	writeActivityJSON(w, "application/activity+json", map[string]interface{}{
+		"@context":   activityStreamsContext,
+		"id":         eng.apURL("/ap/followers"),
+		"type":       "OrderedCollection",
+		"totalItems": len(inboxes),
+	})
+}
+
+func (eng *Engine) serveNote(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/ap/notes/"), "/activity")
+	entry, err := eng.DB.GetArchivedMessage(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	note := eng.apNote(entry)
+	note["@context"] = activityStreamsContext
+	writeActivityJSON(w, "application/activity+json", note)
+}
+
+// serveInbox handles Follow and Undo(Follow) activities, which must be signed
+// by their actor. Everything else is accepted and ignored.
+func (eng *Engine) serveInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, apMaxDocumentBytes))
+	if err != nil {
+		http.Error(w, "Bad activity", http.StatusBadRequest)
+		return
+	}
+	var activity struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err = json.Unmarshal(body, &activity); err != nil {
+		http.Error(w, "Bad activity", http.StatusBadRequest)
+		return
+	}
+	if activity.Type != "Follow" && activity.Type != "Undo" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	// Otherwise anyone could subscribe any inbox, or unsubscribe anyone. The
+	// key is taken from the actor's own document, not from wherever keyId
+	// points, which could claim any owner.
+	actor, err := fetchRemoteActor(activity.Actor)
+	if err == nil && actor.ID != activity.Actor {
+		err = ErrActivityPubBadSignature
+	}
+	if err == nil {
+		err = verifyActivitySignature(r, body, actor.key)
+	}
+	if err != nil {
+		log15.Warn("Refused unsigned ActivityPub activity", log15.Ctx{"context": "activitypub", "error": err, "type": activity.Type, "actor": activity.Actor})
+		http.Error(w, "Activity not signed by its actor", http.StatusUnauthorized)
+		return
+	}
+	switch activity.Type {
+	case "Follow":
+		inbox, err := actor.inbox()
+		if err != nil {
+			log15.Error("Error fetching ActivityPub follower", log15.Ctx{"context": "activitypub", "error": err, "actor": activity.Actor})
+			http.Error(w, "Could not fetch actor", http.StatusBadRequest)
+			return
+		}
+		if err = eng.DB.putFollower(activity.Actor, inbox); err != nil {
+			http.Error(w, "Error storing follower", http.StatusInternalServerError)
+			return
+		}
+		log15.Info("New ActivityPub follower", log15.Ctx{"context": "activitypub", "actor": activity.Actor})
+		accept := map[string]interface{}{
+			"@context": activityStreamsContext,
+			"id":       eng.apURL(fmt.Sprintf("/ap/accepts/%d", time.Now().UnixNano())),
+			"type":     "Accept",
+			"actor":    eng.apActorID(),
+			"object":   activity,
+		}
+		go func() {
+			if err := eng.deliverActivity(inbox, accept); err != nil {
+				log15.Error("Error delivering Accept to follower", log15.Ctx{"context": "activitypub", "error": err, "actor": activity.Actor})
+			}
+		}()
+	case "Undo":
+		var undone struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(activity.Object, &undone) == nil && undone.Type == "Follow" {
+			if err := eng.DB.putFollower(activity.Actor, ""); err != nil {
+				http.Error(w, "Error removing follower", http.StatusInternalServerError)
+				return
+			}
+			log15.Info("ActivityPub follower left", log15.Ctx{"context": "activitypub", "actor": activity.Actor})
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// apRemoteActor is what listless needs of a remote actor document.
+type apRemoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// fetchRemoteActor is fetchActor, replaced in tests.
+var fetchRemoteActor = fetchActor
+
+// fetchActor retrieves a remote actor document over https.
+func fetchActor(id string) (*apRemoteActor, error) {
+	if u, err := url.Parse(id); err != nil || u.Scheme != "https" {
+		return nil, ErrActivityPubBadActor
+	}
+	req, err := http.NewRequest("GET", id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/activity+json")
+	resp, err := apClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	actor := new(apRemoteActor)
+	if err = json.NewDecoder(io.LimitReader(resp.Body, apMaxDocumentBytes)).Decode(actor); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+// inbox returns the actor's shared inbox, or its own.
+func (a *apRemoteActor) inbox() (string, error) {
+	if a.Endpoints.SharedInbox != "" {
+		return a.Endpoints.SharedInbox, nil
+	}
+	if a.Inbox == "" {
+		return "", ErrActivityPubBadActor
+	}
+	return a.Inbox, nil
+}
+
+// key returns the actor's public key if it is the one keyID names. Only the
+// key the actor's own document publishes is trusted to sign for it.
+func (a *apRemoteActor) key(keyID string) (*rsa.PublicKey, error) {
+	if a.PublicKey.ID == "" || a.PublicKey.ID != keyID {
+		return nil, ErrActivityPubBadSignature
+	}
+	if a.PublicKey.Owner != "" && a.PublicKey.Owner != a.ID {
+		return nil, ErrActivityPubBadSignature
+	}
+	block, _ := pem.Decode([]byte(a.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, ErrActivityPubBadSignature
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrActivityPubBadSignature
+	}
+	return rsaPub, nil
+}
+
+// apSignedHeaders are the headers signed requests must cover, to bind the
+// signature to this request and body.
+var apSignedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+var signatureParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// signingString is what HTTP Signatures sign of a request: the named
+// headers, one per line.
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+		default:
+			value = r.Header.Get(h)
+		}
+		if value == "" {
+			return "", ErrActivityPubBadSignature
+		}
+		lines[i] = h + ": " + value
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// signActivityRequest signs a POST of body with key, as keyID, using HTTP
+// Signatures (as Mastodon et al. require).
+func signActivityRequest(req *http.Request, body []byte, key *rsa.PrivateKey, keyID string) error {
+	digest := sha256.Sum256(body)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	signed, err := signingString(req, apSignedHeaders)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(apSignedHeaders, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// verifyActivitySignature checks that a request with body is recently and
+// validly signed with the key lookup returns for its keyId.
+func verifyActivitySignature(r *http.Request, body []byte, lookup func(keyID string) (*rsa.PublicKey, error)) error {
+	params := make(map[string]string)
+	for _, m := range signatureParam.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return ErrActivityPubBadSignature
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return ErrActivityPubBadSignature
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	covered := make(map[string]bool)
+	for _, h := range headers {
+		covered[h] = true
+	}
+	for _, required := range apSignedHeaders {
+		if !covered[required] {
+			return ErrActivityPubBadSignature
+		}
+	}
+	digest := sha256.Sum256(body)
+	if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return ErrActivityPubBadSignature
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date) > apSignatureMaxAge || time.Until(date) > apSignatureMaxAge {
+		return ErrActivityPubBadSignature
+	}
+	signed, err := signingString(r, headers)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return ErrActivityPubBadSignature
+	}
+	key, err := lookup(params["keyId"])
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(signed))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature) != nil {
+		return ErrActivityPubBadSignature
+	}
+	return nil
+}
+
+// deliverActivity POSTs an activity to a remote inbox, signed with the list
+// actor's key.
+func (eng *Engine) deliverActivity(inbox string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+	if err = signActivityRequest(req, body, eng.apKey, eng.apActorID()+"#main-key"); err != nil {
+		return err
+	}
+	resp, err := apClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v: %s", ErrActivityPubDeliveryFailed, resp.Status)
+	}
+	return nil
+}
+
+// publishToFediverse delivers a Create(Note) for an archived post to all followers.
+func (eng *Engine) publishToFediverse(entry *ArchivedMessage) {
+	inboxes, err := eng.DB.followerInboxes()
+	if err != nil {
+		log15.Error("Error fetching ActivityPub followers", log15.Ctx{"context": "activitypub", "error": err})
+		return
+	}
+	create := eng.apCreate(entry)
+	for _, inbox := range inboxes {
+		if err := eng.deliverActivity(inbox, create); err != nil {
+			log15.Error("Error delivering post to ActivityPub inbox", log15.Ctx{"context": "activitypub", "error": err, "inbox": inbox})
+		}
+	}
+	log15.Info("Published post to ActivityPub followers", log15.Ctx{"context": "activitypub", "id": entry.ID, "inboxes": len(inboxes)})
+}
+
+func writeActivityJSON(w http.ResponseWriter, contentType string, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Error rendering JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// apTestActor publishes key as the actor id's own key.
+func apTestActor(t *testing.T, id string, key *rsa.PrivateKey) *apRemoteActor {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	actor := &apRemoteActor{ID: id, Inbox: id + "/inbox"}
+	actor.PublicKey.ID = id + "#main-key"
+	actor.PublicKey.Owner = id
+	actor.PublicKey.PublicKeyPem = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return actor
+}
+
+func TestActivitySignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	actor := apTestActor(t, "https://remote.example/users/bob", key)
+	keyID := actor.PublicKey.ID
+	body := []byte(`{"type":"Follow","actor":"https://remote.example/users/bob"}`)
+	signed := func() *http.Request {
+		req, err := http.NewRequest("POST", "https://list.example.com/ap/inbox", bytes.NewReader(body))
+		assert.NoError(t, err)
+		assert.NoError(t, signActivityRequest(req, body, key, keyID))
+		return req
+	}
+
+	assert.NoError(t, verifyActivitySignature(signed(), body, actor.key))
+
+	err = verifyActivitySignature(signed(), []byte(`{"type":"Follow","actor":"https://remote.example/users/eve"}`), actor.key)
+	assert.Equal(t, ErrActivityPubBadSignature, err, "body changed after signing")
+
+	req := signed()
+	req.Header.Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+	err = verifyActivitySignature(req, body, actor.key)
+	assert.Equal(t, ErrActivityPubBadSignature, err, "stale date")
+
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	err = verifyActivitySignature(signed(), body, apTestActor(t, actor.ID, other).key)
+	assert.Equal(t, ErrActivityPubBadSignature, err, "signed with another key")
+
+	req = signed()
+	req.Header.Del("Signature")
+	err = verifyActivitySignature(req, body, actor.key)
+	assert.Equal(t, ErrActivityPubBadSignature, err, "unsigned")
+}
+
+func TestInboxRefusesForeignKey(t *testing.T) {
+	victimKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	evilKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	victim := apTestActor(t, "https://victim.example/users/ann", victimKey)
+	// The attacker's key document claims to belong to the victim.
+	forged := apTestActor(t, "https://evil.example/k", evilKey)
+	forged.PublicKey.Owner = victim.ID
+	documents := map[string]*apRemoteActor{victim.ID: victim, forged.ID: forged}
+	defer func(fetch func(string) (*apRemoteActor, error)) { fetchRemoteActor = fetch }(fetchRemoteActor)
+	fetchRemoteActor = func(id string) (*apRemoteActor, error) {
+		if doc, ok := documents[id]; ok {
+			return doc, nil
+		}
+		return nil, ErrActivityPubBadActor
+	}
+
+	eng := &Engine{Config: &Config{}}
+	for _, activityType := range []string{"Follow", "Undo"} {
+		body := []byte(`{"type":"` + activityType + `","actor":"` + victim.ID + `","object":{"type":"Follow"}}`)
+		req := httptest.NewRequest("POST", "https://list.example.com/ap/inbox", bytes.NewReader(body))
+		assert.NoError(t, signActivityRequest(req, body, evilKey, forged.PublicKey.ID))
+		w := httptest.NewRecorder()
+		eng.serveInbox(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, activityType)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1":    true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"192.168.0.10":    false,
+		"172.16.5.4":      false,
+		"169.254.169.254": false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+	} {
+		assert.Equal(t, public, publicIP(net.ParseIP(addr)), addr)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrDatabaseLocked - Returned when a read-only command can't open the
+	// database because a running list holds it, and there's no AdminSocket to ask.
+	ErrDatabaseLocked = errors.New("Database is in use by a running list; set AdminSocket to inspect it meanwhile")
+
+	// ErrAdminSocketInUse - Returned when something already answers on AdminSocket.
+	ErrAdminSocketInUse = errors.New("AdminSocket is in use; is the list already running?")
+)
+
+// AdminListenAndServe serves the AdminSocket, through which CLI commands that
+// only read the database are given a consistent snapshot of it while the list
+// runs. Anyone who can reach the socket can read everything, so it is made
+// private to the list's user.
+func (eng *Engine) AdminListenAndServe() error {
+	socket := eng.Config.AdminSocket
+	// A socket left by an unclean shutdown would make Listen fail, but one
+	// something still answers on belongs to another instance.
+	if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+			conn.Close()
+			return ErrAdminSocketInUse
+		}
+		os.Remove(socket)
+	}
+	l, err := listenPrivate(socket)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", eng.serveSnapshot)
+	log15.Info("Serving admin socket", log15.Ctx{"context": "admin", "socket": socket})
+	return http.Serve(l, mux)
+}
+
+// listenPrivate listens on a Unix socket only the list's user can connect to.
+// The socket is made in a new directory private to the user, so nobody can
+// connect before it is restricted, and then moved into place.
+func listenPrivate(socket string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(socket), ".listless-admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(private, 0600); err == nil {
+		err = os.Rename(private, socket)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	// The listener would unlink where the socket was made; privateListener
+	// removes it from where it is now.
+	if ul, ok := l.(interface{ SetUnlinkOnClose(bool) }); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return &privateListener{Listener: l, socket: socket}, nil
+}
+
+// privateListener removes its socket when closed, from where listenPrivate
+// moved it.
+type privateListener struct {
+	net.Listener
+	socket string
+}
+
+func (l *privateListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.socket)
+	return err
+}
+
+// serveSnapshot writes out the whole database as of a read transaction.
+func (eng *Engine) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	err := eng.DB.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		log15.Error("Error sending database snapshot", log15.Ctx{"context": "admin", "error": err})
+	}
+}
+
+// openReadOnlyDatabase opens the database for a command that only reads it.
+// If a running list holds it, a snapshot is fetched over AdminSocket instead.
+// Buckets aren't created or migrated, so lookups in an old database may fail.
+func openReadOnlyDatabase(cfg *Config) (*ListlessDB, error) {
+	db, err := bolt.Open(cfg.Database, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err == nil {
+		if err = checkSchema(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &ListlessDB{DB: db}, nil
+	} else if err != bolt.ErrTimeout {
+		return nil, err
+	}
+	if cfg.AdminSocket == "" {
+		return nil, ErrDatabaseLocked
+	}
+	log15.Info("Database in use, fetching a snapshot from the running list", log15.Ctx{"context": "admin", "socket": cfg.AdminSocket})
+	return fetchSnapshot(cfg.AdminSocket)
+}
+
+// fetchSnapshot copies the running list's database to a temporary file over
+// its admin socket, and opens the copy read-only.
+func fetchSnapshot(socket string) (*ListlessDB, error) {
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://listless/snapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Admin socket returned " + resp.Status)
+	}
+	f, err := ioutil.TempFile("", "listless-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	// Once open, the snapshot is readable until closed, so the file needn't
+	// outlive this function.
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(f.Name(), 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ListlessDB{DB: db}, nil
+}
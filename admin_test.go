@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listless-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "list.sock")
+	l, err := listenPrivate(socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fi, err := os.Lstat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// A second instance mustn't take over the socket.
+	eng := &Engine{Config: &Config{AdminSocket: socket}}
+	assert.Equal(t, ErrAdminSocketInUse, eng.AdminListenAndServe())
+	_, err = os.Lstat(socket)
+	assert.NoError(t, err)
+
+	l.Close()
+	_, err = os.Lstat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Kinds of alert, each with its own cooldown.
+const (
+	alertSMTP = "smtp"
+	alertIMAP = "imap"
+)
+
+// alerter tracks recent failures against the configured alert thresholds.
+// Its methods take the current time, and return a non-empty message when an
+// alert is due.
+type alerter struct {
+	mu            sync.Mutex
+	smtpFailures  int
+	smtpWindow    time.Duration
+	imapDown      time.Duration
+	cooldown      time.Duration
+	failures      []time.Time
+	imapDownSince time.Time
+	lastAlert     map[string]time.Time
+}
+
+func newAlerter(cfg *Config) *alerter {
+	return &alerter{
+		smtpFailures: cfg.AlertSMTPFailures,
+		smtpWindow:   time.Duration(cfg.AlertSMTPWindowMinutes) * time.Minute,
+		imapDown:     time.Duration(cfg.AlertIMAPDownMinutes) * time.Minute,
+		cooldown:     time.Duration(cfg.AlertCooldownMinutes) * time.Minute,
+		lastAlert:    make(map[string]time.Time),
+	}
+}
+
+// due reports whether an alert of this kind may be sent, and if so starts
+// its cooldown. Must be called with mu held.
+func (al *alerter) due(kind string, now time.Time) bool {
+	if last, ok := al.lastAlert[kind]; ok && now.Sub(last) < al.cooldown {
+		return false
+	}
+	al.lastAlert[kind] = now
+	return true
+}
+
+// smtpResult records the outcome of a send.
+func (al *alerter) smtpResult(err error, now time.Time) string {
+	if err == nil || al.smtpFailures <= 0 {
+		return ""
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	recent := al.failures[:0]
+	for _, t := range al.failures {
+		if now.Sub(t) < al.smtpWindow {
+			recent = append(recent, t)
+		}
+	}
+	al.failures = append(recent, now)
+	if len(al.failures) < al.smtpFailures || !al.due(alertSMTP, now) {
+		return ""
+	}
+	return strconv.Itoa(len(al.failures)) + " failures sending mail in the last " + al.smtpWindow.String() + "; the latest was: " + err.Error()
+}
+
+// imapResult records the outcome of a poll of the inbox.
+func (al *alerter) imapResult(err error, now time.Time) string {
+	if al.imapDown <= 0 {
+		return ""
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if err == nil {
+		al.imapDownSince = time.Time{}
+		return ""
+	}
+	if al.imapDownSince.IsZero() {
+		al.imapDownSince = now
+	}
+	if now.Sub(al.imapDownSince) < al.imapDown || !al.due(alertIMAP, now) {
+		return ""
+	}
+	return "Fetching mail has been failing since " + al.imapDownSince.Format(time.RFC1123) + "; the latest error was: " + err.Error()
+}
+
+// alertRecipients returns AlertRecipients, or AdminAddress if none are set.
+func (eng *Engine) alertRecipients() []string {
+	if len(eng.Config.AlertRecipients) > 0 {
+		return eng.Config.AlertRecipients
+	}
+	if eng.Config.AdminAddress != "" {
+		return []string{eng.Config.AdminAddress}
+	}
+	return nil
+}
+
+// recordSMTPResult feeds a send's outcome to the alerter.
+func (eng *Engine) recordSMTPResult(err error) {
+	if eng.alerts == nil {
+		return
+	}
+	if message := eng.alerts.smtpResult(err, time.Now()); message != "" {
+		go eng.raiseAlert(message)
+	}
+}
+
+// recordIMAPResult feeds a poll's outcome to the alerter.
+func (eng *Engine) recordIMAPResult(err error) {
+	if eng.alerts == nil {
+		return
+	}
+	if message := eng.alerts.imapResult(err, time.Now()); message != "" {
+		go eng.raiseAlert(message)
+	}
+}
+
+// raiseAlert sends an alert to the alert recipients and webhooks. Mail may
+// well be what's broken, so the webhooks are tried first.
+func (eng *Engine) raiseAlert(message string) {
+	message = "Alert for " + eng.Config.ListAddress + ": " + message
+	log15.Warn("Raising alert", log15.Ctx{"context": "alert", "message": message})
+	for _, hookURL := range eng.Config.AlertWebhooks {
+		body, err := json.Marshal(webhookPayload(hookURL, message))
+		if err != nil {
+			log15.Error("Error encoding alert payload", log15.Ctx{"context": "alert", "error": err})
+			break
+		}
+		resp, err := http.Post(hookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log15.Error("Error posting alert to webhook", log15.Ctx{"context": "alert", "error": err})
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			log15.Error("Webhook rejected alert", log15.Ctx{"context": "alert", "status": resp.Status})
+		}
+	}
+	recipients := eng.alertRecipients()
+	if len(recipients) == 0 {
+		return
+	}
+	e := email.NewEmail()
+	e.From = eng.fromAddress("alerts")
+	e.To = recipients
+	e.Subject = "[listless] Alert for " + eng.Config.ListAddress
+	e.Text = []byte(message + "\n")
+	em := WrapEmail(e)
+	if err := eng.markSent(em); err != nil {
+		log15.Error("Error signing alert", log15.Ctx{"context": "alert", "error": err})
+		return
+	}
+	if err := eng.deliver(context.Background(), em); err != nil {
+		log15.Error("Error mailing alert", log15.Ctx{"context": "alert", "error": err})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerterThresholds(t *testing.T) {
+	al := newAlerter(&Config{AlertSMTPFailures: 3, AlertSMTPWindowMinutes: 10, AlertIMAPDownMinutes: 15, AlertCooldownMinutes: 60})
+	failure := errors.New("connection refused")
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	// Failures spread beyond the window don't add up.
+	assert.Empty(t, al.smtpResult(failure, start))
+	assert.Empty(t, al.smtpResult(failure, start.Add(11*time.Minute)))
+	assert.Empty(t, al.smtpResult(failure, start.Add(12*time.Minute)))
+	assert.Contains(t, al.smtpResult(failure, start.Add(13*time.Minute)), "3 failures sending mail")
+	// Cooldown suppresses repeats.
+	assert.Empty(t, al.smtpResult(failure, start.Add(14*time.Minute)))
+	assert.Empty(t, al.smtpResult(nil, start.Add(15*time.Minute)))
+
+	assert.Empty(t, al.imapResult(failure, start))
+	assert.Empty(t, al.imapResult(failure, start.Add(10*time.Minute)))
+	assert.Contains(t, al.imapResult(failure, start.Add(16*time.Minute)), "connection refused")
+	// Recovery resets the outage.
+	assert.Empty(t, al.imapResult(nil, start.Add(17*time.Minute)))
+	assert.Empty(t, al.imapResult(failure, start.Add(90*time.Minute)))
+}
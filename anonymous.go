@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrAnonymousBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrAnonymousBucketNotFound = errors.New("Anonymous sender bucket not found")
+
+	// ErrAnonymousPostNotFound - Returned when a Message-Id has no recorded anonymous sender.
+	ErrAnonymousPostNotFound = errors.New("No anonymous post recorded with that Message-Id")
+)
+
+// Headers removed from anonymised posts because they identify the sender or
+// the route their message took.
+var identifyingHeaders = []string{
+	"Sender", "Reply-To", "Return-Path", "Received", "X-Originating-IP",
+	"X-Mailer", "User-Agent", "Dkim-Signature", "Authentication-Results",
+	"Received-SPF", "X-Sender", "Organization",
+}
+
+// AnonymousPost is the record of who really sent an anonymised post. It is
+// kept in its own bucket, which isn't exposed to Lua, for abuse handling.
+type AnonymousPost struct {
+	MessageID         string
+	OriginalMessageID string
+	From              string
+	Sender            string
+	Subject           string
+	Time              time.Time
+}
+
+// listDomain returns the domain part of ListAddress.
+func (eng *Engine) listDomain() string {
+	domain := eng.Config.ListAddress
+	if at := strings.LastIndex(domain, "@"); at >= 0 {
+		domain = domain[at+1:]
+	}
+	return domain
+}
+
+// anonymise replaces the author of a post with AnonymousName (or their
+// pseudonym, with AnonymousPseudonyms) at the list address, removes identifying headers, and gives it a new Message-Id (the
+// original usually names the sender's host). The true sender is recorded
+// under the new Message-Id.
+func (eng *Engine) anonymise(em *Email) error {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	post := &AnonymousPost{
+		MessageID:         "<anon-" + hex.EncodeToString(b) + "@" + eng.listDomain() + ">",
+		OriginalMessageID: em.GetHeader("Message-Id"),
+		From:              em.From,
+		Sender:            em.Sender,
+		Subject:           em.Subject,
+		Time:              time.Now().UTC(),
+	}
+	name := eng.Config.AnonymousName
+	if eng.Config.AnonymousPseudonyms {
+		pseudonym, err := eng.DB.PseudonymFor(em.Sender)
+		if err != nil {
+			return err
+		}
+		name = pseudonym
+	}
+	if err := eng.DB.recordAnonymousPost(post); err != nil {
+		return err
+	}
+	em.From = name + " <" + eng.Config.ListAddress + ">"
+	em.Sender = normaliseEmail(eng.Config.ListAddress)
+	em.ReplyTo = nil
+	for _, header := range identifyingHeaders {
+		em.Headers.Del(header)
+	}
+	em.Headers.Set("Message-Id", post.MessageID)
+	return nil
+}
+
+// recordAnonymousPost stores the true sender of an anonymised post.
+func (db *ListlessDB) recordAnonymousPost(post *AnonymousPost) error {
+	postb, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		anonymous := tx.Bucket([]byte(anonymousBucketName))
+		if anonymous == nil {
+			return ErrAnonymousBucketNotFound
+		}
+		return anonymous.Put([]byte(post.MessageID), postb)
+	})
+}
+
+// RevealAnonymousPost returns the record of who sent an anonymised post.
+func (db *ListlessDB) RevealAnonymousPost(messageID string) (*AnonymousPost, error) {
+	post := new(AnonymousPost)
+	err := db.View(func(tx *bolt.Tx) error {
+		anonymous := tx.Bucket([]byte(anonymousBucketName))
+		if anonymous == nil {
+			return ErrAnonymousBucketNotFound
+		}
+		postb := anonymous.Get([]byte(messageID))
+		if postb == nil {
+			return ErrAnonymousPostNotFound
+		}
+		return json.Unmarshal(postb, post)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ArchivePermalink returns the public URL for an archive entry, or "" if no
+// ArchiveURL is configured.
+func (eng *Engine) ArchivePermalink(entry *ArchivedMessage) string {
+	if eng.Config.ArchiveURL == "" || entry == nil {
+		return ""
+	}
+	return strings.TrimRight(eng.Config.ArchiveURL, "/") + "/" + entry.ID
+}
+
+// archiveOutgoing stores an outgoing message in the archive and, if a public
+// ArchiveURL is configured, adds the message's permalink as an Archived-At
+// header (RFC5064) and optionally to the footer of the text and HTML parts.
+func (eng *Engine) archiveOutgoing(em *Email) (*ArchivedMessage, error) {
+	entry, err := eng.DB.ArchiveMessage(em)
+	if err != nil {
+		return nil, err
+	}
+	permalink := eng.ArchivePermalink(entry)
+	if permalink == "" {
+		return entry, nil
+	}
+	em.SetHeader("Archived-At", "<"+permalink+">")
+	if eng.Config.ArchiveFooter && !eng.hasArchiveFooter(em) {
+		if len(em.Text) > 0 {
+			em.Text = append(em.Text, []byte("\n-- \nArchived at: "+permalink+"\n")...)
+		}
+		if len(em.HTML) > 0 {
+			escaped := html.EscapeString(permalink)
+			em.HTML = append(em.HTML, []byte(`<p>Archived at: <a href="`+escaped+`">`+escaped+`</a></p>`)...)
+		}
+		em.markApplied(eng.Config.ListAddress, appliedFooter)
+	}
+	return entry, nil
+}
+
+// hasArchiveFooter reports whether a message already carries this list's
+// archive footer, by its marker header or by finding the footer in the body,
+// so a message coming round again doesn't get a second one.
+func (eng *Engine) hasArchiveFooter(em *Email) bool {
+	if em.hasApplied(eng.Config.ListAddress, appliedFooter) {
+		return true
+	}
+	base := strings.TrimRight(eng.Config.ArchiveURL, "/") + "/"
+	return strings.Contains(string(em.Text), "Archived at: "+base) ||
+		strings.Contains(string(em.HTML), `Archived at: <a href="`+html.EscapeString(base))
+}
+
+// archiveRetention reports whether any archive retention limit is set.
+func (eng *Engine) archiveRetention() bool {
+	return eng.Config.ArchiveRetentionDays > 0 || eng.Config.ArchiveMaxMessages > 0 || eng.Config.ArchiveMaxBytes > 0
+}
+
+// PruneArchive applies the archive retention limits once.
+func (eng *Engine) PruneArchive() (int, error) {
+	return eng.DB.PruneArchive(eng.archiveMaxAge(), eng.Config.ArchiveMaxMessages, int64(eng.Config.ArchiveMaxBytes))
+}
+
+// CountPrunable returns how many archived messages PruneArchive would delete
+// now.
+func (eng *Engine) CountPrunable() (int, error) {
+	return eng.DB.CountPrunable(eng.archiveMaxAge(), eng.Config.ArchiveMaxMessages, int64(eng.Config.ArchiveMaxBytes))
+}
+
+func (eng *Engine) archiveMaxAge() time.Duration {
+	return time.Duration(eng.Config.ArchiveRetentionDays) * 24 * time.Hour
+}
+
+// ArchivePruneLoop runs PruneArchive hourly until closeCh is closed.
+func (eng *Engine) ArchivePruneLoop(closeCh <-chan struct{}) {
+	for {
+		removed, err := eng.PruneArchive()
+		if err != nil {
+			log15.Error("Error pruning archive", log15.Ctx{"context": "db", "error": err})
+		} else if removed > 0 {
+			log15.Info("Pruned archive", log15.Ctx{"context": "db", "removed": removed})
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// ErrUnknownObfuscation - Returned when ArchiveObfuscation isn't a known style.
+var ErrUnknownObfuscation = errors.New("Unknown ArchiveObfuscation; use \"off\", \"words\" or \"hide\"")
+
+// emailPattern matches things that look like email addresses in free text.
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)+`)
+
+// obfuscateEmails rewrites the addresses in s in the given style: "words"
+// gives "user at example dot com", and "hide" replaces them entirely.
+func obfuscateEmails(s, style string) string {
+	switch style {
+	case "words":
+		return emailPattern.ReplaceAllStringFunc(s, func(addr string) string {
+			at := strings.LastIndex(addr, "@")
+			return addr[:at] + " at " + strings.Replace(addr[at+1:], ".", " dot ", -1)
+		})
+	case "hide":
+		return emailPattern.ReplaceAllString(s, "[address hidden]")
+	}
+	return s
+}
+
+// publicEntry returns a copy of an archive entry for public output (feeds,
+// NNTP and ActivityPub), with addresses obfuscated per ArchiveObfuscation.
+// The Message-Id is left alone, as it is an identifier.
+func (eng *Engine) publicEntry(entry *ArchivedMessage) *ArchivedMessage {
+	style := eng.Config.ArchiveObfuscation
+	if style == "" || style == "off" {
+		return entry
+	}
+	public := *entry
+	public.From = obfuscateEmails(entry.From, style)
+	public.Sender = obfuscateEmails(entry.Sender, style)
+	public.Subject = obfuscateEmails(entry.Subject, style)
+	public.Text = obfuscateEmails(entry.Text, style)
+	public.HTML = obfuscateEmails(entry.HTML, style)
+	return &public
+}
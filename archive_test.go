@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObfuscateEmails(t *testing.T) {
+	text := "Mail usienne.mc+lists@mail.example.com, or see example.com."
+	assert.Equal(t, "Mail usienne.mc+lists at mail dot example dot com, or see example.com.", obfuscateEmails(text, "words"))
+	assert.Equal(t, "Mail [address hidden], or see example.com.", obfuscateEmails(text, "hide"))
+	assert.Equal(t, text, obfuscateEmails(text, "off"))
+}
+
+func TestArchiveMessageOncePerMessageID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listless-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewDatabase(path.Join(dir, "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	post := func(messageID, text string) *Email {
+		e := email.NewEmail()
+		e.From = "ann@example.com"
+		e.Subject = "Hello"
+		e.Text = []byte(text)
+		e.Headers.Set("Message-Id", messageID)
+		return WrapEmail(e)
+	}
+
+	// A relay that failed after archiving, then the retry.
+	first, err := db.ArchiveMessage(post("<1@example.com>", "First try"))
+	assert.NoError(t, err)
+	retry, err := db.ArchiveMessage(post("<1@example.com>", "Second try"))
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, retry.ID)
+	other, err := db.ArchiveMessage(post("<2@example.com>", "Another post"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, other.ID)
+	count, _, _, err := db.ArchiveBounds()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+	stored, err := db.GetArchivedMessage(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Second try", stored.Text)
+
+	// Once pruned, the Message-Id gets a new entry.
+	removed, err := db.PruneArchive(0, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	again, err := db.ArchiveMessage(post("<1@example.com>", "Third try"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, again.ID)
+}
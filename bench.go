@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// benchOptions shape the synthetic mail used by 'listless bench'.
+type benchOptions struct {
+	Messages       int
+	BodySize       int
+	Recipients     int
+	Attachments    float64 // Fraction of messages with an attachment.
+	AttachmentSize int
+}
+
+// benchResult summarises a benchmark run.
+type benchResult struct {
+	Messages   int
+	Errors     int
+	Elapsed    time.Duration
+	Latencies  []time.Duration // Sorted.
+	Sent       int
+	Recipients int
+	SentBytes  int
+}
+
+type byDuration []time.Duration
+
+func (d byDuration) Len() int           { return len(d) }
+func (d byDuration) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDuration) Less(i, j int) bool { return d[i] < d[j] }
+
+// percentile returns the pth percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// syntheticMessage builds a raw inbound message from sender to the list.
+func syntheticMessage(n int, sender, list string, opts benchOptions, rnd *rand.Rand) ([]byte, error) {
+	e := email.NewEmail()
+	e.From = sender
+	e.To = []string{list}
+	for i := 0; i < opts.Recipients; i++ {
+		e.Cc = append(e.Cc, fmt.Sprintf("bench-cc-%d@example.com", i))
+	}
+	e.Subject = fmt.Sprintf("Benchmark message %d", n)
+	e.Headers.Set("Message-Id", fmt.Sprintf("<bench-%d-%d@example.com>", time.Now().UnixNano(), n))
+	line := "The quick brown fox jumps over the lazy dog. "
+	e.Text = []byte(strings.Repeat(line, opts.BodySize/len(line)+1)[:opts.BodySize])
+	if opts.Attachments > 0 && rnd.Float64() < opts.Attachments {
+		data := make([]byte, opts.AttachmentSize)
+		rnd.Read(data)
+		if _, err := e.Attach(bytes.NewReader(data), "bench.bin", "application/octet-stream"); err != nil {
+			return nil, err
+		}
+	}
+	return e.Bytes()
+}
+
+// copyFile copies src to dst, if src exists.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// runBench drives synthetic mail through Handler, and so eventLoop, against
+// a copy of the list's database, sending to a fake SMTP server. Mirroring,
+// alerting and error reporting are turned off so nothing leaves the machine.
+func runBench(cfg *Config, opts benchOptions) (*benchResult, error) {
+	tmp, err := ioutil.TempDir("", "listless-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	dbCopy := filepath.Join(tmp, "bench.db")
+	if err = copyFile(cfg.Database, dbCopy); err != nil {
+		return nil, err
+	}
+	sink, err := newFakeSMTP()
+	if err != nil {
+		return nil, err
+	}
+	defer sink.Close()
+	bcfg := *cfg
+	bcfg.Database = dbCopy
+	bcfg.Transport = "smtp"
+	bcfg.SMTPHost = "127.0.0.1"
+	bcfg.smtpAddr = sink.Addr()
+	bcfg.OAuthRefreshToken = ""
+	bcfg.Identities = nil
+	bcfg.Webhooks = nil
+	bcfg.ChangeScript = ""
+	bcfg.ChangeWebhooks = nil
+	bcfg.MatrixRoomID = ""
+	bcfg.ActivityPub = false
+	bcfg.AdminAddress = ""
+	bcfg.AlertRecipients = nil
+	bcfg.AlertWebhooks = nil
+	bcfg.SentryDSN = ""
+	bcfg.ErrorWebhook = ""
+	eng, err := NewEngine(&bcfg)
+	if err != nil {
+		return nil, err
+	}
+	defer eng.Close()
+	senders := eng.DB.goGetAllSubscribers(false)
+	if len(senders) == 0 {
+		senders = []string{"bench-sender@example.com"}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	result := &benchResult{Messages: opts.Messages}
+	start := time.Now()
+	for i := 0; i < opts.Messages; i++ {
+		raw, err := syntheticMessage(i, senders[i%len(senders)], bcfg.ListAddress, opts, rnd)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Now()
+		if err = eng.Handler(bytes.NewReader(raw), uint32(i+1), nil); err != nil {
+			result.Errors++
+		}
+		result.Latencies = append(result.Latencies, time.Since(t))
+	}
+	result.Elapsed = time.Since(start)
+	sort.Sort(byDuration(result.Latencies))
+	result.Sent, result.Recipients, result.SentBytes = sink.counts()
+	return result, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(sorted, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(sorted, 99))
+	assert.Equal(t, 100*time.Millisecond, percentile(sorted, 100))
+	assert.Equal(t, time.Millisecond, percentile(sorted, 0))
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+}
+
+func TestFakeSMTP(t *testing.T) {
+	sink, err := newFakeSMTP()
+	assert.NoError(t, err)
+	defer sink.Close()
+	auth := smtp.PlainAuth("", "user", "pass", "127.0.0.1")
+	err = smtp.SendMail(sink.Addr(), auth, "a@example.com", []string{"b@example.com", "c@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	assert.NoError(t, err)
+	messages, recipients, _ := sink.counts()
+	assert.Equal(t, 1, messages)
+	assert.Equal(t, 2, recipients)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// handleBounce records a bounce or complaint for an address and, once the
+// address's score reaches BounceThreshold (if set), stops delivery to it by
+// setting the member's Delivery to "nomail". The member is kept, so they can
+// still be found and re-enabled.
+func (eng *Engine) handleBounce(email, kind, detail string) {
+	record, err := eng.DB.RecordBounce(email, kind, detail)
+	if err != nil {
+		log15.Error("Error recording bounce", log15.Ctx{"context": "bounce", "email": email, "error": err})
+		return
+	}
+	log15.Info("Recorded bounce", log15.Ctx{"context": "bounce", "email": record.Email, "kind": kind, "score": record.Score})
+	if eng.Config.BounceThreshold <= 0 || record.Score < eng.Config.BounceThreshold {
+		return
+	}
+	meta, err := eng.DB.GetSubscriber(record.Email)
+	if err != nil || meta.Delivery == DeliveryNoMail {
+		return
+	}
+	meta.Delivery = DeliveryNoMail
+	if err := eng.DB.UpdateSubscriber(record.Email, meta); err != nil {
+		log15.Error("Error disabling delivery for bouncing member", log15.Ctx{"context": "bounce", "email": record.Email, "error": err})
+		return
+	}
+	log15.Info("Disabled delivery for bouncing member", log15.Ctx{"context": "bounce", "email": record.Email, "score": record.Score})
+}
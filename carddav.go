@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrCardDAVRequestFailed - Returned when the CardDAV server responds with an unexpected status.
+	ErrCardDAVRequestFailed = errors.New("CardDAV request failed")
+
+	// ErrBadCardDAVSyncInterval - Returned when CardDAV sync is on but CardDAVSyncInterval isn't positive.
+	ErrBadCardDAVSyncInterval = errors.New("CardDAVSyncInterval must be a number of minutes above 0")
+)
+
+// cardDAVSource is the MemberMeta.Source of members managed by CardDAV sync.
+const cardDAVSource = "carddav"
+
+// Asks for every vCard in the address book; group filtering is done locally
+// as servers differ in their support for text-match on CATEGORIES.
+const cardDAVQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:prop><D:getetag/><C:address-data/></D:prop>
+</C:addressbook-query>`
+
+// The parts of a CardDAV REPORT multistatus response that sync cares about.
+type cardDAVMultistatus struct {
+	Responses []struct {
+		Href        string `xml:"href"`
+		AddressData string `xml:"propstat>prop>address-data"`
+	} `xml:"response"`
+}
+
+// vCard is the subset of a vCard used for membership.
+type vCard struct {
+	UID        string
+	FN         string
+	Emails     []string
+	Categories []string
+}
+
+// unescapeVCardText undoes vCard TEXT value escaping.
+func unescapeVCardText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// splitVCardList splits a comma-separated vCard list value, honouring "\,".
+func splitVCardList(s string) []string {
+	var (
+		out  []string
+		cur  bytes.Buffer
+		prev rune
+	)
+	for _, r := range s {
+		if r == ',' && prev != '\\' {
+			out = append(out, unescapeVCardText(cur.String()))
+			cur.Reset()
+		} else {
+			cur.WriteRune(r)
+		}
+		prev = r
+	}
+	return append(out, unescapeVCardText(cur.String()))
+}
+
+// parseVCards reads the UID, FN, EMAIL and CATEGORIES properties of each
+// vCard in r, after unfolding continuation lines.
+func parseVCards(r io.Reader) ([]*vCard, error) {
+	var (
+		cards   []*vCard
+		current *vCard
+		lines   []string
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		name, value := strings.ToUpper(line[:colon]), line[colon+1:]
+		// Drop parameters ("EMAIL;TYPE=work") and groups ("item1.EMAIL").
+		if semi := strings.Index(name, ";"); semi >= 0 {
+			name = name[:semi]
+		}
+		if dot := strings.LastIndex(name, "."); dot >= 0 {
+			name = name[dot+1:]
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			current = new(vCard)
+		case current == nil:
+			continue
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			cards = append(cards, current)
+			current = nil
+		case name == "UID":
+			current.UID = value
+		case name == "FN":
+			current.FN = unescapeVCardText(value)
+		case name == "EMAIL":
+			current.Emails = append(current.Emails, strings.TrimSpace(value))
+		case name == "CATEGORIES":
+			current.Categories = append(current.Categories, splitVCardList(value)...)
+		}
+	}
+	return cards, nil
+}
+
+// inGroup reports whether a vCard has the given category, ignoring case.
+func (card *vCard) inGroup(group string) bool {
+	for _, cat := range card.Categories {
+		if strings.EqualFold(strings.TrimSpace(cat), group) {
+			return true
+		}
+	}
+	return false
+}
+
+// cardDAVMembers fetches the address book at CardDAVURL and returns the
+// contacts in CardDAVGroup (or all contacts, if no group is configured),
+// using each contact's first email address.
+func (eng *Engine) cardDAVMembers() ([]directoryMember, error) {
+	req, err := http.NewRequest("REPORT", eng.Config.CardDAVURL, strings.NewReader(cardDAVQuery))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(eng.Config.CardDAVUsername, eng.Config.CardDAVPassword)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("%w: %s", ErrCardDAVRequestFailed, resp.Status)
+	}
+	var ms cardDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+	var members []directoryMember
+	for _, r := range ms.Responses {
+		cards, err := parseVCards(strings.NewReader(r.AddressData))
+		if err != nil {
+			return nil, err
+		}
+		for _, card := range cards {
+			if eng.Config.CardDAVGroup != "" && !card.inGroup(eng.Config.CardDAVGroup) {
+				continue
+			}
+			if len(card.Emails) == 0 {
+				log15.Info("Skipping contact with no email", log15.Ctx{"context": "carddav", "contact": card.FN})
+				continue
+			}
+			id := card.UID
+			if id == "" {
+				id = r.Href
+			}
+			members = append(members, directoryMember{ID: id, Email: card.Emails[0], Name: card.FN})
+		}
+	}
+	return members, nil
+}
+
+// CardDAVSync reconciles the roster with the CardDAV address book once; see
+// reconcileMembers for what changes.
+func (eng *Engine) CardDAVSync() (added, departed int, err error) {
+	members, err := eng.cardDAVMembers()
+	if err != nil {
+		return 0, 0, err
+	}
+	return eng.DB.reconcileMembers(cardDAVSource, members)
+}
+
+// CardDAVSyncLoop runs CardDAVSync every CardDAVSyncInterval minutes until
+// closeCh is closed.
+func (eng *Engine) CardDAVSyncLoop(closeCh <-chan struct{}) {
+	for {
+		added, departed, err := eng.CardDAVSync()
+		if err != nil {
+			log15.Error("Error syncing members from CardDAV", log15.Ctx{"context": "carddav", "error": err})
+		} else {
+			log15.Info("Synced members from CardDAV", log15.Ctx{"context": "carddav", "added": added, "departed": departed})
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(time.Duration(eng.Config.CardDAVSyncInterval) * time.Minute):
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVCards(t *testing.T) {
+	data := "BEGIN:VCARD\r\nVERSION:3.0\r\nUID:abc-123\r\nFN:Usienne Mc\r\n Userface\r\n" +
+		"item1.EMAIL;TYPE=work:usienne@example.com\r\nCATEGORIES:Staff,Board\\, Trustees\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nFN:No Email\r\nEND:VCARD\r\n"
+	cards, err := parseVCards(strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Len(t, cards, 2)
+	assert.Equal(t, "abc-123", cards[0].UID)
+	assert.Equal(t, "Usienne McUserface", cards[0].FN)
+	assert.Equal(t, []string{"usienne@example.com"}, cards[0].Emails)
+	assert.True(t, cards[0].inGroup("staff"))
+	assert.True(t, cards[0].inGroup("Board, Trustees"))
+	assert.False(t, cards[1].inGroup("Staff"))
+	assert.Empty(t, cards[1].Emails)
+}
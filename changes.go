@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/layeh/gopher-luar"
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// changeQueue hands database changes to the one goroutine that runs the
+// ChangeScript and posts to ChangeWebhooks, so that commits don't wait on
+// them. It never blocks, as changes may be made while that goroutine waits
+// for eventLoop to finish with Lua.
+type changeQueue struct {
+	mu      sync.Mutex
+	pending []DBChange
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newChangeQueue() *changeQueue {
+	return &changeQueue{
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (q *changeQueue) push(change DBChange) {
+	q.mu.Lock()
+	q.pending = append(q.pending, change)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *changeQueue) take() []DBChange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := q.pending
+	q.pending = nil
+	return pending
+}
+
+// close waits for the changes already queued to be passed on.
+func (q *changeQueue) close() {
+	close(q.stop)
+	<-q.stopped
+}
+
+// dbChanged queues a database change for the ChangeScript and
+// ChangeWebhooks. It runs as the change commits.
+func (eng *Engine) dbChanged(change DBChange) {
+	eng.changes.push(change)
+}
+
+// passOnChanges passes queued changes on, in order, until the queue is
+// closed. Failures are only logged.
+func (eng *Engine) passOnChanges() {
+	defer close(eng.changes.stopped)
+	for {
+		stopping := false
+		select {
+		case <-eng.changes.wake:
+		case <-eng.changes.stop:
+			stopping = true
+		}
+		for _, change := range eng.changes.take() {
+			eng.passOnChange(change)
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+func (eng *Engine) passOnChange(change DBChange) {
+	if eng.Config.ChangeScript != "" {
+		// The script runs on Lua, as eventLoop does.
+		eng.scripts.Lock()
+		err := eng.runChangeScript(change)
+		eng.scripts.Unlock()
+		if err != nil {
+			log15.Error("Error running ChangeScript", log15.Ctx{"context": "lua", "script": eng.Config.ChangeScript, "change": change.Kind, "error": err})
+		}
+	}
+	if len(eng.Config.ChangeWebhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		log15.Error("Error encoding change for webhooks", log15.Ctx{"context": "webhook", "error": err})
+		return
+	}
+	for _, hookURL := range eng.Config.ChangeWebhooks {
+		if err := postJSON(hookURL, body, nil); err != nil {
+			log15.Error("Error posting change to webhook", log15.Ctx{"context": "webhook", "change": change.Kind, "error": err})
+		}
+	}
+}
+
+// runChangeScript calls changed(database, change) in the ChangeScript.
+func (eng *Engine) runChangeScript(change DBChange) error {
+	L, fn, done, err := eng.loadScriptHook(eng.Config.ChangeScript, "changed")
+	if err != nil {
+		return err
+	}
+	defer done()
+	return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, L.GetGlobal("database"), luar.New(L, &change))
+}
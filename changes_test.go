@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeQueue(t *testing.T) {
+	q := newChangeQueue()
+	q.push(DBChange{Kind: ChangeMemberAdded, Email: "a@example.com"})
+	q.push(DBChange{Kind: ChangeMemberRemoved, Email: "a@example.com"})
+	pending := q.take()
+	assert.Len(t, pending, 2)
+	assert.Equal(t, ChangeMemberAdded, pending[0].Kind)
+	assert.Equal(t, ChangeMemberRemoved, pending[1].Kind)
+	assert.Empty(t, q.take())
+
+	// Closing waits for what's queued to be passed on.
+	var passed []DBChange
+	go func() {
+		defer close(q.stopped)
+		<-q.stop
+		passed = q.take()
+	}()
+	q.push(DBChange{Kind: ChangeKVStored})
+	q.close()
+	assert.Len(t, passed, 1)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+	"gopkg.in/ldap.v2"
+)
+
+// Exit codes of the commands, documented in the Readme for scripts.
+const (
+	// exitFailure - The command failed for some other reason, e.g. the
+	// database couldn't be written.
+	exitFailure = 1
+	// exitInvalid - The command was given bad input, e.g. an address that
+	// doesn't normalise, and nothing was changed.
+	exitInvalid = 2
+	// exitConfig - The config file couldn't be read, or the list couldn't be
+	// started with it.
+	exitConfig = 3
+	// exitConnection - A server the command needed, e.g. the LDAP directory,
+	// couldn't be reached or refused the request.
+	exitConnection = 4
+	// exitPartial - The command failed part way, after making some of its
+	// changes.
+	exitPartial = 5
+)
+
+// exitWith tells the user why a command failed, without a stack trace, and
+// exits with code, closing the command's engine first.
+func exitWith(code int, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "listless: "+format+"\n", args...)
+	runExitHooks()
+	os.Exit(code)
+}
+
+// exitHooks are run by exitWith before the process exits.
+var exitHooks []func()
+
+// closeAtExit has exitWith close engine, as os.Exit skips the command's
+// deferred Close and so would lose changes waiting for the ChangeScript and
+// ChangeWebhooks. Commands that change the database call it as well as
+// deferring Close.
+func closeAtExit(engine *Engine) {
+	exitHooks = append(exitHooks, engine.Close)
+}
+
+// runExitHooks runs the exitHooks, latest first, once.
+func runExitHooks() {
+	hooks := exitHooks
+	exitHooks = nil
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// exitCode chooses the exit code for a command's error, which may wrap one
+// of the errors below with detail such as the server's response.
+func exitCode(err error) int {
+	switch {
+	case errorIsOneOf(err, ErrInvalidEmail, ErrMemberEntryNotFound, ErrUnknownRole, ErrInvalidSenderPattern,
+		ErrQueuedMessageNotFound, ErrQuarantinedMessageNotFound, ErrQuarantinedHeadersOnly,
+		ErrAnonymousPostNotFound, ErrUnknownImportFormat, ErrNoImportHeader, ErrImportNeedsPath, ErrUnknownSandbox,
+		ErrServiceUnsupported, ErrServiceExists):
+		return exitInvalid
+	case errorIsOneOf(err, ErrCardDAVRequestFailed, ErrJMAPRequestFailed, ErrMatrixRequestFailed, ErrTransportRequestFailed):
+		return exitConnection
+	case errorIsOneOf(err, ErrBadLDAPURL):
+		return exitConfig
+	}
+	switch err.(type) {
+	case net.Error, *ldap.Error:
+		return exitConnection
+	}
+	return exitFailure
+}
+
+// errorIsOneOf reports whether err is, or wraps, any of targets.
+func errorIsOneOf(err error, targets ...error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail exits with err and the exit code for it.
+func fail(err error) {
+	exitWith(exitCode(err), "%v", err)
+}
+
+// failToStart exits after an Engine couldn't be loaded, which is down to the
+// configuration unless the database is in use.
+func failToStart(err error) {
+	code := exitConfig
+	if err == ErrDatabaseLocked {
+		code = exitFailure
+	}
+	exitWith(code, "couldn't start: %v", err)
+}
+
+// failPartly exits with exitPartial if changes were made before err, or as
+// fail would otherwise.
+func failPartly(err error, changed bool) {
+	if changed {
+		exitWith(exitPartial, "stopped part way: %v", err)
+	}
+	fail(err)
+}
+
+// confirm asks before a destructive command goes ahead, once it has shown
+// what will be affected, unless yes (the command's --yes flag) is set. Any
+// answer but y or yes, including none where stdin isn't a terminal, exits
+// without changing anything.
+func confirm(yes bool, question string) {
+	if yes {
+		return
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return
+	}
+	exitWith(exitInvalid, "not confirmed, so nothing was changed; pass --yes to go ahead without asking")
+}
+
+// parseDateFlag parses a YYYY-MM-DD flag as midnight UTC, or exits. An empty
+// value gives the zero time.
+func parseDateFlag(flag, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		exitWith(exitInvalid, "%s expects a date as YYYY-MM-DD, got %q", flag, value)
+	}
+	return t
+}
+
+// quietenLogs drops log records below Error, for --quiet. It wraps the
+// current handler, so is applied again after setupLogging replaces that.
+func quietenLogs() {
+	log15.Root().SetHandler(log15.LvlFilterHandler(log15.LvlError, log15.Root().GetHandler()))
+}
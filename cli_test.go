@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, exitInvalid, exitCode(ErrInvalidEmail))
+	assert.Equal(t, exitConfig, exitCode(ErrBadLDAPURL))
+	assert.Equal(t, exitConnection, exitCode(ErrCardDAVRequestFailed))
+	// Request errors carry the server's response.
+	assert.Equal(t, exitConnection, exitCode(fmt.Errorf("%w: %s", ErrCardDAVRequestFailed, "503 Service Unavailable")))
+	assert.Equal(t, exitConnection, exitCode(fmt.Errorf("%w: %s", ErrJMAPRequestFailed, "401 Unauthorized")))
+	assert.Equal(t, exitConnection, exitCode(fmt.Errorf("%w: %s", ErrMatrixRequestFailed, "429 Too Many Requests")))
+	assert.Equal(t, exitConnection, exitCode(fmt.Errorf("%w: %s: %s", ErrTransportRequestFailed, "400 Bad Request", "invalid sender")))
+	assert.Equal(t, exitConnection, exitCode(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.Equal(t, exitFailure, exitCode(errors.New("disk full")))
+}
+
+func TestExitPassesOnChanges(t *testing.T) {
+	var mu sync.Mutex
+	var received []DBChange
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change DBChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err == nil {
+			mu.Lock()
+			received = append(received, change)
+			mu.Unlock()
+		}
+	}))
+	defer hook.Close()
+	dir, err := ioutil.TempDir("", "listless-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	engine, err := NewEngine(&Config{Database: path.Join(dir, "cli.db"), Transport: "fake", ChangeWebhooks: []string{hook.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As "sub update" does, up to a failure that exits before its defers run.
+	defer engine.Close()
+	closeAtExit(engine)
+	assert.NoError(t, engine.DB.UpdateSubscriber("ann@example.com", engine.DB.CreateSubscriber("ann@example.com", "Ann", true, false)))
+	runExitHooks()
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, ChangeMemberAdded, received[0].Kind)
+		assert.Equal(t, "ann@example.com", received[0].Email)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+// completionNode is the application, or one of its commands, as the
+// completion scripts see it: the commands that may follow it, and the flags
+// it takes.
+type completionNode struct {
+	// Command words leading to it, e.g. ["sub", "list"]; none for the
+	// application itself.
+	path     []string
+	commands []completionWord
+	flags    []completionFlag
+}
+
+type completionWord struct {
+	name, help string
+}
+
+type completionFlag struct {
+	name, help string
+	short      rune
+}
+
+// completionNodes walks the application's model. The application itself comes
+// first; its flags may be given after any command too.
+func completionNodes(model *kingpin.ApplicationModel) []completionNode {
+	root := completionNode{flags: completionFlags(model.FlagGroupModel)}
+	for _, cmd := range model.Commands {
+		if !cmd.Hidden {
+			root.commands = append(root.commands, completionWord{cmd.Name, cmd.Help})
+		}
+	}
+	nodes := []completionNode{root}
+	for _, cmd := range model.FlattenedCommands() {
+		if cmd.Hidden {
+			continue
+		}
+		node := completionNode{
+			path:  strings.Fields(cmd.FullCommand),
+			flags: completionFlags(cmd.FlagGroupModel),
+		}
+		for _, sub := range cmd.Commands {
+			if !sub.Hidden {
+				node.commands = append(node.commands, completionWord{sub.Name, sub.Help})
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func completionFlags(group *kingpin.FlagGroupModel) (flags []completionFlag) {
+	if group == nil {
+		return nil
+	}
+	for _, f := range group.Flags {
+		if !f.Hidden {
+			flags = append(flags, completionFlag{f.Name, f.Help, f.Short})
+		}
+	}
+	return flags
+}
+
+// writeCompletion writes the completion script for shell: bash, zsh or fish.
+func writeCompletion(w io.Writer, shell string, nodes []completionNode) error {
+	switch shell {
+	case "bash":
+		return writeBashCompletion(w, nodes)
+	case "zsh":
+		// zsh runs the bash script through its bash compatibility layer.
+		_, err := io.WriteString(w, "# zsh completion for listless, from \"listless completion zsh\".\n"+
+			"autoload -U +X bashcompinit && bashcompinit\n")
+		if err != nil {
+			return err
+		}
+		return writeBashCompletion(w, nodes)
+	case "fish":
+		return writeFishCompletion(w, nodes)
+	}
+	return fmt.Errorf("unknown shell %q; use bash, zsh or fish", shell)
+}
+
+// writeBashCompletion writes a bash completion function, which follows the
+// command words typed so far to offer the commands or flags that may come
+// next. Arguments, which are mostly files, fall back to file completion.
+func writeBashCompletion(w io.Writer, nodes []completionNode) error {
+	var paths []string
+	for _, node := range nodes {
+		if len(node.path) > 0 {
+			paths = append(paths, `"`+strings.Join(node.path, " ")+`"`)
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString("# bash completion for listless, from \"listless completion bash\".\n")
+	b.WriteString("_listless() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" path=\"\" next w cmds flags\n")
+	b.WriteString("\tfor w in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do\n")
+	b.WriteString("\t\tnext=\"${path:+$path }$w\"\n")
+	b.WriteString("\t\tcase \"$next\" in\n")
+	fmt.Fprintf(&b, "\t\t%s) path=\"$next\" ;;\n", strings.Join(paths, "|"))
+	b.WriteString("\t\tesac\n\tdone\n")
+	b.WriteString("\tcase \"$path\" in\n")
+	for _, node := range nodes {
+		var cmds []string
+		for _, cmd := range node.commands {
+			cmds = append(cmds, cmd.name)
+		}
+		flags := bashFlagWords(node.flags)
+		if len(node.path) > 0 {
+			flags = append(flags, bashFlagWords(nodes[0].flags)...)
+		}
+		fmt.Fprintf(&b, "\t\"%s\") cmds=\"%s\"; flags=\"%s\" ;;\n", strings.Join(node.path, " "), strings.Join(cmds, " "), strings.Join(flags, " "))
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("\telse\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$cmds\" -- \"$cur\"))\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o default -F _listless listless\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func bashFlagWords(flags []completionFlag) (words []string) {
+	for _, f := range flags {
+		words = append(words, "--"+f.name)
+		if f.short != 0 {
+			words = append(words, "-"+string(f.short))
+		}
+	}
+	return words
+}
+
+// writeFishCompletion writes fish complete commands, conditioned on the
+// command words seen so far.
+func writeFishCompletion(w io.Writer, nodes []completionNode) error {
+	var b bytes.Buffer
+	b.WriteString("# fish completion for listless, from \"listless completion fish\".\n")
+	for _, node := range nodes {
+		var seen []string
+		for _, word := range node.path {
+			seen = append(seen, "__fish_seen_subcommand_from "+word)
+		}
+		if len(node.commands) > 0 {
+			var names []string
+			for _, cmd := range node.commands {
+				names = append(names, cmd.name)
+			}
+			cond := "__fish_use_subcommand"
+			if len(seen) > 0 {
+				cond = strings.Join(seen, "; and ") + "; and not __fish_seen_subcommand_from " + strings.Join(names, " ")
+			}
+			for _, cmd := range node.commands {
+				fmt.Fprintf(&b, "complete -c listless -n %s -a %s -d %s\n", fishQuote(cond), cmd.name, fishQuote(cmd.help))
+			}
+		}
+		// The application's own flags are offered everywhere, unconditionally.
+		for _, f := range node.flags {
+			b.WriteString("complete -c listless")
+			if len(seen) > 0 {
+				fmt.Fprintf(&b, " -n %s", fishQuote(strings.Join(seen, "; and ")))
+			}
+			fmt.Fprintf(&b, " -l %s", f.name)
+			if f.short != 0 {
+				fmt.Fprintf(&b, " -s %c", f.short)
+			}
+			fmt.Fprintf(&b, " -d %s\n", fishQuote(f.help))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fishQuote quotes s for fish, in which only \ and ' are special within
+// single quotes.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCompletionNodes() []completionNode {
+	return []completionNode{
+		{
+			commands: []completionWord{{"loop", "Run the list"}, {"sub", "Manage subscribers"}},
+			flags:    []completionFlag{{"quiet", "Log only errors", 'q'}},
+		},
+		{path: []string{"loop"}},
+		{
+			path:     []string{"sub"},
+			commands: []completionWord{{"list", "List subscribers"}},
+		},
+		{
+			path:  []string{"sub", "list"},
+			flags: []completionFlag{{name: "format", help: "Output as csv or json; the 'default' is csv"}},
+		},
+	}
+}
+
+func TestBashCompletion(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeCompletion(&out, "bash", testCompletionNodes()))
+	script := out.String()
+	assert.Contains(t, script, "\t\t\"loop\"|\"sub\"|\"sub list\") path=\"$next\" ;;\n")
+	assert.Contains(t, script, "\t\"\") cmds=\"loop sub\"; flags=\"--quiet -q\" ;;\n")
+	assert.Contains(t, script, "\t\"sub list\") cmds=\"\"; flags=\"--format --quiet -q\" ;;\n")
+	assert.Contains(t, script, "complete -o default -F _listless listless\n")
+}
+
+func TestFishCompletion(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeCompletion(&out, "fish", testCompletionNodes()))
+	script := out.String()
+	assert.Contains(t, script, "complete -c listless -n '__fish_use_subcommand' -a loop -d 'Run the list'\n")
+	assert.Contains(t, script, "complete -c listless -n '__fish_seen_subcommand_from sub; and not __fish_seen_subcommand_from list' -a list -d 'List subscribers'\n")
+	assert.Contains(t, script, "complete -c listless -n '__fish_seen_subcommand_from sub; and __fish_seen_subcommand_from list' -l format -d 'Output as csv or json; the \\'default\\' is csv'\n")
+	assert.Contains(t, script, "complete -c listless -l quiet -s q -d 'Log only errors'\n")
+}
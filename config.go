@@ -3,6 +3,7 @@ package main
 import (
 	"net"
 	"strconv"
+	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
@@ -16,6 +17,29 @@ type Config struct {
 	IMAPPassword string
 	IMAPHost     string
 	IMAPPort     int
+	Fetcher      string
+	// IMAP search criteria
+	IMAPSearchSubject string
+	IMAPToListOnly    bool
+	IMAPSince         string
+	imapSince         time.Time
+	IMAPBatchSize     int
+	MaxMessageMB      int
+	SpoolThresholdKB  int
+	SpoolDir          string
+	// IMAP folders
+	IMAPInbox       string
+	IMAPDoneFolder  string
+	IMAPErrorFolder string
+	IMAPNamespace   string
+	// JMAP Details
+	JMAPSessionURL string
+	JMAPToken      string
+	// POP3 Details
+	POP3Host   string
+	POP3Port   int
+	POP3TLS    bool
+	POP3Delete bool
 	// SMTP Details
 	SMTPUsername string
 	SMTPPassword string
@@ -23,13 +47,151 @@ type Config struct {
 	SMTPPort     int
 	smtpAddr     string
 	SMTPIP       string
+	Identities   map[string]*Identity
+	Transport    string
+	// Fakes, for testing
+	FakeInbox  string
+	FakeOutbox string
+	// OAuth2 for the list account
+	OAuthProvider     string
+	OAuthTokenURL     string
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthRefreshToken string
+	GraphTenantID     string
+	// Amazon SES
+	SESRegion            string
+	SESAccessKeyID       string
+	SESSecretAccessKey   string
+	SESConfigurationSet  string
+	SESNotificationToken string
+	// Mailgun and SendGrid
+	MailgunDomain  string
+	MailgunAPIKey  string
+	MailgunRegion  string
+	SendGridAPIKey string
 	// Local stuff
 	ListAddress      string
+	AdminAddress     string
 	Database         string
+	AdminSocket      string
+	RosterCache      bool
 	DeliverScript    string
 	MessageFrequency int
 	PollFrequency    int // Seconds
+	PollMinFrequency int // Seconds
+	PollJitter       float64
+	ProcessTimeout   int // Seconds
+	SendRateLimit    int // Per minute
 	Constants        map[string]string
+	// Logging
+	LogLevel      string
+	LogLevels     map[string]string
+	LogFormat     string
+	LogFile       string
+	LogMaxSizeMB  int
+	LogMaxAgeDays int
+	LogKeep       int
+	// Tracing
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+	// Metrics
+	SlowMessageSeconds float64
+	// Error reporting
+	SentryDSN    string
+	ErrorWebhook string
+	// Syslog
+	SyslogAddress  string
+	SyslogFacility string
+	SyslogTag      string
+	// Alerts
+	AlertRecipients        []string
+	AlertWebhooks          []string
+	AlertSMTPFailures      int
+	AlertSMTPWindowMinutes int
+	AlertIMAPDownMinutes   int
+	AlertCooldownMinutes   int
+	// Message handling
+	HTMLSanitisePolicy string
+	SubjectTag         string
+	TrimQuotes         int
+	// Notices
+	Language    string
+	TemplateDir string
+	// Lua whitelist adjustments
+	LuaPrivilegedAllow []string
+	LuaPrivilegedDeny  []string
+	LuaModeratorAllow  []string
+	LuaModeratorDeny   []string
+	LuaKVStoreAllow    []string
+	LuaKVStoreDeny     []string
+	// Named scripts for transactions
+	Scripts            map[string]ScriptEntry
+	TransactionKVStore string
+	TransactionKey     string
+	TransactionScan    string
+	// Database change hooks
+	ChangeScript   string
+	ChangeWebhooks []string
+	ChangeKVStores []string
+	// Anonymous posting
+	AnonymousPosting    bool
+	AnonymousName       string
+	AnonymousPseudonyms bool
+	// Archive
+	Archive            bool
+	ArchiveURL         string
+	ArchiveFooter      bool
+	ArchiveObfuscation string
+	// Archive retention
+	ArchiveRetentionDays int
+	ArchiveMaxMessages   int
+	ArchiveMaxBytes      int
+	// HTTP server
+	HTTPAddress  string
+	FeedItems    int
+	FeedFullBody bool
+	PublicURL    string
+	ActivityPub  bool
+	// Held messages
+	HoldExpiryHours  int
+	ModerationToken  string
+	ModerationQuorum int
+	SenderPolicy     string
+	// NNTP gateway
+	NNTPAddress string
+	NNTPGroup   string
+	NNTPPosting bool
+	// Matrix bridge
+	MatrixHomeserver  string
+	MatrixAccessToken string
+	MatrixRoomID      string
+	MatrixUsers       map[string]string
+	// Chat webhooks
+	Webhooks []string
+	// LDAP membership sync
+	LDAPURL          string
+	LDAPStartTLS     bool
+	LDAPBindDN       string
+	LDAPBindPassword string
+	LDAPGroupDN      string
+	LDAPAttributes   map[string]string
+	LDAPSyncInterval int // Minutes
+	// CardDAV membership sync
+	CardDAVURL          string
+	CardDAVUsername     string
+	CardDAVPassword     string
+	CardDAVGroup        string
+	CardDAVSyncInterval int // Minutes
+	// SCIM provisioning
+	SCIMToken string
+	// Bounce handling
+	BounceThreshold float64
+	BounceAddress   string
+	// Traffic reports
+	ReportInterval   string
+	ReportRecipients []string
+	ReportTemplate   string
 }
 
 // Returns "" if failed to parse.
@@ -52,37 +214,461 @@ func intOrDefault(l lua.LValue, def int) int {
 	return i
 }
 
+// Returns def if absent or not a whole number.
+func numberOrDefault(l lua.LValue, def int) int {
+	if l.Type() != lua.LTNumber {
+		return def
+	}
+	i, err := strconv.Atoi(l.String())
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// Returns def if absent or not a number.
+func floatOrDefault(l lua.LValue, def float64) float64 {
+	if l.Type() != lua.LTNumber {
+		return def
+	}
+	return float64(lua.LVAsNumber(l))
+}
+
+// Returns def if not a boolean.
+func boolOrDefault(l lua.LValue, def bool) bool {
+	if l.Type() != lua.LTBool {
+		return def
+	}
+	return lua.LVAsBool(l)
+}
+
+// Returns the string->string contents of a table, or an empty map if not a table.
+func stringMapOrEmpty(l lua.LValue) map[string]string {
+	m := make(map[string]string)
+	if table, ok := l.(*lua.LTable); ok {
+		table.ForEach(func(key, val lua.LValue) {
+			m[key.String()] = val.String()
+		})
+	}
+	return m
+}
+
+// Returns the string values of a list-like table, or nil if not a table.
+func stringListOrNothing(l lua.LValue) []string {
+	table, ok := l.(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	var out []string
+	table.ForEach(func(_, val lua.LValue) {
+		out = append(out, val.String())
+	})
+	return out
+}
+
 // ConfigFromState converts a Lua state to a Config object; expects the following variables to
-// be defined, or defaults to either accepted default port numbers or empty strings:
+// be defined, or defaults to either accepted default port numbers or empty strings.
+// With the config file "env:", they come from LISTLESS_ environment variables instead
+// (see envSettings):
 // * IMAPUsername string
 // * IMAPPassword string
 // * IMAPHost     string
 // * IMAPPort     int
+// * IMAPSearchSubject string; only fetch unseen messages whose subject
+//     contains this (searched on the server).
+// * IMAPToListOnly bool; leave messages not addressed to ListAddress (in To,
+//     Cc, Delivered-To etc.) in the mailbox, rather than consuming them.
+// * IMAPSince    string; "YYYY-MM-DD"; leave messages dated earlier alone.
+// * IMAPBatchSize int; most messages fetched per poll (default 50). A full
+//     batch is followed straight away by another poll, so bursts drain
+//     quickly; MessageFrequency still spaces out what is relayed.
+// * MaxMessageMB int; incoming messages larger than this many megabytes are
+//     never held in memory whole or parsed: their headers are quarantined and
+//     AdminAddress is told (default 25; 0 for no limit).
+// * SpoolThresholdKB int; incoming messages larger than this are written to
+//     a temporary file while they are fetched, rather than held in memory
+//     (default 1024; 0 never spools). Parsing still reads each part in.
+// * SpoolDir     string; where spooled messages go (default the system's
+//     temporary directory).
+// * IMAPInbox    string; folder to fetch from, default "INBOX".
+// * IMAPDoneFolder string; move delivered messages here instead of deleting.
+// * IMAPErrorFolder string; move messages that fail to deliver here.
+// * IMAPNamespace string; prefix for folder names, e.g. "INBOX." on Courier.
+//     Default "auto" asks the server (NAMESPACE); "" uses names as given.
+//     Write subfolders with "/"; it's replaced by the server's delimiter.
+// * Fetcher      string; how to receive mail: "imap" (default), "jmap" or
+//     "pop3", or "fake" for FakeInbox. JMAP and POP3 log in with IMAPUsername
+//     and IMAPPassword.
+// * JMAPSessionURL string; JMAP session resource, e.g.
+//     "https://api.fastmail.com/jmap/session", for the "jmap" Fetcher.
+// * JMAPToken    string; JMAP API token; if unset, the IMAP username and
+//     password are used.
+// * POP3Host     string; defaults to IMAPHost.
+// * POP3Port     int; defaults to 995 (or 110 without POP3TLS).
+// * POP3TLS      bool; connect with TLS, default true.
+// * POP3Delete   bool; delete delivered messages from the server, default
+//     true. Fetched messages are tracked by UIDL either way.
 // * SMTPUsername string
 // * SMTPPassword string
 // * SMTPHost     string
 // * SMTPPort     int
+// * Identities   table; named From addresses the list sends as, e.g.
+//     {announce = {Address = "announce@host.com", Name = "Announcements"}}.
+//     Each may give SMTPUsername and SMTPPassword (and SMTPHost, SMTPPort) to
+//     send through its own login with the "smtp" Transport. Those named
+//     "moderation", "alerts" and "reports" send the matching system mail.
+// * Transport    string; how to send mail: "smtp" (default), "gmail", which
+//     submits through the Gmail API as the OAuth-authenticated account, or
+//     "graph", which submits through Microsoft Graph as the ListAddress
+//     mailbox using app-only (client credential) auth, "ses" for the
+//     Amazon SES v2 API, or "mailgun" or "sendgrid" for their HTTP APIs.
+//     "fake" sends nothing, keeping messages in memory for exec scripts
+//     (see the fakemail table) and optionally writing them to FakeOutbox.
+// * FakeInbox    string; folder of .eml files read by the "fake" Fetcher,
+//     default "./fake-inbox". Handled files move to done/ or error/.
+// * FakeOutbox   string; folder the "fake" Transport writes sent mail to.
+// * OAuthProvider string; "google" or "microsoft", to preset OAuthTokenURL.
+// * OAuthTokenURL string; OAuth2 token endpoint for other providers.
+// * OAuthClientID, OAuthClientSecret, OAuthRefreshToken string; if
+//     OAuthRefreshToken is set, SMTP authenticates with XOAUTH2 using
+//     access tokens refreshed from it, rather than with SMTPPassword.
+// * GraphTenantID string; the Microsoft 365 tenant, for the "graph" Transport,
+//     which uses OAuthClientID and OAuthClientSecret as app credentials.
+// * SESRegion    string; AWS region, for the "ses" Transport.
+// * SESAccessKeyID, SESSecretAccessKey string; AWS credentials; if unset,
+//     the environment or instance IAM role is used.
+// * SESConfigurationSet string; SES configuration set to send with.
+// * SESNotificationToken string; if set, SES bounce and complaint
+//     notifications are accepted from SNS at
+//     HTTPAddress/ses/notifications?token=<SESNotificationToken>.
+// * MailgunDomain, MailgunAPIKey string; sending domain and key for "mailgun".
+// * MailgunRegion string; "eu" for Mailgun's EU region, else the US.
+// * SendGridAPIKey string; API key for "sendgrid".
 // * Database      string
+// * AdminSocket   string; if set, path of a Unix socket the running list
+//     serves database snapshots on, so read-only commands ("sub list",
+//     "queue list" and so on) work while it holds the database.
+// * RosterCache   bool; keep the recipient lists GetAllSubscribers returns in
+//     memory between membership changes (default true). Turn it off to save
+//     memory on very large lists that post rarely.
 // * DeliverScript string
+// * PollFrequency int; longest wait in seconds between polls of an idle
+//     mailbox (default 60).
+// * PollMinFrequency int; wait in seconds after a poll that found mail; each
+//     empty poll doubles it, up to PollFrequency (default 5). Set it to
+//     PollFrequency to always wait that long.
+// * PollJitter float; fraction each wait is randomly varied by either way,
+//     so lists on one provider don't poll in step (default 0.2; 0 for none).
+// * ProcessTimeout int; seconds a message's eventLoop and sending may take
+//     before they are abandoned and the message is quarantined, so one
+//     pathological message can't stall the list (default 120; 0 for no limit).
+// * AdminAddress  string; if set, this address is mailed the error and the
+//     original message whenever an incoming message fails to parse or eventLoop
+//     fails on it.
+// * SendRateLimit int; most messages scripts may send with sendmail in a
+//     minute; more wait in the outgoing queue. 0 (default) is unlimited.
+// * LogLevel      string; "debug", "info" (default), "warn", "error" or "crit".
+// * LogLevels     map/table of log context->level, overriding LogLevel for
+//     that context, e.g. {lua = "debug", imap = "warn"}.
+// * LogFormat     string; "terminal", "logfmt" or "json" (one object per line,
+//     for shipping to Loki, Elasticsearch etc.). Defaults to terminal on
+//     standard output and logfmt in LogFile.
+// * LogFile       string; if set, log here rather than to the terminal.
+// * LogMaxSizeMB  int; start a new LogFile once it reaches this size (default 10).
+// * LogMaxAgeDays int; start a new LogFile once it's this old (default 0, off).
+// * LogKeep       int; how many old log files to keep (default 5).
+// * SyslogAddress string; if set, log to syslog: "local", or a remote
+//     "udp://host:514" or "tcp://host:514". Replaces the terminal, and may be
+//     used alongside LogFile. On Windows, "local" is the Event Log, with
+//     SyslogTag as the event source, and there's no remote syslog.
+// * SyslogFacility string; syslog facility name (default "daemon").
+// * SyslogTag     string; syslog tag (default "listless").
+// * OTLPEndpoint  string; if set, e.g. "http://localhost:4318", the fetch,
+//     parse, eventLoop and send steps of each message are traced and
+//     exported to this OpenTelemetry collector over OTLP/HTTP.
+// * OTLPHeaders   map/table of headers to send with traces, e.g. for auth.
+// * SlowMessageSeconds float; each message's fetch, parse, eventLoop and
+//     send times are logged, as a warning if together they took this long
+//     or longer (default 30; 0 never warns).
+// * SentryDSN     string; if set, panics, eventLoop errors and messages the
+//     outgoing queue gives up on are reported to this Sentry project.
+// * ErrorWebhook  string; URL to POST the same reports to as JSON.
+// * AlertRecipients []string; addresses to mail alerts to. Defaults to
+//     AdminAddress. Alerts are off unless there's a recipient or webhook.
+// * AlertWebhooks []string; Slack or Discord webhook URLs to post alerts to.
+// * AlertSMTPFailures int; alert when this many sends fail within
+//     AlertSMTPWindowMinutes (defaults 5 and 10). 0 disables.
+// * AlertIMAPDownMinutes int; alert when fetching mail has failed for this
+//     long (default 15). 0 disables.
+// * AlertCooldownMinutes int; minimum time between repeats of an alert
+//     (default 60).
 // * Constants    map/table of string->string values. This can be used to store
 //     data which is made available in each iteration of eventLoop.
+// * HTMLSanitisePolicy string; one of "off", "ugc", "noimages", "strict".
+// * SubjectTag   string; if set, the engine tags and tidies outgoing subjects.
+// * Language     string; language of the list's notices, e.g. "fr", unless a
+//     member has their own Language. Built in: "en" (default), "fr", "de".
+// * TemplateDir  string; folder of notice templates overriding or adding to
+//     the built-in ones, named like "welcome.body.fr.tmpl".
+// * TrimQuotes   int; if 0 or more, relayed posts have their signature and
+//     quotes of quotes removed, and quoted runs cut to this many lines (see
+//     Email.TrimQuotes). Default -1, off.
+// * LuaPrivilegedAllow, LuaPrivilegedDeny []string; database methods to add
+//     to or remove from what eventLoop may call (see PrivilegedDBPermittedMethods).
+// * LuaModeratorAllow, LuaModeratorDeny []string; likewise for moderator
+//     scripts (see ModeratorDBPermittedMethods).
+// * LuaKVStoreAllow, LuaKVStoreDeny []string; likewise for KV stores.
+// * Scripts      table; names scripts for transactions to call by ScriptName.
+//     Each is a path, run in the moderator sandbox, or a table like
+//     {path = "unsub.lua", sandbox = "privileged"}.
+// * TransactionKVStore string; if set, the KV store whose entry is keyed by a
+//     transaction's RefCode is cleaned up when the transaction expires or is
+//     used. "{script}" is replaced by its ScriptName, e.g. "{script}-pending".
+// * TransactionKey string; secret key for hashing transaction secrets (HMAC),
+//     e.g. from "openssl rand -hex 32". It also signs the list's loop marks.
+//     Without it, a random key kept in the database is used instead, which
+//     anyone with a copy of the database has too. Setting, changing or
+//     removing it voids pending transactions and moderation links: their
+//     secrets no longer match.
+// * TransactionScan string; where incoming mail is searched for transaction
+//     secrets, which are then triggered instead of calling eventLoop:
+//     "subject" (default), "body" (the subject and first unquoted body
+//     lines) or "off".
+// * ChangeScript string; name of a script in Scripts whose function
+//     changed(database, change) is called whenever a member is added, updated
+//     or removed, or a ChangeKVStores entry changes, however it happened. The
+//     change has Time, Kind (e.g. "member.added", "kv.stored"), Email and
+//     Member, or Store, Key and Value. Changes the script makes are reported
+//     too, so take care not to loop. Changes are passed on in order, soon
+//     after they commit, and the script never runs alongside eventLoop.
+// * ChangeWebhooks []string; URLs each change is POSTed to as JSON.
+// * ChangeKVStores []string; KV stores whose changes are reported; others
+//     aren't.
+// * AnonymousPosting bool; relay posts as from AnonymousName at the list
+//     address, stripping identifying headers. The true sender is kept for
+//     abuse handling, and shown by "listless anon reveal".
+// * AnonymousName string; default "Anonymous".
+// * AnonymousPseudonyms bool; use each sender's persistent pseudonym (see
+//     PseudonymFor) instead of AnonymousName, so conversations can be followed.
+// * Archive       bool; store a copy of each relayed message in the database.
+// * ArchiveURL    string; base URL of the public archive, for permalinks.
+// * ArchiveFooter bool; add the permalink to the footer of relayed messages.
+// * ArchiveObfuscation string; how addresses appear in feeds, NNTP and
+//     ActivityPub: "off" (default), "words" ("user at example dot com") or
+//     "hide".
+// * ArchiveRetentionDays int; prune archived messages older than this.
+// * ArchiveMaxMessages int; prune the oldest messages beyond this many.
+// * ArchiveMaxBytes int; prune the oldest messages beyond this much storage.
+//     Retention limits are off (zero) by default, and applied hourly.
+// * HTTPAddress  string; if set, serve the HTTP endpoints (feeds etc.) here,
+//     including /healthz, which answers 503 once fetching mail has failed or
+//     stalled for three PollFrequency waits and a ProcessTimeout.
+// * FeedItems    int; number of archived posts in RSS/Atom feeds.
+// * FeedFullBody bool; put whole posts in feeds rather than excerpts.
+// * PublicURL    string; the URL at which the HTTP server is reachable publicly.
+// * ActivityPub  bool; publish archived posts as ActivityPub Notes (needs
+//     Archive, HTTPAddress and PublicURL).
+// * HoldExpiryHours int; how long moderators' links to release or reject a
+//     message held by Email.Hold stay valid. Default 72. Holding needs
+//     HTTPAddress and PublicURL.
+// * ModerationToken string; if set, moderators must also enter this to act
+//     on a held message.
+// * ModerationQuorum int; how many distinct moderators must approve a held
+//     message before it is sent (default 1). One rejection discards it.
+// * SenderPolicy string; what to do with posts from senders who aren't
+//     members allowed to post, nor allowed senders ("listless allow"), before
+//     eventLoop sees them: "open" (default; leave it to eventLoop), "reject"
+//     or "hold". Either way the sender is told, unless their message was
+//     automated.
+// * NNTPAddress  string; if set, serve the archive over NNTP here.
+// * NNTPGroup    string; newsgroup name, derived from ListAddress if unset.
+// * NNTPPosting  bool; accept NNTP posts, passing them to eventLoop like mail.
+// * MatrixHomeserver, MatrixAccessToken, MatrixRoomID string; if MatrixRoomID is
+//     set, relayed posts are mirrored into that Matrix room.
+// * MatrixUsers  map/table of Matrix user ID->email; room messages from these
+//     users are posted to the list as if sent from the mapped address.
+// * Webhooks     list/table of Slack or Discord incoming webhook URLs, which
+//     receive a summary of each relayed message.
+// * LDAPURL      string; ldap:// or ldaps:// server to sync members from.
+// * LDAPStartTLS bool; upgrade ldap:// connections with StartTLS.
+// * LDAPBindDN, LDAPBindPassword string; credentials, or anonymous if unset.
+// * LDAPGroupDN  string; if set (with LDAPURL), the group whose members are
+//     kept subscribed in loop mode.
+// * LDAPAttributes map/table of "Member", "Email" and "Name" to the LDAP
+//     attributes holding them; defaults are "member", "mail" and "cn".
+// * LDAPSyncInterval int; minutes between LDAP syncs.
+// * CardDAVURL   string; if set, the address book whose contacts are kept
+//     subscribed in loop mode.
+// * CardDAVUsername, CardDAVPassword string; HTTP basic auth credentials.
+// * CardDAVGroup string; only sync contacts in this group (vCard category).
+// * CardDAVSyncInterval int; minutes between CardDAV syncs.
+// * SCIMToken    string; if set, serve a SCIM 2.0 Users endpoint at
+//     /scim/v2/Users for identity providers bearing this token. Deactivated
+//     users are suspended; deleted ones are removed if SCIM added them, or
+//     else go back to being managed by hand.
+// * BounceAddress string; SMTP envelope sender (Return-Path) for outgoing
+//     mail, so bounces go to a mailbox of their own rather than the list
+//     INBOX. Used by the "smtp" and "fake" Transports.
+// * BounceThreshold number; stop delivery to members whose bounce score
+//     reaches this (hard bounces and complaints score 1, soft bounces 0.25).
+//     Zero, the default, only records bounces.
+// * ReportInterval string; "weekly" or "monthly" to mail a traffic report
+//     (volume, top posters, joins and leaves, bounces) to ReportRecipients.
+// * ReportRecipients []string; owner addresses to send reports to.
+// * ReportTemplate string; optional Go text/template file for the report.
 func ConfigFromState(L *lua.LState) *Config {
 	C := new(Config)
 	C.IMAPUsername = stringOrNothing(L.GetGlobal("IMAPUsername"))
 	C.IMAPPassword = stringOrNothing(L.GetGlobal("IMAPPassword"))
 	C.IMAPHost = stringOrNothing(L.GetGlobal("IMAPHost"))
 	C.IMAPPort = intOrDefault(L.GetGlobal("IMAPPort"), 143)
+	C.IMAPSearchSubject = stringOrNothing(L.GetGlobal("IMAPSearchSubject"))
+	C.IMAPToListOnly = boolOrDefault(L.GetGlobal("IMAPToListOnly"), false)
+	C.IMAPSince = stringOrNothing(L.GetGlobal("IMAPSince"))
+	C.IMAPBatchSize = numberOrDefault(L.GetGlobal("IMAPBatchSize"), 50)
+	C.MaxMessageMB = numberOrDefault(L.GetGlobal("MaxMessageMB"), 25)
+	C.SpoolThresholdKB = numberOrDefault(L.GetGlobal("SpoolThresholdKB"), 1024)
+	C.SpoolDir = stringOrNothing(L.GetGlobal("SpoolDir"))
+	C.IMAPInbox = stringOrNothing(L.GetGlobal("IMAPInbox"))
+	if C.IMAPInbox == "" {
+		C.IMAPInbox = "INBOX"
+	}
+	C.IMAPDoneFolder = stringOrNothing(L.GetGlobal("IMAPDoneFolder"))
+	C.IMAPErrorFolder = stringOrNothing(L.GetGlobal("IMAPErrorFolder"))
+	C.IMAPNamespace = "auto"
+	if ns, ok := L.GetGlobal("IMAPNamespace").(lua.LString); ok {
+		C.IMAPNamespace = string(ns)
+	}
+	C.Fetcher = stringOrNothing(L.GetGlobal("Fetcher"))
+	C.JMAPSessionURL = stringOrNothing(L.GetGlobal("JMAPSessionURL"))
+	C.JMAPToken = stringOrNothing(L.GetGlobal("JMAPToken"))
+	C.POP3Host = stringOrNothing(L.GetGlobal("POP3Host"))
+	if C.POP3Host == "" {
+		C.POP3Host = C.IMAPHost
+	}
+	C.POP3TLS = boolOrDefault(L.GetGlobal("POP3TLS"), true)
+	if C.POP3TLS {
+		C.POP3Port = numberOrDefault(L.GetGlobal("POP3Port"), 995)
+	} else {
+		C.POP3Port = numberOrDefault(L.GetGlobal("POP3Port"), 110)
+	}
+	C.POP3Delete = boolOrDefault(L.GetGlobal("POP3Delete"), true)
 	C.SMTPUsername = stringOrNothing(L.GetGlobal("SMTPUsername"))
 	C.SMTPPassword = stringOrNothing(L.GetGlobal("SMTPPassword"))
 	C.SMTPHost = stringOrNothing(L.GetGlobal("SMTPHost"))
 	C.SMTPPort = intOrDefault(L.GetGlobal("SMTPPort"), 465)
 	C.ListAddress = stringOrNothing(L.GetGlobal("ListAddress"))
+	C.AdminAddress = stringOrNothing(L.GetGlobal("AdminAddress"))
+	C.LogLevel = stringOrNothing(L.GetGlobal("LogLevel"))
+	C.LogLevels = stringMapOrEmpty(L.GetGlobal("LogLevels"))
+	C.LogFormat = stringOrNothing(L.GetGlobal("LogFormat"))
+	C.LogFile = stringOrNothing(L.GetGlobal("LogFile"))
+	C.LogMaxSizeMB = numberOrDefault(L.GetGlobal("LogMaxSizeMB"), 10)
+	C.LogMaxAgeDays = numberOrDefault(L.GetGlobal("LogMaxAgeDays"), 0)
+	C.LogKeep = numberOrDefault(L.GetGlobal("LogKeep"), 5)
+	C.SyslogAddress = stringOrNothing(L.GetGlobal("SyslogAddress"))
+	C.SyslogFacility = stringOrNothing(L.GetGlobal("SyslogFacility"))
+	if C.SyslogFacility == "" {
+		C.SyslogFacility = "daemon"
+	}
+	C.SyslogTag = stringOrNothing(L.GetGlobal("SyslogTag"))
+	if C.SyslogTag == "" {
+		C.SyslogTag = "listless"
+	}
+	C.OTLPEndpoint = stringOrNothing(L.GetGlobal("OTLPEndpoint"))
+	C.OTLPHeaders = stringMapOrEmpty(L.GetGlobal("OTLPHeaders"))
+	C.SlowMessageSeconds = floatOrDefault(L.GetGlobal("SlowMessageSeconds"), 30)
+	C.SentryDSN = stringOrNothing(L.GetGlobal("SentryDSN"))
+	C.ErrorWebhook = stringOrNothing(L.GetGlobal("ErrorWebhook"))
+	C.AlertRecipients = stringListOrNothing(L.GetGlobal("AlertRecipients"))
+	C.AlertWebhooks = stringListOrNothing(L.GetGlobal("AlertWebhooks"))
+	C.AlertSMTPFailures = numberOrDefault(L.GetGlobal("AlertSMTPFailures"), 5)
+	C.AlertSMTPWindowMinutes = numberOrDefault(L.GetGlobal("AlertSMTPWindowMinutes"), 10)
+	C.AlertIMAPDownMinutes = numberOrDefault(L.GetGlobal("AlertIMAPDownMinutes"), 15)
+	C.AlertCooldownMinutes = numberOrDefault(L.GetGlobal("AlertCooldownMinutes"), 60)
 	C.Database = stringOrNothing(L.GetGlobal("Database"))
+	C.AdminSocket = stringOrNothing(L.GetGlobal("AdminSocket"))
+	C.RosterCache = boolOrDefault(L.GetGlobal("RosterCache"), true)
 	C.DeliverScript = stringOrNothing(L.GetGlobal("DeliverScript"))
 	C.MessageFrequency = intOrDefault(L.GetGlobal("MessageFrequency"), 1)
 	C.PollFrequency = intOrDefault(L.GetGlobal("PollFrequency"), 60)
+	C.PollMinFrequency = numberOrDefault(L.GetGlobal("PollMinFrequency"), 5)
+	C.PollJitter = floatOrDefault(L.GetGlobal("PollJitter"), 0.2)
+	C.ProcessTimeout = numberOrDefault(L.GetGlobal("ProcessTimeout"), 120)
+	C.SendRateLimit = numberOrDefault(L.GetGlobal("SendRateLimit"), 0)
 	C.smtpAddr = C.SMTPHost + ":" + strconv.Itoa(C.SMTPPort)
 	C.SMTPIP = stringOrNothing(L.GetGlobal("SMTPIP"))
+	C.Identities = identityTableOrEmpty(L.GetGlobal("Identities"))
+	C.Transport = stringOrNothing(L.GetGlobal("Transport"))
+	C.FakeInbox = stringOrNothing(L.GetGlobal("FakeInbox"))
+	if C.FakeInbox == "" {
+		C.FakeInbox = "./fake-inbox"
+	}
+	C.FakeOutbox = stringOrNothing(L.GetGlobal("FakeOutbox"))
+	C.OAuthProvider = stringOrNothing(L.GetGlobal("OAuthProvider"))
+	C.OAuthTokenURL = stringOrNothing(L.GetGlobal("OAuthTokenURL"))
+	C.OAuthClientID = stringOrNothing(L.GetGlobal("OAuthClientID"))
+	C.OAuthClientSecret = stringOrNothing(L.GetGlobal("OAuthClientSecret"))
+	C.OAuthRefreshToken = stringOrNothing(L.GetGlobal("OAuthRefreshToken"))
+	C.GraphTenantID = stringOrNothing(L.GetGlobal("GraphTenantID"))
+	C.SESRegion = stringOrNothing(L.GetGlobal("SESRegion"))
+	C.SESAccessKeyID = stringOrNothing(L.GetGlobal("SESAccessKeyID"))
+	C.SESSecretAccessKey = stringOrNothing(L.GetGlobal("SESSecretAccessKey"))
+	C.SESConfigurationSet = stringOrNothing(L.GetGlobal("SESConfigurationSet"))
+	C.SESNotificationToken = stringOrNothing(L.GetGlobal("SESNotificationToken"))
+	C.MailgunDomain = stringOrNothing(L.GetGlobal("MailgunDomain"))
+	C.MailgunAPIKey = stringOrNothing(L.GetGlobal("MailgunAPIKey"))
+	C.MailgunRegion = stringOrNothing(L.GetGlobal("MailgunRegion"))
+	C.SendGridAPIKey = stringOrNothing(L.GetGlobal("SendGridAPIKey"))
+	C.HTMLSanitisePolicy = stringOrNothing(L.GetGlobal("HTMLSanitisePolicy"))
+	C.SubjectTag = stringOrNothing(L.GetGlobal("SubjectTag"))
+	C.TrimQuotes = numberOrDefault(L.GetGlobal("TrimQuotes"), -1)
+	C.Language = stringOrNothing(L.GetGlobal("Language"))
+	C.TemplateDir = stringOrNothing(L.GetGlobal("TemplateDir"))
+	C.LuaPrivilegedAllow = stringListOrNothing(L.GetGlobal("LuaPrivilegedAllow"))
+	C.LuaPrivilegedDeny = stringListOrNothing(L.GetGlobal("LuaPrivilegedDeny"))
+	C.LuaModeratorAllow = stringListOrNothing(L.GetGlobal("LuaModeratorAllow"))
+	C.LuaModeratorDeny = stringListOrNothing(L.GetGlobal("LuaModeratorDeny"))
+	C.LuaKVStoreAllow = stringListOrNothing(L.GetGlobal("LuaKVStoreAllow"))
+	C.LuaKVStoreDeny = stringListOrNothing(L.GetGlobal("LuaKVStoreDeny"))
+	C.Scripts = scriptTableOrEmpty(L.GetGlobal("Scripts"))
+	C.TransactionKVStore = stringOrNothing(L.GetGlobal("TransactionKVStore"))
+	C.TransactionKey = stringOrNothing(L.GetGlobal("TransactionKey"))
+	C.TransactionScan = stringOrNothing(L.GetGlobal("TransactionScan"))
+	if C.TransactionScan == "" {
+		C.TransactionScan = "subject"
+	}
+	C.ChangeScript = stringOrNothing(L.GetGlobal("ChangeScript"))
+	C.ChangeWebhooks = stringListOrNothing(L.GetGlobal("ChangeWebhooks"))
+	C.ChangeKVStores = stringListOrNothing(L.GetGlobal("ChangeKVStores"))
+	C.AnonymousPosting = boolOrDefault(L.GetGlobal("AnonymousPosting"), false)
+	C.AnonymousName = stringOrNothing(L.GetGlobal("AnonymousName"))
+	if C.AnonymousName == "" {
+		C.AnonymousName = "Anonymous"
+	}
+	C.AnonymousPseudonyms = boolOrDefault(L.GetGlobal("AnonymousPseudonyms"), false)
+	C.Archive = boolOrDefault(L.GetGlobal("Archive"), false)
+	C.ArchiveURL = stringOrNothing(L.GetGlobal("ArchiveURL"))
+	C.ArchiveFooter = boolOrDefault(L.GetGlobal("ArchiveFooter"), false)
+	C.ArchiveObfuscation = stringOrNothing(L.GetGlobal("ArchiveObfuscation"))
+	C.ArchiveRetentionDays = numberOrDefault(L.GetGlobal("ArchiveRetentionDays"), 0)
+	C.ArchiveMaxMessages = numberOrDefault(L.GetGlobal("ArchiveMaxMessages"), 0)
+	C.ArchiveMaxBytes = numberOrDefault(L.GetGlobal("ArchiveMaxBytes"), 0)
+	C.HTTPAddress = stringOrNothing(L.GetGlobal("HTTPAddress"))
+	C.FeedItems = numberOrDefault(L.GetGlobal("FeedItems"), 20)
+	C.FeedFullBody = boolOrDefault(L.GetGlobal("FeedFullBody"), false)
+	C.PublicURL = stringOrNothing(L.GetGlobal("PublicURL"))
+	C.ActivityPub = boolOrDefault(L.GetGlobal("ActivityPub"), false)
+	C.HoldExpiryHours = numberOrDefault(L.GetGlobal("HoldExpiryHours"), 72)
+	C.ModerationToken = stringOrNothing(L.GetGlobal("ModerationToken"))
+	C.ModerationQuorum = numberOrDefault(L.GetGlobal("ModerationQuorum"), 1)
+	C.SenderPolicy = stringOrNothing(L.GetGlobal("SenderPolicy"))
+	if C.SenderPolicy == "" {
+		C.SenderPolicy = "open"
+	}
+	C.NNTPAddress = stringOrNothing(L.GetGlobal("NNTPAddress"))
+	C.NNTPGroup = stringOrNothing(L.GetGlobal("NNTPGroup"))
+	C.NNTPPosting = boolOrDefault(L.GetGlobal("NNTPPosting"), false)
 	if C.SMTPIP == "" {
 		// Guess IP address by seeking DNS host for SMTPHost
 		ips, err := net.LookupIP(C.SMTPHost)
@@ -99,12 +685,30 @@ func ConfigFromState(L *lua.LState) *Config {
 		C.ListAddress = C.SMTPUsername + "@" + C.SMTPHost
 		log15.Info("Creating a uniquey 'ListAddress' config option as none was provided manually", log15.Ctx{"context": "setup", "ListAddress": C.ListAddress})
 	}
-	C.Constants = make(map[string]string)
-	if constantsTable, ok := L.GetGlobal("Constants").(*lua.LTable); ok {
-		constantsTable.ForEach(func(key, val lua.LValue) {
-			C.Constants[key.String()] = val.String()
-		})
-	}
+	C.Constants = stringMapOrEmpty(L.GetGlobal("Constants"))
+	C.MatrixHomeserver = stringOrNothing(L.GetGlobal("MatrixHomeserver"))
+	C.MatrixAccessToken = stringOrNothing(L.GetGlobal("MatrixAccessToken"))
+	C.MatrixRoomID = stringOrNothing(L.GetGlobal("MatrixRoomID"))
+	C.MatrixUsers = stringMapOrEmpty(L.GetGlobal("MatrixUsers"))
+	C.Webhooks = stringListOrNothing(L.GetGlobal("Webhooks"))
+	C.LDAPURL = stringOrNothing(L.GetGlobal("LDAPURL"))
+	C.LDAPStartTLS = boolOrDefault(L.GetGlobal("LDAPStartTLS"), false)
+	C.LDAPBindDN = stringOrNothing(L.GetGlobal("LDAPBindDN"))
+	C.LDAPBindPassword = stringOrNothing(L.GetGlobal("LDAPBindPassword"))
+	C.LDAPGroupDN = stringOrNothing(L.GetGlobal("LDAPGroupDN"))
+	C.LDAPAttributes = stringMapOrEmpty(L.GetGlobal("LDAPAttributes"))
+	C.LDAPSyncInterval = numberOrDefault(L.GetGlobal("LDAPSyncInterval"), 60)
+	C.CardDAVURL = stringOrNothing(L.GetGlobal("CardDAVURL"))
+	C.CardDAVUsername = stringOrNothing(L.GetGlobal("CardDAVUsername"))
+	C.CardDAVPassword = stringOrNothing(L.GetGlobal("CardDAVPassword"))
+	C.CardDAVGroup = stringOrNothing(L.GetGlobal("CardDAVGroup"))
+	C.CardDAVSyncInterval = numberOrDefault(L.GetGlobal("CardDAVSyncInterval"), 60)
+	C.SCIMToken = stringOrNothing(L.GetGlobal("SCIMToken"))
+	C.BounceThreshold = floatOrDefault(L.GetGlobal("BounceThreshold"), 0)
+	C.BounceAddress = stringOrNothing(L.GetGlobal("BounceAddress"))
+	C.ReportInterval = stringOrNothing(L.GetGlobal("ReportInterval"))
+	C.ReportRecipients = stringListOrNothing(L.GetGlobal("ReportRecipients"))
+	C.ReportTemplate = stringOrNothing(L.GetGlobal("ReportTemplate"))
 	log15.Info("SMTP Address..", log15.Ctx{"context": "setup", "SMTP Address": C.smtpAddr})
 	return C
 }
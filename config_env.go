@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// envConfigFile, given where a config file is expected, reads the settings
+// from LISTLESS_ environment variables instead, e.g. in a container image.
+const envConfigFile = "env:"
+
+// envConfigPrefix starts the names of the environment variables read for
+// envConfigFile. The rest of the name is a setting, in any case, so
+// LISTLESS_IMAPHOST sets IMAPHost. Tables are set an entry at a time, as
+// LISTLESS_CONSTANTS_greeting sets Constants.greeting, and lists are
+// comma-separated.
+const envConfigPrefix = "LISTLESS_"
+
+var (
+	// ErrUnknownEnvSetting - Returned for a LISTLESS_ variable that names no setting.
+	ErrUnknownEnvSetting = errors.New("No such setting")
+
+	// ErrEnvSettingUnsupported - Returned for settings too structured to give as variables.
+	ErrEnvSettingUnsupported = errors.New("This setting needs a config file")
+
+	// ErrBadEnvSetting - Returned when a variable's value doesn't suit its setting.
+	ErrBadEnvSetting = errors.New("Value should be a number, or true or false, as the setting expects")
+)
+
+// envSettingFields maps upper-cased setting names to the Config fields
+// ConfigFromState reads them into.
+func envSettingFields() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" {
+			fields[strings.ToUpper(f.Name)] = f
+		}
+	}
+	return fields
+}
+
+// envSettings reads the LISTLESS_ variables in environ (as from os.Environ)
+// into the values a config file would set, by setting name: a string,
+// float64, bool, []string or map[string]string.
+func envSettings(environ []string) (map[string]interface{}, error) {
+	fields := envSettingFields()
+	settings := make(map[string]interface{})
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envConfigPrefix) {
+			continue
+		}
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			continue
+		}
+		variable, value := kv[:eq], kv[eq+1:]
+		name, key := variable[len(envConfigPrefix):], ""
+		if us := strings.Index(name, "_"); us > 0 {
+			name, key = name[:us], name[us+1:]
+		}
+		f, ok := fields[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("%s: %v", variable, ErrUnknownEnvSetting)
+		}
+		// Only tables take a key.
+		if (key != "") != (f.Type.Kind() == reflect.Map) {
+			return nil, fmt.Errorf("%s: %v", variable, ErrUnknownEnvSetting)
+		}
+		var setting interface{}
+		switch f.Type.Kind() {
+		case reflect.String:
+			setting = value
+		case reflect.Int, reflect.Float64:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", variable, ErrBadEnvSetting)
+			}
+			setting = n
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", variable, ErrBadEnvSetting)
+			}
+			setting = b
+		case reflect.Slice:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			setting = list
+		case reflect.Map:
+			// Scripts may be given as paths, but Identities need tables.
+			if f.Type.Elem().Kind() == reflect.Ptr {
+				return nil, fmt.Errorf("%s: %v", variable, ErrEnvSettingUnsupported)
+			}
+			m, _ := settings[f.Name].(map[string]string)
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[key] = value
+			setting = m
+		default:
+			return nil, fmt.Errorf("%s: %v", variable, ErrEnvSettingUnsupported)
+		}
+		settings[f.Name] = setting
+	}
+	return settings, nil
+}
+
+// setEnvGlobals sets the globals of L from envSettings, as running a config
+// file would, for ConfigFromState to read.
+func setEnvGlobals(L *lua.LState, settings map[string]interface{}) {
+	for name, setting := range settings {
+		var value lua.LValue
+		switch s := setting.(type) {
+		case string:
+			value = lua.LString(s)
+		case float64:
+			value = lua.LNumber(s)
+		case bool:
+			value = lua.LBool(s)
+		case []string:
+			table := L.NewTable()
+			for _, item := range s {
+				table.Append(lua.LString(item))
+			}
+			value = table
+		case map[string]string:
+			table := L.NewTable()
+			for k, v := range s {
+				table.RawSetString(k, lua.LString(v))
+			}
+			value = table
+		}
+		L.SetGlobal(name, value)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvSettings(t *testing.T) {
+	settings, err := envSettings([]string{
+		"HOME=/root",
+		"LISTLESS_IMAPHOST=imap.example.com",
+		"LISTLESS_ImapPort=993",
+		"LISTLESS_ARCHIVE=true",
+		"LISTLESS_ALERTRECIPIENTS=owner@example.com, help@example.com",
+		"LISTLESS_DELIVERSCRIPT=/etc/listless/eventloop.lua",
+		"LISTLESS_CONSTANTS_greeting=Hello, all",
+		"LISTLESS_CONSTANTS_footer=Bye",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"IMAPHost":        "imap.example.com",
+		"IMAPPort":        float64(993),
+		"Archive":         true,
+		"AlertRecipients": []string{"owner@example.com", "help@example.com"},
+		"DeliverScript":   "/etc/listless/eventloop.lua",
+		"Constants":       map[string]string{"greeting": "Hello, all", "footer": "Bye"},
+	}, settings)
+
+	for _, bad := range []string{
+		"LISTLESS_IMAPHOTS=typo.example.com",
+		"LISTLESS_IMAPHOST_extra=x",
+		"LISTLESS_CONSTANTS=no key",
+		"LISTLESS_IMAPPORT=imaps",
+		"LISTLESS_IDENTITIES_announce=announce@example.com",
+	} {
+		_, err = envSettings([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 
 	"github.com/boltdb/bolt"
 	"github.com/layeh/gopher-luar"
@@ -18,10 +19,41 @@ var (
 	// ErrArchiveBucketNotFound - Returned when a database lookup fails at the bucket level.
 	ErrArchiveBucketNotFound = errors.New("Archive bucket not found")
 
-	memberBucketName      = "members"
-	kvBucketName          = "kvstores"
-	transactionBucketName = "transactions"
-	bucketList            = []string{memberBucketName, kvBucketName, transactionBucketName}
+	// ErrActivityPubBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrActivityPubBucketNotFound = errors.New("ActivityPub bucket not found")
+
+	// ErrBounceBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrBounceBucketNotFound = errors.New("Bounce bucket not found")
+
+	// ErrUnknownLuaMethod - Returned when a whitelist option names a method that doesn't exist.
+	ErrUnknownLuaMethod = errors.New("No such method to whitelist in Lua")
+
+	// ErrKVBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrKVBucketNotFound = errors.New("KV store bucket not found")
+
+	// ErrTransactionBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrTransactionBucketNotFound = errors.New("Transaction bucket not found")
+
+	memberBucketName        = "members"
+	kvBucketName            = "kvstores"
+	transactionBucketName   = "transactions"
+	archiveBucketName       = "archive"
+	activityPubBucketName   = "activitypub"
+	bounceBucketName        = "bounces"
+	pop3BucketName          = "pop3"
+	activityBucketName      = "activity"
+	eventBucketName         = "events"
+	reportBucketName        = "reports"
+	anonymousBucketName     = "anonymous"
+	pseudonymBucketName     = "pseudonyms"
+	heldBucketName          = "held"
+	queueBucketName         = "queue"
+	quarantineBucketName    = "quarantine"
+	allowedSenderBucketName = "allowedsenders"
+	aliasBucketName         = "aliases"
+	metaBucketName          = "meta"
+	indexBucketName         = "indexes"
+	bucketList              = []string{memberBucketName, kvBucketName, transactionBucketName, archiveBucketName, activityPubBucketName, bounceBucketName, pop3BucketName, activityBucketName, eventBucketName, reportBucketName, anonymousBucketName, pseudonymBucketName, heldBucketName, queueBucketName, quarantineBucketName, allowedSenderBucketName, aliasBucketName, metaBucketName, indexBucketName}
 )
 
 // ListlessDB - The database object used by Listless. This wraps boltdb and adds
@@ -31,6 +63,17 @@ var (
 // appropriate to their execution contexts.
 type ListlessDB struct {
 	*bolt.DB
+	// Runs transaction scripts; set by NewEngine.
+	runHook func(name, hook string, em *Email, refcode string) (string, error)
+	// The TransactionKVStore pattern; set by NewEngine.
+	transactionKVStore string
+	// HMAC key for transaction secrets; set by NewEngine.
+	transactionKey []byte
+	// Told of changes to members and ChangeKVStores; set by NewEngine.
+	onChange       func(DBChange)
+	changeKVStores map[string]bool
+	// Cached recipient lists, if RosterCache is on; set by NewEngine.
+	roster *rosterCache
 }
 
 // NewDatabase - Open a Bolt DB optionally with a Bolt Options instance.
@@ -45,7 +88,7 @@ func NewDatabase(loc string, boltconf ...*bolt.Options) (ldb *ListlessDB, err er
 	if err != nil {
 		return nil, err
 	}
-	// Configure database buckets.
+	// Configure database buckets, and bring the schema up to date.
 	ldb.DB = db
 	return ldb, db.Update(func(tx *bolt.Tx) error {
 		for _, bucketName := range bucketList {
@@ -53,13 +96,13 @@ func NewDatabase(loc string, boltconf ...*bolt.Options) (ldb *ListlessDB, err er
 				return err
 			}
 		}
-		return nil
+		return migrate(tx)
 	})
 }
 
 // Create a temporary Boltdb to register whitelisted methods in this Lua state
 // using Luar, then destroy the temporary boltdb once it's finished.
-func applyLuarWhitelists(L *lua.LState) error {
+func applyLuarWhitelists(L *lua.LState, wl *luaWhitelists) error {
 	// Mail Objects:
 	emailMT := luar.MT(L, Email{})
 	emailMT.Whitelist(EmailPermittedMethods...)
@@ -80,13 +123,13 @@ func applyLuarWhitelists(L *lua.LState) error {
 	// Apply levelled whitelists for "Privileged" (full access) and
 	// "Moderator" (limited access) database wrappers.
 	privDBMT := luar.MT(L, dummydb.PrivilegedDBWrapper())
-	privDBMT.Whitelist(PrivilegedDBPermittedMethods...)
+	privDBMT.Whitelist(wl.Privileged...)
 	modrDBMT := luar.MT(L, dummydb.ModeratorDBWrapper())
-	modrDBMT.Whitelist(ModeratorDBPermittedMethods...)
+	modrDBMT.Whitelist(wl.Moderator...)
 	// Must also whitelist the Key/Value stores to prevent access to underlying DB.
 	dummykv := dummydb.KVStore("dummy")
 	kvMT := luar.MT(L, dummykv)
-	kvMT.Whitelist(ListlessKVStorePermittedMethods...)
+	kvMT.Whitelist(wl.KVStore...)
 	return nil
 }
 
@@ -123,24 +166,100 @@ func (db *ListlessDB) ModeratorDBWrapper() *ModeratorDBWrapper {
 // PrivilegedDBPermittedMethods is a list of permitted fields/methods on a PrivilegedDBWrapper
 // within Lua.
 var PrivilegedDBPermittedMethods = []string{
-	"IsModerator", "IsAllowedPost",
+	"IsModerator", "IsAllowedPost", "HasRole",
 	"CreateSubscriber", "UpdateSubscriber", "DelSubscriber",
-	"GetAllSubscribers", "KVStore",
+	"GetAllSubscribers", "UpdateAll", "MembersIn", "InIndex",
+	"MemberActivity", "PseudonymFor", "KVStore",
 	"RegisterTransaction", "HasTransaction", "TriggerTransaction",
+	"AllowSender", "DisallowSender", "IsAllowedSender", "AllowedSenders",
+	"AddAlias", "RemoveAlias", "AliasesOf", "PrimaryAddress",
 }
 
 // ModeratorDBPermittedMethods is a list of permitted fields/methods on a ModeratorDBWrapper
 // within Lua.
 var ModeratorDBPermittedMethods = []string{
-	"IsModerator", "IsAllowedPost",
+	"IsModerator", "IsAllowedPost", "HasRole", "InIndex",
 	"CreateSubscriber", "UpdateSubscriber", "GetSubscriber", "DelSubscriber",
+	"MemberActivity", "PseudonymFor",
 	// Getting subscriber list is not permitted for Moderators, as they can always
 	// GetSubscriber using a known email address.
 	// Moderators are also not currently given KVStore access.
 	"RegisterTransaction", "HasTransaction", "TriggerTransaction",
+	"AllowSender", "DisallowSender", "IsAllowedSender",
+	"AddAlias", "RemoveAlias", "AliasesOf", "PrimaryAddress",
 }
 
 // ListlessKVStorePermittedMethods - Whitelisted fields/methods for the ListlessKVStore type in luar.
 var ListlessKVStorePermittedMethods = []string{
 	"Store", "Retrieve", "Delete", "Keys", "Destroy", "BucketName",
 }
+
+// luaWhitelists are the method whitelists in effect: the defaults above,
+// adjusted by the Lua*Allow and Lua*Deny config options.
+type luaWhitelists struct {
+	Privileged []string
+	Moderator  []string
+	KVStore    []string
+}
+
+// adjustWhitelist returns base with allow added and deny removed. Added names
+// must be fields or methods of the type of example.
+func adjustWhitelist(base, allow, deny []string, example interface{}) ([]string, error) {
+	denied := make(map[string]bool)
+	for _, name := range deny {
+		denied[name] = true
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string(nil), base...), allow...) {
+		if denied[name] || seen[name] {
+			continue
+		}
+		if !hasFieldOrMethod(example, name) {
+			return nil, errors.New(ErrUnknownLuaMethod.Error() + ": " + name)
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+// boltDBType is the type ListlessDB embeds, and the wrappers with it.
+var boltDBType = reflect.TypeOf(&bolt.DB{})
+
+// hasFieldOrMethod reports whether a struct pointer has an exported field or
+// method of the given name. What the wrappers get from the embedded *bolt.DB
+// (Update, Close and the like) doesn't count, nor do the embedded fields
+// themselves: either would give Lua the raw database.
+func hasFieldOrMethod(example interface{}, name string) bool {
+	if _, ok := boltDBType.MethodByName(name); ok {
+		return false
+	}
+	if _, ok := boltDBType.Elem().FieldByName(name); ok {
+		return false
+	}
+	t := reflect.TypeOf(example)
+	if _, ok := t.MethodByName(name); ok {
+		return true
+	}
+	f, ok := t.Elem().FieldByName(name)
+	return ok && !f.Anonymous
+}
+
+// buildLuaWhitelists applies the config's whitelist adjustments to the defaults.
+func buildLuaWhitelists(cfg *Config) (*luaWhitelists, error) {
+	var (
+		wl  luaWhitelists
+		err error
+	)
+	if wl.Privileged, err = adjustWhitelist(PrivilegedDBPermittedMethods, cfg.LuaPrivilegedAllow, cfg.LuaPrivilegedDeny, &PrivilegedDBWrapper{}); err != nil {
+		return nil, err
+	}
+	if wl.Moderator, err = adjustWhitelist(ModeratorDBPermittedMethods, cfg.LuaModeratorAllow, cfg.LuaModeratorDeny, &ModeratorDBWrapper{}); err != nil {
+		return nil, err
+	}
+	if wl.KVStore, err = adjustWhitelist(ListlessKVStorePermittedMethods, cfg.LuaKVStoreAllow, cfg.LuaKVStoreDeny, &ListlessKVStore{}); err != nil {
+		return nil, err
+	}
+	return &wl, nil
+}
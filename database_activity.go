@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrActivityBucketNotFound - Returned when a database lookup fails at the bucket level.
+var ErrActivityBucketNotFound = errors.New("Activity bucket not found")
+
+// MemberActivity counts the posts an address has made to the list.
+type MemberActivity struct {
+	Email     string
+	Posts     int
+	FirstPost time.Time
+	LastPost  time.Time
+}
+
+// RecordPost counts a relayed post from an address, and logs it.
+func (db *ListlessDB) RecordPost(email string) error {
+	email = normaliseEmail(email)
+	if email == "" {
+		return ErrInvalidEmail
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(activityBucketName))
+		if bucket == nil {
+			return ErrActivityBucketNotFound
+		}
+		activity := &MemberActivity{Email: email}
+		if activityb := bucket.Get([]byte(email)); activityb != nil {
+			if err := json.Unmarshal(activityb, activity); err != nil {
+				return err
+			}
+		}
+		now := time.Now().UTC()
+		if activity.FirstPost.IsZero() {
+			activity.FirstPost = now
+		}
+		activity.LastPost = now
+		activity.Posts++
+		activityb, err := json.Marshal(activity)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(email), activityb); err != nil {
+			return err
+		}
+		return logEvent(tx, EventPost, email)
+	})
+}
+
+// MemberActivity returns the posting activity of an address; addresses that
+// never posted have an empty record.
+func (db *ListlessDB) MemberActivity(email string) (*MemberActivity, error) {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil, ErrInvalidEmail
+	}
+	activity := &MemberActivity{Email: email}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(activityBucketName))
+		if bucket == nil {
+			return ErrActivityBucketNotFound
+		}
+		if activityb := bucket.Get([]byte(email)); activityb != nil {
+			return json.Unmarshal(activityb, activity)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
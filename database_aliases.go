@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrAliasBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrAliasBucketNotFound = errors.New("Alias bucket not found")
+
+	// ErrAliasIsMember - Returned when adding an alias that is a member's own address.
+	ErrAliasIsMember = errors.New("Alias is already a member's address")
+
+	// ErrAliasTaken - Returned when adding an alias that belongs to another member.
+	ErrAliasTaken = errors.New("Alias already belongs to another member")
+)
+
+// AddAlias registers alias as another address of the member primary: they
+// may post from it, and count as the member in IsAllowedPost, IsModerator and
+// HasRole, but mail is only delivered to primary. Adding an alias a second
+// time is not an error.
+func (db *ListlessDB) AddAlias(primary, alias string) error {
+	primary, alias = normaliseEmail(primary), normaliseEmail(alias)
+	if primary == "" || alias == "" {
+		return ErrInvalidEmail
+	}
+	if primary == alias {
+		return ErrAliasIsMember
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		aliases := tx.Bucket([]byte(aliasBucketName))
+		if aliases == nil {
+			return ErrAliasBucketNotFound
+		}
+		if members.Get([]byte(primary)) == nil {
+			return ErrMemberEntryNotFound
+		}
+		if members.Get([]byte(alias)) != nil {
+			return ErrAliasIsMember
+		}
+		if owner := aliases.Get([]byte(alias)); owner != nil && string(owner) != primary {
+			return ErrAliasTaken
+		}
+		return aliases.Put([]byte(alias), []byte(primary))
+	})
+}
+
+// RemoveAlias forgets an alias. It is not an error if it wasn't one.
+func (db *ListlessDB) RemoveAlias(alias string) error {
+	alias = normaliseEmail(alias)
+	if alias == "" {
+		return ErrInvalidEmail
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		aliases := tx.Bucket([]byte(aliasBucketName))
+		if aliases == nil {
+			return ErrAliasBucketNotFound
+		}
+		return aliases.Delete([]byte(alias))
+	})
+}
+
+// AliasesOf returns the aliases of the member primary.
+func (db *ListlessDB) AliasesOf(primary string) (found []string, err error) {
+	primary = normaliseEmail(primary)
+	if primary == "" {
+		return nil, ErrInvalidEmail
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		aliases := tx.Bucket([]byte(aliasBucketName))
+		if aliases == nil {
+			return ErrAliasBucketNotFound
+		}
+		return aliases.ForEach(func(k, v []byte) error {
+			if string(v) == primary {
+				found = append(found, string(k))
+			}
+			return nil
+		})
+	})
+	return found, err
+}
+
+// PrimaryAddress returns the member address that email is an alias of, or
+// email itself (normalised) if it isn't an alias.
+func (db *ListlessDB) PrimaryAddress(email string) string {
+	email, err := parseExpressiveEmail(email)
+	if err != nil {
+		return ""
+	}
+	primary := email
+	db.View(func(tx *bolt.Tx) error {
+		aliases := tx.Bucket([]byte(aliasBucketName))
+		if aliases == nil {
+			return ErrAliasBucketNotFound
+		}
+		if owner := aliases.Get([]byte(email)); owner != nil {
+			primary = string(owner)
+		}
+		return nil
+	})
+	return primary
+}
+
+// memberFor is GetSubscriber, but also finds members by their aliases.
+func (db *ListlessDB) memberFor(email string) (*MemberMeta, error) {
+	sub, err := db.GetSubscriber(email)
+	if err != ErrMemberEntryNotFound {
+		return sub, err
+	}
+	addr, _ := parseExpressiveEmail(email)
+	if primary := db.PrimaryAddress(email); primary != addr {
+		return db.GetSubscriber(primary)
+	}
+	return nil, err
+}
+
+// delAliasesOf removes the aliases of a member being removed.
+func delAliasesOf(tx *bolt.Tx, primary string) error {
+	aliases := tx.Bucket([]byte(aliasBucketName))
+	if aliases == nil {
+		return ErrAliasBucketNotFound
+	}
+	// Deleting while iterating skips keys, so collect them first.
+	var keys []string
+	aliases.ForEach(func(k, v []byte) error {
+		if string(v) == primary {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	for _, k := range keys {
+		if err := aliases.Delete([]byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
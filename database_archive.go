@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrArchiveEntryNotFound - Returned when an archive ID has no database entry.
+	ErrArchiveEntryNotFound = errors.New("Archive entry not found by provided ID")
+)
+
+// ArchivedMessage is the database representation of a relayed message.
+// Archive IDs are zero-padded sequence numbers, so bolt's byte-ordered keys
+// iterate in posting order.
+type ArchivedMessage struct {
+	ID        string
+	MessageID string
+	Subject   string
+	From      string
+	Sender    string
+	Date      time.Time
+	Text      string
+	HTML      string
+}
+
+// archiveID formats an archive sequence number as an archive ID.
+func archiveID(seq uint64) string {
+	return fmt.Sprintf("%010d", seq)
+}
+
+// archiveMessageIDIndex is the index, in the indexes bucket, of archive IDs by
+// Message-Id.
+const archiveMessageIDIndex = "archive-message-ids"
+
+// ArchiveMessage stores a copy of a message in the archive bucket and returns
+// the stored entry, whose ID can be used to construct a permalink. A message
+// archived before under the same Message-Id, as when relaying it failed and
+// is tried again, replaces its earlier entry rather than adding another.
+func (db *ListlessDB) ArchiveMessage(em *Email) (*ArchivedMessage, error) {
+	entry := &ArchivedMessage{
+		MessageID: em.GetHeader("Message-Id"),
+		Subject:   em.Subject,
+		From:      em.From,
+		Sender:    em.Sender,
+		Date:      time.Now().UTC(),
+		Text:      string(em.Text),
+		HTML:      string(em.HTML),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		indexes := tx.Bucket([]byte(indexBucketName))
+		if indexes == nil {
+			return ErrIndexBucketNotFound
+		}
+		byMessageID, err := indexes.CreateBucketIfNotExists([]byte(archiveMessageIDIndex))
+		if err != nil {
+			return err
+		}
+		if entry.MessageID != "" {
+			if id := byMessageID.Get([]byte(entry.MessageID)); id != nil && archive.Get(id) != nil {
+				entry.ID = string(id)
+			}
+		}
+		if entry.ID == "" {
+			seq, err := archive.NextSequence()
+			if err != nil {
+				return err
+			}
+			entry.ID = archiveID(seq)
+		}
+		entryb, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err = archive.Put([]byte(entry.ID), entryb); err != nil {
+			return err
+		}
+		if entry.MessageID == "" {
+			return nil
+		}
+		return byMessageID.Put([]byte(entry.MessageID), []byte(entry.ID))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GetArchivedMessage fetches an archived message by ID.
+func (db *ListlessDB) GetArchivedMessage(id string) (*ArchivedMessage, error) {
+	entry := &ArchivedMessage{}
+	err := db.View(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		entryb := archive.Get([]byte(id))
+		if entryb == nil {
+			return ErrArchiveEntryNotFound
+		}
+		return json.Unmarshal(entryb, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// RecentArchivedMessages returns up to n of the most recently archived
+// messages, newest first.
+func (db *ListlessDB) RecentArchivedMessages(n int) ([]*ArchivedMessage, error) {
+	entries := make([]*ArchivedMessage, 0, n)
+	err := db.View(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		c := archive.Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < n; k, v = c.Prev() {
+			entry := &ArchivedMessage{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ArchiveBounds returns the number of archived messages, and the lowest and
+// highest sequence numbers in the archive (zero if the archive is empty).
+func (db *ListlessDB) ArchiveBounds() (count, low, high uint64, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		c := archive.Cursor()
+		first, _ := c.First()
+		if first == nil {
+			return nil
+		}
+		last, _ := c.Last()
+		var err error
+		if low, err = strconv.ParseUint(string(first), 10, 64); err != nil {
+			return err
+		}
+		if high, err = strconv.ParseUint(string(last), 10, 64); err != nil {
+			return err
+		}
+		return archive.ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		})
+	})
+	return count, low, high, err
+}
+
+// ArchivedMessagesBetween returns archived messages with sequence numbers in
+// the inclusive range low to high, oldest first.
+func (db *ListlessDB) ArchivedMessagesBetween(low, high uint64) ([]*ArchivedMessage, error) {
+	var entries []*ArchivedMessage
+	err := db.View(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		c := archive.Cursor()
+		highID := []byte(archiveID(high))
+		for k, v := c.Seek([]byte(archiveID(low))); k != nil && string(k) <= string(highID); k, v = c.Next() {
+			entry := &ArchivedMessage{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// PruneArchive deletes the oldest archived messages until none is older than
+// maxAge, there are at most maxMessages, and they take at most maxBytes
+// (measured as stored). Zero limits are ignored. Bolt reuses the freed pages
+// but doesn't shrink the file.
+func (db *ListlessDB) PruneArchive(maxAge time.Duration, maxMessages int, maxBytes int64) (removed int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		expired, err := expiredArchiveKeys(archive, maxAge, maxMessages, maxBytes)
+		if err != nil {
+			return err
+		}
+		// Deleting through a cursor skips keys, so delete afterwards.
+		for _, k := range expired {
+			entry := &ArchivedMessage{}
+			if err := json.Unmarshal(archive.Get(k), entry); err != nil {
+				return err
+			}
+			if err := unindexArchived(tx, entry); err != nil {
+				return err
+			}
+			if err := archive.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// unindexArchived removes an archive entry's Message-Id from the index, if it
+// still points at that entry.
+func unindexArchived(tx *bolt.Tx, entry *ArchivedMessage) error {
+	if entry.MessageID == "" {
+		return nil
+	}
+	indexes := tx.Bucket([]byte(indexBucketName))
+	if indexes == nil {
+		return ErrIndexBucketNotFound
+	}
+	byMessageID := indexes.Bucket([]byte(archiveMessageIDIndex))
+	if byMessageID == nil || string(byMessageID.Get([]byte(entry.MessageID))) != entry.ID {
+		return nil
+	}
+	return byMessageID.Delete([]byte(entry.MessageID))
+}
+
+// CountPrunable returns how many archived messages PruneArchive would delete
+// with the same limits.
+func (db *ListlessDB) CountPrunable(maxAge time.Duration, maxMessages int, maxBytes int64) (n int, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		expired, err := expiredArchiveKeys(archive, maxAge, maxMessages, maxBytes)
+		n = len(expired)
+		return err
+	})
+	return n, err
+}
+
+// expiredArchiveKeys returns the keys of the oldest archived messages that
+// are over the limits, as described for PruneArchive.
+func expiredArchiveKeys(archive *bolt.Bucket, maxAge time.Duration, maxMessages int, maxBytes int64) ([][]byte, error) {
+	var (
+		count   int
+		size    int64
+		expired [][]byte
+	)
+	archive.ForEach(func(k, v []byte) error {
+		count++
+		size += int64(len(v))
+		return nil
+	})
+	cutoff := time.Now().Add(-maxAge)
+	c := archive.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		over := (maxMessages > 0 && count > maxMessages) || (maxBytes > 0 && size > maxBytes)
+		if !over && maxAge > 0 {
+			entry := &ArchivedMessage{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return nil, err
+			}
+			over = entry.Date.Before(cutoff)
+		}
+		if !over {
+			break
+		}
+		count--
+		size -= int64(len(v))
+		expired = append(expired, append([]byte(nil), k...))
+	}
+	return expired, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Kinds of BounceEvent, and how much each adds to a member's bounce score.
+const (
+	BounceHard      = "hard"
+	BounceSoft      = "soft"
+	BounceComplaint = "complaint"
+)
+
+var bounceWeights = map[string]float64{
+	BounceHard:      1,
+	BounceSoft:      0.25,
+	BounceComplaint: 1,
+}
+
+// BounceEvent is a single delivery failure or complaint for a member.
+type BounceEvent struct {
+	Time   time.Time
+	Kind   string
+	Detail string
+}
+
+// BounceRecord is the bounce history of an address, and its score (the
+// weighted sum of its events).
+type BounceRecord struct {
+	Email  string
+	Score  float64
+	Events []BounceEvent
+}
+
+// RecordBounce adds an event to the bounce history of an address and returns
+// the updated record.
+func (db *ListlessDB) RecordBounce(email, kind, detail string) (*BounceRecord, error) {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil, ErrInvalidEmail
+	}
+	record := &BounceRecord{Email: email}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bounces := tx.Bucket([]byte(bounceBucketName))
+		if bounces == nil {
+			return ErrBounceBucketNotFound
+		}
+		if recordb := bounces.Get([]byte(email)); recordb != nil {
+			if err := json.Unmarshal(recordb, record); err != nil {
+				return err
+			}
+		}
+		record.Events = append(record.Events, BounceEvent{Time: time.Now().UTC(), Kind: kind, Detail: detail})
+		record.Score += bounceWeights[kind]
+		recordb, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := bounces.Put([]byte(email), recordb); err != nil {
+			return err
+		}
+		return logEvent(tx, EventBounce, email)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// GetBounces returns the bounce history of an address; addresses that never
+// bounced have an empty record.
+func (db *ListlessDB) GetBounces(email string) (*BounceRecord, error) {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil, ErrInvalidEmail
+	}
+	record := &BounceRecord{Email: email}
+	err := db.View(func(tx *bolt.Tx) error {
+		bounces := tx.Bucket([]byte(bounceBucketName))
+		if bounces == nil {
+			return ErrBounceBucketNotFound
+		}
+		if recordb := bounces.Get([]byte(email)); recordb != nil {
+			return json.Unmarshal(recordb, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ResetBounces clears the bounce history of an address.
+func (db *ListlessDB) ResetBounces(email string) error {
+	email = normaliseEmail(email)
+	if email == "" {
+		return ErrInvalidEmail
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bounces := tx.Bucket([]byte(bounceBucketName))
+		if bounces == nil {
+			return ErrBounceBucketNotFound
+		}
+		return bounces.Delete([]byte(email))
+	})
+}
+
+// ListBounces returns the bounce records of every address with a history.
+func (db *ListlessDB) ListBounces() ([]*BounceRecord, error) {
+	var records []*BounceRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		bounces := tx.Bucket([]byte(bounceBucketName))
+		if bounces == nil {
+			return ErrBounceBucketNotFound
+		}
+		return bounces.ForEach(func(k, v []byte) error {
+			record := new(BounceRecord)
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Kinds of DBChange.
+const (
+	ChangeMemberAdded   = "member.added"
+	ChangeMemberUpdated = "member.updated"
+	ChangeMemberRemoved = "member.removed"
+	ChangeKVStored      = "kv.stored"
+	ChangeKVDeleted     = "kv.deleted"
+)
+
+// DBChange describes a change to a member or a key/value store entry, for
+// keeping other systems in step (see ChangeScript and ChangeWebhooks). Member
+// is the record as stored, and is nil for removals. Store, Key and Value are
+// set for key/value changes.
+type DBChange struct {
+	Time   time.Time
+	Kind   string
+	Email  string      `json:",omitempty"`
+	Member *MemberMeta `json:",omitempty"`
+	Store  string      `json:",omitempty"`
+	Key    string      `json:",omitempty"`
+	Value  string      `json:",omitempty"`
+}
+
+// changed reports a change made in tx once tx has committed, if anything is
+// listening. Erasures aren't reported, as passing on the address would undo
+// them, nor are migrations.
+func (db *ListlessDB) changed(tx *bolt.Tx, change DBChange) {
+	if db.onChange == nil {
+		return
+	}
+	change.Time = time.Now().UTC()
+	tx.OnCommit(func() { db.onChange(change) })
+}
+
+// kvChanged reports a change to a key/value store, if it is one of the
+// ChangeKVStores. Other stores, such as counters updated on every post, would
+// only make noise.
+func (db *ListlessDB) kvChanged(tx *bolt.Tx, kind, store, key, value string) {
+	if !db.changeKVStores[store] {
+		return
+	}
+	db.changed(tx, DBChange{Kind: kind, Store: store, Key: key, Value: value})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// dedupeKey folds an address to what it likely delivers to: the "+tag" is
+// dropped from the local part and, for Gmail, so are dots.
+func dedupeKey(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	local, domain := addr[:at], addr[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		local = strings.Replace(local, ".", "", -1)
+	}
+	return local + "@" + domain
+}
+
+// byJoindate sorts member addresses by when they joined, then by address.
+type byJoindate struct {
+	addrs   []string
+	members map[string]*MemberMeta
+}
+
+func (b byJoindate) Len() int      { return len(b.addrs) }
+func (b byJoindate) Swap(i, j int) { b.addrs[i], b.addrs[j] = b.addrs[j], b.addrs[i] }
+func (b byJoindate) Less(i, j int) bool {
+	a, c := b.members[b.addrs[i]], b.members[b.addrs[j]]
+	if !a.Joindate.Equal(c.Joindate) {
+		return a.Joindate.Before(c.Joindate)
+	}
+	return b.addrs[i] < b.addrs[j]
+}
+
+// duplicateGroups returns the sets of member addresses that fold to the same
+// dedupeKey, in order of key. Each set begins with its earliest joiner, the
+// suggested primary.
+func duplicateGroups(members map[string]*MemberMeta) [][]string {
+	byKey := make(map[string][]string)
+	for addr := range members {
+		key := dedupeKey(addr)
+		byKey[key] = append(byKey[key], addr)
+	}
+	var keys []string
+	for key, addrs := range byKey {
+		if len(addrs) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var groups [][]string
+	for _, key := range keys {
+		sort.Sort(byJoindate{addrs: byKey[key], members: members})
+		groups = append(groups, byKey[key])
+	}
+	return groups
+}
+
+// mergeMemberMeta folds duplicate records into primary: the earliest Joindate
+// is kept, and the union of roles, except that readonly is only kept if every
+// record had it. Empty fields of primary, custom ones included, are filled
+// from the others.
+func mergeMemberMeta(primary *MemberMeta, others []*MemberMeta) *MemberMeta {
+	merged := *primary
+	merged.Roles = append([]string(nil), primary.Roles...)
+	merged.Custom = nil
+	for name, value := range primary.Custom {
+		merged.SetField(name, value)
+	}
+	readOnly := primary.hasRole(RoleReadOnly)
+	for _, other := range others {
+		if other.Joindate.Before(merged.Joindate) {
+			merged.Joindate = other.Joindate
+		}
+		for _, role := range other.Roles {
+			if !merged.hasRole(role) {
+				merged.Roles = append(merged.Roles, role)
+			}
+		}
+		readOnly = readOnly && other.hasRole(RoleReadOnly)
+		merged.Departed = merged.Departed && other.Departed
+		merged.Suspended = merged.Suspended || other.Suspended
+		if merged.Name == "" {
+			merged.Name = other.Name
+		}
+		if merged.Language == "" {
+			merged.Language = other.Language
+		}
+		for name, value := range other.Custom {
+			if merged.GetField(name) == "" {
+				merged.SetField(name, value)
+			}
+		}
+	}
+	if !readOnly {
+		merged.RemoveRole(RoleReadOnly)
+	}
+	merged.syncFlags()
+	return &merged
+}
+
+// DuplicateMembers returns the sets of member addresses that probably belong
+// to one person (see dedupeKey), each beginning with its earliest joiner.
+func (db *ListlessDB) DuplicateMembers() ([][]string, error) {
+	members := make(map[string]*MemberMeta)
+	err := db.forEachSubscriber(func(email string, meta *MemberMeta) error {
+		members[email] = meta
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return duplicateGroups(members), nil
+}
+
+// MergeMembers folds the records of others into the member primary (see
+// mergeMemberMeta), adds their posting activity to primary's, and removes
+// them, keeping their addresses and aliases as aliases of primary.
+func (db *ListlessDB) MergeMembers(primary string, others []string) error {
+	primary = normaliseEmail(primary)
+	if primary == "" {
+		return ErrInvalidEmail
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		aliases := tx.Bucket([]byte(aliasBucketName))
+		if aliases == nil {
+			return ErrAliasBucketNotFound
+		}
+		activity := tx.Bucket([]byte(activityBucketName))
+		if activity == nil {
+			return ErrActivityBucketNotFound
+		}
+		get := func(addr string) (*MemberMeta, error) {
+			metab := members.Get([]byte(addr))
+			if metab == nil {
+				return nil, ErrMemberEntryNotFound
+			}
+			meta := new(MemberMeta)
+			return meta, json.Unmarshal(metab, meta)
+		}
+		primaryMeta, err := get(primary)
+		if err != nil {
+			return err
+		}
+		primaryActivity := &MemberActivity{Email: primary}
+		if activityb := activity.Get([]byte(primary)); activityb != nil {
+			if err = json.Unmarshal(activityb, primaryActivity); err != nil {
+				return err
+			}
+		}
+		var otherMetas []*MemberMeta
+		for _, other := range others {
+			other = normaliseEmail(other)
+			if other == "" || other == primary {
+				continue
+			}
+			meta, err := get(other)
+			if err != nil {
+				return err
+			}
+			otherMetas = append(otherMetas, meta)
+			if activityb := activity.Get([]byte(other)); activityb != nil {
+				otherActivity := new(MemberActivity)
+				if err = json.Unmarshal(activityb, otherActivity); err != nil {
+					return err
+				}
+				primaryActivity.Posts += otherActivity.Posts
+				if primaryActivity.FirstPost.IsZero() || otherActivity.FirstPost.Before(primaryActivity.FirstPost) {
+					primaryActivity.FirstPost = otherActivity.FirstPost
+				}
+				if otherActivity.LastPost.After(primaryActivity.LastPost) {
+					primaryActivity.LastPost = otherActivity.LastPost
+				}
+				if err = activity.Delete([]byte(other)); err != nil {
+					return err
+				}
+			}
+			// Bolt forbids changing a bucket while iterating it, so collect them first.
+			var moved []string
+			aliases.ForEach(func(k, v []byte) error {
+				if string(v) == other {
+					moved = append(moved, string(k))
+				}
+				return nil
+			})
+			for _, alias := range append(moved, other) {
+				if err = aliases.Put([]byte(alias), []byte(primary)); err != nil {
+					return err
+				}
+			}
+			if err = members.Delete([]byte(other)); err != nil {
+				return err
+			}
+			if err = indexMember(tx, other, nil); err != nil {
+				return err
+			}
+			db.changed(tx, DBChange{Kind: ChangeMemberRemoved, Email: other})
+		}
+		merged := mergeMemberMeta(primaryMeta, otherMetas)
+		metab, err := json.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		db.changed(tx, DBChange{Kind: ChangeMemberUpdated, Email: primary, Member: merged})
+		if err = members.Put([]byte(primary), metab); err != nil {
+			return err
+		}
+		if err = indexMember(tx, primary, merged); err != nil {
+			return err
+		}
+		db.rosterChanged(tx)
+		if primaryActivity.Posts == 0 {
+			return nil
+		}
+		activityb, err := json.Marshal(primaryActivity)
+		if err != nil {
+			return err
+		}
+		return activity.Put([]byte(primary), activityb)
+	})
+}
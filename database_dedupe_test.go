@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeKey(t *testing.T) {
+	assert.Equal(t, "bob@example.com", dedupeKey("Bob+lists@Example.com"))
+	assert.Equal(t, "b.o.b@example.com", dedupeKey("b.o.b@example.com"))
+	assert.Equal(t, "janedoe@gmail.com", dedupeKey("jane.doe+x@googlemail.com"))
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	early := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.AddDate(1, 0, 0)
+	members := map[string]*MemberMeta{
+		"bob@example.com":       {Joindate: late},
+		"bob+list@example.com":  {Joindate: early},
+		"alice@example.com":     {Joindate: early},
+		"jane.doe@gmail.com":    {Joindate: early},
+		"janedoe@gmail.com":     {Joindate: early},
+		"someone@elsewhere.org": {Joindate: late},
+	}
+	assert.Equal(t, [][]string{
+		{"bob+list@example.com", "bob@example.com"},
+		{"jane.doe@gmail.com", "janedoe@gmail.com"},
+	}, duplicateGroups(members))
+}
+
+func TestMergeMemberMeta(t *testing.T) {
+	early := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	primary := &MemberMeta{Joindate: early.AddDate(1, 0, 0), Roles: []string{RolePoster, RoleReadOnly}}
+	other := &MemberMeta{Joindate: early, Name: "Bob", Roles: []string{RoleModerator}}
+	merged := mergeMemberMeta(primary, []*MemberMeta{other})
+	assert.Equal(t, early, merged.Joindate)
+	assert.Equal(t, "Bob", merged.Name)
+	assert.Equal(t, []string{RolePoster, RoleModerator}, merged.Roles)
+	assert.True(t, merged.AllowedPost)
+	assert.True(t, merged.Moderator)
+	assert.Equal(t, []string{RolePoster, RoleReadOnly}, primary.Roles)
+}
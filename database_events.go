@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrEventBucketNotFound - Returned when a database lookup fails at the bucket level.
+var ErrEventBucketNotFound = errors.New("Event bucket not found")
+
+// Kinds of ListEvent.
+const (
+	EventPost     = "post"
+	EventWithheld = "withheld"
+	EventJoin     = "join"
+	EventLeave    = "leave"
+	EventBounce   = "bounce"
+	EventErased   = "erased"
+)
+
+// ListEvent is an entry in the list's event log, which traffic reports are
+// drawn from. Keys are zero-padded sequence numbers, like archive IDs, so
+// events iterate in the order they happened.
+type ListEvent struct {
+	Time  time.Time
+	Kind  string
+	Email string
+}
+
+// logEvent appends an event to the log within an existing transaction, so it
+// is recorded if and only if the change it describes is.
+func logEvent(tx *bolt.Tx, kind, email string) error {
+	events := tx.Bucket([]byte(eventBucketName))
+	if events == nil {
+		return ErrEventBucketNotFound
+	}
+	seq, err := events.NextSequence()
+	if err != nil {
+		return err
+	}
+	eventb, err := json.Marshal(ListEvent{Time: time.Now().UTC(), Kind: kind, Email: email})
+	if err != nil {
+		return err
+	}
+	return events.Put([]byte(archiveID(seq)), eventb)
+}
+
+// LogEvent appends an event to the log.
+func (db *ListlessDB) LogEvent(kind, email string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return logEvent(tx, kind, email)
+	})
+}
+
+// EventsBetween returns logged events from the period [from, to).
+func (db *ListlessDB) EventsBetween(from, to time.Time) ([]ListEvent, error) {
+	var found []ListEvent
+	err := db.View(func(tx *bolt.Tx) error {
+		events := tx.Bucket([]byte(eventBucketName))
+		if events == nil {
+			return ErrEventBucketNotFound
+		}
+		return events.ForEach(func(k, v []byte) error {
+			var event ListEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if !event.Time.Before(from) && event.Time.Before(to) {
+				found = append(found, event)
+			}
+			return nil
+		})
+	})
+	return found, err
+}
+
+// PruneEvents deletes logged events from before a time.
+func (db *ListlessDB) PruneEvents(before time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		events := tx.Bucket([]byte(eventBucketName))
+		if events == nil {
+			return ErrEventBucketNotFound
+		}
+		// Deleting through a cursor skips keys, so collect them first.
+		var expired [][]byte
+		c := events.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var event ListEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if !event.Time.Before(before) {
+				break
+			}
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := events.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
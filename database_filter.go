@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// MemberFilter selects members, e.g. for sub list. Its zero value selects
+// everyone; each field set narrows the selection further.
+type MemberFilter struct {
+	ModeratorsOnly bool
+	CanPost        bool
+	// Joined strictly after or before these, if not zero.
+	JoinedAfter, JoinedBefore time.Time
+	// Each tag is a role, a custom field name that must be set, or a
+	// name=value the field must equal. Members must have all of them.
+	Tags []string
+	// Matched without regard to case.
+	NameContains string
+}
+
+// Matches reports whether the filter selects a member.
+func (f *MemberFilter) Matches(meta *MemberMeta) bool {
+	if f.ModeratorsOnly && !meta.HasRole(RoleModerator) {
+		return false
+	}
+	if f.CanPost && !meta.AllowedPost {
+		return false
+	}
+	if !f.JoinedAfter.IsZero() && !meta.Joindate.After(f.JoinedAfter) {
+		return false
+	}
+	if !f.JoinedBefore.IsZero() && !meta.Joindate.Before(f.JoinedBefore) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !meta.hasTag(tag) {
+			return false
+		}
+	}
+	if f.NameContains != "" && !strings.Contains(strings.ToLower(meta.Name), strings.ToLower(f.NameContains)) {
+		return false
+	}
+	return true
+}
+
+// hasTag reports whether a member has a role or custom field, as described
+// for MemberFilter.Tags.
+func (m *MemberMeta) hasTag(tag string) bool {
+	if eq := strings.Index(tag, "="); eq > 0 {
+		return m.GetField(tag[:eq]) == tag[eq+1:]
+	}
+	return m.HasRole(tag) || m.GetField(tag) != ""
+}
+
+// forEachMatchingSubscriber is forEachSubscriber over the members a filter
+// selects. With ModeratorsOnly, only the records in the moderators index are
+// read.
+func (db *ListlessDB) forEachMatchingSubscriber(f *MemberFilter, viewer subscriberViewF) error {
+	if !f.ModeratorsOnly {
+		return db.forEachSubscriber(func(email string, meta *MemberMeta) error {
+			if !f.Matches(meta) {
+				return nil
+			}
+			return viewer(email, meta)
+		})
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		indexes := tx.Bucket([]byte(indexBucketName))
+		if indexes == nil {
+			return ErrIndexBucketNotFound
+		}
+		index := indexes.Bucket([]byte(IndexModerators))
+		if index == nil {
+			return nil
+		}
+		return index.ForEach(func(k, v []byte) error {
+			metab := members.Get(k)
+			if metab == nil {
+				return nil
+			}
+			meta := MemberMeta{}
+			if err := json.Unmarshal(metab, &meta); err != nil {
+				return err
+			}
+			if !f.Matches(&meta) {
+				return nil
+			}
+			return viewer(string(k), &meta)
+		})
+	})
+}
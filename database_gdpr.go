@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// KVEntry is a key/value store entry in a SubjectAccessExport.
+type KVEntry struct {
+	Store string
+	Key   string
+	Value string
+}
+
+// SubjectAccessExport is everything stored about an address, for answering
+// data-access requests.
+type SubjectAccessExport struct {
+	Email          string
+	Generated      time.Time
+	Member         *MemberMeta
+	Activity       *MemberActivity
+	Bounces        *BounceRecord
+	Pseudonym      string
+	Aliases        []string
+	KVEntries      []KVEntry
+	Transactions   []*MailTransaction
+	ArchivedPosts  []*ArchivedMessage
+	AnonymousPosts []*AnonymousPost
+	Events         []ListEvent
+}
+
+// mentionsEmail reports whether s contains a normalised address, ignoring
+// case. Only the whole address counts: not the end of a longer one, as in
+// jimbob@example.com for bob@example.com, nor the start of one with a longer
+// domain, as in bob@example.com.au.
+func mentionsEmail(s, email string) bool {
+	return len(addressIndexes(s, email)) > 0
+}
+
+// addressIndexes returns where email occurs whole in s, as mentionsEmail
+// matches it.
+func addressIndexes(s, email string) (found []int) {
+	n := len(email)
+	for i := 0; i+n <= len(s); i++ {
+		if !strings.EqualFold(s[i:i+n], email) {
+			continue
+		}
+		if i > 0 && isLocalPartByte(s[i-1]) {
+			continue
+		}
+		if j := i + n; j < len(s) {
+			// A full stop may end a sentence, but not lead to more domain.
+			next := s[j]
+			if next == '.' && j+1 < len(s) {
+				next = s[j+1]
+			}
+			if isDomainByte(next) {
+				continue
+			}
+		}
+		found = append(found, i)
+	}
+	return found
+}
+
+func isDomainByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func isLocalPartByte(c byte) bool {
+	return isDomainByte(c) || strings.IndexByte("!#$%&'*+/=?^_`{|}~.", c) >= 0
+}
+
+// SubjectAccessExport collects everything stored about an address: its
+// member, activity and bounce records, its aliases, key/value entries whose
+// keys contain it, transactions it may trigger, the archived and anonymised
+// posts it sent, and the event log entries naming it.
+func (db *ListlessDB) SubjectAccessExport(email string) (*SubjectAccessExport, error) {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil, ErrInvalidEmail
+	}
+	export := &SubjectAccessExport{Email: email, Generated: time.Now().UTC()}
+	member, err := db.GetSubscriber(email)
+	switch err {
+	case nil:
+		export.Member = member
+	case ErrMemberEntryNotFound:
+	default:
+		return nil, err
+	}
+	if export.Activity, err = db.MemberActivity(email); err != nil {
+		return nil, err
+	}
+	if export.Bounces, err = db.GetBounces(email); err != nil {
+		return nil, err
+	}
+	if export.Aliases, err = db.AliasesOf(email); err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		pseudonyms := tx.Bucket([]byte(pseudonymBucketName))
+		if pseudonyms == nil {
+			return ErrPseudonymBucketNotFound
+		}
+		export.Pseudonym = string(pseudonyms.Get([]byte(email)))
+		kvstores := tx.Bucket([]byte(kvBucketName))
+		if kvstores == nil {
+			return ErrKVBucketNotFound
+		}
+		err := kvstores.ForEach(func(name, v []byte) error {
+			store := kvstores.Bucket(name)
+			if v != nil || store == nil {
+				return nil
+			}
+			return store.ForEach(func(key, value []byte) error {
+				if mentionsEmail(string(key), email) {
+					export.KVEntries = append(export.KVEntries, KVEntry{Store: string(name), Key: string(key), Value: string(value)})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		transactions := tx.Bucket([]byte(transactionBucketName))
+		if transactions == nil {
+			return ErrTransactionBucketNotFound
+		}
+		err = transactions.ForEach(func(k, v []byte) error {
+			trans := new(MailTransaction)
+			if err := json.Unmarshal(v, trans); err != nil {
+				return err
+			}
+			for _, permitted := range trans.Permitted {
+				if permitted == email {
+					export.Transactions = append(export.Transactions, trans)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		archive := tx.Bucket([]byte(archiveBucketName))
+		if archive == nil {
+			return ErrArchiveBucketNotFound
+		}
+		err = archive.ForEach(func(k, v []byte) error {
+			entry := new(ArchivedMessage)
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			if entry.Sender == email || mentionsEmail(entry.From, email) {
+				export.ArchivedPosts = append(export.ArchivedPosts, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		anonymous := tx.Bucket([]byte(anonymousBucketName))
+		if anonymous == nil {
+			return ErrAnonymousBucketNotFound
+		}
+		err = anonymous.ForEach(func(k, v []byte) error {
+			post := new(AnonymousPost)
+			if err := json.Unmarshal(v, post); err != nil {
+				return err
+			}
+			if post.Sender == email {
+				export.AnonymousPosts = append(export.AnonymousPosts, post)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		events := tx.Bucket([]byte(eventBucketName))
+		if events == nil {
+			return ErrEventBucketNotFound
+		}
+		return events.ForEach(func(k, v []byte) error {
+			var event ListEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if event.Email == email {
+				export.Events = append(export.Events, event)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// redactAddress replaces each whole occurrence of email in s, as
+// mentionsEmail finds them, with token.
+func redactAddress(s, email, token string) string {
+	indexes := addressIndexes(s, email)
+	if len(indexes) == 0 {
+		return s
+	}
+	var b bytes.Buffer
+	last := 0
+	for _, i := range indexes {
+		b.WriteString(s[last:i])
+		b.WriteString(token)
+		last = i + len(email)
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// newErasureToken returns a random token to stand in for an erased address.
+// It is random rather than derived from the address, so it can't be reversed
+// by hashing guesses.
+func newErasureToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(b), nil
+}
+
+// EraseSubject removes an address from the database for right-to-be-forgotten
+// requests, returning the opaque token that replaces it. The member, alias,
+// activity and bounce records and pseudonym are deleted, as are key/value
+// entries whose keys contain the address, and messages they sent that are
+// held for moderation. In archived messages, anonymous post records, event
+// log entries, held messages' approvals and transaction permissions the
+// address is replaced with the token; archived posts they sent lose their
+// From name too.
+// An EventErased entry records the erasure under the token. Copies already sent out (mail,
+// feeds, NNTP, ActivityPub) can't be recalled.
+func (db *ListlessDB) EraseSubject(email string) (token string, err error) {
+	email = normaliseEmail(email)
+	if email == "" {
+		return "", ErrInvalidEmail
+	}
+	if token, err = newErasureToken(); err != nil {
+		return "", err
+	}
+	redact := func(s string) string {
+		return redactAddress(s, email, token)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		records := map[string]error{
+			memberBucketName:   ErrMemberBucketNotFound,
+			activityBucketName: ErrActivityBucketNotFound,
+			bounceBucketName:   ErrBounceBucketNotFound,
+			aliasBucketName:    ErrAliasBucketNotFound,
+		}
+		for bucketName, bucketErr := range records {
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket == nil {
+				return bucketErr
+			}
+			if err := bucket.Delete([]byte(email)); err != nil {
+				return err
+			}
+		}
+		if err := delAliasesOf(tx, email); err != nil {
+			return err
+		}
+		if err := indexMember(tx, email, nil); err != nil {
+			return err
+		}
+		db.rosterChanged(tx)
+		// The pseudonym stays reserved, so it isn't given to anyone else.
+		pseudonyms := tx.Bucket([]byte(pseudonymBucketName))
+		if pseudonyms == nil {
+			return ErrPseudonymBucketNotFound
+		}
+		if pseudonym := pseudonyms.Get([]byte(email)); pseudonym != nil {
+			if err := pseudonyms.Put([]byte(pseudonymReversePrefix+string(pseudonym)), []byte(token)); err != nil {
+				return err
+			}
+			if err := pseudonyms.Delete([]byte(email)); err != nil {
+				return err
+			}
+		}
+		kvstores := tx.Bucket([]byte(kvBucketName))
+		if kvstores == nil {
+			return ErrKVBucketNotFound
+		}
+		err := kvstores.ForEach(func(name, v []byte) error {
+			store := kvstores.Bucket(name)
+			if v != nil || store == nil {
+				return nil
+			}
+			// Deleting while iterating skips keys, so collect them first.
+			var keys []string
+			store.ForEach(func(k, v []byte) error {
+				if mentionsEmail(string(k), email) {
+					keys = append(keys, string(k))
+				}
+				return nil
+			})
+			for _, k := range keys {
+				if err := store.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		heldBucket := tx.Bucket([]byte(heldBucketName))
+		if heldBucket == nil {
+			return ErrHeldBucketNotFound
+		}
+		var sent []*HeldMessage
+		err = heldBucket.ForEach(func(k, v []byte) error {
+			held := new(HeldMessage)
+			if err := json.Unmarshal(v, held); err != nil {
+				return err
+			}
+			if held.Sender == email {
+				sent = append(sent, held)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, held := range sent {
+			if err := deleteHeld(tx, held); err != nil {
+				return err
+			}
+		}
+		// rewrite re-encodes every value in a bucket that mentions the address.
+		rewrite := func(bucketName string, bucketErr error, edit func(v []byte) (interface{}, error)) error {
+			bucket := tx.Bucket([]byte(bucketName))
+			if bucket == nil {
+				return bucketErr
+			}
+			updates := make(map[string][]byte)
+			err := bucket.ForEach(func(k, v []byte) error {
+				// Only a quick check: JSON may escape the characters around
+				// the address, so edit decides on the decoded fields.
+				if !bytes.Contains(bytes.ToLower(v), []byte(email)) {
+					return nil
+				}
+				edited, err := edit(v)
+				if err != nil {
+					return err
+				}
+				updated, err := json.Marshal(edited)
+				if err != nil {
+					return err
+				}
+				updates[string(k)] = updated
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range updates {
+				if err := bucket.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		err = rewrite(archiveBucketName, ErrArchiveBucketNotFound, func(v []byte) (interface{}, error) {
+			entry := new(ArchivedMessage)
+			if err := json.Unmarshal(v, entry); err != nil {
+				return nil, err
+			}
+			if mentionsEmail(entry.MessageID, email) {
+				if err := unindexArchived(tx, entry); err != nil {
+					return nil, err
+				}
+			}
+			if entry.Sender == email || mentionsEmail(entry.From, email) {
+				entry.From = token
+			}
+			entry.Sender = redact(entry.Sender)
+			entry.MessageID = redact(entry.MessageID)
+			entry.Subject = redact(entry.Subject)
+			entry.Text = redact(entry.Text)
+			entry.HTML = redact(entry.HTML)
+			return entry, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = rewrite(anonymousBucketName, ErrAnonymousBucketNotFound, func(v []byte) (interface{}, error) {
+			post := new(AnonymousPost)
+			if err := json.Unmarshal(v, post); err != nil {
+				return nil, err
+			}
+			post.From = redact(post.From)
+			post.Sender = redact(post.Sender)
+			return post, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = rewrite(eventBucketName, ErrEventBucketNotFound, func(v []byte) (interface{}, error) {
+			var event ListEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return nil, err
+			}
+			event.Email = redact(event.Email)
+			return event, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = rewrite(heldBucketName, ErrHeldBucketNotFound, func(v []byte) (interface{}, error) {
+			held := new(HeldMessage)
+			if err := json.Unmarshal(v, held); err != nil {
+				return nil, err
+			}
+			for i, approver := range held.Approvals {
+				held.Approvals[i] = redact(approver)
+			}
+			transactions := make(map[string]string, len(held.Transactions))
+			for moderator, hash := range held.Transactions {
+				transactions[redact(moderator)] = hash
+			}
+			held.Transactions = transactions
+			return held, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = rewrite(transactionBucketName, ErrTransactionBucketNotFound, func(v []byte) (interface{}, error) {
+			trans := new(MailTransaction)
+			if err := json.Unmarshal(v, trans); err != nil {
+				return nil, err
+			}
+			// Replaced rather than removed: an empty list would let anyone
+			// trigger the transaction.
+			for i, permitted := range trans.Permitted {
+				trans.Permitted[i] = redact(permitted)
+			}
+			return trans, nil
+		})
+		if err != nil {
+			return err
+		}
+		return logEvent(tx, EventErased, token)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMentionsEmail(t *testing.T) {
+	const bob = "bob@example.com"
+	for s, mentions := range map[string]bool{
+		"bob@example.com":                  true,
+		"Bob <BOB@Example.com>":            true,
+		"pending:bob@example.com":          true,
+		"Write to bob@example.com.":        true,
+		"bob@example.com, amy@example.com": true,
+		"jimbob@example.com":               false,
+		"jim.bob@example.com":              false,
+		"Jim <jimbob@example.com>":         false,
+		"bob@example.com.au":               false,
+		"bob@example.community":            false,
+		"bob@example.com-mail.net":         false,
+	} {
+		assert.Equal(t, mentions, mentionsEmail(s, bob), s)
+	}
+}
+
+func TestRedactAddress(t *testing.T) {
+	const bob, token = "bob@example.com", "erased-0123456789abcdef"
+	assert.Equal(t, "From erased-0123456789abcdef, cc jimbob@example.com and bob@example.com.au.",
+		redactAddress("From Bob@Example.com, cc jimbob@example.com and bob@example.com.au.", bob, token))
+	assert.Equal(t, "<erased-0123456789abcdef> wrote to <erased-0123456789abcdef>.",
+		redactAddress("<bob@example.com> wrote to <bob@example.com>.", bob, token))
+	assert.Equal(t, "jimbob@example.com", redactAddress("jimbob@example.com", bob, token))
+}
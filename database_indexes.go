@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/boltdb/bolt"
+	"github.com/layeh/gopher-luar"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrIndexBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrIndexBucketNotFound = errors.New("Index bucket not found")
+
+	// ErrUnknownIndex - Returned when asked for an index that isn't kept.
+	ErrUnknownIndex = errors.New("Unknown index; use moderators, readonly or digest")
+)
+
+// Member indexes, kept up to date on every write so these members can be
+// found without reading every record.
+const (
+	// IndexModerators holds moderators and owners.
+	IndexModerators = "moderators"
+	// IndexReadOnly holds members with the readonly role.
+	IndexReadOnly = "readonly"
+	// IndexDigest holds members who want digests, by role or Delivery.
+	IndexDigest = "digest"
+)
+
+// memberIndexes maps each index to whether a member belongs in it.
+var memberIndexes = map[string]func(*MemberMeta) bool{
+	IndexModerators: func(m *MemberMeta) bool { return m.HasRole(RoleModerator) },
+	IndexReadOnly:   func(m *MemberMeta) bool { return m.hasRole(RoleReadOnly) },
+	IndexDigest:     func(m *MemberMeta) bool { return m.hasRole(RoleDigestOnly) || m.Delivery == DeliveryDigest },
+}
+
+// indexMember files a member's address in the indexes it belongs in, and
+// takes it out of the rest. A nil meta takes it out of all of them, for
+// members being removed. Call it wherever member records are written.
+func indexMember(tx *bolt.Tx, email string, meta *MemberMeta) error {
+	indexes := tx.Bucket([]byte(indexBucketName))
+	if indexes == nil {
+		return ErrIndexBucketNotFound
+	}
+	for name, belongs := range memberIndexes {
+		index, err := indexes.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		if meta != nil && belongs(meta) {
+			err = index.Put([]byte(email), []byte{})
+		} else {
+			err = index.Delete([]byte(email))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildMemberIndexes refiles every member, for databases from before the
+// indexes were kept.
+func rebuildMemberIndexes(tx *bolt.Tx) error {
+	members := tx.Bucket([]byte(memberBucketName))
+	if members == nil {
+		return ErrMemberBucketNotFound
+	}
+	metas := make(map[string]*MemberMeta)
+	err := members.ForEach(func(k, v []byte) error {
+		meta := new(MemberMeta)
+		if err := json.Unmarshal(v, meta); err != nil {
+			return err
+		}
+		metas[string(k)] = meta
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for email, meta := range metas {
+		if err = indexMember(tx, email, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goMembersIn returns the addresses in an index.
+func (db *ListlessDB) goMembersIn(name string) (found []string, err error) {
+	if _, ok := memberIndexes[name]; !ok {
+		return nil, ErrUnknownIndex
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		indexes := tx.Bucket([]byte(indexBucketName))
+		if indexes == nil {
+			return ErrIndexBucketNotFound
+		}
+		index := indexes.Bucket([]byte(name))
+		if index == nil {
+			return nil
+		}
+		return index.ForEach(func(k, v []byte) error {
+			found = append(found, string(k))
+			return nil
+		})
+	})
+	return found, err
+}
+
+// MembersIn - Return a list-like table of the addresses in an index:
+// "moderators", "readonly" or "digest".
+func (db *ListlessDB) MembersIn(L *luar.LState) int {
+	found, err := db.goMembersIn(L.CheckString(1))
+	if err != nil {
+		log15.Error("Error reading member index", log15.Ctx{"context": "db", "error": err})
+		L.RaiseError("MembersIn: %s", err.Error())
+		return 0
+	}
+	T := L.CreateTable(len(found), 0)
+	for _, email := range found {
+		// Need to explicitly pass lua.LState rather than luar.LState..
+		T.Append(luar.New(L.LState, email))
+	}
+	L.Push(T)
+	return 1
+}
+
+// InIndex reports whether an address is in an index, without reading its
+// member record. Unknown indexes and addresses give false.
+func (db *ListlessDB) InIndex(name, email string) bool {
+	if _, ok := memberIndexes[name]; !ok {
+		return false
+	}
+	email, err := parseExpressiveEmail(email)
+	if err != nil {
+		return false
+	}
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		indexes := tx.Bucket([]byte(indexBucketName))
+		if indexes == nil {
+			return ErrIndexBucketNotFound
+		}
+		if index := indexes.Bucket([]byte(name)); index != nil {
+			found = index.Get([]byte(email)) != nil
+		}
+		return nil
+	})
+	return found
+}
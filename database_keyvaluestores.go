@@ -42,6 +42,7 @@ func (kv *ListlessKVStore) Store(key, value string) {
 	err := kv.parentDB.Update(func(tx *bolt.Tx) error {
 		kvbucket := tx.Bucket([]byte(kvBucketName))
 		bucket := kvbucket.Bucket([]byte(kv.BucketName))
+		kv.parentDB.kvChanged(tx, ChangeKVStored, kv.BucketName, key, value)
 		return bucket.Put([]byte(key), []byte(value))
 	})
 	if err != nil {
@@ -80,6 +81,9 @@ func (kv *ListlessKVStore) Delete(key string) {
 	err := kv.parentDB.Update(func(tx *bolt.Tx) error {
 		kvbucket := tx.Bucket([]byte(kvBucketName))
 		bucket := kvbucket.Bucket([]byte(kv.BucketName))
+		if bucket.Get([]byte(key)) != nil {
+			kv.parentDB.kvChanged(tx, ChangeKVDeleted, kv.BucketName, key, "")
+		}
 		return bucket.Delete([]byte(key))
 	})
 	if err != nil {
@@ -3,12 +3,14 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"sort"
 	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
 	"github.com/boltdb/bolt"
 	"github.com/layeh/gopher-luar"
+	"github.com/yuin/gopher-lua"
 )
 
 var (
@@ -20,15 +22,75 @@ var (
 	ErrMemberEntryNotFound = errors.New("Member entry not found by provided email")
 )
 
+// Delivery preferences for MemberMeta.Delivery. Digests aren't sent yet, so
+// digest members currently receive mail as normal; the preference is kept so
+// that imported lists don't lose it.
+const (
+	DeliveryNormal = ""
+	DeliveryDigest = "digest"
+	DeliveryNoMail = "nomail"
+)
+
 // MemberMeta is the database representation of a subscriber.
 // This is all pretty pedestrian but note that "Joindate" is a Go time object,
 // so consult the documentation for how to extract data using time methods.
+// Delivery is one of "", "digest" or "nomail"; "nomail" members are left out
+// of GetAllSubscribers, so may post (if permitted) without receiving mail.
+// Source records what manages the entry ("" for manual, or e.g. "ldap" for a
+// directory sync) and SourceID the entry's identifier there, so that address
+// changes can be followed. Departed is set by a sync when the member is no
+// longer found in the directory, for an administrator to review.
+// Suspended is set by "listless sub suspend": suspended members are left out
+// of GetAllSubscribers and may not post, but keep their record and Joindate
+// until resumed.
+// Roles is the member's role set (see RoleOwner etc.); Moderator and
+// AllowedPost are derived from it, and kept so older scripts still work:
+// changing either flag before UpdateSubscriber changes the roles to match.
+// Custom holds fields the list defines for itself, e.g. "chapter"; from Lua,
+// use GetField and SetField.
 type MemberMeta struct {
 	Joindate    time.Time
+	Roles       []string
 	Moderator   bool
 	AllowedPost bool
 	Name        string
 	Email       string
+	Delivery    string
+	Source      string
+	SourceID    string
+	Departed    bool
+	Suspended   bool
+	// Preferred language for the list's notices, e.g. "fr".
+	Language string
+	// The list's own data about the member, such as a membership number.
+	Custom map[string]string `json:",omitempty"`
+}
+
+// GetField returns a custom field, or "" if unset.
+func (m *MemberMeta) GetField(name string) string {
+	return m.Custom[name]
+}
+
+// fieldList returns the custom fields as "name=value", in order of name.
+func (m *MemberMeta) fieldList() []string {
+	var fields []string
+	for name, value := range m.Custom {
+		fields = append(fields, name+"="+value)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// SetField sets a custom field; setting it to "" removes it.
+func (m *MemberMeta) SetField(name, value string) {
+	if value == "" {
+		delete(m.Custom, name)
+		return
+	}
+	if m.Custom == nil {
+		m.Custom = make(map[string]string)
+	}
+	m.Custom[name] = value
 }
 
 // CreateSubscriber - Create a new Subscriber. It is not added to the database.
@@ -42,6 +104,7 @@ func (db *ListlessDB) CreateSubscriber(usremail, usrname string, allowedpost, mo
 		Name:        usrname,
 		Email:       normaliseEmail(usremail),
 	}
+	m.syncRoles(nil)
 	return &m
 }
 
@@ -54,10 +117,10 @@ func (m *MemberMeta) SetJoinDateUTC(year, month, day, hour int) {
 }
 
 // IsModerator - Fetch a subscriber and return whether the "Moderator" flag is true.
-// For unknown addresses the answer is always false.
+// Aliases count as their member. For unknown addresses the answer is always false.
 // On error, returns false.
 func (db *ListlessDB) IsModerator(email string) bool {
-	sub, err := db.GetSubscriber(email)
+	sub, err := db.memberFor(email)
 	if err != nil {
 		return false
 	}
@@ -65,15 +128,54 @@ func (db *ListlessDB) IsModerator(email string) bool {
 }
 
 // IsAllowedPost - Fetch a subscriber and return whether the "AllowedPost" flag is true.
-// For unknown addresses the answer is always false.
+// Aliases count as their member. For unknown addresses the answer is always false.
 // On error, returns false.
 func (db *ListlessDB) IsAllowedPost(email string) bool {
-	sub, err := db.GetSubscriber(email)
+	sub, err := db.memberFor(email)
 	if err != nil {
 		log15.Error("Error in IsAllowedPost getting subscriber", log15.Ctx{"context": "db", "email": email, "error": err})
 		return false
 	}
-	return sub.AllowedPost
+	return sub.mayPost()
+}
+
+// receivesMail reports whether the member is sent the list's mail.
+func (m *MemberMeta) receivesMail() bool {
+	return m.Delivery != DeliveryNoMail && !m.Suspended
+}
+
+// mayPost reports whether the member may post, which suspended members may
+// not whatever their roles.
+func (m *MemberMeta) mayPost() bool {
+	return m.AllowedPost && !m.Suspended
+}
+
+// SetSuspended - Suspend or resume a member. Returns ErrMemberEntryNotFound
+// for addresses that aren't members.
+func (db *ListlessDB) SetSuspended(email string, suspended bool) error {
+	email = normaliseEmail(email)
+	if email == "" {
+		return ErrInvalidEmail
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		mementry := members.Get([]byte(email))
+		if mementry == nil {
+			return ErrMemberEntryNotFound
+		}
+		meta := new(MemberMeta)
+		if err := json.Unmarshal(mementry, meta); err != nil {
+			return err
+		}
+		if meta.Suspended == suspended {
+			return nil
+		}
+		meta.Suspended = suspended
+		return db.putSubscriber(tx, email, meta)
+	})
 }
 
 // GetSubscriber - Normalise email and fetch subscriber meta, if any.
@@ -112,16 +214,42 @@ func (db *ListlessDB) UpdateSubscriber(usremail string, meta *MemberMeta) error
 		return ErrInvalidEmail
 	}
 	return db.Update(func(tx *bolt.Tx) error {
-		members := tx.Bucket([]byte(memberBucketName))
-		if members == nil {
-			return ErrMemberBucketNotFound
-		}
-		mementry, err := json.Marshal(meta)
-		if err != nil {
+		return db.putSubscriber(tx, usremail, meta)
+	})
+}
+
+// putSubscriber stores a member record under a normalised address, logging a
+// join if it is new.
+func (db *ListlessDB) putSubscriber(tx *bolt.Tx, email string, meta *MemberMeta) error {
+	members := tx.Bucket([]byte(memberBucketName))
+	if members == nil {
+		return ErrMemberBucketNotFound
+	}
+	var stored *MemberMeta
+	if storedb := members.Get([]byte(email)); storedb != nil {
+		stored = new(MemberMeta)
+		if err := json.Unmarshal(storedb, stored); err != nil {
 			return err
 		}
-		return members.Put([]byte(usremail), mementry)
-	})
+	} else if err := logEvent(tx, EventJoin, email); err != nil {
+		return err
+	}
+	meta.syncRoles(stored)
+	mementry, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	change := DBChange{Kind: ChangeMemberUpdated, Email: email, Member: new(MemberMeta)}
+	if stored == nil {
+		change.Kind = ChangeMemberAdded
+	}
+	*change.Member = *meta
+	db.changed(tx, change)
+	if err = indexMember(tx, email, meta); err != nil {
+		return err
+	}
+	db.rosterChanged(tx)
+	return members.Put([]byte(email), mementry)
 }
 
 // DelSubscriber - Delete a subscriber. Returns no error if subscriber didn't exist.
@@ -131,12 +259,53 @@ func (db *ListlessDB) DelSubscriber(email string) error {
 		return ErrInvalidEmail
 	}
 	return db.Update(func(tx *bolt.Tx) error {
+		return db.delSubscriber(tx, email)
+	})
+}
+
+// DelSubscribers - Delete several subscribers, by normalised address, all at
+// once or not at all. Returns those that were members.
+func (db *ListlessDB) DelSubscribers(emails []string) (removed []string, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		removed = nil
 		members := tx.Bucket([]byte(memberBucketName))
 		if members == nil {
 			return ErrMemberBucketNotFound
 		}
-		return members.Delete([]byte(email))
+		for _, email := range emails {
+			if members.Get([]byte(email)) != nil {
+				removed = append(removed, email)
+			}
+			if err := db.delSubscriber(tx, email); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
+	return removed, err
+}
+
+// delSubscriber removes a member record and its aliases by normalised
+// address, logging a leave if it existed.
+func (db *ListlessDB) delSubscriber(tx *bolt.Tx, email string) error {
+	members := tx.Bucket([]byte(memberBucketName))
+	if members == nil {
+		return ErrMemberBucketNotFound
+	}
+	if members.Get([]byte(email)) != nil {
+		if err := logEvent(tx, EventLeave, email); err != nil {
+			return err
+		}
+		db.changed(tx, DBChange{Kind: ChangeMemberRemoved, Email: email})
+	}
+	if err := delAliasesOf(tx, email); err != nil {
+		return err
+	}
+	if err := indexMember(tx, email, nil); err != nil {
+		return err
+	}
+	db.rosterChanged(tx)
+	return members.Delete([]byte(email))
 }
 
 // TODO: Do away with this "true for moderators" crap and let people iterate in Lua
@@ -169,8 +338,19 @@ func (db *ListlessDB) GetAllSubscribers(L *luar.LState) int {
 // GetAllSubscribers - Return a slice of all member emails.
 // The variadic modsOnly argument is used in order to allow argumentless use
 // within Lua; all booleans after the first are ignored.
-func (db *ListlessDB) goGetAllSubscribers(modsOnly bool) (subscribers []string) {
+func (db *ListlessDB) goGetAllSubscribers(modsOnly bool) []string {
+	if db.roster != nil {
+		return db.roster.get(modsOnly, db.readSubscribers)
+	}
+	return db.readSubscribers(modsOnly)
+}
+
+// readSubscribers is goGetAllSubscribers without the roster cache.
+func (db *ListlessDB) readSubscribers(modsOnly bool) (subscribers []string) {
 	subscribers = make([]string, 0)
+	if modsOnly {
+		return db.goGetModerators()
+	}
 	err := db.View(func(tx *bolt.Tx) error {
 		members := tx.Bucket([]byte(memberBucketName))
 		return members.ForEach(func(email, metabytes []byte) error {
@@ -179,7 +359,7 @@ func (db *ListlessDB) goGetAllSubscribers(modsOnly bool) (subscribers []string)
 			if err != nil {
 				return err
 			}
-			if modsOnly && (!meta.Moderator) {
+			if !meta.receivesMail() {
 				return nil
 			}
 			subscribers = append(subscribers, meta.Email)
@@ -192,6 +372,45 @@ func (db *ListlessDB) goGetAllSubscribers(modsOnly bool) (subscribers []string)
 	return subscribers
 }
 
+// goGetModerators finds the receiving moderators through the moderators index,
+// so only their records are read.
+func (db *ListlessDB) goGetModerators() (moderators []string) {
+	moderators = make([]string, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		indexes := tx.Bucket([]byte(indexBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		if indexes == nil {
+			return ErrIndexBucketNotFound
+		}
+		index := indexes.Bucket([]byte(IndexModerators))
+		if index == nil {
+			return nil
+		}
+		return index.ForEach(func(email, _ []byte) error {
+			metabytes := members.Get(email)
+			if metabytes == nil {
+				return nil
+			}
+			meta := MemberMeta{}
+			if err := json.Unmarshal(metabytes, &meta); err != nil {
+				return err
+			}
+			if !meta.receivesMail() {
+				return nil
+			}
+			moderators = append(moderators, meta.Email)
+			return nil
+		})
+	})
+	if err != nil {
+		log15.Error("Error in goGetModerators", log15.Ctx{"context": "db", "error": err})
+	}
+	return moderators
+}
+
 // This is a function that can iterate over members to gather data.
 type subscriberViewF func(email string, meta *MemberMeta) error
 
@@ -215,55 +434,100 @@ func (db *ListlessDB) forEachSubscriber(viewer subscriberViewF) error {
 // changes to them.
 type subscriberUpdateF func(email string, meta *MemberMeta) (edit bool, newemail string, newmeta *MemberMeta, err error)
 
+// subscriberChange is a change to a member queued by forEachSubscriberRW.
+type subscriberChange struct {
+	email    string
+	newemail string
+	meta     *MemberMeta
+}
+
 // A RW iteration over subscribers. If the provided function returns edit=false, then
-// no changes are made (a read only operation). In this case, the iteration is
-// safe and the database will be guaranteed consistent, within Bolt's usual guarantees.
-// If, however, it provides edit=true, then the following rules apply:
+// no changes are made for that member. If it returns edit=true:
 // * If the returned MemberMeta is nil, then the original entry is deleted.
 // * If the returned MemberMeta is not nil, and the returned string is empty,
 //   then the data for the selected user is modified in-place in the database.
 // * If the returned MemberMeta is not nil, and the returned string is non-empty,
 //   then the original data is deleted and the new MemberMeta is entered under
 //   the new string key (expected to be an email address, as usual).
-// Please note: The above operations are queued during iteration but do not
-// take place until afterwards, as they must get a lock on the database. This
-// means that forEachSubscriber is not a safe operation if the database might
-// get interrupted; it is built for convenience, not safety!
-func (db *ListlessDB) forEachSubscriberRW(updater subscriberUpdateF) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		members := tx.Bucket([]byte(memberBucketName))
-		return members.ForEach(func(email_b, meta_b []byte) error {
-			oldemail := string(email_b)
-			meta := MemberMeta{}
-			err := json.Unmarshal(meta_b, &meta)
-			if err != nil {
-				return err
-			}
-			edit, newemail, newmeta, err := updater(oldemail, &meta)
-			if err != nil {
-				return err
+// The function sees the members as of one read transaction, and the changes
+// are queued and then made together in one update afterwards, so either all
+// are made or, on any error, none. The function may read the database, but
+// changes it makes itself may be overwritten by the queued ones.
+func (db *ListlessDB) forEachSubscriberRW(updater subscriberUpdateF) (changed int, err error) {
+	var changes []subscriberChange
+	err = db.forEachSubscriber(func(email string, meta *MemberMeta) error {
+		edit, newemail, newmeta, err := updater(email, meta)
+		if err != nil || !edit {
+			return err
+		}
+		change := subscriberChange{email: email, meta: newmeta}
+		if newemail != "" {
+			if change.newemail = normaliseEmail(newemail); change.newemail == "" {
+				return ErrInvalidEmail
 			}
-			if !edit {
-				return nil
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, change := range changes {
+			target := change.email
+			if change.newemail != "" {
+				target = change.newemail
 			}
-			if newmeta == nil {
-				// Delete original entry. This spins up a goroutine that will wait for an Update tx.
-				go db.DelSubscriber(oldemail)
-				return nil
-			} else {
-				// Edit original entry. This may involve scheduling a deletion.
-				if newemail != "" {
-					// spin up a delete for the old entry and an add for the new entry.
-					// Both will await their turn so the database could get screwed during
-					// these ops.
-					go db.DelSubscriber(oldemail)
-					go db.UpdateSubscriber(newemail, newmeta)
-					return nil
-				} else {
-					go db.UpdateSubscriber(oldemail, newmeta)
+			if change.meta == nil || target != change.email {
+				if err := db.delSubscriber(tx, change.email); err != nil {
+					return err
 				}
 			}
-			return nil
-		})
+			if change.meta == nil {
+				continue
+			}
+			if err := db.putSubscriber(tx, target, change.meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(changes), nil
+}
+
+// UpdateAll calls fn(email, member) for every member, from Lua. fn may change
+// the member and return true to save it, optionally with a new address as a
+// second value to move it to; return false to remove the member; or return
+// nil to leave it be. The changes are made together once fn has seen every
+// member, so if fn raises an error nothing is changed. Returns the number of
+// members changed.
+func (db *ListlessDB) UpdateAll(L *luar.LState) int {
+	fn := L.CheckFunction(1)
+	changed, err := db.forEachSubscriberRW(func(email string, meta *MemberMeta) (bool, string, *MemberMeta, error) {
+		err := L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, lua.LString(email), luar.New(L.LState, meta))
+		if err != nil {
+			return false, "", nil, err
+		}
+		ret, newemail := L.Get(-2), L.Get(-1)
+		L.Pop(2)
+		switch ret {
+		case lua.LTrue:
+			if newemail.Type() == lua.LTString {
+				return true, newemail.String(), meta, nil
+			}
+			return true, "", meta, nil
+		case lua.LFalse:
+			return true, "", nil, nil
+		}
+		return false, "", nil, nil
 	})
+	if err != nil {
+		L.RaiseError("UpdateAll made no changes: %s", err.Error())
+		return 0
+	}
+	L.Push(lua.LNumber(changed))
+	return 1
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrMetaBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrMetaBucketNotFound = errors.New("Meta bucket not found")
+
+	// ErrSchemaTooNew - Returned when opening a database migrated by a newer
+	// listless, which this one may not understand.
+	ErrSchemaTooNew = errors.New("Database was upgraded by a newer listless; upgrade listless to open it")
+)
+
+// The meta bucket key holding the schema version, a decimal number.
+const schemaVersionKey = "schema-version"
+
+// A migration upgrades a database from one schema version to the next, within
+// the transaction that opens it.
+type migration struct {
+	name  string
+	apply func(tx *bolt.Tx) error
+}
+
+// migrations[i] upgrades the schema from version i to i+1, so the current
+// version is len(migrations). Add new migrations to the end; never reorder
+// or remove them. New buckets need no migration, as they are created when the
+// database is opened.
+var migrations = []migration{
+	{"Give members roles matching their flags", migrateMemberRoles},
+	{"Index moderators, readonly and digest members", rebuildMemberIndexes},
+}
+
+// schemaVersion reads the schema version, which is 0 for databases from
+// before versioning.
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return 0, nil
+	}
+	versionb := meta.Get([]byte(schemaVersionKey))
+	if versionb == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(versionb))
+}
+
+// migrate brings the database up to the current schema version.
+func migrate(tx *bolt.Tx) error {
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return ErrSchemaTooNew
+	}
+	if version == len(migrations) {
+		return nil
+	}
+	for i := version; i < len(migrations); i++ {
+		log15.Info("Migrating database", log15.Ctx{"context": "db", "version": i + 1, "migration": migrations[i].name})
+		if err = migrations[i].apply(tx); err != nil {
+			return err
+		}
+	}
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta == nil {
+		return ErrMetaBucketNotFound
+	}
+	return meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(len(migrations))))
+}
+
+// checkSchema is for databases opened read-only, which can't be migrated. A
+// newer schema is refused; an older one is allowed, with a warning.
+func checkSchema(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > len(migrations) {
+			return ErrSchemaTooNew
+		}
+		if version < len(migrations) {
+			log15.Warn("Database needs migrating; until listless opens it for writing, some records may read oddly", log15.Ctx{"context": "db", "version": version, "current": len(migrations)})
+		}
+		return nil
+	})
+}
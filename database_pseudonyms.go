@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrPseudonymBucketNotFound - Returned when a database lookup fails at the bucket level.
+var ErrPseudonymBucketNotFound = errors.New("Pseudonym bucket not found")
+
+// The pseudonym bucket maps addresses to pseudonyms and back; reverse entries
+// and the secret are prefixed so they can't collide with addresses.
+const (
+	pseudonymReversePrefix = "name:"
+	pseudonymSecretKey     = "\x00secret"
+)
+
+var pseudonymAdjectives = []string{
+	"Amber", "Bold", "Brave", "Bright", "Calm", "Clever", "Copper", "Crimson",
+	"Curious", "Dapper", "Eager", "Gentle", "Golden", "Hazel", "Honest", "Jolly",
+	"Keen", "Lively", "Lucky", "Merry", "Misty", "Nimble", "Patient", "Quiet",
+	"Rapid", "Rosy", "Silver", "Steady", "Sunny", "Swift", "Tidy", "Witty",
+}
+
+var pseudonymAnimals = []string{
+	"Badger", "Beaver", "Bittern", "Curlew", "Dormouse", "Dunnock", "Ferret", "Finch",
+	"Fox", "Gannet", "Hare", "Hedgehog", "Heron", "Kestrel", "Lapwing", "Marten",
+	"Mole", "Newt", "Otter", "Owl", "Plover", "Puffin", "Raven", "Robin",
+	"Salmon", "Seal", "Stoat", "Swift", "Toad", "Vole", "Wren", "Yellowhammer",
+}
+
+// pseudonymSecret returns the database's pseudonym key, creating it if needed.
+// Pseudonyms are derived from addresses with this key so that they can't be
+// reversed by trying known addresses.
+func pseudonymSecret(bucket *bolt.Bucket) ([]byte, error) {
+	if secret := bucket.Get([]byte(pseudonymSecretKey)); secret != nil {
+		return secret, nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, bucket.Put([]byte(pseudonymSecretKey), secret)
+}
+
+// PseudonymFor returns a member's persistent pseudonym, such as "Swift Otter",
+// creating one if they have none. The choice is derived from the address, and
+// a number is appended if another address already has it.
+func (db *ListlessDB) PseudonymFor(email string) (pseudonym string, err error) {
+	email = normaliseEmail(email)
+	if email == "" {
+		return "", ErrInvalidEmail
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pseudonymBucketName))
+		if bucket == nil {
+			return ErrPseudonymBucketNotFound
+		}
+		if existing := bucket.Get([]byte(email)); existing != nil {
+			pseudonym = string(existing)
+			return nil
+		}
+		secret, err := pseudonymSecret(bucket)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(email))
+		sum := binary.BigEndian.Uint64(mac.Sum(nil))
+		base := pseudonymAdjectives[sum%uint64(len(pseudonymAdjectives))] + " " +
+			pseudonymAnimals[(sum>>32)%uint64(len(pseudonymAnimals))]
+		pseudonym = base
+		for n := 2; bucket.Get([]byte(pseudonymReversePrefix+pseudonym)) != nil; n++ {
+			pseudonym = base + " " + strconv.Itoa(n)
+		}
+		if err := bucket.Put([]byte(email), []byte(pseudonym)); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(pseudonymReversePrefix+pseudonym), []byte(email))
+	})
+	if err != nil {
+		return "", err
+	}
+	return pseudonym, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrUnknownRole - Returned when a role name isn't one of the known roles.
+var ErrUnknownRole = errors.New("Unknown role; use owner, moderator, poster, digest-only or readonly")
+
+// Member roles. Owners count as moderators. Posters may post unless they are
+// also readonly, which overrides it. digest-only marks members who should
+// only receive digests; like DeliveryDigest, it is recorded for when digests
+// are sent.
+const (
+	RoleOwner      = "owner"
+	RoleModerator  = "moderator"
+	RolePoster     = "poster"
+	RoleDigestOnly = "digest-only"
+	RoleReadOnly   = "readonly"
+)
+
+var knownRoles = map[string]bool{
+	RoleOwner: true, RoleModerator: true, RolePoster: true, RoleDigestOnly: true, RoleReadOnly: true,
+}
+
+// hasRole reports whether the role is in the member's role set, without
+// implied roles.
+func (m *MemberMeta) hasRole(role string) bool {
+	for _, r := range m.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the member has a role, counting owners as
+// moderators.
+func (m *MemberMeta) HasRole(role string) bool {
+	if role == RoleModerator && m.hasRole(RoleOwner) {
+		return true
+	}
+	return m.hasRole(role)
+}
+
+// AddRole adds a role to the member, if it is a known role.
+func (m *MemberMeta) AddRole(role string) error {
+	if !knownRoles[role] {
+		return ErrUnknownRole
+	}
+	if !m.hasRole(role) {
+		m.Roles = append(m.Roles, role)
+	}
+	m.syncFlags()
+	return nil
+}
+
+// RemoveRole removes a role from the member.
+func (m *MemberMeta) RemoveRole(role string) {
+	roles := m.Roles[:0]
+	for _, r := range m.Roles {
+		if r != role {
+			roles = append(roles, r)
+		}
+	}
+	m.Roles = roles
+	m.syncFlags()
+}
+
+// syncFlags sets the Moderator and AllowedPost flags from the role set. The
+// flags are kept for scripts written before roles existed.
+func (m *MemberMeta) syncFlags() {
+	m.Moderator = m.HasRole(RoleModerator)
+	m.AllowedPost = m.hasRole(RolePoster) && !m.hasRole(RoleReadOnly)
+}
+
+// setFlagRole adds or removes a role to match a flag.
+func (m *MemberMeta) setFlagRole(role string, set bool) {
+	if set {
+		m.AddRole(role)
+	} else {
+		m.RemoveRole(role)
+	}
+}
+
+// syncRoles reconciles the role set with the Moderator and AllowedPost flags
+// before storing a record. Flags changed since the stored record (nil for a
+// new member) were set by an older script, so are applied to the roles;
+// otherwise the roles win. Records from before roles existed get roles from
+// their flags.
+func (m *MemberMeta) syncRoles(stored *MemberMeta) {
+	if m.Roles == nil {
+		moderator, allowedPost := m.Moderator, m.AllowedPost
+		m.Roles = []string{}
+		m.setFlagRole(RoleModerator, moderator)
+		m.setFlagRole(RolePoster, allowedPost)
+		return
+	}
+	if stored == nil {
+		// A new member: compare the flags with those its roles imply.
+		implied := *m
+		implied.syncFlags()
+		stored = &implied
+	}
+	moderator, allowedPost := m.Moderator, m.AllowedPost
+	if moderator != stored.Moderator {
+		if moderator {
+			m.AddRole(RoleModerator)
+		} else {
+			m.RemoveRole(RoleOwner)
+			m.RemoveRole(RoleModerator)
+		}
+	}
+	if allowedPost != stored.AllowedPost {
+		m.setFlagRole(RolePoster, allowedPost)
+		if allowedPost {
+			m.RemoveRole(RoleReadOnly)
+		}
+	}
+	m.syncFlags()
+}
+
+// HasRole fetches a subscriber, or the member an alias belongs to, and reports
+// whether they have a role. For unknown addresses, or on error, the answer is
+// false.
+func (db *ListlessDB) HasRole(email, role string) bool {
+	sub, err := db.memberFor(email)
+	if err != nil {
+		return false
+	}
+	return sub.HasRole(role)
+}
+
+// migrateMemberRoles gives records stored before roles existed a role set
+// matching their flags.
+func migrateMemberRoles(tx *bolt.Tx) error {
+	members := tx.Bucket([]byte(memberBucketName))
+	if members == nil {
+		return ErrMemberBucketNotFound
+	}
+	updates := make(map[string][]byte)
+	err := members.ForEach(func(k, v []byte) error {
+		var meta MemberMeta
+		if err := json.Unmarshal(v, &meta); err != nil {
+			return err
+		}
+		if meta.Roles != nil {
+			return nil
+		}
+		meta.syncRoles(nil)
+		metab, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		updates[string(k)] = metab
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		if err := members.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
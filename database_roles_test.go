@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberRoles(t *testing.T) {
+	// Records from before roles existed take roles from their flags.
+	old := &MemberMeta{Moderator: true, AllowedPost: true}
+	old.syncRoles(nil)
+	assert.Equal(t, []string{RoleModerator, RolePoster}, old.Roles)
+
+	m := &MemberMeta{Roles: []string{}}
+	assert.Nil(t, m.AddRole(RoleOwner))
+	assert.True(t, m.HasRole(RoleModerator))
+	assert.True(t, m.Moderator)
+	assert.Equal(t, ErrUnknownRole, m.AddRole("admin"))
+
+	m.AddRole(RolePoster)
+	assert.True(t, m.AllowedPost)
+	m.AddRole(RoleReadOnly)
+	assert.False(t, m.AllowedPost)
+
+	// Flags changed by older scripts are applied to the roles.
+	stored := *m
+	stored.Roles = append([]string(nil), m.Roles...)
+	m.Moderator = false
+	m.AllowedPost = true
+	m.syncRoles(&stored)
+	assert.False(t, m.HasRole(RoleModerator))
+	assert.False(t, m.HasRole(RoleReadOnly))
+	assert.True(t, m.AllowedPost)
+
+	// ...including on new members, whose flags were set after CreateSubscriber.
+	created := &MemberMeta{Roles: []string{RolePoster}, AllowedPost: true}
+	created.Moderator = true
+	created.syncRoles(nil)
+	assert.True(t, created.HasRole(RoleModerator))
+}
+
+func TestMemberFields(t *testing.T) {
+	m := &MemberMeta{}
+	assert.Equal(t, "", m.GetField("chapter"))
+	m.SetField("chapter", "Cork")
+	m.SetField("number", "1041")
+	assert.Equal(t, "Cork", m.GetField("chapter"))
+	assert.Equal(t, []string{"chapter=Cork", "number=1041"}, m.fieldList())
+	m.SetField("chapter", "")
+	assert.Equal(t, map[string]string{"number": "1041"}, m.Custom)
+}
+
+func TestMemberIndexes(t *testing.T) {
+	owner := &MemberMeta{Roles: []string{RoleOwner}}
+	assert.True(t, memberIndexes[IndexModerators](owner))
+	assert.False(t, memberIndexes[IndexReadOnly](owner))
+	reader := &MemberMeta{Roles: []string{RoleReadOnly}, Delivery: DeliveryDigest}
+	assert.False(t, memberIndexes[IndexModerators](reader))
+	assert.True(t, memberIndexes[IndexReadOnly](reader))
+	assert.True(t, memberIndexes[IndexDigest](reader))
+}
+
+func TestMemberFilter(t *testing.T) {
+	m := &MemberMeta{
+		Name:        "Alice Smith",
+		Roles:       []string{RoleOwner, RolePoster},
+		AllowedPost: true,
+		Joindate:    time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+		Custom:      map[string]string{"branch": "north"},
+	}
+	assert.True(t, (&MemberFilter{}).Matches(m))
+	assert.True(t, (&MemberFilter{ModeratorsOnly: true, CanPost: true, NameContains: "smith"}).Matches(m))
+	assert.True(t, (&MemberFilter{JoinedAfter: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}).Matches(m))
+	assert.False(t, (&MemberFilter{JoinedBefore: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}).Matches(m))
+	assert.True(t, (&MemberFilter{Tags: []string{RoleModerator, "branch", "branch=north"}}).Matches(m))
+	assert.False(t, (&MemberFilter{Tags: []string{"branch=south"}}).Matches(m))
+	assert.False(t, (&MemberFilter{Tags: []string{RoleReadOnly}}).Matches(m))
+	assert.False(t, (&MemberFilter{NameContains: "jones"}).Matches(m))
+}
+
+func TestSuspendedMember(t *testing.T) {
+	m := &MemberMeta{Roles: []string{RolePoster}, AllowedPost: true}
+	assert.True(t, m.receivesMail())
+	assert.True(t, m.mayPost())
+	m.Suspended = true
+	assert.False(t, m.receivesMail())
+	assert.False(t, m.mayPost())
+	// Suspension leaves the roles to come back to.
+	assert.True(t, m.HasRole(RolePoster))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// rosterCache keeps the recipient lists from goGetAllSubscribers in memory,
+// so a busy list needn't read every member record for every message. It is
+// emptied whenever a write to the members commits (see rosterChanged).
+type rosterCache struct {
+	sync.Mutex
+	// Bumped on every invalidation, so a list read from before a write isn't
+	// stored after it.
+	generation uint64
+	all, mods  []string
+}
+
+// get returns the cached list, or loads and caches it.
+func (r *rosterCache) get(modsOnly bool, load func(bool) []string) []string {
+	r.Lock()
+	cached := r.all
+	if modsOnly {
+		cached = r.mods
+	}
+	generation := r.generation
+	r.Unlock()
+	if cached == nil {
+		cached = load(modsOnly)
+		r.Lock()
+		if r.generation == generation {
+			if modsOnly {
+				r.mods = cached
+			} else {
+				r.all = cached
+			}
+		}
+		r.Unlock()
+	}
+	// Callers may change what they're given.
+	return append([]string{}, cached...)
+}
+
+// invalidate empties the cache.
+func (r *rosterCache) invalidate() {
+	r.Lock()
+	r.generation++
+	r.all, r.mods = nil, nil
+	r.Unlock()
+}
+
+// rosterChanged empties the roster cache, if in use, once tx commits. Call it
+// wherever member records are written.
+func (db *ListlessDB) rosterChanged(tx *bolt.Tx) {
+	if db.roster == nil {
+		return
+	}
+	tx.OnCommit(db.roster.invalidate)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRosterCache(t *testing.T) {
+	r := new(rosterCache)
+	loads := 0
+	load := func(modsOnly bool) []string {
+		loads++
+		if modsOnly {
+			return []string{"mod@example.com"}
+		}
+		return []string{"mod@example.com", "member@example.com"}
+	}
+	assert.Len(t, r.get(false, load), 2)
+	assert.Len(t, r.get(false, load), 2)
+	assert.Equal(t, []string{"mod@example.com"}, r.get(true, load))
+	assert.Equal(t, 2, loads)
+
+	// A list loaded across an invalidation isn't kept.
+	stale := func(modsOnly bool) []string {
+		r.invalidate()
+		return load(modsOnly)
+	}
+	r.invalidate()
+	r.get(false, stale)
+	r.get(false, load)
+	assert.Equal(t, 4, loads)
+	r.get(false, load)
+	assert.Equal(t, 4, loads)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrAllowedSenderBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrAllowedSenderBucketNotFound = errors.New("Allowed sender bucket not found")
+
+	// ErrInvalidSenderPattern - Returned when an allowed sender is neither an
+	// address nor a domain.
+	ErrInvalidSenderPattern = errors.New("Allowed sender must be an address or a domain like @example.org")
+)
+
+// AllowedSender is an address, or a whole domain written "@example.org",
+// that may post without being a member, such as a ticketing system.
+type AllowedSender struct {
+	Pattern string
+	Added   time.Time
+}
+
+// allowedSenderKey normalises an allowed sender pattern: an address, or a
+// domain with or without a leading "@", which is stored with one.
+func allowedSenderKey(pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if at := strings.LastIndex(pattern, "@"); at > 0 {
+		if addr := normaliseEmail(pattern); addr != "" {
+			return addr, nil
+		}
+		return "", ErrInvalidSenderPattern
+	}
+	domain := strings.TrimPrefix(pattern, "@")
+	if domain == "" || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "@ \t<>") {
+		return "", ErrInvalidSenderPattern
+	}
+	return "@" + domain, nil
+}
+
+// AllowSender lets an address or domain post without being a member.
+func (db *ListlessDB) AllowSender(pattern string) error {
+	key, err := allowedSenderKey(pattern)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(AllowedSender{Pattern: key, Added: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		senders := tx.Bucket([]byte(allowedSenderBucketName))
+		if senders == nil {
+			return ErrAllowedSenderBucketNotFound
+		}
+		return senders.Put([]byte(key), entry)
+	})
+}
+
+// DisallowSender removes an address or domain from the allowed senders. It is
+// not an error if it wasn't there.
+func (db *ListlessDB) DisallowSender(pattern string) error {
+	key, err := allowedSenderKey(pattern)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		senders := tx.Bucket([]byte(allowedSenderBucketName))
+		if senders == nil {
+			return ErrAllowedSenderBucketNotFound
+		}
+		return senders.Delete([]byte(key))
+	})
+}
+
+// IsAllowedSender reports whether an address is an allowed sender, by itself
+// or by its domain.
+func (db *ListlessDB) IsAllowedSender(email string) bool {
+	addr, err := parseExpressiveEmail(email)
+	if err != nil || addr == "" {
+		return false
+	}
+	allowed := false
+	db.View(func(tx *bolt.Tx) error {
+		senders := tx.Bucket([]byte(allowedSenderBucketName))
+		if senders == nil {
+			return ErrAllowedSenderBucketNotFound
+		}
+		allowed = senders.Get([]byte(addr)) != nil ||
+			senders.Get([]byte(addr[strings.LastIndex(addr, "@"):])) != nil
+		return nil
+	})
+	return allowed
+}
+
+// AllowedSenders returns the allowed senders, in order.
+func (db *ListlessDB) AllowedSenders() (allowed []*AllowedSender, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		senders := tx.Bucket([]byte(allowedSenderBucketName))
+		if senders == nil {
+			return ErrAllowedSenderBucketNotFound
+		}
+		return senders.ForEach(func(k, v []byte) error {
+			as := new(AllowedSender)
+			if err := json.Unmarshal(v, as); err != nil {
+				return err
+			}
+			allowed = append(allowed, as)
+			return nil
+		})
+	})
+	return allowed, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// directoryMember is a member as listed by an external directory such as LDAP.
+// ID is the directory's stable identifier for the entry, if it has one.
+type directoryMember struct {
+	ID    string
+	Email string
+	Name  string
+}
+
+// reconcileMembers brings the members managed by source into line with the
+// members a directory currently lists, in a single transaction:
+// * Listed addresses that aren't members are added as posting members.
+// * Members from source that are listed have their name refreshed and any
+//   Departed flag cleared. If a member's address is no longer listed but its
+//   SourceID is, the member is moved to the new address.
+// * Members from source that are no longer listed are flagged as Departed,
+//   not deleted, so an administrator can decide what to do with them.
+// Members added by hand or by another source are left alone.
+func (db *ListlessDB) reconcileMembers(source string, listed []directoryMember) (added, departed int, err error) {
+	wanted := make(map[string]directoryMember, len(listed))
+	byID := make(map[string]string)
+	for _, m := range listed {
+		if m.Email = normaliseEmail(m.Email); m.Email == "" {
+			continue
+		}
+		wanted[m.Email] = m
+		if m.ID != "" {
+			byID[m.ID] = m.Email
+		}
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		// Bolt forbids writes during ForEach, so collect changes first.
+		changed := make(map[string]*MemberMeta)
+		moved := make(map[string]*MemberMeta)
+		isNew := make(map[string]bool)
+		err := members.ForEach(func(k, v []byte) error {
+			email := string(k)
+			meta := new(MemberMeta)
+			if err := json.Unmarshal(v, meta); err != nil {
+				return err
+			}
+			m, isListed := wanted[email]
+			delete(wanted, email)
+			if meta.Source != source {
+				return nil
+			}
+			if !isListed {
+				if _, ok := byID[meta.SourceID]; ok && meta.SourceID != "" {
+					moved[email] = meta
+				} else if !meta.Departed {
+					meta.Departed = true
+					changed[email] = meta
+					departed++
+				}
+				return nil
+			}
+			if meta.Departed || (m.Name != "" && m.Name != meta.Name) || m.ID != meta.SourceID {
+				meta.Departed = false
+				if m.Name != "" {
+					meta.Name = m.Name
+				}
+				meta.SourceID = m.ID
+				changed[email] = meta
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for oldemail, meta := range moved {
+			newemail := byID[meta.SourceID]
+			m, free := wanted[newemail]
+			if !free {
+				// The new address is already a member in its own right.
+				if !meta.Departed {
+					meta.Departed = true
+					changed[oldemail] = meta
+					departed++
+				}
+				continue
+			}
+			delete(wanted, newemail)
+			if err := members.Delete([]byte(oldemail)); err != nil {
+				return err
+			}
+			if err := indexMember(tx, oldemail, nil); err != nil {
+				return err
+			}
+			db.rosterChanged(tx)
+			db.changed(tx, DBChange{Kind: ChangeMemberRemoved, Email: oldemail})
+			isNew[newemail] = true
+			meta.Email = newemail
+			meta.Departed = false
+			if m.Name != "" {
+				meta.Name = m.Name
+			}
+			changed[newemail] = meta
+		}
+		for email, m := range wanted {
+			meta := db.CreateSubscriber(email, m.Name, true, false)
+			meta.Source = source
+			meta.SourceID = m.ID
+			changed[email] = meta
+			isNew[email] = true
+			added++
+		}
+		for email, meta := range changed {
+			metab, err := json.Marshal(meta)
+			if err != nil {
+				return err
+			}
+			if err := members.Put([]byte(email), metab); err != nil {
+				return err
+			}
+			if err := indexMember(tx, email, meta); err != nil {
+				return err
+			}
+			db.rosterChanged(tx)
+			kind := ChangeMemberUpdated
+			if isNew[email] {
+				kind = ChangeMemberAdded
+			}
+			db.changed(tx, DBChange{Kind: kind, Email: email, Member: meta})
+		}
+		return nil
+	})
+	return added, departed, err
+}
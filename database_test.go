@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdjustWhitelist(t *testing.T) {
+	wl, err := adjustWhitelist(ModeratorDBPermittedMethods, []string{"GetAllSubscribers"}, []string{"DelSubscriber"}, &ModeratorDBWrapper{})
+	assert.Nil(t, err)
+	assert.Contains(t, wl, "GetAllSubscribers")
+	assert.NotContains(t, wl, "DelSubscriber")
+	assert.Contains(t, wl, "IsModerator")
+	_, err = adjustWhitelist(ModeratorDBPermittedMethods, []string{"NoSuchMethod"}, nil, &ModeratorDBWrapper{})
+	assert.NotNil(t, err)
+	// Nothing from the embedded database itself can be allowed.
+	for _, name := range []string{"Close", "Update", "View", "DB", "ListlessDB"} {
+		_, err = adjustWhitelist(PrivilegedDBPermittedMethods, []string{name}, nil, &PrivilegedDBWrapper{})
+		assert.NotNil(t, err, name)
+	}
+	wl, err = adjustWhitelist(ListlessKVStorePermittedMethods, nil, nil, &ListlessKVStore{})
+	assert.Nil(t, err)
+	assert.Contains(t, wl, "BucketName")
+}
+
+func TestTransactionPermitted(t *testing.T) {
+	anyone := &MailTransaction{}
+	assert.True(t, anyone.isPermitted("someone@example.com"))
+	mods := &MailTransaction{Permitted: []string{"mod@example.com"}}
+	assert.True(t, mods.isPermitted("mod@example.com"))
+	assert.False(t, mods.isPermitted("someone@example.com"))
+}
+
+func TestHashSecret(t *testing.T) {
+	keyed := &ListlessDB{transactionKey: []byte("installation key")}
+	other := &ListlessDB{transactionKey: []byte("another key")}
+	assert.Equal(t, keyed.hashSecret("s3cret"), keyed.hashSecret("s3cret"))
+	assert.NotEqual(t, other.hashSecret("s3cret"), keyed.hashSecret("s3cret"))
+	assert.NotEqual(t, keyed.hashSecret("s3cret"), keyed.hashSecret("s3cret!"))
+	// A bare SHA-256 would let anyone with the database check guesses.
+	bare := sha256.Sum256([]byte("s3cret"))
+	assert.NotEqual(t, bare[:], (&ListlessDB{}).hashSecret("s3cret"))
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,6 +20,8 @@ var (
 	// ErrTransactionNotFound is returned when a secret fails to yield a transaction item in the database.
 	// This may be due to expiry or nonexistence.
 	ErrTransactionNotFound = errors.New("Provided transaction secret did not yield a transaction item; nonexistent or expired and cleared out?")
+	// ErrTransactionNotPermitted is returned when the sender isn't permitted to trigger a transaction.
+	ErrTransactionNotPermitted = errors.New("Sender is not permitted to trigger this transaction")
 )
 
 // MailTransaction is the unit of authentication for mailing list subscriptions,
@@ -49,6 +54,8 @@ type MailTransaction struct {
 	// When this job expires, and can be deleted by the calling script.
 	// A function is provided in Lua scope to fetch all refcodes for expired
 	// transactions, so that implementing scripts can clean up their buckets.
+	// If TransactionKVStore is set, expired and consumed transactions have
+	// their KV entries removed automatically.
 	Expires time.Time
 	// Can this transaction be triggered more than once?
 	Persists bool
@@ -85,6 +92,9 @@ func (trans *MailTransaction) isExpired() bool {
 
 // Is sender email address permitted to trigger this Transaction
 func (trans *MailTransaction) isPermitted(emailAddr string) bool {
+	if len(trans.Permitted) == 0 {
+		return true
+	}
 	emailAddr = normaliseEmail(emailAddr)
 	for _, pEmail := range trans.Permitted {
 		if emailAddr == pEmail {
@@ -100,11 +110,13 @@ func (trans *MailTransaction) isPermitted(emailAddr string) bool {
 // deleted, but an ErrExpiredTransaction error will be returned; this can be
 // identified to send an expiry notice to the caller, if desired.
 func (db *ListlessDB) GetTransaction(secret string) (trans *MailTransaction, err error) {
-	sHash := hashSecret(secret)
+	sHash := db.hashSecret(secret)
+	trans = new(MailTransaction)
 	err = db.View(func(tx *bolt.Tx) error {
 		transBucket := tx.Bucket([]byte(transactionBucketName))
-		v := transBucket.Get(sHash)
-		if v == nil {
+		// Get's own key comparison isn't constant-time, so check again.
+		k, v := transBucket.Cursor().Seek(sHash)
+		if v == nil || !hmac.Equal(k, sHash) {
 			return ErrTransactionNotFound
 		}
 		return json.Unmarshal(v, trans)
@@ -124,7 +136,7 @@ func (db *ListlessDB) PutTransaction(secret string, newTransaction *MailTransact
 	if err := newTransaction.prepare(); err != nil {
 		return err
 	}
-	sHash := hashSecret(secret)
+	sHash := db.hashSecret(secret)
 	jTransaction, err := json.Marshal(newTransaction)
 	if err != nil {
 		return err
@@ -151,7 +163,16 @@ func (db *ListlessDB) RegisterTransaction(secret, scriptname, scripthook, refcod
 // HasTransaction is exposed in Lua. It accepts a secret value and returns true if it exists, but does
 // not trigger it.
 func (db *ListlessDB) HasTransaction(secret string) bool {
-	return false
+	trans, err := db.GetTransaction(secret)
+	return err == nil && !trans.isExpired()
+}
+
+// DelTransaction removes a transaction. No error if absent.
+func (db *ListlessDB) DelTransaction(secret string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		transBucket := tx.Bucket([]byte(transactionBucketName))
+		return transBucket.Delete(db.hashSecret(secret))
+	})
 }
 
 // TriggerTransaction is exposed in Lua. It is how new transactions are searched for and triggered.
@@ -160,18 +181,145 @@ func (db *ListlessDB) HasTransaction(secret string) bool {
 // The hook may return an abitrary string which is returned to Lua, and an arbitrary string which is
 // converted to an error on the way out of TriggerTransaction. In turn, the triggering script will
 // receive (hookReturnedString, transactionRefcode, error), all strings or nil.
+// ScriptName is looked up in the Scripts table of the config. Unless the
+// transaction Persists, it is deleted once its hook has run without error.
 func (db *ListlessDB) TriggerTransaction(secret string, email *Email) (hookreturnvalue, refcode string, err error) {
-	// Get transaction
-	// Validate transaction
-	// Trigger transaction
-	// If transaction is expired, delete transaction
-	// Return refcode so script can clean up
-	return hookreturnvalue, refcode, nil
-}
-
-// sha256 the secret to get the hash. May change in future to some other function;
-// deliberately partitioned for modularity.
-func hashSecret(secret string) []byte {
-	h := sha256.Sum256([]byte(secret))
-	return h[:]
+	trans, err := db.GetTransaction(secret)
+	if err != nil {
+		return "", "", err
+	}
+	refcode = trans.RefCode
+	if trans.isExpired() {
+		// Return refcode so script can clean up
+		if err = db.consumeTransaction(secret, trans); err != nil {
+			return "", refcode, err
+		}
+		return "", refcode, ErrExpiredTransaction
+	}
+	if !trans.isPermitted(email.Sender) {
+		return "", refcode, ErrTransactionNotPermitted
+	}
+	if db.runHook == nil {
+		return "", refcode, ErrNoScriptRunner
+	}
+	hookreturnvalue, err = db.runHook(trans.ScriptName, trans.ScriptHook, email, refcode)
+	if err != nil {
+		return hookreturnvalue, refcode, err
+	}
+	if !trans.Persists {
+		err = db.consumeTransaction(secret, trans)
+	}
+	return hookreturnvalue, refcode, err
+}
+
+// transactionKVStoreName returns the KV store holding the RefCodes of
+// scriptName's transactions: pattern with "{script}" replaced by scriptName.
+// An empty pattern means no store is cleaned up.
+func transactionKVStoreName(pattern, scriptName string) string {
+	return strings.Replace(pattern, "{script}", scriptName, -1)
+}
+
+// forgetTransaction deletes a transaction and, if TransactionKVStore is set,
+// the entry keyed by its RefCode in that KV store.
+func (db *ListlessDB) forgetTransaction(tx *bolt.Tx, key []byte, trans *MailTransaction) error {
+	if err := tx.Bucket([]byte(transactionBucketName)).Delete(key); err != nil {
+		return err
+	}
+	store := transactionKVStoreName(db.transactionKVStore, trans.ScriptName)
+	if store == "" || trans.RefCode == "" {
+		return nil
+	}
+	bucket := tx.Bucket([]byte(kvBucketName)).Bucket([]byte(store))
+	if bucket == nil || bucket.Get([]byte(trans.RefCode)) == nil {
+		return nil
+	}
+	db.kvChanged(tx, ChangeKVDeleted, store, trans.RefCode, "")
+	return bucket.Delete([]byte(trans.RefCode))
+}
+
+// consumeTransaction forgets a transaction once used or found expired.
+func (db *ListlessDB) consumeTransaction(secret string, trans *MailTransaction) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return db.forgetTransaction(tx, db.hashSecret(secret), trans)
+	})
+}
+
+// PurgeExpiredTransactions forgets all expired transactions, with their KV
+// entries if TransactionKVStore is set, so abandoned workflows don't linger.
+func (db *ListlessDB) PurgeExpiredTransactions() (removed int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		var (
+			keys    [][]byte
+			expired []*MailTransaction
+		)
+		err := tx.Bucket([]byte(transactionBucketName)).ForEach(func(k, v []byte) error {
+			trans := new(MailTransaction)
+			if err := json.Unmarshal(v, trans); err != nil {
+				return err
+			}
+			if trans.isExpired() {
+				keys = append(keys, append([]byte(nil), k...))
+				expired = append(expired, trans)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if err := db.forgetTransaction(tx, k, expired[i]); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// hashSecret derives the database key for a secret: an HMAC-SHA256 keyed
+// with TransactionKey, or the installation key if that isn't set. A copy of
+// the database without the key is no use for triggering transactions.
+// Pending transactions are keyed on the hash, so setting or changing
+// TransactionKey voids them, along with their links and moderation links.
+func (db *ListlessDB) hashSecret(secret string) []byte {
+	mac := hmac.New(sha256.New, db.transactionKey)
+	mac.Write([]byte(secret))
+	return mac.Sum(nil)
+}
+
+// The meta bucket key holding the random key used when no TransactionKey is
+// set.
+const installationKeyName = "installation-key"
+
+// installationKey loads the random key used in place of TransactionKey,
+// generating and storing one the first time if create is set. Without
+// create, as for read-only engines, it is nil until one has been stored.
+func (db *ListlessDB) installationKey(create bool) ([]byte, error) {
+	var key []byte
+	load := func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucketName))
+		if meta == nil {
+			return ErrMetaBucketNotFound
+		}
+		if stored := meta.Get([]byte(installationKeyName)); stored != nil {
+			key = append([]byte(nil), stored...)
+			return nil
+		}
+		if !create {
+			return nil
+		}
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		return meta.Put([]byte(installationKeyName), key)
+	}
+	var err error
+	if create {
+		err = db.Update(load)
+	} else {
+		err = db.View(load)
+	}
+	return key, err
 }
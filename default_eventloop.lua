@@ -4,12 +4,9 @@
 function setSubjectTag(message, tag)
   -- If a subject tag is provided as the "SubjectTag" key in the Constants table
   -- of the config file, then it is used here to add the tag to subject lines if
-  -- it's not already present.
-  if tag ~= "" then
-    if message.Subject:find(tag, 1, true) == nil then
-      message.Subject = tag .. " " .. message.Subject
-    end
-  end
+  -- it's not already present. NormaliseSubject also collapses "Re: Re: Fwd:"
+  -- chains into a single "Re:", and works with an empty tag too.
+  message:NormaliseSubject(tag or "")
 end
 
 function listifyMessage(config, database, message)
@@ -5,6 +5,7 @@ import (
 	"net/mail"
 	"net/smtp"
 	"strings"
+	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
@@ -30,6 +31,14 @@ type Email struct {
 	// "To", "CC", or "BCC".
 	inRecipientLists map[string]struct{}
 	Sender           string
+	// Set by Hold, to keep the message for moderator approval.
+	holdReason string
+	// Set by SendAt, to queue the message for later.
+	sendAt time.Time
+	// Trace span of handling this message, if tracing.
+	span *span
+	// Time spent on each stage of handling this message, if incoming.
+	timings *stageTimings
 }
 
 func (em *Email) isValid() bool {
@@ -53,6 +62,8 @@ var EmailPermittedMethods = []string{
 	"GetText", "SetText", "GetHeader", "SetHeader", "AddHeader", "DelHeader",
 	"AddToRecipient", "AddCcRecipient", "AddBccRecipient", "AddRecipient", "AddRecipientList",
 	"ClearRecipients", "RemoveRecipient", "Sender",
+	"SanitiseHTML", "HasSubjectTag", "NormaliseSubject", "CanonicalSubject",
+	"Hold", "SendAt", "TrimQuotes",
 }
 
 // WrapEmail - given an email.Email object, return the wrapper used in this
@@ -71,17 +82,45 @@ func WrapEmail(e *email.Email) *Email {
 	} else {
 		newe.Sender = nsender
 	}
+	// Messages built to be sent, or stored and sent later, already have their
+	// recipients.
+	for _, field := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, entry := range field {
+			if addr, err := parseExpressiveEmail(entry); err == nil && addr != "" {
+				newe.addRecipient(addr)
+			}
+		}
+	}
 	return newe
 }
 
-// GetText returns the message Text as a string. Warning: Encoding-naive!
+// Hold asks for the message to be kept for moderator approval rather than
+// sent, whatever eventLoop returns. Moderators are mailed links to release or
+// reject it; when released it is sent as eventLoop left it.
+func (em *Email) Hold(reason string) {
+	if reason == "" {
+		reason = "Held for moderation"
+	}
+	em.holdReason = reason
+}
+
+// SendAt asks for the message to be kept in the outgoing queue until the
+// given Unix time, for embargoed announcements or quiet hours. Times in the
+// past send the message straight away, as usual.
+func (em *Email) SendAt(timestamp int64) {
+	em.sendAt = time.Unix(timestamp, 0)
+}
+
+// GetText returns the message Text as a string. Incoming mail has its transfer
+// encoding and charset decoded before reaching Lua, so this is plain UTF-8.
 // This returns the text body, not a HTML body if included in the mail!
 func (em *Email) GetText() string {
 	return string(em.Text)
 }
 
 // SetText sets the email Text as a given string. This replaces the existing
-// Body/Text.
+// Body/Text. The text should be plain UTF-8; it is quoted-printable encoded
+// when the message is sent.
 // This sets the text body, not HTML!
 func (em *Email) SetText(newtext string) {
 	em.Text = append(em.Text[:0], []byte(newtext)...)
@@ -295,6 +334,7 @@ func (em *Email) normaliseEmailSlice(field string, emailSlice []string) []string
 // This is run prior to calling eventLoop in Lua, and added emails are all
 // normalised under the hood, so there should be no need to call this from Lua.
 func (em *Email) NormaliseRecipients() {
+	em.clearRecipients()
 	newTo := em.normaliseEmailSlice("To", em.To)
 	if newTo != nil {
 		em.To = append(em.To[:0], newTo...)
@@ -349,6 +389,16 @@ func parseMultiExpressiveEmails(entry string) ([]string, error) {
 //    more efficient
 //  - (More urgently) avoid bounce notices by avoiding sending to the list address!
 func (em *Email) Send(addr string, a smtp.Auth, excludeEmails ...string) error {
+	from, to, raw, err := em.envelope(excludeEmails...)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(addr, a, from, to, raw)
+}
+
+// envelope returns the envelope sender and recipients for sending an email
+// (the merged To, Cc and Bcc fields, minus excludeEmails) and its raw bytes.
+func (em *Email) envelope(excludeEmails ...string) (from string, to []string, raw []byte, err error) {
 	nuexcludeEmails := make(map[string]struct{})
 	for _, e := range excludeEmails {
 		e = normaliseEmail(e)
@@ -358,7 +408,7 @@ func (em *Email) Send(addr string, a smtp.Auth, excludeEmails ...string) error {
 		nuexcludeEmails[e] = struct{}{}
 	}
 	// Merge the To, Cc, and Bcc fields, minus excluded emails.
-	to := make([]string, 0, len(em.To)+len(em.Cc)+len(em.Bcc)-len(nuexcludeEmails))
+	to = make([]string, 0, len(em.To)+len(em.Cc)+len(em.Bcc)-len(nuexcludeEmails))
 	for k := range em.inRecipientLists {
 		if _, ok := nuexcludeEmails[k]; ok {
 			continue
@@ -368,21 +418,21 @@ func (em *Email) Send(addr string, a smtp.Auth, excludeEmails ...string) error {
 	for i := 0; i < len(to); i++ {
 		addr, err := mail.ParseAddress(to[i])
 		if err != nil {
-			return err
+			return "", nil, nil, err
 		}
 		to[i] = addr.Address
 	}
 	// Check to make sure there is at least one recipient and one "From" address
 	if em.From == "" || len(to) == 0 {
-		return errors.New("Must specify at least one From address and one To address")
+		return "", nil, nil, errors.New("Must specify at least one From address and one To address")
 	}
-	from, err := mail.ParseAddress(em.From)
+	fromAddr, err := mail.ParseAddress(em.From)
 	if err != nil {
-		return err
+		return "", nil, nil, err
 	}
-	raw, err := em.Bytes()
+	raw, err = em.Bytes()
 	if err != nil {
-		return err
+		return "", nil, nil, err
 	}
-	return smtp.SendMail(addr, a, from.Address, to, raw)
+	return fromAddr.Address, to, raw, nil
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	// ErrUnknownCharset - Returned when a body part declares a charset that
+	// cannot be decoded.
+	ErrUnknownCharset = errors.New("Body part declares an unknown charset, cannot decode to UTF-8")
+	// ErrUnknownTransferEncoding - Returned when a body part declares a
+	// Content-Transfer-Encoding other than 7bit, 8bit, binary, quoted-printable or base64.
+	ErrUnknownTransferEncoding = errors.New("Body part declares an unknown Content-Transfer-Encoding")
+)
+
+// mimeTextPart is a text/plain or text/html body part found in a raw message,
+// along with the headers and media type parameters that describe its encoding.
+type mimeTextPart struct {
+	Header textproto.MIMEHeader
+	Params map[string]string
+	Body   []byte
+}
+
+// walkMIMEParts recurses through a (possibly multipart) MIME entity, calling visit
+// for every inline text/* leaf part with its media type, parameters, headers and
+// body. Bodies are passed to visit with their transfer encoding already decoded.
+// Attachments and other media types aren't read any further, and a part that
+// can't be read or decoded is logged and skipped, so one bad part doesn't lose
+// the rest.
+func walkMIMEParts(header textproto.MIMEHeader, body io.Reader, visit func(mediatype string, params map[string]string, header textproto.MIMEHeader, body []byte)) error {
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC2045 default for absent or broken Content-Type headers.
+		mediatype, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	if strings.HasPrefix(mediatype, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = walkMIMEParts(part.Header, part, visit); err != nil {
+				return err
+			}
+		}
+	}
+	if !strings.HasPrefix(mediatype, "text/") || strings.HasPrefix(strings.ToLower(header.Get("Content-Disposition")), "attachment") {
+		return nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err == nil {
+		b, err = decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), b)
+	}
+	if err != nil {
+		log15.Warn("Skipping body part that couldn't be decoded", log15.Ctx{"context": "imap", "type": mediatype, "error": err})
+		return nil
+	}
+	visit(mediatype, params, header, b)
+	return nil
+}
+
+// decodeTransferEncoding reverses a part's Content-Transfer-Encoding. Note that
+// mime/multipart already transparently decodes quoted-printable parts (and
+// hides the header), so this mostly matters for base64 parts and single-part
+// messages.
+func decodeTransferEncoding(cte string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "", "7bit", "8bit", "binary":
+		return body, nil
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case "base64":
+		// Encoded bodies are line-wrapped; the decoder doesn't like that.
+		stripped := bytes.Map(func(r rune) rune {
+			switch r {
+			case '\r', '\n', ' ', '\t':
+				return -1
+			}
+			return r
+		}, body)
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(stripped)))
+		n, err := base64.StdEncoding.Decode(decoded, stripped)
+		if err != nil {
+			return nil, err
+		}
+		return decoded[:n], nil
+	default:
+		return nil, ErrUnknownTransferEncoding
+	}
+}
+
+// findTextParts parses a raw message and returns the first inline text/plain
+// and text/html parts found. Either or both may be nil.
+func findTextParts(raw io.Reader) (textPart, htmlPart *mimeTextPart, err error) {
+	msg, err := mail.ReadMessage(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = walkMIMEParts(textproto.MIMEHeader(msg.Header), msg.Body, func(mediatype string, params map[string]string, header textproto.MIMEHeader, body []byte) {
+		part := &mimeTextPart{Header: header, Params: params, Body: body}
+		switch {
+		case mediatype == "text/plain" && textPart == nil:
+			textPart = part
+		case mediatype == "text/html" && htmlPart == nil:
+			htmlPart = part
+		}
+	})
+	return textPart, htmlPart, err
+}
+
+// toUTF8 decodes a body in the named charset into UTF-8. Bodies that are
+// already UTF-8 (or ASCII, or undeclared) are returned unchanged.
+func toUTF8(charsetName string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(charsetName)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return body, nil
+	}
+	enc, _ := charset.Lookup(charsetName)
+	if enc == nil {
+		return nil, ErrUnknownCharset
+	}
+	return enc.NewDecoder().Bytes(body)
+}
+
+// normaliseBodies re-reads the raw message to find the declared charset and
+// transfer encoding of the text and HTML parts, and replaces Text and HTML with
+// decoded, UTF-8 versions so Lua always sees plain UTF-8 text. Outgoing mail is
+// always written by email.Bytes as multipart with UTF-8, quoted-printable text
+// parts, so the original Content-Type and Content-Transfer-Encoding headers are
+// dropped so as not to contradict it. Finally, a text part is derived from
+// HTML-only messages.
+func (em *Email) normaliseBodies(raw io.Reader) error {
+	textPart, htmlPart, err := findTextParts(raw)
+	if err != nil {
+		return err
+	}
+	if textPart != nil {
+		decoded, err := toUTF8(textPart.Params["charset"], textPart.Body)
+		if err != nil {
+			log15.Error("Error decoding charset of text part, leaving as-is", log15.Ctx{"context": "imap", "error": err, "charset": textPart.Params["charset"]})
+		} else {
+			em.Text = decoded
+		}
+	}
+	if htmlPart != nil {
+		decoded, err := toUTF8(htmlPart.Params["charset"], htmlPart.Body)
+		if err != nil {
+			log15.Error("Error decoding charset of HTML part, leaving as-is", log15.Ctx{"context": "imap", "error": err, "charset": htmlPart.Params["charset"]})
+		} else {
+			em.HTML = decoded
+		}
+	}
+	em.Headers.Del("Content-Type")
+	em.Headers.Del("Content-Transfer-Encoding")
+	if em.DeriveText() {
+		log15.Info("Derived text part from HTML-only email", log15.Ctx{"context": "imap", "sender": em.Sender})
+	}
+	return nil
+}
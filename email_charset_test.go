@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeTransferEncoding(t *testing.T) {
+	decoded, err := decodeTransferEncoding("base64", []byte("SGVsbG8s\r\nIHdvcmxk\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, world", string(decoded))
+	decoded, err = decodeTransferEncoding("Quoted-Printable", []byte("caf=C3=A9 =\r\nau lait"))
+	assert.NoError(t, err)
+	assert.Equal(t, "café au lait", string(decoded))
+	decoded, err = decodeTransferEncoding("7bit", []byte("as is"))
+	assert.NoError(t, err)
+	assert.Equal(t, "as is", string(decoded))
+	_, err = decodeTransferEncoding("x-uuencode", []byte("begin 644"))
+	assert.Equal(t, ErrUnknownTransferEncoding, err)
+}
+
+func TestToUTF8(t *testing.T) {
+	// "café" in ISO-8859-1, and "naïve – ok" in Windows-1252, whose en dash
+	// is 0x96.
+	decoded, err := toUTF8("ISO-8859-1", []byte("caf\xe9"))
+	assert.NoError(t, err)
+	assert.Equal(t, "café", string(decoded))
+	decoded, err = toUTF8("windows-1252", []byte("na\xefve \x96 ok"))
+	assert.NoError(t, err)
+	assert.Equal(t, "naïve – ok", string(decoded))
+	decoded, err = toUTF8("", []byte("as is"))
+	assert.NoError(t, err)
+	assert.Equal(t, "as is", string(decoded))
+	_, err = toUTF8("x-klingon", []byte("Qapla'"))
+	assert.Equal(t, ErrUnknownCharset, err)
+}
+
+func TestNormaliseBodiesCharset(t *testing.T) {
+	raw := "From: ann@example.com\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gar=E7on, un caf=E9.\r\n"
+	em := &Email{Email: &email.Email{Headers: textproto.MIMEHeader{}}}
+	assert.NoError(t, em.normaliseBodies(strings.NewReader(raw)))
+	assert.Equal(t, "Garçon, un café.\r\n", string(em.Text))
+
+	// Parts in an unknown charset are left as they came.
+	raw = strings.Replace(raw, "iso-8859-1", "x-klingon", 1)
+	em = &Email{Email: &email.Email{Headers: textproto.MIMEHeader{}, Text: []byte("original")}}
+	assert.NoError(t, em.normaliseBodies(strings.NewReader(raw)))
+	assert.Equal(t, "original", string(em.Text))
+}
+
+func TestFindTextPartsSkipsBadParts(t *testing.T) {
+	raw := "From: ann@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9 au lait\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"not*base64!\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=menu.pdf\r\n" +
+		"Content-Transfer-Encoding: x-unknown\r\n" +
+		"\r\n" +
+		"%PDF\r\n" +
+		"--b--\r\n"
+	textPart, htmlPart, err := findTextParts(strings.NewReader(raw))
+	assert.NoError(t, err)
+	if assert.NotNil(t, textPart) {
+		assert.Equal(t, "café au lait", strings.TrimSpace(string(textPart.Body)))
+	}
+	assert.Nil(t, htmlPart)
+}
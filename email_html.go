@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+)
+
+var (
+	// ErrUnknownHTMLPolicy - Returned when HTMLSanitisePolicy names a policy level
+	// that listless doesn't know about.
+	ErrUnknownHTMLPolicy = errors.New("Unknown HTML sanitisation policy; expected one of 'off', 'ugc', 'noimages', 'strict'")
+)
+
+// htmlPolicy returns the bluemonday policy for a named sanitisation level:
+// * "" or "off" - No sanitisation; HTML is relayed as received. Returns nil.
+// * "ugc" - Strips scripts, styles, iframes, forms, event handlers and the like,
+//   but permits ordinary formatting, links and images.
+// * "noimages" - As "ugc", but also strips all images, which removes remote
+//   image beacons/tracking pixels at the cost of inline pictures.
+// * "strict" - Strips all markup, leaving only text content.
+func htmlPolicy(level string) (*bluemonday.Policy, error) {
+	switch level {
+	case "", "off":
+		return nil, nil
+	case "ugc":
+		return bluemonday.UGCPolicy(), nil
+	case "noimages":
+		p := bluemonday.NewPolicy()
+		p.AllowStandardAttributes()
+		p.AllowStandardURLs()
+		p.AllowLists()
+		p.AllowTables()
+		p.AllowElements("p", "br", "hr", "div", "span", "blockquote", "pre", "code",
+			"b", "i", "u", "s", "em", "strong", "small", "sub", "sup", "del", "ins",
+			"h1", "h2", "h3", "h4", "h5", "h6")
+		p.AllowAttrs("href").OnElements("a")
+		p.RequireNoFollowOnLinks(true)
+		return p, nil
+	case "strict":
+		return bluemonday.StrictPolicy(), nil
+	default:
+		return nil, ErrUnknownHTMLPolicy
+	}
+}
+
+// SanitiseHTML runs the HTML part of the message (if any) through the named
+// sanitisation policy; see htmlPolicy for the available levels. The text part
+// is never touched. This is applied automatically before relay according to
+// the HTMLSanitisePolicy config option, but can also be called from Lua.
+func (em *Email) SanitiseHTML(level string) error {
+	policy, err := htmlPolicy(level)
+	if err != nil {
+		return err
+	}
+	if policy == nil || len(em.HTML) == 0 {
+		return nil
+	}
+	em.HTML = policy.SanitizeBytes(em.HTML)
+	return nil
+}
+
+var (
+	// Elements whose content is never meaningful as text.
+	htmlSkippedElements = map[string]bool{
+		"head": true, "script": true, "style": true, "title": true, "noscript": true,
+	}
+	// Elements which should begin on a fresh line when rendered as text.
+	htmlBlockElements = map[string]bool{
+		"p": true, "div": true, "br": true, "tr": true, "li": true, "blockquote": true,
+		"pre": true, "table": true, "ul": true, "ol": true, "hr": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+	htmlWhitespaceRun = regexp.MustCompile(`[ \t\r\n]+`)
+	htmlBlankLineRun  = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)+`)
+)
+
+// htmlToText derives a readable plain text rendering of a HTML body. This is
+// not a faithful renderer; it drops markup, keeps paragraph/line structure,
+// bullets list items, and appends link targets after link text so they are
+// not lost.
+func htmlToText(htmlBody []byte) []byte {
+	out := new(bytes.Buffer)
+	skipDepth := 0
+	var linkHref string
+	z := html.NewTokenizer(bytes.NewReader(htmlBody))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if htmlSkippedElements[tok.Data] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if htmlBlockElements[tok.Data] {
+				out.WriteString("\n")
+			}
+			switch tok.Data {
+			case "li":
+				out.WriteString("* ")
+			case "a":
+				linkHref = ""
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" {
+						linkHref = attr.Val
+					}
+				}
+			}
+		case html.EndTagToken:
+			if htmlSkippedElements[tok.Data] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if tok.Data == "a" && linkHref != "" && !strings.HasPrefix(linkHref, "#") {
+				out.WriteString(" <" + linkHref + ">")
+				linkHref = ""
+			}
+			// List items are closed by the next item's newline.
+			if htmlBlockElements[tok.Data] && tok.Data != "li" {
+				out.WriteString("\n")
+			}
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			out.WriteString(htmlWhitespaceRun.ReplaceAllString(tok.Data, " "))
+		}
+	}
+	text := htmlBlankLineRun.ReplaceAll(out.Bytes(), []byte("\n\n"))
+	lines := strings.Split(string(text), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return []byte(strings.TrimSpace(strings.Join(lines, "\n")) + "\n")
+}
+
+// DeriveText generates a text part from the HTML part, if the message has HTML
+// but no text. Returns true if a text part was generated. This is called when
+// incoming mail is wrapped, so that HTML-only mail still has something useful
+// in GetText.
+func (em *Email) DeriveText() bool {
+	if len(bytes.TrimSpace(em.Text)) != 0 || len(bytes.TrimSpace(em.HTML)) == 0 {
+		return false
+	}
+	em.Text = htmlToText(em.HTML)
+	return true
+}
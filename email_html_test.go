@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToText(t *testing.T) {
+	body := `<html><head><style>p {color: red}</style></head><body>
+<p>Hello <b>world</b></p>
+<ul><li>One</li><li>Two</li></ul>
+<a href="https://example.org">a link</a>
+<script>alert("hi")</script>
+</body></html>`
+	text := string(htmlToText([]byte(body)))
+	assert.Contains(t, text, "Hello world")
+	assert.Contains(t, text, "* One\n* Two")
+	assert.Contains(t, text, "a link <https://example.org>")
+	assert.NotContains(t, text, "color: red")
+	assert.NotContains(t, text, "alert")
+}
+
+func TestSanitiseHTML(t *testing.T) {
+	const body = `<p onclick="steal()">Hi <b>all</b> <img src="https://tracker.example/px.gif"></p><script>alert("hi")</script>`
+	for _, c := range []struct {
+		policy           string
+		contains, absent []string
+	}{
+		{"off", []string{`onclick="steal()"`, "<script>", "<img"}, nil},
+		{"", []string{"<script>"}, nil},
+		{"ugc", []string{"<b>all</b>", "<img"}, []string{"<script", "alert", "onclick"}},
+		{"noimages", []string{"<b>all</b>"}, []string{"<img", "<script", "onclick"}},
+		{"strict", []string{"Hi all"}, []string{"<", "alert"}},
+	} {
+		em := &Email{Email: &email.Email{HTML: []byte(body)}}
+		assert.NoError(t, em.SanitiseHTML(c.policy), c.policy)
+		for _, s := range c.contains {
+			assert.Contains(t, string(em.HTML), s, c.policy)
+		}
+		for _, s := range c.absent {
+			assert.NotContains(t, string(em.HTML), s, c.policy)
+		}
+	}
+	em := &Email{Email: &email.Email{HTML: []byte(body)}}
+	assert.Equal(t, ErrUnknownHTMLPolicy, em.SanitiseHTML("paranoid"))
+	assert.Equal(t, body, string(em.HTML))
+	_, err := htmlPolicy("paranoid")
+	assert.Equal(t, ErrUnknownHTMLPolicy, err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Lines that start a forwarded or quoted original in clients that don't
+// quote with ">"; everything from them on is dropped.
+var originalMessageMarkers = []string{
+	"-----Original Message-----",
+	"-------- Original Message --------",
+}
+
+// quoteDepth returns how many ">" levels quote a line.
+func quoteDepth(line string) int {
+	depth := 0
+	for _, r := range line {
+		switch r {
+		case '>':
+			depth++
+		case ' ', '\t':
+		default:
+			return depth
+		}
+	}
+	return depth
+}
+
+// trimQuotes removes the signature block (from a "-- " line) and anything
+// from an "Original Message" marker on, drops quotes of quotes, and cuts each
+// remaining run of quoted lines to maxLines, noting how many were trimmed.
+func trimQuotes(text string, maxLines int) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	var (
+		out     []string
+		kept    int // Lines kept from the current quoted run.
+		trimmed int // Lines dropped from the current quoted run.
+	)
+	endRun := func() {
+		if trimmed > 0 {
+			out = append(out, "> [... "+strconv.Itoa(trimmed)+" quoted lines trimmed]")
+		}
+		kept, trimmed = 0, 0
+	}
+scan:
+	for _, line := range lines {
+		if line == "-- " {
+			break
+		}
+		for _, marker := range originalMessageMarkers {
+			if strings.TrimSpace(line) == marker {
+				break scan
+			}
+		}
+		switch depth := quoteDepth(line); {
+		case depth == 0:
+			endRun()
+			out = append(out, line)
+		case depth == 1 && kept < maxLines:
+			kept++
+			out = append(out, line)
+		default:
+			trimmed++
+		}
+	}
+	endRun()
+	return strings.TrimRight(strings.Join(out, "\n"), "\n ") + "\n"
+}
+
+// TrimQuotes shortens the text body for readers of digests and archives: the
+// signature and quotes of quotes are dropped, and quoted runs cut to maxLines
+// (0 removes quoted text entirely). Set TrimQuotes in the config to do this
+// to every relayed post. HTML bodies are left alone.
+func (em *Email) TrimQuotes(maxLines int) {
+	if len(em.Text) == 0 {
+		return
+	}
+	if maxLines < 0 {
+		maxLines = 0
+	}
+	em.SetText(trimQuotes(string(em.Text), maxLines))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimQuotes(t *testing.T) {
+	text := "Agreed, let's do Tuesday.\n\n" +
+		"On Mon, Jo wrote:\n" +
+		"> How about Tuesday?\n" +
+		"> Or Wednesday?\n" +
+		"> Or Thursday?\n" +
+		">> Earlier: when shall we meet?\n" +
+		">> Any time.\n" +
+		"\n" +
+		"-- \n" +
+		"Sam\n" +
+		"Sent from a phone\n"
+	assert.Equal(t, "Agreed, let's do Tuesday.\n\n"+
+		"On Mon, Jo wrote:\n"+
+		"> How about Tuesday?\n"+
+		"> Or Wednesday?\n"+
+		"> [... 3 quoted lines trimmed]\n", trimQuotes(text, 2))
+	assert.Equal(t, "Agreed, let's do Tuesday.\n\n"+
+		"On Mon, Jo wrote:\n"+
+		"> [... 5 quoted lines trimmed]\n", trimQuotes(text, 0))
+	outlook := "Yes.\r\n\r\n-----Original Message-----\r\nFrom: Jo\r\nWhen shall we meet?\r\n"
+	assert.Equal(t, "Yes.\n", trimQuotes(outlook, 3))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Matches one leading reply/forward prefix, including localised variants
+	// ("AW:", "SV:", "Antw:") and Outlook's counted form ("Re[2]:").
+	subjectPrefixPattern = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|sv|antw)(\[\d+\])?\s*:\s*`)
+	subjectSpaceRun      = regexp.MustCompile(`\s+`)
+)
+
+// splitSubject breaks a subject into whether it was a reply, and the base
+// subject with all occurrences of tag and all reply/forward prefixes removed.
+func splitSubject(subject, tag string) (isReply bool, base string) {
+	if tag != "" {
+		subject = strings.Replace(subject, tag, "", -1)
+	}
+	for {
+		loc := subjectPrefixPattern.FindStringSubmatchIndex(subject)
+		if loc == nil {
+			break
+		}
+		// Forwards ("Fw:", "Fwd:") don't make a message a reply.
+		if !strings.HasPrefix(strings.ToLower(subject[loc[2]:loc[3]]), "f") {
+			isReply = true
+		}
+		subject = subject[loc[1]:]
+	}
+	return isReply, strings.TrimSpace(subjectSpaceRun.ReplaceAllString(subject, " "))
+}
+
+// HasSubjectTag returns true if the subject already carries the list tag.
+func (em *Email) HasSubjectTag(tag string) bool {
+	return tag != "" && strings.Contains(em.Subject, tag)
+}
+
+// NormaliseSubject rewrites the subject so that accumulated prefixes like
+// "Re: [list] Re: Fwd: Re:" are collapsed into a single "Re:", and the list tag
+// (if given) appears exactly once at the start: "[list] Re: Subject".
+// An empty tag only collapses prefixes.
+func (em *Email) NormaliseSubject(tag string) {
+	isReply, base := splitSubject(em.Subject, tag)
+	if isReply {
+		base = "Re: " + base
+	}
+	if tag != "" {
+		base = tag + " " + base
+	}
+	em.Subject = base
+}
+
+// CanonicalSubject returns a lowercased form of the subject with the list tag
+// and all reply/forward prefixes removed, suitable for grouping messages into
+// threads.
+func (em *Email) CanonicalSubject(tag string) string {
+	_, base := splitSubject(em.Subject, tag)
+	return strings.ToLower(base)
+}
+
+// appliedHeader records which of a list's own changes a message already
+// carries, as "<list address> <change>" values, so they aren't made twice if
+// it passes through the list again (cross-posted, or bounced back).
+const appliedHeader = "X-Listless-Applied"
+
+// Changes recorded in appliedHeader.
+const (
+	appliedTag    = "tag"
+	appliedFooter = "footer"
+)
+
+// hasApplied reports whether list has already made the given change.
+func (em *Email) hasApplied(list, change string) bool {
+	mark := normaliseEmail(list) + " " + change
+	for _, v := range em.Headers[appliedHeader] {
+		if strings.TrimSpace(v) == mark {
+			return true
+		}
+	}
+	return false
+}
+
+// markApplied records that list has made the given change.
+func (em *Email) markApplied(list, change string) {
+	if !em.hasApplied(list, change) {
+		em.Headers.Add(appliedHeader, normaliseEmail(list)+" "+change)
+	}
+}
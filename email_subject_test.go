@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseSubject(t *testing.T) {
+	em := &Email{Email: &email.Email{}}
+	em.Subject = "Re: [list] RE: Fwd: AW: Meeting notes"
+	assert.True(t, em.HasSubjectTag("[list]"))
+	assert.Equal(t, "meeting notes", em.CanonicalSubject("[list]"))
+	em.NormaliseSubject("[list]")
+	assert.Equal(t, "[list] Re: Meeting notes", em.Subject)
+	em.Subject = "Fwd: Meeting notes"
+	em.NormaliseSubject("[list]")
+	assert.Equal(t, "[list] Meeting notes", em.Subject)
+	em.Subject = "Re[2]: Re:  Meeting   notes"
+	em.NormaliseSubject("")
+	assert.Equal(t, "Re: Meeting notes", em.Subject)
+}
+
+func TestAppliedMarker(t *testing.T) {
+	em := &Email{Email: &email.Email{Headers: textproto.MIMEHeader{}}}
+	assert.False(t, em.hasApplied("list@example.com", appliedTag))
+	em.markApplied("List@Example.com", appliedTag)
+	em.markApplied("list@example.com", appliedTag)
+	assert.True(t, em.hasApplied("list@example.com", appliedTag))
+	assert.False(t, em.hasApplied("list@example.com", appliedFooter))
+	assert.False(t, em.hasApplied("other@example.com", appliedTag))
+	assert.Equal(t, 1, len(em.Headers[appliedHeader]))
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/mail"
 	"net/smtp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
+	"github.com/aws/aws-sdk-go/service/sesv2"
 	"github.com/cathalgarvey/gospf"
 	"github.com/cjoudrey/gluaurl"
 	"github.com/jordan-wright/email"
@@ -20,6 +26,7 @@ import (
 	"github.com/layeh/gopher-luar"
 	"github.com/tgulacsi/imapclient"
 	"github.com/yuin/gopher-lua"
+	"golang.org/x/oauth2"
 )
 
 var (
@@ -29,6 +36,12 @@ var (
 	ErrOkNotBoolean = errors.New("'ok' value returned from eventLoop function in Lua is not boolean")
 	// ErrEmailInvalid
 	ErrEmailInvalid = errors.New("listless failed to wrap or parse email, cannot proceed safely")
+	// ErrUnknownFetcher - returned when the Fetcher option isn't a known way of receiving mail.
+	ErrUnknownFetcher = errors.New("Unknown Fetcher; expected imap, jmap, pop3 or fake")
+	// ErrUnknownSandbox - returned when exec is asked for a sandbox other than privileged or moderator.
+	ErrUnknownSandbox = errors.New("Unknown sandbox; expected privileged or moderator")
+	// ErrProcessTimeout - recorded for messages quarantined because handling them took longer than ProcessTimeout.
+	ErrProcessTimeout = errors.New("Handling the message took longer than ProcessTimeout")
 )
 
 // Engine is the state and event looper that manages the account and list.
@@ -38,29 +51,178 @@ type Engine struct {
 	Client   imapclient.Client
 	Config   *Config
 	Shutdown chan struct{}
+	// Cancelled by Close, ending the fetch loops and what they started.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Close may be called both by a command's defer and as it exits.
+	closeOnce sync.Once
+	// OAuth access tokens for the list account, if OAuth is configured.
+	oauthTokens oauth2.TokenSource
+	// App-only tokens for the Microsoft Graph transport.
+	graphTokens oauth2.TokenSource
+	// Client for the SES transport.
+	ses *sesv2.SESV2
+	// Lua method whitelists, after config adjustments.
+	whitelists *luaWhitelists
+	// Failure tracking for alerts; nil if alerts have nowhere to go.
+	alerts *alerter
+	// Where to report errors in Sentry, if SentryDSN is set.
+	sentry *sentryDSN
+	// Pipeline tracing; nil unless OTLPEndpoint is set.
+	tracer *tracer
+	// Per-stage timings of the current fetch cycle.
+	metrics *deliveryMetrics
+	// Whether fetching is working, for /healthz.
+	health *fetchHealth
+	// What the "fake" Transport has sent.
+	fake *fakeOutbox
+	// Paces mail sent by scripts.
+	sendLimit *sendLimiter
+	// Spaces out relayed posts by MessageFrequency.
+	relayPace *relayPacer
+	// Database changes waiting for the ChangeScript and ChangeWebhooks; nil
+	// if neither is set.
+	changes *changeQueue
+	// The ActivityPub actor's signing key, if ActivityPub is on.
+	apKey *rsa.PrivateKey
+	// The random key kept in the database, used instead of TransactionKey
+	// if that isn't set.
+	installationKey []byte
+	// Held while a message is handled: eventLoop and the scripts it triggers
+	// run on Lua, which isn't safe for concurrent use, and messages arrive
+	// from NNTP connections as well as the fetch loop.
+	scripts sync.Mutex
 }
 
 // NewEngine - Return a new Engine from the given config.
 func NewEngine(cfg *Config) (*Engine, error) {
+	return newEngine(cfg, false)
+}
+
+// NewReadOnlyEngine - Return a new Engine whose database is opened read-only,
+// for commands that only inspect the list. These work while the list runs
+// if it has an AdminSocket.
+func NewReadOnlyEngine(cfg *Config) (*Engine, error) {
+	return newEngine(cfg, true)
+}
+
+func newEngine(cfg *Config, readOnly bool) (*Engine, error) {
 	var err error
 	if cfg == nil {
 		return nil, errors.New("Fatal error, Cannot load Listless engine with empty configuration.")
 	}
+	if _, err = htmlPolicy(cfg.HTMLSanitisePolicy); err != nil {
+		return nil, err
+	}
+	if err = cfg.parseIMAPSince(); err != nil {
+		return nil, err
+	}
+	switch cfg.ArchiveObfuscation {
+	case "", "off", "words", "hide":
+	default:
+		return nil, ErrUnknownObfuscation
+	}
+	if cfg.LDAPURL != "" && cfg.LDAPGroupDN != "" && cfg.LDAPSyncInterval <= 0 {
+		return nil, ErrBadLDAPSyncInterval
+	}
+	if cfg.CardDAVURL != "" && cfg.CardDAVSyncInterval <= 0 {
+		return nil, ErrBadCardDAVSyncInterval
+	}
+	if cfg.FeedItems < 0 {
+		return nil, ErrBadFeedItems
+	}
+	switch cfg.ReportInterval {
+	case "", "weekly", "monthly":
+	default:
+		return nil, ErrUnknownReportInterval
+	}
+	switch cfg.TransactionScan {
+	case "", "subject", "body", "off":
+	default:
+		return nil, ErrUnknownTransactionScan
+	}
+	switch cfg.SenderPolicy {
+	case "", "open", "reject", "hold":
+	default:
+		return nil, ErrUnknownSenderPolicy
+	}
 	E := new(Engine)
 	E.Config = cfg
+	E.oauthTokens, err = newOAuthTokenSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = E.setupTransport(); err != nil {
+		return nil, err
+	}
+	switch cfg.Fetcher {
+	case "", "imap", "jmap", "pop3", "fake":
+	default:
+		return nil, ErrUnknownFetcher
+	}
 	E.Lua = lua.NewState()
-	// Preload a few extra libs..
-	luajson.Preload(E.Lua)
-	E.Lua.PreloadModule("url", gluaurl.Loader)
-	// Disabled for security, right now:
-	// E.Lua.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
-	E.DB, err = NewDatabase(cfg.Database)
+	preloadModules(E.Lua, true)
+	if err = checkScripts(cfg.Scripts); err != nil {
+		return nil, err
+	}
+	if _, ok := cfg.Scripts[cfg.ChangeScript]; cfg.ChangeScript != "" && !ok {
+		return nil, ErrUnknownScript
+	}
+	if readOnly {
+		E.DB, err = openReadOnlyDatabase(cfg)
+	} else {
+		E.DB, err = NewDatabase(cfg.Database)
+	}
 	if err != nil {
 		return nil, err
 	}
+	E.DB.runHook = E.runScriptHook
+	E.DB.transactionKVStore = cfg.TransactionKVStore
+	E.DB.transactionKey = []byte(cfg.TransactionKey)
+	if cfg.RosterCache {
+		E.DB.roster = new(rosterCache)
+	}
+	if cfg.ChangeScript != "" || len(cfg.ChangeWebhooks) > 0 {
+		E.changes = newChangeQueue()
+		go E.passOnChanges()
+		E.DB.onChange = E.dbChanged
+		E.DB.changeKVStores = make(map[string]bool)
+		for _, store := range cfg.ChangeKVStores {
+			E.DB.changeKVStores[store] = true
+		}
+	}
+	if cfg.ActivityPub && !readOnly {
+		if E.apKey, err = E.DB.activityPubKey(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TransactionKey == "" {
+		if E.installationKey, err = E.DB.installationKey(!readOnly); err != nil {
+			return nil, err
+		}
+		E.DB.transactionKey = E.installationKey
+	}
 	E.Client = imapclient.NewClientTLS(cfg.IMAPHost, cfg.IMAPPort, cfg.IMAPUsername, cfg.IMAPPassword)
 	E.Shutdown = make(chan struct{})
-	err = applyLuarWhitelists(E.Lua)
+	E.ctx, E.cancel = context.WithCancel(context.Background())
+	if len(E.alertRecipients()) > 0 || len(cfg.AlertWebhooks) > 0 {
+		E.alerts = newAlerter(cfg)
+	}
+	E.tracer = newTracer(cfg)
+	E.metrics = new(deliveryMetrics)
+	E.health = newFetchHealth(time.Now())
+	E.sendLimit = &sendLimiter{perMinute: cfg.SendRateLimit}
+	E.relayPace = &relayPacer{gap: time.Duration(cfg.MessageFrequency) * time.Second}
+	if cfg.SentryDSN != "" {
+		if E.sentry, err = parseSentryDSN(cfg.SentryDSN); err != nil {
+			return nil, err
+		}
+	}
+	E.whitelists, err = buildLuaWhitelists(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = applyLuarWhitelists(E.Lua, E.whitelists)
 	if err != nil {
 		log15.Error("Error setting method whitelists in lua runtime", log15.Ctx{"context": "lua", "error": err})
 		return nil, err
@@ -68,6 +230,20 @@ func NewEngine(cfg *Config) (*Engine, error) {
 	return E, nil
 }
 
+// preloadModules makes the extra libraries available to require in L.
+// Unprivileged states get no module that reads local files.
+func preloadModules(L *lua.LState, privileged bool) {
+	luajson.Preload(L)
+	L.PreloadModule("url", gluaurl.Loader)
+	L.PreloadModule("crypto", luaCryptoLoader)
+	L.PreloadModule("time", luaTimeLoader)
+	L.PreloadModule("uuid", luaUUIDLoader)
+	L.PreloadModule("encoding", luaEncodingLoader)
+	L.PreloadModule("mime", luaMimeLoader(privileged))
+	// Disabled for security, right now:
+	// L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+}
+
 func constructRFC5322(email, name string) string {
 	m := new(mail.Address)
 	m.Name = name
@@ -131,11 +307,24 @@ func (eng *Engine) ChooseListSenderEmail(fromEmail string) string {
 
 // Close all open database, scripting engine and IMAP connections.
 func (eng *Engine) Close() {
-	log15.Info("Shutting down..", log15.Ctx{"context": "teardown"})
-	close(eng.Shutdown)
-	eng.Lua.Close()
-	eng.DB.Close()
-	eng.Client.Close(true)
+	eng.closeOnce.Do(func() {
+		log15.Info("Shutting down..", log15.Ctx{"context": "teardown"})
+		eng.cancel()
+		close(eng.Shutdown)
+		if eng.changes != nil {
+			// Pass on what's queued while the database is still open.
+			eng.changes.close()
+		}
+		eng.Lua.Close()
+		eng.DB.Close()
+		eng.Client.Close(true)
+	})
+}
+
+// Stop makes Run return once the message being handled is done, so that the
+// Engine can be closed.
+func (eng *Engine) Stop() {
+	eng.cancel()
 }
 
 // ModeratorSandbox creates a new lua state for executing mod commands. The state
@@ -158,7 +347,9 @@ func (eng *Engine) ModeratorSandbox() (*lua.LState, error) {
 	} {
 		opener(L)
 	}
-	err := applyLuarWhitelists(L)
+	preloadModules(L, false)
+	eng.setMailGlobals(L)
+	err := applyLuarWhitelists(L, eng.whitelists)
 	if err != nil {
 		log15.Error("Error setting method whitelists in lua runtime", log15.Ctx{"context": "lua", "error": err})
 		return nil, err
@@ -187,12 +378,13 @@ func (eng *Engine) ModeratorSandbox() (*lua.LState, error) {
 func (eng *Engine) PrivilegedSandbox() *lua.LState {
 	L := eng.Lua.NewThread()
 	L.OpenLibs() // ALL THE LIBS
+	eng.setMailGlobals(L)
 	return L
 }
 
 // ProcessMail takes an email struct, passes is to the Lua script, and applies
-// any edits *in place* on the email.
-func (eng *Engine) ProcessMail(e *Email) (ok bool, err error) {
+// any edits *in place* on the email. The script is stopped if ctx ends first.
+func (eng *Engine) ProcessMail(ctx context.Context, e *Email) (ok bool, err error) {
 	log15.Info("Received email", log15.Ctx{"context": "imap", "subject": e.Subject})
 	log15.Info("Normalising recipient lists", log15.Ctx{"context": "imap"})
 	e.NormaliseRecipients()
@@ -204,6 +396,7 @@ func (eng *Engine) ProcessMail(e *Email) (ok bool, err error) {
 	// when this thread goes out of scope it will be garbage collected without
 	// extra effort.
 	L := eng.PrivilegedSandbox()
+	L.SetContext(ctx)
 	err = L.DoFile(eng.Config.DeliverScript)
 	if err != nil {
 		log15.Error("Error loading eventLoop file", log15.Ctx{"context": "lua", "error": err})
@@ -244,42 +437,175 @@ func (eng *Engine) ProcessMail(e *Email) (ok bool, err error) {
 	return true, nil
 }
 
-// Handler is the main loop that handles incoming mail - It satisfies the DeliverFunc
-// interface required by imapclient but is a method attached to a set of rich state
-// objects.
+// Handler is HandleMessage with no deadline, for messages that don't come
+// from a fetch loop, such as quarantine retries. It satisfies the DeliverFunc
+// interface required by imapclient.
 func (eng *Engine) Handler(r io.ReadSeeker, uid uint32, sha1 []byte) error {
+	return eng.HandleMessage(context.Background(), r, uid, sha1)
+}
+
+// handlerFor returns HandleMessage bound to ctx, as a DeliverFunc.
+func (eng *Engine) handlerFor(ctx context.Context) imapclient.DeliverFunc {
+	return func(r io.ReadSeeker, uid uint32, sha1 []byte) error {
+		return eng.HandleMessage(ctx, r, uid, sha1)
+	}
+}
+
+// HandleMessage is the main loop that handles incoming mail, from parsing to
+// relaying. Running eventLoop and sending stop early if ctx ends.
+func (eng *Engine) HandleMessage(ctx context.Context, r io.ReadSeeker, uid uint32, sha1 []byte) error {
+	eng.scripts.Lock()
+	defer eng.scripts.Unlock()
+	return eng.handleMessage(ctx, r, uid, sha1)
+}
+
+// handleMessage is HandleMessage for callers already holding eng.scripts.
+func (eng *Engine) handleMessage(ctx context.Context, r io.ReadSeeker, uid uint32, sha1 []byte) (err error) {
+	timings := eng.metrics.messageArrived()
+	defer eng.finishTimings(timings)
+	defer eng.recordProgress()
+	msgSpan := eng.tracer.startSpan("message")
+	msgSpan.set("imap.uid", strconv.FormatUint(uint64(uid), 10))
+	defer func() { msgSpan.finish(err) }()
+	// A panic in parsing or a Lua binding costs only this message.
+	var luaMail *Email
+	defer func() {
+		if p := recover(); p != nil {
+			err = eng.recoverMessage(p, r, luaMail)
+		}
+	}()
+	if max := eng.maxMessageBytes(); max > 0 {
+		// Fetchers keep no more than max+1 bytes, so this catches those too.
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if size > max {
+			return eng.quarantineOversize(r, size)
+		}
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	parseSpan := msgSpan.child("parse")
+	parseStart := time.Now()
 	thismail, err := email.NewEmailFromReader(r)
+	timings.parse = time.Since(parseStart)
+	parseSpan.finish(err)
 	if err != nil {
 		r.Seek(0, 0)
-		ioutil.ReadAll(r)
 		erroneousBody, err2 := ioutil.ReadAll(r)
 		if err2 != nil {
-			panic("Error getting body from bad email, to report actual error: " + err2.Error())
+			log15.Error("Error rereading email that failed to parse", log15.Ctx{"context": "imap", "error": err2, "parseError": err})
+			return err
 		}
 		log15.Error("Received email but failed to parse", log15.Ctx{"context": "imap", "error": err, "email": string(erroneousBody)})
+		// Keep the raw message, so it can be looked at and retried later.
+		qm, err2 := eng.DB.Quarantine(erroneousBody, err)
+		if err2 != nil {
+			log15.Error("Error quarantining unparseable email", log15.Ctx{"context": "db", "error": err2})
+		} else {
+			log15.Info("Quarantined unparseable email", log15.Ctx{"context": "db", "id": qm.ID})
+		}
+		eng.notifyAdmin("Incoming message could not be parsed", err, erroneousBody)
 		return err
 	}
 	// Check for header indicating this was sent BY the list to itself (common pattern)
-	if thismail.Headers.Get("sent-from-listless") == eng.Config.ListAddress {
-		log15.Info("Received mail with a sent-from-listless header matching own. Ignoring.", log15.Ctx{"context": "imap"})
+	if eng.sentByList(thismail.Headers) {
+		log15.Info("Received mail signed as sent by this list. Ignoring.", log15.Ctx{"context": "imap"})
 		return nil
 	}
 	log15.Info("Received mail addressed to..", log15.Ctx{"context": "imap", "to": strings.Join(thismail.To, ", ")})
-	luaMail := WrapEmail(thismail)
+	luaMail = WrapEmail(thismail)
 	if luaMail == nil || !luaMail.isValid() {
 		log15.Error("Received email but failed to wrap", log15.Ctx{"context": "imap", "error": ErrEmailInvalid, "email": thismail})
 		return ErrEmailInvalid
 	}
+	luaMail.span = msgSpan
+	luaMail.timings = timings
+	msgSpan.set("message.sender", luaMail.Sender)
+	msgSpan.set("message.id", luaMail.GetHeader("Message-Id"))
+	// Decode bodies to UTF-8 using the raw message, as email.NewEmailFromReader
+	// discards the per-part headers that declare charsets.
+	r.Seek(0, 0)
+	if err = luaMail.normaliseBodies(r); err != nil {
+		log15.Error("Error normalising email bodies, using them as parsed", log15.Ctx{"context": "imap", "error": err})
+	}
 	log15.Info("Email about to be processed", log15.Ctx{"context": "imap", "email": luaMail})
-	ok, err := eng.ProcessMail(luaMail)
+	parent := ctx
+	if eng.Config.ProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(eng.Config.ProcessTimeout)*time.Second)
+		defer cancel()
+	}
+	// Running out of time isn't an error of the message's own, and shutting
+	// down isn't running out of time.
+	timedOut := func() bool { return ctx.Err() == context.DeadlineExceeded && parent.Err() == nil }
+	if eng.triggerFromMail(luaMail) {
+		return nil
+	}
+	if handled, err := eng.applySenderPolicy(luaMail); handled {
+		return err
+	}
+	luaSpan := msgSpan.child("eventLoop")
+	luaStart := time.Now()
+	ok, err := eng.ProcessMail(ctx, luaMail)
+	timings.lua = time.Since(luaStart)
+	luaSpan.finish(err)
+	if err != nil && timedOut() {
+		return eng.quarantineTimedOut(r, "eventLoop")
+	}
 	if err != nil {
 		log15.Error("Error calling ProcessMail handler", log15.Ctx{"context": "lua", "error": err})
+		go eng.reportError(reportLua, err, messageContext(luaMail))
+		r.Seek(0, 0)
+		raw, _ := ioutil.ReadAll(r)
+		eng.notifyAdmin("eventLoop failed on incoming message", err, raw)
 		return err
 	}
+	if luaMail.holdReason != "" {
+		return eng.holdMessage(luaMail)
+	}
 	if !ok {
 		log15.Debug("No error occurred, but not sending message on instruction from Lua", log15.Ctx{"context": "smtp"})
+		if err = eng.DB.LogEvent(EventWithheld, luaMail.Sender); err != nil {
+			log15.Error("Error logging withheld message", log15.Ctx{"context": "db", "error": err})
+		}
 		return nil
 	}
+	if err = eng.dispatch(ctx, luaMail); err != nil && timedOut() {
+		return eng.quarantineTimedOut(r, "sending")
+	}
+	return err
+}
+
+// quarantineTimedOut quarantines a message that took longer than
+// ProcessTimeout to handle, and tells the admin. The message then counts as
+// handled, so the fetch loop moves on. A send may have been under way, so
+// retrying it from quarantine could post it twice.
+func (eng *Engine) quarantineTimedOut(r io.ReadSeeker, stage string) error {
+	log15.Error("Gave up on message that took too long", log15.Ctx{"context": "imap", "stage": stage, "timeout": eng.Config.ProcessTimeout})
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	qm, err := eng.DB.Quarantine(raw, ErrProcessTimeout)
+	if err != nil {
+		log15.Error("Error quarantining timed out email", log15.Ctx{"context": "db", "error": err})
+		return err
+	}
+	log15.Info("Quarantined timed out email", log15.Ctx{"context": "db", "id": qm.ID})
+	eng.notifyAdmin("Gave up on incoming message during "+stage, ErrProcessTimeout, raw)
+	return nil
+}
+
+// relay sends a message that eventLoop approved to its recipients, applying
+// the list's sender, anonymity, subject tag, sanitising and archive settings.
+func (eng *Engine) relay(ctx context.Context, luaMail *Email) error {
+	poster := luaMail.Sender
 	// Verify that using the actual sender is OK according to SPF records for
 	// sender Domain, otherwise fall back to list address.
 	newSender := eng.ChooseListSenderEmail(luaMail.Sender)
@@ -287,52 +613,180 @@ func (eng *Engine) Handler(r io.ReadSeeker, uid uint32, sha1 []byte) error {
 		log15.Info("Outgoing email sender changed for SPF policy", log15.Ctx{"context": "smtp", "original": luaMail.Sender, "new": newSender})
 	}
 	luaMail.Email.From = newSender
+	if eng.Config.AnonymousPosting {
+		if err := eng.anonymise(luaMail); err != nil {
+			log15.Error("Error anonymising email", log15.Ctx{"context": "smtp", "error": err})
+			return err
+		}
+	}
+	// A message tagged by this list before keeps its subject as it was, unless
+	// the tag has since been lost.
+	tagged := luaMail.hasApplied(eng.Config.ListAddress, appliedTag) && luaMail.HasSubjectTag(eng.Config.SubjectTag)
+	if eng.Config.SubjectTag != "" && !tagged {
+		luaMail.NormaliseSubject(eng.Config.SubjectTag)
+		luaMail.markApplied(eng.Config.ListAddress, appliedTag)
+	}
+	if eng.Config.TrimQuotes >= 0 {
+		luaMail.TrimQuotes(eng.Config.TrimQuotes)
+	}
+	// Strip hazardous HTML according to the configured policy level.
+	err := luaMail.SanitiseHTML(eng.Config.HTMLSanitisePolicy)
+	if err != nil {
+		log15.Error("Error sanitising HTML part of outgoing email", log15.Ctx{"context": "smtp", "error": err})
+		return err
+	}
+	// Sign the message as sent by Listless, in case it loops around somehow
+	// (some lists retain the "To: <list@address.com>" header unchanged). This
+	// also gives it a Message-Id, which a retry is archived under again.
+	if err = eng.markSent(luaMail); err != nil {
+		return err
+	}
+	var entry *ArchivedMessage
+	if eng.Config.Archive {
+		entry, err = eng.archiveOutgoing(luaMail)
+		if err != nil {
+			log15.Error("Error archiving outgoing email", log15.Ctx{"context": "db", "error": err})
+			return err
+		}
+		log15.Info("Archived outgoing email", log15.Ctx{"context": "db", "id": entry.ID, "permalink": eng.ArchivePermalink(entry)})
+	}
 	log15.Info("Outgoing email", log15.Ctx{"context": "smtp", "subject": luaMail.Subject})
-	// Set header to indicate that this was sent by Listless, in case it loops around
-	// somehow (some lists retain the "To: <list@address.com>" header unchanged).
-	luaMail.Headers.Set("sent-from-listless", eng.Config.ListAddress)
-	auth := smtp.PlainAuth("", eng.Config.SMTPUsername, eng.Config.SMTPPassword, eng.Config.SMTPHost)
-	//auth := smtp.PlainAuth(eng.Config.SMTPUsername, eng.Config.SMTPUsername, eng.Config.SMTPPassword, eng.Config.SMTPHost)
-	// Patched to allow excluding of variadic emails added after auth.
-	err = luaMail.Send(eng.Config.smtpAddr, auth, eng.Config.ListAddress)
+	if err = eng.relayPace.wait(ctx); err != nil {
+		return err
+	}
+	// Exclude the list address to avoid sending the message back to ourselves.
+	err = eng.deliver(ctx, luaMail, eng.Config.ListAddress)
 	if err != nil {
-		log15.Error("Error sending message by SMTP", log15.Ctx{"context": "smtp", "error": err})
+		log15.Error("Error sending message", log15.Ctx{"context": "smtp", "error": err, "transport": eng.Config.Transport})
 		return err
 	}
 	log15.Info("Sent message successfully", log15.Ctx{"context": "smtp", "subject": luaMail.Subject})
+	if err = eng.DB.RecordPost(poster); err != nil {
+		log15.Error("Error recording member activity", log15.Ctx{"context": "db", "sender": poster, "error": err})
+	}
+	eng.afterRelay(luaMail, entry)
 	return nil
 }
 
+// smtpAuth returns the authentication used for the configured SMTP relay:
+// XOAUTH2 if OAuth is configured, or PLAIN with SMTPPassword otherwise.
+func (eng *Engine) smtpAuth() smtp.Auth {
+	if eng.oauthTokens != nil {
+		return &xoauth2Auth{username: eng.Config.SMTPUsername, tokens: eng.oauthTokens}
+	}
+	return smtp.PlainAuth("", eng.Config.SMTPUsername, eng.Config.SMTPPassword, eng.Config.SMTPHost)
+}
+
+// sendToList submits a new message to the list address, so that it
+// arrives in the INBOX and passes through eventLoop like any other post.
+func (eng *Engine) sendToList(from, subject, text string, headers map[string]string) error {
+	e := email.NewEmail()
+	e.From = from
+	e.Subject = subject
+	e.Text = []byte(text)
+	for k, v := range headers {
+		e.Headers.Set(k, v)
+	}
+	em := WrapEmail(e)
+	em.AddToRecipient(eng.Config.ListAddress)
+	return eng.deliver(context.Background(), em)
+}
+
+// notifyAdmin mails AdminAddress, if set, about a failure to handle an incoming
+// message, attaching the original. Failures to notify are only logged.
+func (eng *Engine) notifyAdmin(summary string, failure error, raw []byte) {
+	if eng.Config.AdminAddress == "" {
+		return
+	}
+	e := email.NewEmail()
+	e.From = eng.fromAddress("alerts")
+	e.To = []string{eng.Config.AdminAddress}
+	e.Subject = "[listless] " + summary + " on " + eng.Config.ListAddress
+	e.Text = []byte(summary + " on " + eng.Config.ListAddress + ".\n\n" +
+		"Error: " + failure.Error() + "\n\n" +
+		"The original message is attached.\n")
+	if _, err := e.Attach(bytes.NewReader(raw), "original.eml", "message/rfc822"); err != nil {
+		log15.Error("Error attaching message to admin notification", log15.Ctx{"context": "smtp", "error": err})
+	}
+	em := WrapEmail(e)
+	if err := eng.markSent(em); err != nil {
+		log15.Error("Error signing admin notification", log15.Ctx{"context": "smtp", "error": err})
+		return
+	}
+	if err := eng.deliver(context.Background(), em); err != nil {
+		log15.Error("Error notifying admin of failure", log15.Ctx{"context": "smtp", "admin": eng.Config.AdminAddress, "error": err})
+	}
+}
+
+// afterRelay mirrors a successfully relayed message to any configured external
+// services. entry is nil unless the archive is enabled. Mirroring happens in
+// the background and never holds up the delivery loop.
+func (eng *Engine) afterRelay(em *Email, entry *ArchivedMessage) {
+	if eng.Config.MatrixRoomID != "" && em.GetHeader(matrixEventHeader) == "" {
+		go eng.mirrorToMatrix(em, entry)
+	}
+	if len(eng.Config.Webhooks) > 0 {
+		go eng.mirrorToWebhooks(em, entry)
+	}
+	if eng.Config.ActivityPub && entry != nil {
+		go eng.publishToFediverse(entry)
+	}
+}
+
 // DeliveryLoop is the poll loop for listless, mostly lifted from imapclient.
-func (eng *Engine) DeliveryLoop(c imapclient.Client, inbox, pattern string, deliver imapclient.DeliverFunc, outbox, errbox string, closeCh <-chan struct{}) {
+// It runs until ctx ends.
+func (eng *Engine) DeliveryLoop(ctx context.Context, c imapclient.Client, inbox, pattern string, deliver imapclient.DeliverFunc, outbox, errbox string) {
 	if inbox == "" {
 		inbox = "INBOX"
 	}
+	backoff := newPollBackoff(eng.Config)
 	for {
-		n, err := imapclient.DeliverOne(c, inbox, pattern, deliver, outbox, errbox)
+		pollSpan := eng.tracer.startSpan("imap.poll")
+		eng.metrics.beginCycle()
+		n, err := imapDeliverBatch(ctx, c, inbox, pattern, deliver, outbox, errbox, eng.Config.IMAPBatchSize, eng.newSpool())
+		eng.logCycleTimings("imap")
+		pollSpan.set("imap.delivered", strconv.Itoa(n))
+		pollSpan.finish(err)
+		eng.recordIMAPResult(err)
+		eng.recordFetchResult(err)
 		if err != nil {
 			log15.Error("Error during DeliveryLoop cycle", log15.Ctx{"context": "imap", "deliveries": n, "error": err})
 		} else {
 			log15.Info("DeliveryLoop complete", log15.Ctx{"context": "imap", "delivered": n})
 		}
-		select {
-		case _, ok := <-closeCh:
-			if !ok { //channel is closed
-				return
-			}
-		default:
-		}
-
+		var wait time.Duration
 		if err != nil {
-			<-time.After(time.Duration(eng.Config.PollFrequency) * time.Second)
-			continue
-		}
-		if n > 0 {
-			<-time.After(time.Duration(eng.Config.MessageFrequency) * time.Second)
+			wait = backoff.failed()
 		} else {
-			<-time.After(time.Duration(eng.Config.PollFrequency) * time.Second)
+			wait = backoff.next(n > 0)
+			if eng.Config.IMAPBatchSize > 0 && n >= eng.Config.IMAPBatchSize {
+				// A full batch; there may be more waiting.
+				wait = 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
 		}
-		continue
+	}
+}
+
+// Run receives mail with the configured Fetcher, passing each message to
+// HandleMessage, until the Engine is closed.
+func (eng *Engine) Run() {
+	ctx := eng.ctx
+	handler := eng.handlerFor(ctx)
+	switch eng.Config.Fetcher {
+	case "jmap":
+		eng.JMAPDeliveryLoop(ctx, handler)
+	case "pop3":
+		eng.POP3DeliveryLoop(ctx, handler)
+	case "fake":
+		eng.FakeDeliveryLoop(ctx, handler)
+	default:
+		inbox, done, errbox := eng.imapFolders()
+		eng.DeliveryLoop(ctx, eng.Client, inbox, eng.Config.IMAPSearchSubject, eng.withIMAPCriteria(handler), done, errbox)
 	}
 }
 
@@ -340,9 +794,40 @@ func (eng *Engine) DeliveryLoop(c imapclient.Client, inbox, pattern string, deli
 // Inject the database into the runtime, and execute the given string as exec Script.
 // Can later add helper functions for Exec mode, like a CSV parser to mass-add
 // list subscribers.
-func (eng *Engine) ExecOnce(script string) error {
-	L := eng.Lua.NewThread()
-	L.SetGlobal("config", luar.New(L, eng.Config))
-	L.SetGlobal("database", luar.New(L, eng.DB))
+// The script's command line arguments are given as the args table, and stdin,
+// if it was read, as the stdin string.
+// sandbox may be "privileged" or "moderator" to run the script with only what
+// eventLoop or ModeratorSandbox scripts are given, instead of the full database.
+func (eng *Engine) ExecOnce(script, sandbox string, args []string, stdin []byte) error {
+	// The ChangeScript may run meanwhile, also on Lua.
+	eng.scripts.Lock()
+	defer eng.scripts.Unlock()
+	var L *lua.LState
+	if sandbox == "" {
+		L = eng.Lua.NewThread()
+		L.SetGlobal("config", luar.New(L, eng.Config))
+		L.SetGlobal("database", luar.New(L, eng.DB))
+		eng.setMailGlobals(L)
+	} else {
+		var (
+			done func()
+			err  error
+		)
+		if L, done, err = eng.sandbox(sandbox); err != nil {
+			return err
+		}
+		defer done()
+	}
+	argsT := L.NewTable()
+	for _, arg := range args {
+		argsT.Append(lua.LString(arg))
+	}
+	L.SetGlobal("args", argsT)
+	if stdin != nil {
+		L.SetGlobal("stdin", lua.LString(stdin))
+	}
+	if eng.fake != nil {
+		L.SetGlobal("fakemail", eng.fakemailModule(L))
+	}
 	return L.DoString(script)
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrBadSentryDSN - Returned when SentryDSN isn't of the form
+// https://key@host/project.
+var ErrBadSentryDSN = errors.New("SentryDSN should look like https://key@sentry.example.com/42")
+
+// Kinds of reported error.
+const (
+	reportPanic    = "panic"
+	reportLua      = "lua"
+	reportDelivery = "delivery"
+)
+
+// sentryDSN is a parsed Sentry DSN: where to send events, and the key to
+// send them with.
+type sentryDSN struct {
+	storeURL string
+	key      string
+}
+
+func parseSentryDSN(dsn string) (*sentryDSN, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, ErrBadSentryDSN
+	}
+	path := strings.Trim(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return nil, ErrBadSentryDSN
+	}
+	prefix := ""
+	if slash >= 0 {
+		prefix = "/" + path[:slash]
+	}
+	return &sentryDSN{
+		storeURL: u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/store/",
+		key:      u.User.Username(),
+	}, nil
+}
+
+// ErrorReport is what's sent to ErrorWebhook, and the basis of Sentry events.
+type ErrorReport struct {
+	List    string
+	Kind    string
+	Error   string
+	Time    time.Time
+	Context map[string]string
+}
+
+// messageContext describes a message for error reports.
+func messageContext(em *Email) map[string]string {
+	if em == nil || em.Email == nil {
+		return map[string]string{}
+	}
+	return map[string]string{
+		"sender":     em.Sender,
+		"subject":    em.Subject,
+		"message_id": em.GetHeader("Message-Id"),
+	}
+}
+
+// reportError sends an error to Sentry and/or ErrorWebhook, if configured.
+// Failures to report are only logged.
+func (eng *Engine) reportError(kind string, failure error, context map[string]string) {
+	if eng.sentry == nil && eng.Config.ErrorWebhook == "" {
+		return
+	}
+	report := &ErrorReport{
+		List:    eng.Config.ListAddress,
+		Kind:    kind,
+		Error:   failure.Error(),
+		Time:    time.Now().UTC(),
+		Context: context,
+	}
+	if eng.sentry != nil {
+		if err := eng.sendToSentry(report); err != nil {
+			log15.Error("Error reporting to Sentry", log15.Ctx{"context": "report", "error": err})
+		}
+	}
+	if eng.Config.ErrorWebhook != "" {
+		body, err := json.Marshal(report)
+		if err == nil {
+			err = postJSON(eng.Config.ErrorWebhook, body, nil)
+		}
+		if err != nil {
+			log15.Error("Error reporting to ErrorWebhook", log15.Ctx{"context": "report", "error": err})
+		}
+	}
+}
+
+// sendToSentry posts a report to Sentry's store API as an event.
+func (eng *Engine) sendToSentry(report *ErrorReport) error {
+	eventID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	level := "error"
+	if report.Kind == reportPanic {
+		level = "fatal"
+	}
+	event := map[string]interface{}{
+		"event_id":  eventID,
+		"timestamp": report.Time.Format("2006-01-02T15:04:05"),
+		"level":     level,
+		"logger":    "listless",
+		"platform":  "go",
+		"message":   report.Error,
+		"tags":      map[string]string{"list": report.List, "kind": report.Kind},
+		"extra":     report.Context,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	auth := "Sentry sentry_version=7, sentry_client=listless/1.0, sentry_key=" + eng.sentry.key
+	return postJSON(eng.sentry.storeURL, body, map[string]string{"X-Sentry-Auth": auth})
+}
+
+// postJSON posts a JSON body, failing on non-2xx responses.
+func postJSON(target string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkAPIResponse(resp)
+}
+
+// recoverMessage deals with a panic recovered while handling a message: raw
+// is the message as received, and em the message as wrapped, if it got that
+// far. The panic is logged and reported with its stack, and the message is
+// quarantined, so that the list can carry on with the next one.
+func (eng *Engine) recoverMessage(p interface{}, raw io.ReadSeeker, em *Email) error {
+	err := fmt.Errorf("panic: %v", p)
+	details := messageContext(em)
+	details["stack"] = string(debug.Stack())
+	logCtx := log15.Ctx{"context": "imap", "error": err}
+	for k, v := range details {
+		logCtx[k] = v
+	}
+	log15.Crit("Panic while handling message", logCtx)
+	eng.reportError(reportPanic, err, details)
+	if _, serr := raw.Seek(0, io.SeekStart); serr != nil {
+		log15.Error("Error rereading message that caused panic", log15.Ctx{"context": "imap", "error": serr})
+		return err
+	}
+	rawb, rerr := ioutil.ReadAll(raw)
+	if rerr != nil {
+		log15.Error("Error rereading message that caused panic", log15.Ctx{"context": "imap", "error": rerr})
+		return err
+	}
+	if qm, qerr := eng.DB.Quarantine(rawb, err); qerr != nil {
+		log15.Error("Error quarantining message that caused panic", log15.Ctx{"context": "db", "error": qerr})
+	} else {
+		log15.Info("Quarantined message that caused panic", log15.Ctx{"context": "db", "id": qm.ID})
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSentryDSN(t *testing.T) {
+	dsn, err := parseSentryDSN("https://abc123@sentry.example.com/42")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sentry.example.com/api/42/store/", dsn.storeURL)
+	assert.Equal(t, "abc123", dsn.key)
+	dsn, err = parseSentryDSN("https://abc123@example.com/sentry/7")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/sentry/api/7/store/", dsn.storeURL)
+	_, err = parseSentryDSN("https://sentry.example.com/42")
+	assert.Equal(t, ErrBadSentryDSN, err)
+	_, err = parseSentryDSN("https://abc123@sentry.example.com/")
+	assert.Equal(t, ErrBadSentryDSN, err)
+}
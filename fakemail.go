@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/imapclient"
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// fakeSentMessage is a message handed to the "fake" Transport.
+type fakeSentMessage struct {
+	From string
+	To   []string
+	Raw  []byte
+}
+
+// fakeOutbox keeps what was sent with the "fake" Transport, for exec scripts
+// and tests to check, and optionally writes each message to FakeOutbox.
+type fakeOutbox struct {
+	mu   sync.Mutex
+	dir  string
+	sent []fakeSentMessage
+}
+
+func (fo *fakeOutbox) send(from string, to []string, raw []byte) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	fo.sent = append(fo.sent, fakeSentMessage{From: from, To: to, Raw: raw})
+	log15.Info("Fake transport accepted message", log15.Ctx{"context": "smtp", "from": from, "recipients": len(to)})
+	if fo.dir == "" {
+		return nil
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + ".eml"
+	return ioutil.WriteFile(filepath.Join(fo.dir, name), raw, 0600)
+}
+
+// messages returns a copy of everything sent so far.
+func (fo *fakeOutbox) messages() []fakeSentMessage {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	return append([]fakeSentMessage(nil), fo.sent...)
+}
+
+func (fo *fakeOutbox) clear() {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	fo.sent = nil
+}
+
+// fakeDeliverAll hands each .eml file in FakeInbox to deliver, oldest name
+// first, then moves it into the "done" or "error" subfolder. If ctx ends, the
+// rest are left for next time.
+func (eng *Engine) fakeDeliverAll(ctx context.Context, deliver imapclient.DeliverFunc) (n int, err error) {
+	dir := eng.Config.FakeInbox
+	for _, sub := range []string{"done", "error"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return 0, err
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if ctx.Err() != nil {
+			return n, nil
+		}
+		raw, err := ioutil.ReadFile(name)
+		if err != nil {
+			return n, err
+		}
+		dest := "done"
+		if err = deliver(bytes.NewReader(raw), uint32(i+1), nil); err != nil {
+			log15.Error("Error handling fake inbox message", log15.Ctx{"context": "fake", "file": name, "error": err})
+			dest = "error"
+		} else {
+			n++
+		}
+		if err = os.Rename(name, filepath.Join(dir, dest, filepath.Base(name))); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// FakeDeliveryLoop is the "fake" Fetcher: it polls FakeInbox for .eml files
+// instead of a mail server, until ctx ends.
+func (eng *Engine) FakeDeliveryLoop(ctx context.Context, deliver imapclient.DeliverFunc) {
+	for {
+		n, err := eng.fakeDeliverAll(ctx, deliver)
+		eng.recordFetchResult(err)
+		if err != nil {
+			log15.Error("Error during fake inbox cycle", log15.Ctx{"context": "fake", "deliveries": n, "error": err})
+		} else {
+			log15.Info("Fake inbox cycle complete", log15.Ctx{"context": "fake", "delivered": n})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(eng.Config.PollFrequency) * time.Second):
+		}
+	}
+}
+
+// fakemailModule returns the "fakemail" table given to exec scripts when the
+// "fake" Transport is used:
+// * fakemail.receive(raw) passes a raw message through Handler as if it had
+//     just arrived, returning an error string or nil.
+// * fakemail.sent() returns what has been sent, as a list of tables with
+//     from, to (a list) and raw fields.
+// * fakemail.clear() forgets what has been sent.
+func (eng *Engine) fakemailModule(L *lua.LState) *lua.LTable {
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"receive": func(L *lua.LState) int {
+			raw := L.CheckString(1)
+			// The exec script already holds eng.scripts.
+			if err := eng.handleMessage(context.Background(), strings.NewReader(raw), 0, nil); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			L.Push(lua.LNil)
+			return 1
+		},
+		"sent": func(L *lua.LState) int {
+			list := L.NewTable()
+			for _, msg := range eng.fake.messages() {
+				to := L.NewTable()
+				for _, addr := range msg.To {
+					to.Append(lua.LString(addr))
+				}
+				entry := L.NewTable()
+				entry.RawSetString("from", lua.LString(msg.From))
+				entry.RawSetString("to", to)
+				entry.RawSetString("raw", lua.LString(msg.Raw))
+				list.Append(entry)
+			}
+			L.Push(list)
+			return 1
+		},
+		"clear": func(L *lua.LState) int {
+			eng.fake.clear()
+			return 0
+		},
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// fakeSMTP is a minimal SMTP server which accepts any login and any message,
+// keeping a count of what it was sent. It stands in for a real relay when
+// benchmarking.
+type fakeSMTP struct {
+	listener   net.Listener
+	mu         sync.Mutex
+	messages   int
+	recipients int
+	bytes      int
+}
+
+// newFakeSMTP starts a fakeSMTP on a free local port.
+func newFakeSMTP() (*fakeSMTP, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	fs := &fakeSMTP{listener: l}
+	go fs.serve()
+	return fs, nil
+}
+
+// Addr returns the host:port the server is listening on.
+func (fs *fakeSMTP) Addr() string {
+	return fs.listener.Addr().String()
+}
+
+// Close stops the server.
+func (fs *fakeSMTP) Close() error {
+	return fs.listener.Close()
+}
+
+func (fs *fakeSMTP) serve() {
+	for {
+		c, err := fs.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fs.serveConn(c)
+	}
+}
+
+func (fs *fakeSMTP) serveConn(c net.Conn) {
+	defer c.Close()
+	tp := textproto.NewConn(c)
+	tp.PrintfLine("220 listless fake SMTP ready")
+	recipients := 0
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			tp.PrintfLine("250-listless\r\n250-AUTH PLAIN LOGIN\r\n250 8BITMIME")
+		case "HELO", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "AUTH":
+			tp.PrintfLine("235 Authenticated")
+		case "MAIL":
+			recipients = 0
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			recipients++
+			tp.PrintfLine("250 OK")
+		case "RSET":
+			recipients = 0
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			body, err := tp.ReadDotBytes()
+			if err != nil {
+				log15.Error("Fake SMTP server failed reading message", log15.Ctx{"context": "smtp", "error": err})
+				return
+			}
+			fs.mu.Lock()
+			fs.messages++
+			fs.recipients += recipients
+			fs.bytes += len(body)
+			fs.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// counts returns how many messages, recipients and bytes have been sent.
+func (fs *fakeSMTP) counts() (messages, recipients, size int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.messages, fs.recipients, fs.bytes
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Length, in characters, of the excerpt used in feeds when FeedFullBody is false.
+const feedExcerptLength = 280
+
+// ErrBadFeedItems - Returned when FeedItems is negative.
+var ErrBadFeedItems = errors.New("FeedItems can't be negative")
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link,omitempty"`
+	GUID        string `xml:"guid"`
+	Author      string `xml:"author,omitempty"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    *atomLink   `xml:"link,omitempty"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Link    *atomLink  `xml:"link,omitempty"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Summary string     `xml:"summary,omitempty"`
+	Content string     `xml:"content,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// feedAuthor prefers the display name of a post's author over their address.
+func feedAuthor(entry *ArchivedMessage) string {
+	if parsed, err := mail.ParseAddress(entry.From); err == nil && parsed.Name != "" {
+		return parsed.Name
+	}
+	return entry.Sender
+}
+
+// feedBody returns the full text or an excerpt, per FeedFullBody.
+func (eng *Engine) feedBody(entry *ArchivedMessage) string {
+	body := []rune(entry.Text)
+	if eng.Config.FeedFullBody || len(body) <= feedExcerptLength {
+		return string(body)
+	}
+	return string(body[:feedExcerptLength]) + "…"
+}
+
+// feedEntries fetches the archive entries to include in a feed, writing an
+// error response and returning nil if they can't be fetched.
+func (eng *Engine) feedEntries(w http.ResponseWriter) []*ArchivedMessage {
+	entries, err := eng.DB.RecentArchivedMessages(eng.Config.FeedItems)
+	if err != nil {
+		log15.Error("Error fetching archive entries for feed", log15.Ctx{"context": "http", "error": err})
+		http.Error(w, "Error fetching archive", http.StatusInternalServerError)
+		return nil
+	}
+	for i, entry := range entries {
+		entries[i] = eng.publicEntry(entry)
+	}
+	return entries
+}
+
+func (eng *Engine) serveRSSFeed(w http.ResponseWriter, r *http.Request) {
+	entries := eng.feedEntries(w)
+	if entries == nil {
+		return
+	}
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       eng.Config.ListAddress,
+			Link:        eng.Config.ArchiveURL,
+			Description: "Recent posts to " + eng.Config.ListAddress,
+		},
+	}
+	for _, entry := range entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       entry.Subject,
+			Link:        eng.ArchivePermalink(entry),
+			GUID:        eng.Config.ListAddress + "/" + entry.ID,
+			Author:      feedAuthor(entry),
+			PubDate:     entry.Date.Format(time.RFC1123Z),
+			Description: eng.feedBody(entry),
+		})
+	}
+	eng.writeFeed(w, "application/rss+xml", feed)
+}
+
+func (eng *Engine) serveAtomFeed(w http.ResponseWriter, r *http.Request) {
+	entries := eng.feedEntries(w)
+	if entries == nil {
+		return
+	}
+	feed := atomFeed{
+		Title:   eng.Config.ListAddress,
+		ID:      "mailto:" + eng.Config.ListAddress,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if eng.Config.ArchiveURL != "" {
+		feed.Link = &atomLink{Href: eng.Config.ArchiveURL}
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].Date.Format(time.RFC3339)
+	}
+	for _, entry := range entries {
+		aentry := atomEntry{
+			Title:   entry.Subject,
+			ID:      "mailto:" + eng.Config.ListAddress + "?archive=" + entry.ID,
+			Updated: entry.Date.Format(time.RFC3339),
+			Author:  atomAuthor{Name: feedAuthor(entry)},
+		}
+		if permalink := eng.ArchivePermalink(entry); permalink != "" {
+			aentry.Link = &atomLink{Href: permalink}
+		}
+		if eng.Config.FeedFullBody {
+			aentry.Content = eng.feedBody(entry)
+		} else {
+			aentry.Summary = eng.feedBody(entry)
+		}
+		feed.Entries = append(feed.Entries, aentry)
+	}
+	eng.writeFeed(w, "application/atom+xml", feed)
+}
+
+func (eng *Engine) writeFeed(w http.ResponseWriter, contentType string, feed interface{}) {
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log15.Error("Error rendering feed", log15.Ctx{"context": "http", "error": err})
+		http.Error(w, "Error rendering feed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fetchHealth tracks whether the fetch loop is getting mail, for the
+// /healthz endpoint a container's health check polls. Like alerter, its
+// methods take the current time.
+type fetchHealth struct {
+	mu      sync.Mutex
+	started time.Time
+	// When a fetch cycle last succeeded or a message was last handled.
+	lastGood time.Time
+	lastErr  error
+}
+
+func newFetchHealth(now time.Time) *fetchHealth {
+	return &fetchHealth{started: now}
+}
+
+// cycleDone records the outcome of a fetch cycle.
+func (h *fetchHealth) cycleDone(err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = err
+	if err == nil {
+		h.lastGood = now
+	}
+}
+
+// progress records that a message was handled, so a long batch doesn't
+// look like a stalled loop.
+func (h *fetchHealth) progress(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastGood = now
+}
+
+// problem returns why the list is unhealthy, or "" if it isn't. Fetching
+// must have failed, or stalled, for longer than stale: one failed poll is
+// only a blip.
+func (h *fetchHealth) problem(stale time.Duration, now time.Time) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since := h.lastGood
+	if since.IsZero() {
+		since = h.started
+	}
+	if now.Sub(since) < stale {
+		return ""
+	}
+	if h.lastErr != nil {
+		return "fetching mail has failed since " + since.Format(time.RFC3339) + ": " + h.lastErr.Error()
+	}
+	return "no fetch cycle has finished since " + since.Format(time.RFC3339)
+}
+
+// healthStaleAfter is how long fetching may fail or stall before /healthz
+// reports it: a few polls, and a message's ProcessTimeout.
+func (eng *Engine) healthStaleAfter() time.Duration {
+	return time.Duration(3*eng.Config.PollFrequency+eng.Config.ProcessTimeout) * time.Second
+}
+
+// recordFetchResult feeds a fetch cycle's outcome to the health check.
+func (eng *Engine) recordFetchResult(err error) {
+	eng.health.cycleDone(err, time.Now())
+}
+
+// recordProgress tells the health check a message was handled.
+func (eng *Engine) recordProgress() {
+	eng.health.progress(time.Now())
+}
+
+// serveHealth answers 200 while the list is fetching mail, and 503 with the
+// reason otherwise, for container health checks and load balancers.
+func (eng *Engine) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if problem := eng.health.problem(eng.healthStaleAfter(), time.Now()); problem != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(problem + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
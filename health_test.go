@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchHealth(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stale := 5 * time.Minute
+	h := newFetchHealth(start)
+	assert.Equal(t, "", h.problem(stale, start.Add(time.Minute)))
+	assert.Contains(t, h.problem(stale, start.Add(10*time.Minute)), "no fetch cycle")
+
+	h.cycleDone(nil, start.Add(6*time.Minute))
+	h.cycleDone(errors.New("connection refused"), start.Add(7*time.Minute))
+	assert.Equal(t, "", h.problem(stale, start.Add(8*time.Minute)), "one failed poll is a blip")
+	assert.Contains(t, h.problem(stale, start.Add(12*time.Minute)), "connection refused")
+
+	h.progress(start.Add(11 * time.Minute))
+	assert.Equal(t, "", h.problem(stale, start.Add(12*time.Minute)))
+}
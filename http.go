@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// HTTPHandler returns the handler for listless's built-in HTTP server.
+func (eng *Engine) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.atom", eng.serveAtomFeed)
+	mux.HandleFunc("/feed.rss", eng.serveRSSFeed)
+	mux.HandleFunc("/moderation/", eng.serveModeration)
+	mux.HandleFunc("/healthz", eng.serveHealth)
+	if eng.Config.ActivityPub {
+		mux.HandleFunc("/.well-known/webfinger", eng.serveWebfinger)
+		mux.HandleFunc("/ap/actor", eng.serveActor)
+		mux.HandleFunc("/ap/inbox", eng.serveInbox)
+		mux.HandleFunc("/ap/outbox", eng.serveOutbox)
+		mux.HandleFunc("/ap/followers", eng.serveFollowers)
+		mux.HandleFunc("/ap/notes/", eng.serveNote)
+	}
+	if eng.Config.SESNotificationToken != "" {
+		mux.HandleFunc("/ses/notifications", eng.serveSESNotifications)
+	}
+	if eng.Config.SCIMToken != "" {
+		mux.HandleFunc("/scim/v2/Users", eng.serveSCIMUsers)
+		mux.HandleFunc("/scim/v2/Users/", eng.serveSCIMUsers)
+	}
+	return mux
+}
+
+// ListenAndServe runs the built-in HTTP server on the configured HTTPAddress.
+// This blocks, so is usually called in a goroutine alongside DeliveryLoop.
+func (eng *Engine) ListenAndServe() error {
+	log15.Info("Starting HTTP server", log15.Ctx{"context": "http", "address": eng.Config.HTTPAddress})
+	return http.ListenAndServe(eng.Config.HTTPAddress, eng.HTTPHandler())
+}
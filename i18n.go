@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// ErrUnknownNotice - Returned when no template is found for a notice.
+var ErrUnknownNotice = errors.New("No template for that notice")
+
+// builtinNotices are the templates for the list's own notices, by language
+// and then "<notice>.subject" or "<notice>.body". TemplateDir can override or
+// add to them. Every notice is given .List, the list address.
+var builtinNotices = map[string]map[string]string{
+	"en": {
+		"moderation.subject": "Held for moderation: {{.Subject}}",
+		"moderation.body": `A message to {{.List}} was held for moderation.
+
+From: {{.Sender}}
+Subject: {{.Subject}}
+Reason: {{.Reason}}
+Approvals: {{.Approvals}} of {{.Quorum}} needed
+
+To release or reject it, visit:
+{{.Link}}
+
+This link is for you alone, and expires at {{.Expires}}.
+`,
+		"welcome.subject": "Welcome to {{.List}}",
+		"welcome.body": `Hello{{if .Name}} {{.Name}}{{end}},
+
+You are now subscribed to {{.List}}. To post to the list, write to {{.List}}.
+`,
+		"confirm.subject": "Please confirm: {{.Token}}",
+		"confirm.body": `Someone, hopefully you, asked to {{.Action}} {{.Email}} on {{.List}}.
+
+To confirm, reply to this message without changing the subject.
+If it wasn't you, ignore this message and nothing will change.
+`,
+		"rejected.subject": "Not delivered: {{.Subject}}",
+		"rejected.body": `Your message to {{.List}} was not delivered, as only members may post to it.
+
+Subject: {{.Subject}}
+`,
+		"held.subject": "Awaiting approval: {{.Subject}}",
+		"held.body": `Your message to {{.List}} was held for a moderator's approval, as you are not a member allowed to post to it.
+
+Subject: {{.Subject}}
+
+If it is approved, it will be sent to the list.
+`,
+	},
+	"fr": {
+		"moderation.subject": "En attente de modération : {{.Subject}}",
+		"moderation.body": `Un message envoyé à {{.List}} est en attente de modération.
+
+De : {{.Sender}}
+Objet : {{.Subject}}
+Motif : {{.Reason}}
+Approbations : {{.Approvals}} sur {{.Quorum}} requises
+
+Pour le publier ou le rejeter, rendez-vous sur :
+{{.Link}}
+
+Ce lien vous est personnel et expire le {{.Expires}}.
+`,
+		"welcome.subject": "Bienvenue sur {{.List}}",
+		"welcome.body": `Bonjour{{if .Name}} {{.Name}}{{end}},
+
+Vous êtes maintenant abonné(e) à {{.List}}. Pour écrire à la liste, envoyez un message à {{.List}}.
+`,
+		"confirm.subject": "Merci de confirmer : {{.Token}}",
+		"confirm.body": `Quelqu'un, vous sans doute, a demandé l'action « {{.Action}} » pour {{.Email}} sur {{.List}}.
+
+Pour confirmer, répondez à ce message sans modifier son objet.
+Si ce n'était pas vous, ignorez ce message et rien ne changera.
+`,
+		"rejected.subject": "Non distribué : {{.Subject}}",
+		"rejected.body": `Votre message à {{.List}} n'a pas été distribué, car seuls les membres peuvent y écrire.
+
+Objet : {{.Subject}}
+`,
+		"held.subject": "En attente d'approbation : {{.Subject}}",
+		"held.body": `Votre message à {{.List}} est en attente d'approbation par un modérateur, car vous n'êtes pas un membre autorisé à y écrire.
+
+Objet : {{.Subject}}
+
+S'il est approuvé, il sera envoyé à la liste.
+`,
+	},
+	"de": {
+		"moderation.subject": "Zur Moderation zurückgehalten: {{.Subject}}",
+		"moderation.body": `Eine Nachricht an {{.List}} wurde zur Moderation zurückgehalten.
+
+Von: {{.Sender}}
+Betreff: {{.Subject}}
+Grund: {{.Reason}}
+Freigaben: {{.Approvals}} von {{.Quorum}} benötigt
+
+Zum Freigeben oder Ablehnen besuchen Sie:
+{{.Link}}
+
+Dieser Link gilt nur für Sie und läuft am {{.Expires}} ab.
+`,
+		"welcome.subject": "Willkommen bei {{.List}}",
+		"welcome.body": `Hallo{{if .Name}} {{.Name}}{{end}},
+
+Sie sind jetzt bei {{.List}} angemeldet. Um an die Liste zu schreiben, senden Sie eine Nachricht an {{.List}}.
+`,
+		"confirm.subject": "Bitte bestätigen: {{.Token}}",
+		"confirm.body": `Jemand, hoffentlich Sie, hat die Aktion „{{.Action}}“ für {{.Email}} bei {{.List}} angefordert.
+
+Zum Bestätigen antworten Sie auf diese Nachricht, ohne den Betreff zu ändern.
+Falls Sie das nicht waren, ignorieren Sie diese Nachricht einfach.
+`,
+		"rejected.subject": "Nicht zugestellt: {{.Subject}}",
+		"rejected.body": `Ihre Nachricht an {{.List}} wurde nicht zugestellt, da nur Mitglieder an die Liste schreiben dürfen.
+
+Betreff: {{.Subject}}
+`,
+		"held.subject": "Wartet auf Freigabe: {{.Subject}}",
+		"held.body": `Ihre Nachricht an {{.List}} wartet auf die Freigabe durch einen Moderator, da Sie kein Mitglied mit Schreibrecht sind.
+
+Betreff: {{.Subject}}
+
+Wird sie freigegeben, geht sie an die Liste.
+`,
+	},
+}
+
+// noticeLanguages returns the languages to try for a notice to recipient:
+// their own Language, if a member with one, then the list's, then English.
+func (eng *Engine) noticeLanguages(recipient string) []string {
+	var langs []string
+	seen := make(map[string]bool)
+	add := func(lang string) {
+		if lang != "" && !seen[lang] {
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+	if recipient != "" {
+		if member, err := eng.DB.GetSubscriber(recipient); err == nil && member != nil {
+			add(member.Language)
+		}
+	}
+	add(eng.Config.Language)
+	add("en")
+	return langs
+}
+
+// noticeTemplate finds the template for part ("<notice>.subject" or
+// "<notice>.body") in the first of langs that has one: a file
+// "<part>.<lang>.tmpl" in TemplateDir, or a built-in template.
+func (eng *Engine) noticeTemplate(part string, langs []string) (string, error) {
+	for _, lang := range langs {
+		if eng.Config.TemplateDir != "" {
+			text, err := ioutil.ReadFile(filepath.Join(eng.Config.TemplateDir, part+"."+lang+".tmpl"))
+			if err == nil {
+				return string(text), nil
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+		if text, ok := builtinNotices[lang][part]; ok {
+			return text, nil
+		}
+	}
+	return "", ErrUnknownNotice
+}
+
+// renderNotice renders the subject and body of a notice to recipient, in
+// their language where possible.
+func (eng *Engine) renderNotice(notice, recipient string, data map[string]interface{}) (subject, body string, err error) {
+	langs := eng.noticeLanguages(recipient)
+	vars := map[string]interface{}{"List": eng.Config.ListAddress}
+	for k, v := range data {
+		vars[k] = v
+	}
+	render := func(part string) (string, error) {
+		text, err := eng.noticeTemplate(notice+"."+part, langs)
+		if err != nil {
+			return "", err
+		}
+		tmpl, err := template.New(notice + "." + part).Parse(text)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, vars)
+		return buf.String(), err
+	}
+	if subject, err = render("subject"); err != nil {
+		return "", "", err
+	}
+	if body, err = render("body"); err != nil {
+		return "", "", err
+	}
+	return subject, body, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderNotice(t *testing.T) {
+	eng := &Engine{Config: &Config{ListAddress: "list@example.com", Language: "fr"}}
+	subject, body, err := eng.renderNotice("welcome", "", map[string]interface{}{"Name": "Ana"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Bienvenue sur list@example.com", subject)
+	assert.Contains(t, body, "Bonjour Ana,")
+	// Languages without built-in notices fall back to English.
+	eng.Config.Language = "ga"
+	subject, _, err = eng.renderNotice("welcome", "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Welcome to list@example.com", subject)
+	_, _, err = eng.renderNotice("nonesuch", "", nil)
+	assert.Equal(t, ErrUnknownNotice, err)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/smtp"
+	"strconv"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Identity is a named From address the list can send as, such as
+// announcements@ or moderation@, optionally through its own SMTP login.
+// Identities named "moderation", "alerts" and "reports" are used for
+// moderation notices, alerts and admin notices, and traffic reports.
+type Identity struct {
+	Address      string
+	Name         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// String returns the identity as a From header value.
+func (id *Identity) String() string {
+	if id.Name == "" {
+		return id.Address
+	}
+	return constructRFC5322(id.Address, id.Name)
+}
+
+// identityTableOrEmpty reads the Identities table: names to tables of Address,
+// Name and, optionally, SMTPHost, SMTPPort, SMTPUsername and SMTPPassword.
+func identityTableOrEmpty(l lua.LValue) map[string]*Identity {
+	identities := make(map[string]*Identity)
+	table, ok := l.(*lua.LTable)
+	if !ok {
+		return identities
+	}
+	table.ForEach(func(key, val lua.LValue) {
+		fields, ok := val.(*lua.LTable)
+		if !ok {
+			return
+		}
+		identities[key.String()] = &Identity{
+			Address:      stringOrNothing(fields.RawGetString("Address")),
+			Name:         stringOrNothing(fields.RawGetString("Name")),
+			SMTPHost:     stringOrNothing(fields.RawGetString("SMTPHost")),
+			SMTPPort:     numberOrDefault(fields.RawGetString("SMTPPort"), 0),
+			SMTPUsername: stringOrNothing(fields.RawGetString("SMTPUsername")),
+			SMTPPassword: stringOrNothing(fields.RawGetString("SMTPPassword")),
+		}
+	})
+	return identities
+}
+
+// fromAddress returns the From header for the named identity, or the list
+// address if there's no such identity.
+func (eng *Engine) fromAddress(identity string) string {
+	if id, ok := eng.Config.Identities[identity]; ok && id.Address != "" {
+		return id.String()
+	}
+	return eng.Config.ListAddress
+}
+
+// identityFor returns the identity with the given address, if any.
+func (eng *Engine) identityFor(address string) *Identity {
+	address = normaliseEmail(address)
+	for _, id := range eng.Config.Identities {
+		if address != "" && normaliseEmail(id.Address) == address {
+			return id
+		}
+	}
+	return nil
+}
+
+// sendAsIdentity sends mail from an identity through its own SMTP login, if
+// it has one, reporting whether it did.
+func (eng *Engine) sendAsIdentity(from, envelopeFrom string, to []string, raw []byte) (bool, error) {
+	id := eng.identityFor(from)
+	if id == nil || id.SMTPUsername == "" {
+		return false, nil
+	}
+	host, port := id.SMTPHost, id.SMTPPort
+	if host == "" {
+		host = eng.Config.SMTPHost
+	}
+	if port == 0 {
+		port = eng.Config.SMTPPort
+	}
+	auth := smtp.PlainAuth("", id.SMTPUsername, id.SMTPPassword, host)
+	return true, smtp.SendMail(host+":"+strconv.Itoa(port), auth, envelopeFrom, to, raw)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/tgulacsi/imapclient"
+)
+
+var (
+	// ErrNotListMail - Returned for messages that don't match the IMAP criteria, so they are left in the mailbox.
+	ErrNotListMail = errors.New("Message doesn't match IMAP criteria, leaving it in the mailbox")
+
+	// ErrBadIMAPSince - Returned when IMAPSince isn't a YYYY-MM-DD date.
+	ErrBadIMAPSince = errors.New("IMAPSince must be a date in the form YYYY-MM-DD")
+)
+
+// Headers that may name the list address as a recipient; Delivered-To and
+// X-Original-To cover mail that reached the list by Bcc or an alias.
+var listRecipientHeaders = []string{"To", "Cc", "Delivered-To", "X-Original-To", "Envelope-To"}
+
+// isToList reports whether any recipient header names the list address.
+func (eng *Engine) isToList(header mail.Header) bool {
+	list := normaliseEmail(eng.Config.ListAddress)
+	for _, name := range listRecipientHeaders {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if normaliseEmail(addr.Address) == list {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesIMAPCriteria applies IMAPToListOnly and IMAPSince to a message.
+// Messages with unparseable dates are given the benefit of the doubt.
+func (eng *Engine) matchesIMAPCriteria(header mail.Header) bool {
+	if eng.Config.IMAPToListOnly && !eng.isToList(header) {
+		return false
+	}
+	if !eng.Config.imapSince.IsZero() {
+		if date, err := header.Date(); err == nil && date.Before(eng.Config.imapSince) {
+			return false
+		}
+	}
+	return true
+}
+
+// withIMAPCriteria wraps a DeliverFunc so that messages not matching the IMAP
+// criteria are refused. imapDeliverBatch only deletes messages that were
+// delivered successfully, so refused messages stay in the mailbox; fetching
+// them marks them seen, so they are not fetched again.
+// imapclient can only search by subject on the server, so these criteria are
+// checked after fetching.
+func (eng *Engine) withIMAPCriteria(deliver imapclient.DeliverFunc) imapclient.DeliverFunc {
+	if !eng.Config.IMAPToListOnly && eng.Config.imapSince.IsZero() {
+		return deliver
+	}
+	return func(r io.ReadSeeker, uid uint32, sha1 []byte) error {
+		msg, err := mail.ReadMessage(r)
+		if err == nil && !eng.matchesIMAPCriteria(msg.Header) {
+			log15.Info("Leaving message that doesn't match IMAP criteria", log15.Ctx{"context": "imap", "uid": uid, "subject": msg.Header.Get("Subject")})
+			return ErrNotListMail
+		}
+		if _, err := r.Seek(0, 0); err != nil {
+			return err
+		}
+		return deliver(r, uid, sha1)
+	}
+}
+
+// parseIMAPSince sets the parsed form of the IMAPSince option.
+func (cfg *Config) parseIMAPSince() error {
+	if cfg.IMAPSince == "" {
+		return nil
+	}
+	since, err := time.Parse("2006-01-02", cfg.IMAPSince)
+	if err != nil {
+		return ErrBadIMAPSince
+	}
+	cfg.imapSince = since
+	return nil
+}
+
+// ErrIMAPNamespace - Returned when NAMESPACE discovery fails.
+var ErrIMAPNamespace = errors.New("IMAP NAMESPACE discovery failed")
+
+// namespaceRe matches the first personal namespace of a NAMESPACE response,
+// e.g. `* NAMESPACE (("INBOX." ".")) NIL NIL`.
+var namespaceRe = regexp.MustCompile(`^\* NAMESPACE \(\("((?:[^"\\]|\\.)*)" (?:"((?:[^"\\]|\\.)*)"|NIL)\)`)
+
+// parseNamespace returns the personal namespace prefix and hierarchy
+// delimiter from a NAMESPACE response line.
+func parseNamespace(line string) (prefix, delim string, ok bool) {
+	m := namespaceRe.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	unquote := strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+	return unquote.Replace(m[1]), unquote.Replace(m[2]), true
+}
+
+// imapQuote renders s as an IMAP quoted string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// discoverIMAPNamespace logs in and asks the server for its personal
+// namespace (RFC2342). imapclient doesn't expose raw commands, so this uses
+// its own short-lived connection.
+func (eng *Engine) discoverIMAPNamespace() (prefix, delim string, err error) {
+	addr := net.JoinHostPort(eng.Config.IMAPHost, strconv.Itoa(eng.Config.IMAPPort))
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: eng.Config.IMAPHost})
+	if err != nil {
+		return "", "", err
+	}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	if _, err = c.ReadLine(); err != nil {
+		return "", "", err
+	}
+	// cmd sends a tagged command, returning its untagged responses.
+	cmd := func(tag, command string) ([]string, error) {
+		if err := c.PrintfLine("%s %s", tag, command); err != nil {
+			return nil, err
+		}
+		var untagged []string
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(line, tag+" ") {
+				untagged = append(untagged, line)
+				continue
+			}
+			if !strings.HasPrefix(line, tag+" OK") {
+				return nil, errors.New(ErrIMAPNamespace.Error() + ": " + line)
+			}
+			return untagged, nil
+		}
+	}
+	if _, err = cmd("a1", "LOGIN "+imapQuote(eng.Config.IMAPUsername)+" "+imapQuote(eng.Config.IMAPPassword)); err != nil {
+		return "", "", err
+	}
+	defer cmd("a3", "LOGOUT")
+	untagged, err := cmd("a2", "NAMESPACE")
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range untagged {
+		if prefix, delim, ok := parseNamespace(line); ok {
+			return prefix, delim, nil
+		}
+	}
+	return "", "", ErrIMAPNamespace
+}
+
+// imapFolder applies a namespace prefix to a configured folder name, using
+// the server's delimiter in place of "/". INBOX, and names that already carry
+// the prefix, are left alone.
+func imapFolder(name, prefix, delim string) string {
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		return name
+	}
+	if delim != "" && delim != "/" {
+		name = strings.Replace(name, "/", delim, -1)
+	}
+	if prefix == "" || strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
+// imapFolders returns the inbox, done and error folders, with the namespace
+// prefix applied. With IMAPNamespace "auto" the prefix is discovered from
+// the server, but only if a folder other than INBOX is configured; if
+// discovery fails the names are used as given.
+func (eng *Engine) imapFolders() (inbox, done, errbox string) {
+	inbox, done, errbox = eng.Config.IMAPInbox, eng.Config.IMAPDoneFolder, eng.Config.IMAPErrorFolder
+	prefix, delim := eng.Config.IMAPNamespace, ""
+	if prefix == "auto" {
+		prefix = ""
+		if !strings.EqualFold(inbox, "INBOX") || done != "" || errbox != "" {
+			var err error
+			prefix, delim, err = eng.discoverIMAPNamespace()
+			if err != nil {
+				log15.Error("Couldn't discover IMAP namespace, using folder names as given", log15.Ctx{"context": "imap", "error": err})
+			} else {
+				log15.Info("Discovered IMAP namespace", log15.Ctx{"context": "imap", "prefix": prefix, "delimiter": delim})
+			}
+		}
+	}
+	return imapFolder(inbox, prefix, delim), imapFolder(done, prefix, delim), imapFolder(errbox, prefix, delim)
+}
+
+// imapDeliverBatch is imapclient.DeliverOne, but stops after batch messages
+// (or none, if batch isn't positive) so one cycle can drain a burst of mail
+// without holding the connection open indefinitely. Each message is fetched
+// into body, which is emptied before the next. As with DeliverOne, delivered
+// messages are moved to outbox or deleted, and failed ones are moved to errbox
+// if it's set; fetching marks them seen either way. If ctx ends, the rest of
+// the batch is left for next time.
+func imapDeliverBatch(ctx context.Context, c imapclient.Client, inbox, pattern string, deliver imapclient.DeliverFunc, outbox, errbox string, batch int, body *spool) (n int, err error) {
+	if err = c.Connect(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := c.Close(true); err == nil {
+			err = cerr
+		}
+	}()
+	uids, err := c.List(inbox, pattern, false)
+	if err != nil {
+		return 0, err
+	}
+	if batch > 0 && len(uids) > batch {
+		uids = uids[:batch]
+	}
+	defer body.Close()
+	hash := sha1.New()
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			return n, nil
+		}
+		body.Close()
+		hash.Reset()
+		if _, err = c.ReadTo(io.MultiWriter(body, hash), uid); err != nil {
+			return n, err
+		}
+		r, err := body.Reader()
+		if err != nil {
+			return n, err
+		}
+		if derr := deliver(r, uid, hash.Sum(nil)); derr != nil {
+			log15.Error("Error delivering IMAP message", log15.Ctx{"context": "imap", "uid": uid, "error": derr})
+			if errbox != "" {
+				if err = c.Move(uid, errbox); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+		n++
+		if outbox != "" {
+			err = c.Move(uid, outbox)
+		} else {
+			err = c.Delete(uid)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIMAPNamespace(t *testing.T) {
+	prefix, delim, ok := parseNamespace(`* NAMESPACE (("INBOX." ".")) NIL NIL`)
+	assert.True(t, ok)
+	assert.Equal(t, "INBOX.", prefix)
+	assert.Equal(t, ".", delim)
+	prefix, delim, ok = parseNamespace(`* NAMESPACE (("" "/")) NIL (("Public/" "/"))`)
+	assert.True(t, ok)
+	assert.Equal(t, "", prefix)
+	assert.Equal(t, "/", delim)
+	_, _, ok = parseNamespace(`* NAMESPACE NIL NIL NIL`)
+	assert.False(t, ok)
+
+	assert.Equal(t, "INBOX", imapFolder("INBOX", "INBOX.", "."))
+	assert.Equal(t, "INBOX.Lists.Done", imapFolder("Lists/Done", "INBOX.", "."))
+	assert.Equal(t, "INBOX.Done", imapFolder("INBOX.Done", "INBOX.", "."))
+	assert.Equal(t, "Lists/Done", imapFolder("Lists/Done", "", "/"))
+	assert.Equal(t, "", imapFolder("", "INBOX.", "."))
+}
+
+// fakeIMAPClient serves an inbox of numbered messages.
+type fakeIMAPClient struct {
+	inbox   map[uint32]string
+	deleted []uint32
+	moved   map[uint32]string
+}
+
+func (c *fakeIMAPClient) Connect() error          { return nil }
+func (c *fakeIMAPClient) Close(commit bool) error { return nil }
+func (c *fakeIMAPClient) List(mbox, pattern string, all bool) ([]uint32, error) {
+	var uids []uint32
+	for uid := uint32(1); uid <= uint32(len(c.inbox)); uid++ {
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+func (c *fakeIMAPClient) ReadTo(w io.Writer, msgID uint32) (int64, error) {
+	n, err := io.WriteString(w, c.inbox[msgID])
+	return int64(n), err
+}
+func (c *fakeIMAPClient) Mark(msgID uint32, seen bool) error { return nil }
+func (c *fakeIMAPClient) Delete(msgID uint32) error {
+	c.deleted = append(c.deleted, msgID)
+	return nil
+}
+func (c *fakeIMAPClient) Move(msgID uint32, mbox string) error {
+	c.moved[msgID] = mbox
+	return nil
+}
+
+func TestIMAPDeliverBatch(t *testing.T) {
+	c := &fakeIMAPClient{
+		inbox: map[uint32]string{1: "one", 2: "bad", 3: "three", 4: "four"},
+		moved: make(map[uint32]string),
+	}
+	var got []string
+	deliver := func(r io.ReadSeeker, uid uint32, sha1 []byte) error {
+		body, _ := ioutil.ReadAll(r)
+		if string(body) == "bad" {
+			return errors.New("bad message")
+		}
+		got = append(got, string(body))
+		return nil
+	}
+	n, err := imapDeliverBatch(context.Background(), c, "INBOX", "", deliver, "", "Failed", 3, new(spool))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"one", "three"}, got)
+	assert.Equal(t, []uint32{1, 3}, c.deleted)
+	assert.Equal(t, map[uint32]string{2: "Failed"}, c.moved)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrUnknownImportFormat - Returned when asked to import from an unsupported list manager.
+	ErrUnknownImportFormat = errors.New("Unknown import format")
+
+	// ErrNoImportHeader - Returned when a CSV import has no recognisable header row.
+	ErrNoImportHeader = errors.New("No header row found in import file")
+
+	// ErrImportNeedsPath - Returned when asked to import an mlmmj list from a
+	// stream, as it is a directory of files.
+	ErrImportNeedsPath = errors.New("mlmmj imports need the list directory, not standard input")
+)
+
+// importedMember is a member record parsed from another list manager's data.
+type importedMember struct {
+	Email       string
+	Name        string
+	Moderator   bool
+	AllowedPost bool
+	Delivery    string
+	Joindate    time.Time
+	// Set for list moderators who aren't subscribers: they are made
+	// moderators, but aren't sent the list's mail or let post.
+	ModeratorOnly bool
+}
+
+// parseAddressLines reads one address per line, as used by mlmmj and Majordomo
+// alike. Blank lines and '#' comments are skipped, and any of "foo@bar.com",
+// "Foo Bar <foo@bar.com>" or "foo@bar.com (Foo Bar)" are accepted.
+func parseAddressLines(r io.Reader) ([]importedMember, error) {
+	var members []importedMember
+	err := scanAddressLines(r, func(m importedMember) error {
+		members = append(members, m)
+		return nil
+	})
+	return members, err
+}
+
+// scanAddressLines is parseAddressLines passing each member to emit as it is
+// read, stopping at emit's first error.
+func scanAddressLines(r io.Reader, emit func(importedMember) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parsed, err := mail.ParseAddress(line)
+		if err != nil {
+			log15.Error("Skipping unparseable address line", log15.Ctx{"context": "import", "line": line, "error": err})
+			continue
+		}
+		email := normaliseEmail(parsed.Address)
+		if email == "" {
+			log15.Error("Skipping invalid address", log15.Ctx{"context": "import", "line": line})
+			continue
+		}
+		if err = emit(importedMember{Email: email, Name: parsed.Name, AllowedPost: true}); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAddressFile is parseAddressLines for a named file. Absent files yield
+// no members rather than an error, as optional files are common in list
+// manager layouts.
+func parseAddressFile(path string) ([]importedMember, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAddressLines(f)
+}
+
+// parseAddressDir applies parseAddressFile to every file in a directory, as
+// mlmmj shards its subscriber lists across files in "subscribers.d" etc.
+func parseAddressDir(dir string) ([]importedMember, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var members []importedMember
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		found, err := parseAddressFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, found...)
+	}
+	return members, nil
+}
+
+// importMlmmj reads the members of an mlmmj list directory. Normal, digest
+// and nomail subscribers are imported as posting members with the matching
+// Delivery preference. Addresses in control/moderators and control/owner are
+// made moderators; those that aren't also subscribers are imported without
+// delivery or posting, so they aren't sent held posts either until their
+// delivery is turned on.
+func importMlmmj(listdir string) ([]importedMember, error) {
+	var members []importedMember
+	subdirs := map[string]string{
+		"subscribers.d": DeliveryNormal,
+		"digesters.d":   DeliveryDigest,
+		"nomailsubs.d":  DeliveryNoMail,
+	}
+	for sub, delivery := range subdirs {
+		found, err := parseAddressDir(filepath.Join(listdir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range found {
+			m.Delivery = delivery
+			members = append(members, m)
+		}
+	}
+	for _, control := range []string{"moderators", "owner"} {
+		mods, err := parseAddressFile(filepath.Join(listdir, "control", control))
+		if err != nil {
+			return nil, err
+		}
+		for _, mod := range mods {
+			mod.Moderator = true
+			mod.ModeratorOnly = true
+			mod.AllowedPost = false
+			mod.Delivery = DeliveryNoMail
+			members = append(members, mod)
+		}
+	}
+	return members, nil
+}
+
+// importMajordomo reads the members of a Majordomo list file.
+func importMajordomo(listfile string) ([]importedMember, error) {
+	if _, err := os.Stat(listfile); err != nil {
+		return nil, err
+	}
+	return parseAddressFile(listfile)
+}
+
+// importGoogleGroups reads a Google Groups member export CSV.
+func importGoogleGroups(csvfile string) ([]importedMember, error) {
+	f, err := os.Open(csvfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGoogleGroupsCSV(f)
+}
+
+// parseGoogleGroupsCSV maps the columns of a Google Groups member export onto
+// member records. Columns are found by header name, and any title rows before
+// the header are skipped, as the export format has varied over time.
+// Owners and managers become moderators, "Posting permissions" sets
+// AllowedPost, and "Email preference" sets the Delivery preference.
+func parseGoogleGroupsCSV(r io.Reader) ([]importedMember, error) {
+	var members []importedMember
+	err := scanGoogleGroupsCSV(r, func(m importedMember) error {
+		members = append(members, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// scanGoogleGroupsCSV is parseGoogleGroupsCSV passing each member to emit as
+// it is read, stopping at emit's first error.
+func scanGoogleGroupsCSV(r io.Reader, emit func(importedMember) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var columns map[string]int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if columns == nil {
+			columns = googleGroupsHeader(record)
+			continue
+		}
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		email := normaliseEmail(field("email address"))
+		if email == "" {
+			log15.Error("Skipping invalid address", log15.Ctx{"context": "import", "record": record})
+			continue
+		}
+		m := importedMember{
+			Email:       email,
+			Name:        field("nickname"),
+			AllowedPost: true,
+		}
+		switch strings.ToLower(field("group status")) {
+		case "owner", "manager":
+			m.Moderator = true
+		}
+		if posting := strings.ToLower(field("posting permissions")); posting != "" && posting != "allowed" {
+			m.AllowedPost = false
+		}
+		pref := strings.ToLower(field("email preference"))
+		switch {
+		case strings.Contains(pref, "digest"), strings.Contains(pref, "abridged"):
+			m.Delivery = DeliveryDigest
+		case strings.HasPrefix(pref, "no "):
+			m.Delivery = DeliveryNoMail
+		}
+		if year, err := strconv.Atoi(field("join year")); err == nil {
+			month, _ := strconv.Atoi(field("join month"))
+			day, _ := strconv.Atoi(field("join day"))
+			hour, _ := strconv.Atoi(field("join hour"))
+			minute, _ := strconv.Atoi(field("join minute"))
+			m.Joindate = time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC)
+		}
+		if err = emit(m); err != nil {
+			return err
+		}
+	}
+	if columns == nil {
+		return ErrNoImportHeader
+	}
+	return nil
+}
+
+// googleGroupsHeader returns a column index by lowercased name if the record
+// is the export's header row, or nil otherwise.
+func googleGroupsHeader(record []string) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range record {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["email address"]; !ok {
+		return nil
+	}
+	return columns
+}
+
+// importMembers adds imported members to the database. Where an address is
+// already a member, or appears more than once in the import, flags are merged
+// (a moderator anywhere is a moderator) and the existing join date, name and
+// delivery preference are kept unless they are unset. A ModeratorOnly record
+// only adds the moderator flag to an existing member.
+func (db *ListlessDB) importMembers(members []importedMember) (added, updated int, err error) {
+	for _, m := range members {
+		isNew, err := db.importMember(m)
+		if err != nil {
+			return added, updated, err
+		}
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+	}
+	return added, updated, nil
+}
+
+// importMember adds or merges one imported member, as importMembers does,
+// reporting whether it was new.
+func (db *ListlessDB) importMember(m importedMember) (isNew bool, err error) {
+	meta, err := db.GetSubscriber(m.Email)
+	switch err {
+	case nil:
+		meta.Moderator = meta.Moderator || m.Moderator
+		if m.ModeratorOnly {
+			break
+		}
+		meta.AllowedPost = meta.AllowedPost || m.AllowedPost
+		if meta.Name == "" {
+			meta.Name = m.Name
+		}
+		if meta.Delivery == DeliveryNormal {
+			meta.Delivery = m.Delivery
+		}
+	case ErrMemberEntryNotFound:
+		meta = db.CreateSubscriber(m.Email, m.Name, m.AllowedPost, m.Moderator)
+		meta.Delivery = m.Delivery
+		if !m.Joindate.IsZero() {
+			meta.Joindate = m.Joindate
+		}
+		isNew = true
+	default:
+		return false, err
+	}
+	return isNew, db.UpdateSubscriber(m.Email, meta)
+}
+
+// ImportMembers imports the membership of a list managed by other software;
+// format is one of "mlmmj" (path is the list directory), "majordomo" (path
+// is the list file) or "googlegroups" (path is a member export CSV). A path
+// of "-" reads a Majordomo list or Google Groups CSV from standard input.
+func (db *ListlessDB) ImportMembers(format, path string) (added, updated int, err error) {
+	if path == "-" {
+		return db.ImportMembersFrom(format, os.Stdin)
+	}
+	var members []importedMember
+	switch format {
+	case "mlmmj":
+		members, err = importMlmmj(path)
+	case "majordomo":
+		members, err = importMajordomo(path)
+	case "googlegroups":
+		members, err = importGoogleGroups(path)
+	default:
+		return 0, 0, ErrUnknownImportFormat
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return db.importMembers(members)
+}
+
+// ImportMembersFrom imports a Majordomo list ("majordomo") or Google Groups
+// member export CSV ("googlegroups") from r, adding each member as it is
+// read, so that rosters of any size can be piped in.
+func (db *ListlessDB) ImportMembersFrom(format string, r io.Reader) (added, updated int, err error) {
+	var scan func(io.Reader, func(importedMember) error) error
+	switch format {
+	case "majordomo":
+		scan = scanAddressLines
+	case "googlegroups":
+		scan = scanGoogleGroupsCSV
+	case "mlmmj":
+		return 0, 0, ErrImportNeedsPath
+	default:
+		return 0, 0, ErrUnknownImportFormat
+	}
+	err = scan(r, func(m importedMember) error {
+		isNew, err := db.importMember(m)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+		return nil
+	})
+	return added, updated, err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGoogleGroupsCSV(t *testing.T) {
+	export := `Members for group friends@googlegroups.com
+Email address,Nickname,Group status,Email status,Email preference,Posting permissions,Join year,Join month,Join day,Join hour,Join minute
+owner@example.com,Olive,owner,subscribed,email,allowed,2015,3,9,14,30
+Reader@Example.com,,member,subscribed,Digest,not allowed,,,,,
+quiet@example.com,Quinn,member,subscribed,No email,allowed,2016,1,1,0,0
+`
+	members, err := parseGoogleGroupsCSV(strings.NewReader(export))
+	assert.Nil(t, err)
+	assert.Len(t, members, 3)
+	assert.Equal(t, "owner@example.com", members[0].Email)
+	assert.Equal(t, "Olive", members[0].Name)
+	assert.True(t, members[0].Moderator)
+	assert.True(t, members[0].AllowedPost)
+	assert.Equal(t, 2015, members[0].Joindate.Year())
+	assert.Equal(t, "reader@example.com", members[1].Email)
+	assert.False(t, members[1].Moderator)
+	assert.False(t, members[1].AllowedPost)
+	assert.Equal(t, DeliveryDigest, members[1].Delivery)
+	assert.True(t, members[1].Joindate.IsZero())
+	assert.Equal(t, DeliveryNoMail, members[2].Delivery)
+}
+
+func TestScanAddressLinesStops(t *testing.T) {
+	stop := errors.New("stop")
+	var seen []string
+	err := scanAddressLines(strings.NewReader("# members\na@example.com\n\nBee <b@example.com>\nc@example.com\n"), func(m importedMember) error {
+		seen = append(seen, m.Email)
+		if len(seen) == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, seen)
+}
+
+func TestImportMlmmj(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listless-mlmmj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"subscribers.d", "control"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, sub), 0700))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "subscribers.d", "a"), []byte("ann@example.com\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "control", "moderators"), []byte("ann@example.com\nmod@example.com\n"), 0600))
+	members, err := importMlmmj(dir)
+	assert.NoError(t, err)
+	if !assert.Len(t, members, 3) {
+		return
+	}
+	assert.Equal(t, importedMember{Email: "ann@example.com", AllowedPost: true, Delivery: DeliveryNormal}, members[0])
+	// Moderators are imported as moderators only, not as subscribers.
+	for _, mod := range members[1:] {
+		assert.True(t, mod.Moderator)
+		assert.True(t, mod.ModeratorOnly)
+		assert.False(t, mod.AllowedPost)
+		assert.Equal(t, DeliveryNoMail, mod.Delivery)
+	}
+	assert.Equal(t, "mod@example.com", members[2].Email)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrAlreadyRunning - Returned when another listless holds the instance lock
+// of the same database.
+var ErrAlreadyRunning = errors.New("Another listless is already running with this database")
+
+// instanceLock is held by loop mode for as long as it runs, so that a second
+// instance for the same database refuses to start, rather than waiting on the
+// database. It is a file beside the database, holding the running PID.
+type instanceLock struct {
+	f *os.File
+}
+
+// lockInstance takes the instance lock of a database, returning
+// ErrAlreadyRunning if another process has it.
+func lockInstance(database string) (*instanceLock, error) {
+	f, err := os.OpenFile(database+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &instanceLock{f}, nil
+}
+
+// release gives up the lock. The file is left, as removing it could race an
+// instance that is starting.
+func (l *instanceLock) release() {
+	l.f.Truncate(0)
+	l.f.Close()
+}
+
+// lockHolder returns the PID in a database's instance lock file, or 0.
+func lockHolder(database string) int {
+	b, err := ioutil.ReadFile(database + ".lock")
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid
+}
+
+// writePIDFile writes the process ID to path, for init scripts.
+func writePIDFile(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// lockFile does nothing on these platforms; the database's own lock still
+// keeps a second instance out, though it waits rather than refusing to start.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listless-lock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	database := filepath.Join(dir, "list.db")
+
+	lock, err := lockInstance(database)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), lockHolder(database))
+	_, err = lockInstance(database)
+	assert.Equal(t, ErrAlreadyRunning, err)
+
+	lock.release()
+	assert.Equal(t, 0, lockHolder(database))
+	lock, err = lockInstance(database)
+	assert.NoError(t, err)
+	lock.release()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/tgulacsi/imapclient"
+)
+
+const jmapMailCapability = "urn:ietf:params:jmap:mail"
+
+var (
+	// ErrJMAPRequestFailed - Returned when the JMAP server responds with an unexpected status.
+	ErrJMAPRequestFailed = errors.New("JMAP request failed")
+
+	// ErrJMAPNoInbox - Returned when the JMAP account has no mailbox with the inbox role.
+	ErrJMAPNoInbox = errors.New("JMAP account has no inbox")
+
+	// ErrJMAPMethodError - Returned when a JMAP method call fails.
+	ErrJMAPMethodError = errors.New("JMAP method call failed")
+)
+
+// The parts of a JMAP session resource that the fetcher uses.
+type jmapSession struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	EventSourceURL  string            `json:"eventSourceUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+// jmapAuth adds the configured credentials to a request: JMAPToken as a
+// bearer token, or else the IMAP username and password.
+func (eng *Engine) jmapAuth(req *http.Request) {
+	if eng.Config.JMAPToken != "" {
+		req.Header.Set("Authorization", "Bearer "+eng.Config.JMAPToken)
+	} else {
+		req.SetBasicAuth(eng.Config.IMAPUsername, eng.Config.IMAPPassword)
+	}
+}
+
+// jmapGet performs an authenticated GET and returns the response, which must
+// be closed by the caller.
+func (eng *Engine) jmapGet(endpoint string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	eng.jmapAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrJMAPRequestFailed, resp.Status)
+	}
+	return resp, nil
+}
+
+// jmapGetSession fetches the session resource from JMAPSessionURL.
+func (eng *Engine) jmapGetSession() (*jmapSession, error) {
+	resp, err := eng.jmapGet(eng.Config.JMAPSessionURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	session := new(jmapSession)
+	return session, json.NewDecoder(resp.Body).Decode(session)
+}
+
+// jmapCall makes JMAP method calls and returns the arguments of each response
+// in order. Each call is [name, arguments, callID].
+func (eng *Engine) jmapCall(session *jmapSession, calls ...[]interface{}) ([]json.RawMessage, error) {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"using":       []string{"urn:ietf:params:jmap:core", jmapMailCapability},
+		"methodCalls": calls,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", session.APIURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	eng.jmapAuth(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrJMAPRequestFailed, resp.Status)
+	}
+	var out struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.MethodResponses) != len(calls) {
+		return nil, ErrJMAPMethodError
+	}
+	results := make([]json.RawMessage, 0, len(out.MethodResponses))
+	for _, mr := range out.MethodResponses {
+		if len(mr) != 3 {
+			return nil, ErrJMAPMethodError
+		}
+		var name string
+		if err := json.Unmarshal(mr[0], &name); err != nil {
+			return nil, err
+		}
+		if name == "error" {
+			return nil, fmt.Errorf("%w: %s", ErrJMAPMethodError, mr[1])
+		}
+		results = append(results, mr[1])
+	}
+	return results, nil
+}
+
+// jmapDownload fetches a blob, such as a message's raw RFC5322 source, into a
+// spool, which the caller must close.
+func (eng *Engine) jmapDownload(session *jmapSession, accountID, blobID string) (*spool, error) {
+	endpoint := strings.NewReplacer(
+		"{accountId}", url.PathEscape(accountID),
+		"{blobId}", url.PathEscape(blobID),
+		"{type}", url.QueryEscape("message/rfc822"),
+		"{name}", "message.eml",
+	).Replace(session.DownloadURL)
+	resp, err := eng.jmapGet(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return eng.spoolMessage(resp.Body)
+}
+
+// jmapDeliverAll passes every unseen message in the inbox to deliver, like
+// one DeliveryLoop cycle. Delivered messages are destroyed; messages that
+// fail are marked seen and left in the inbox for inspection. If ctx ends, the
+// rest are left for next time.
+func (eng *Engine) jmapDeliverAll(ctx context.Context, deliver imapclient.DeliverFunc) (int, error) {
+	session, err := eng.jmapGetSession()
+	if err != nil {
+		return 0, err
+	}
+	accountID := session.PrimaryAccounts[jmapMailCapability]
+	results, err := eng.jmapCall(session,
+		[]interface{}{"Mailbox/query", map[string]interface{}{
+			"accountId": accountID,
+			"filter":    map[string]string{"role": "inbox"},
+		}, "0"},
+	)
+	if err != nil {
+		return 0, err
+	}
+	var mailboxes struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.Unmarshal(results[0], &mailboxes); err != nil {
+		return 0, err
+	}
+	if len(mailboxes.IDs) == 0 {
+		return 0, ErrJMAPNoInbox
+	}
+	results, err = eng.jmapCall(session,
+		[]interface{}{"Email/query", map[string]interface{}{
+			"accountId": accountID,
+			"filter": map[string]interface{}{
+				"inMailbox":  mailboxes.IDs[0],
+				"notKeyword": "$seen",
+			},
+			"sort":  []map[string]interface{}{{"property": "receivedAt", "isAscending": true}},
+			"limit": 50,
+		}, "0"},
+		[]interface{}{"Email/get", map[string]interface{}{
+			"accountId":  accountID,
+			"#ids":       map[string]string{"resultOf": "0", "name": "Email/query", "path": "/ids"},
+			"properties": []string{"id", "blobId"},
+		}, "1"},
+	)
+	if err != nil {
+		return 0, err
+	}
+	var emails struct {
+		List []struct {
+			ID     string `json:"id"`
+			BlobID string `json:"blobId"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(results[1], &emails); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, em := range emails.List {
+		if ctx.Err() != nil {
+			return n, nil
+		}
+		body, err := eng.jmapDownload(session, accountID, em.BlobID)
+		if err != nil {
+			return n, err
+		}
+		r, err := body.Reader()
+		if err != nil {
+			body.Close()
+			return n, err
+		}
+		update := map[string]interface{}{}
+		err = deliver(r, 0, nil)
+		body.Close()
+		if err != nil {
+			log15.Error("Error delivering JMAP message, marking seen", log15.Ctx{"context": "jmap", "id": em.ID, "error": err})
+			update["update"] = map[string]interface{}{em.ID: map[string]bool{"keywords/$seen": true}}
+		} else {
+			update["destroy"] = []string{em.ID}
+			n++
+		}
+		update["accountId"] = accountID
+		if _, err := eng.jmapCall(session, []interface{}{"Email/set", update, "0"}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// jmapPush listens to the session's EventSource (if it has one) and signals
+// wake whenever the account's state changes, reconnecting after errors until
+// closeCh is closed.
+func (eng *Engine) jmapPush(wake chan<- struct{}, closeCh <-chan struct{}) {
+	for {
+		err := eng.jmapListen(wake, closeCh)
+		select {
+		case <-closeCh:
+			return
+		default:
+		}
+		if err != nil {
+			log15.Error("JMAP push connection failed, polling until reconnected", log15.Ctx{"context": "jmap", "error": err})
+		}
+		<-time.After(time.Duration(eng.Config.PollFrequency) * time.Second)
+	}
+}
+
+// jmapListen reads one EventSource connection until it fails or closes.
+func (eng *Engine) jmapListen(wake chan<- struct{}, closeCh <-chan struct{}) error {
+	session, err := eng.jmapGetSession()
+	if err != nil {
+		return err
+	}
+	if session.EventSourceURL == "" {
+		// No push support; stay on polling.
+		<-closeCh
+		return nil
+	}
+	endpoint := strings.NewReplacer(
+		"{types}", "Email",
+		"{closeafter}", "no",
+		"{ping}", "300",
+	).Replace(session.EventSourceURL)
+	resp, err := eng.jmapGet(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblock the read below on shutdown.
+		select {
+		case <-closeCh:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+	log15.Info("Listening for JMAP push events", log15.Ctx{"context": "jmap"})
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event: state") {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// JMAPDeliveryLoop is DeliveryLoop for JMAP accounts: it delivers new inbox
+// messages as they arrive, using push when the server supports it and
+// polling as often as DeliveryLoop regardless, until ctx ends.
+func (eng *Engine) JMAPDeliveryLoop(ctx context.Context, deliver imapclient.DeliverFunc) {
+	wake := make(chan struct{}, 1)
+	go eng.jmapPush(wake, ctx.Done())
+	backoff := newPollBackoff(eng.Config)
+	for {
+		eng.metrics.beginCycle()
+		n, err := eng.jmapDeliverAll(ctx, deliver)
+		eng.logCycleTimings("jmap")
+		eng.recordFetchResult(err)
+		if err != nil {
+			log15.Error("Error during JMAP delivery cycle", log15.Ctx{"context": "jmap", "deliveries": n, "error": err})
+		} else {
+			log15.Info("JMAP delivery cycle complete", log15.Ctx{"context": "jmap", "delivered": n})
+		}
+		wait := backoff.failed()
+		if err == nil {
+			wait = backoff.next(n > 0)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+			<-time.After(time.Duration(eng.Config.MessageFrequency) * time.Second)
+		case <-time.After(wait):
+		}
+	}
+}
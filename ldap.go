@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+	"gopkg.in/ldap.v2"
+)
+
+var (
+	// ErrBadLDAPURL - Returned when LDAPURL isn't an ldap:// or ldaps:// URL.
+	ErrBadLDAPURL = errors.New("LDAPURL must be an ldap:// or ldaps:// URL")
+
+	// ErrBadLDAPSyncInterval - Returned when LDAP sync is on but LDAPSyncInterval isn't positive.
+	ErrBadLDAPSyncInterval = errors.New("LDAPSyncInterval must be a number of minutes above 0")
+)
+
+// ldapSource is the MemberMeta.Source of members managed by LDAP sync.
+const ldapSource = "ldap"
+
+// Default LDAPAttributes; these suit both OpenLDAP groupOfNames and Active
+// Directory groups.
+var ldapDefaultAttributes = map[string]string{
+	"Member": "member",
+	"Email":  "mail",
+	"Name":   "cn",
+}
+
+// ldapAttribute returns the LDAP attribute configured for a MemberMeta field
+// (or "Member" for the group's membership attribute).
+func (eng *Engine) ldapAttribute(field string) string {
+	if attr := eng.Config.LDAPAttributes[field]; attr != "" {
+		return attr
+	}
+	return ldapDefaultAttributes[field]
+}
+
+// ldapConnect dials and binds to the configured LDAP server.
+func (eng *Engine) ldapConnect() (*ldap.Conn, error) {
+	u, err := url.Parse(eng.Config.LDAPURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	tlsConfig := &tls.Config{ServerName: hostname}
+	var conn *ldap.Conn
+	switch u.Scheme {
+	case "ldaps":
+		if hostname == host {
+			host = net.JoinHostPort(host, "636")
+		}
+		conn, err = ldap.DialTLS("tcp", host, tlsConfig)
+	case "ldap":
+		if hostname == host {
+			host = net.JoinHostPort(host, "389")
+		}
+		conn, err = ldap.Dial("tcp", host)
+		if err == nil && eng.Config.LDAPStartTLS {
+			if err = conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+			}
+		}
+	default:
+		return nil, ErrBadLDAPURL
+	}
+	if err != nil {
+		return nil, err
+	}
+	if eng.Config.LDAPBindDN != "" {
+		if err = conn.Bind(eng.Config.LDAPBindDN, eng.Config.LDAPBindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapGroupMembers reads the member DNs of LDAPGroupDN, then the email and
+// name attributes of each member. Members without an email are skipped.
+func (eng *Engine) ldapGroupMembers() ([]directoryMember, error) {
+	conn, err := eng.ldapConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	memberAttr := eng.ldapAttribute("Member")
+	group, err := conn.Search(ldap.NewSearchRequest(eng.Config.LDAPGroupDN,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{memberAttr}, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(group.Entries) == 0 {
+		return nil, nil
+	}
+	emailAttr, nameAttr := eng.ldapAttribute("Email"), eng.ldapAttribute("Name")
+	var members []directoryMember
+	for _, dn := range group.Entries[0].GetAttributeValues(memberAttr) {
+		res, err := conn.Search(ldap.NewSearchRequest(dn,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{emailAttr, nameAttr}, nil))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			log15.Info("Skipping dangling LDAP group member", log15.Ctx{"context": "ldap", "dn": dn})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) == 0 {
+			continue
+		}
+		entry := res.Entries[0]
+		email := entry.GetAttributeValue(emailAttr)
+		if email == "" {
+			log15.Info("Skipping LDAP group member with no email", log15.Ctx{"context": "ldap", "dn": dn})
+			continue
+		}
+		members = append(members, directoryMember{ID: dn, Email: email, Name: entry.GetAttributeValue(nameAttr)})
+	}
+	return members, nil
+}
+
+// LDAPSync reconciles the roster with the members of LDAPGroupDN once; see
+// reconcileMembers for what changes.
+func (eng *Engine) LDAPSync() (added, departed int, err error) {
+	members, err := eng.ldapGroupMembers()
+	if err != nil {
+		return 0, 0, err
+	}
+	return eng.DB.reconcileMembers(ldapSource, members)
+}
+
+// LDAPSyncLoop runs LDAPSync every LDAPSyncInterval minutes until closeCh is closed.
+func (eng *Engine) LDAPSyncLoop(closeCh <-chan struct{}) {
+	for {
+		added, departed, err := eng.LDAPSync()
+		if err != nil {
+			log15.Error("Error syncing members from LDAP", log15.Ctx{"context": "ldap", "error": err})
+		} else {
+			log15.Info("Synced members from LDAP", log15.Ctx{"context": "ldap", "added": added, "departed": departed})
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(time.Duration(eng.Config.LDAPSyncInterval) * time.Minute):
+		}
+	}
+}
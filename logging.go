@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrUnknownLogFormat - Returned when LogFormat isn't a known format.
+	ErrUnknownLogFormat = errors.New("Unknown LogFormat; use \"terminal\", \"logfmt\" or \"json\"")
+
+	// ErrUnknownSyslogFacility - Returned when SyslogFacility isn't a syslog facility name.
+	ErrUnknownSyslogFacility = errors.New("Unknown SyslogFacility; use e.g. \"daemon\", \"mail\" or \"local0\"")
+
+	// ErrBadSyslogAddress - Returned when SyslogAddress isn't "local" or a udp:// or tcp:// address.
+	ErrBadSyslogAddress = errors.New("SyslogAddress should be \"local\", \"udp://host:port\" or \"tcp://host:port\"")
+
+	// ErrSyslogUnsupported - Returned when SyslogAddress is set on a platform without syslog.
+	ErrSyslogUnsupported = errors.New("Syslog isn't available on this platform")
+)
+
+// logFormat returns the log15 format named by LogFormat, or fallback if unset.
+func logFormat(name string, fallback log15.Format) (log15.Format, error) {
+	switch name {
+	case "":
+		return fallback, nil
+	case "terminal":
+		return log15.TerminalFormat(), nil
+	case "logfmt":
+		return log15.LogfmtFormat(), nil
+	case "json":
+		return log15.JsonFormat(), nil
+	}
+	return nil, ErrUnknownLogFormat
+}
+
+// logContext returns the "context" value from a record's key/value pairs.
+func logContext(ctx []interface{}) string {
+	for i := 0; i+1 < len(ctx); i += 2 {
+		if key, ok := ctx[i].(string); ok && key == "context" {
+			context, _ := ctx[i+1].(string)
+			return context
+		}
+	}
+	return ""
+}
+
+// logLevelFilter keeps records at or above level, or above the level given in
+// overrides for their context, if any.
+func logLevelFilter(level log15.Lvl, overrides map[string]log15.Lvl) func(*log15.Record) bool {
+	return func(r *log15.Record) bool {
+		max := level
+		if override, ok := overrides[logContext(r.Ctx)]; ok {
+			max = override
+		}
+		// log15 levels count up from Crit to Debug.
+		return r.Lvl <= max
+	}
+}
+
+// logLevels parses LogLevel and LogLevels.
+func logLevels(cfg *Config) (level log15.Lvl, overrides map[string]log15.Lvl, err error) {
+	level = log15.LvlInfo
+	if cfg.LogLevel != "" {
+		if level, err = log15.LvlFromString(cfg.LogLevel); err != nil {
+			return level, nil, err
+		}
+	}
+	overrides = make(map[string]log15.Lvl)
+	for context, name := range cfg.LogLevels {
+		if overrides[context], err = log15.LvlFromString(name); err != nil {
+			return level, nil, err
+		}
+	}
+	return level, overrides, nil
+}
+
+// rotatingFile is an io.Writer over a log file which is moved aside once it
+// grows past maxBytes or gets older than maxAge, keeping the newest keep of
+// the moved-aside files. Rotated files are named after the file with the
+// rotation time appended, e.g. listless.log.20170301-120000.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	keep     int
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func newRotatingFile(path string, maxBytes int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxAge: maxAge, keep: keep}
+	return rf, rf.open()
+}
+
+// open opens the log file for appending, carrying on from an existing file.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	rf.opened = info.ModTime()
+	if rf.size == 0 {
+		rf.opened = time.Now()
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	tooBig := rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes
+	tooOld := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if tooBig || tooOld {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, opens a fresh one, and removes the
+// oldest rotated files beyond keep.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(rf.path, rf.path+"."+time.Now().Format("20060102-150405")); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rotated, err := filepath.Glob(rf.path + ".*")
+	if err != nil || rf.keep <= 0 || len(rotated) <= rf.keep {
+		return err
+	}
+	// The timestamps sort in age order.
+	sort.Strings(rotated)
+	for _, old := range rotated[:len(rotated)-rf.keep] {
+		os.Remove(old)
+	}
+	return nil
+}
+
+// setupLogging points log15 at the outputs chosen in the config, filtered by
+// level. Without any logging options, log15's defaults are left alone.
+func setupLogging(cfg *Config) error {
+	if cfg.LogFile == "" && cfg.SyslogAddress == "" && cfg.LogFormat == "" && cfg.LogLevel == "" && len(cfg.LogLevels) == 0 {
+		return nil
+	}
+	level, overrides, err := logLevels(cfg)
+	if err != nil {
+		return err
+	}
+	handler, err := logOutput(cfg)
+	if err != nil {
+		return err
+	}
+	log15.Root().SetHandler(log15.FilterHandler(logLevelFilter(level, overrides), handler))
+	return nil
+}
+
+// logOutput returns the handler writing logs in the configured format, to
+// LogFile and/or syslog, or otherwise standard output.
+func logOutput(cfg *Config) (log15.Handler, error) {
+	if cfg.LogFile == "" && cfg.SyslogAddress == "" {
+		if cfg.LogFormat == "" {
+			return log15.StdoutHandler, nil
+		}
+		format, err := logFormat(cfg.LogFormat, nil)
+		if err != nil {
+			return nil, err
+		}
+		return log15.StreamHandler(os.Stdout, format), nil
+	}
+	// Terminal colour codes don't belong in files or syslog.
+	format, err := logFormat(cfg.LogFormat, log15.LogfmtFormat())
+	if err != nil {
+		return nil, err
+	}
+	var handlers []log15.Handler
+	if cfg.LogFile != "" {
+		rf, err := newRotatingFile(cfg.LogFile, int64(cfg.LogMaxSizeMB)*1024*1024, time.Duration(cfg.LogMaxAgeDays)*24*time.Hour, cfg.LogKeep)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, log15.StreamHandler(rf, format))
+	}
+	if cfg.SyslogAddress != "" {
+		sh, err := syslogHandler(cfg, format)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, sh)
+	}
+	return log15.MultiHandler(handlers...), nil
+}
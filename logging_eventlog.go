@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows/svc/eventlog"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// syslogHandler returns a handler for the Windows Event Log, which stands in
+// for the local syslog here: SyslogAddress "local" logs to the Application
+// log with SyslogTag as the event source. There's no remote syslog.
+func syslogHandler(cfg *Config, format log15.Format) (log15.Handler, error) {
+	if cfg.SyslogAddress != "local" {
+		return nil, ErrSyslogUnsupported
+	}
+	el, err := eventlog.Open(cfg.SyslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return log15.FuncHandler(func(r *log15.Record) error {
+		msg := string(format.Format(r))
+		switch r.Lvl {
+		case log15.LvlCrit, log15.LvlError:
+			return el.Error(1, msg)
+		case log15.LvlWarn:
+			return el.Warning(1, msg)
+		}
+		return el.Info(1, msg)
+	}), nil
+}
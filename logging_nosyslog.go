@@ -0,0 +1,11 @@
+//go:build plan9
+// +build plan9
+
+package main
+
+import "gopkg.in/inconshreveable/log15.v2"
+
+// syslogHandler always fails, as there is no syslog on this platform.
+func syslogHandler(cfg *Config, format log15.Format) (log15.Handler, error) {
+	return nil, ErrSyslogUnsupported
+}
@@ -0,0 +1,38 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogHandler returns a handler for the syslog named by SyslogAddress:
+// "local" for the local daemon, or "udp://host:514" or "tcp://host:514".
+func syslogHandler(cfg *Config, format log15.Format) (log15.Handler, error) {
+	facility, ok := syslogFacilities[cfg.SyslogFacility]
+	if !ok {
+		return nil, ErrUnknownSyslogFacility
+	}
+	if cfg.SyslogAddress == "local" {
+		return log15.SyslogHandler(facility, cfg.SyslogTag, format)
+	}
+	parts := strings.SplitN(cfg.SyslogAddress, "://", 2)
+	if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") {
+		return nil, ErrBadSyslogAddress
+	}
+	return log15.SyslogNetHandler(parts[0], parts[1], facility, cfg.SyslogTag, format)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestLogLevelFilter(t *testing.T) {
+	keep := logLevelFilter(log15.LvlInfo, map[string]log15.Lvl{"lua": log15.LvlDebug, "imap": log15.LvlWarn})
+	record := func(lvl log15.Lvl, context string) *log15.Record {
+		return &log15.Record{Lvl: lvl, Ctx: []interface{}{"id", 3, "context", context}}
+	}
+	assert.True(t, keep(record(log15.LvlInfo, "smtp")))
+	assert.False(t, keep(record(log15.LvlDebug, "smtp")))
+	assert.True(t, keep(record(log15.LvlDebug, "lua")))
+	assert.False(t, keep(record(log15.LvlInfo, "imap")))
+	assert.True(t, keep(record(log15.LvlError, "imap")))
+	assert.True(t, keep(&log15.Record{Lvl: log15.LvlInfo}))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loopHeader marks mail the list sent, so it isn't handled again if it comes
+// back (e.g. a copy to the list address). Its value is "<list> <unix time>
+// <signature>", the signature being an HMAC of the list, time and Message-Id
+// keyed with loopKey: it can't be forged onto other mail to have it ignored,
+// and mail without a valid one is handled as usual.
+const loopHeader = "X-Listless-Loop"
+
+// loopKey returns the key for signing loopHeader: TransactionKey, or failing
+// that, the random key newEngine loaded from the database.
+func (eng *Engine) loopKey() []byte {
+	if eng.Config.TransactionKey != "" {
+		return []byte(eng.Config.TransactionKey)
+	}
+	return eng.installationKey
+}
+
+// loopSignature signs a list, time and Message-Id.
+func loopSignature(key []byte, list, timestamp, messageID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(list + "\n" + timestamp + "\n" + messageID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setMessageID gives a message a Message-Id at the list's domain if it has
+// none.
+func (eng *Engine) setMessageID(em *Email) error {
+	if em.Headers.Get("Message-Id") != "" {
+		return nil
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	domain := eng.Config.ListAddress[strings.LastIndex(eng.Config.ListAddress, "@")+1:]
+	em.Headers.Set("Message-Id", "<"+id+"@"+domain+">")
+	return nil
+}
+
+// markSent signs a message as sent by the list, giving it a Message-Id first
+// if it has none, since the signature covers it.
+func (eng *Engine) markSent(em *Email) error {
+	if err := eng.setMessageID(em); err != nil {
+		return err
+	}
+	list := normaliseEmail(eng.Config.ListAddress)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := loopSignature(eng.loopKey(), list, timestamp, em.Headers.Get("Message-Id"))
+	em.Headers.Set(loopHeader, list+" "+timestamp+" "+sig)
+	return nil
+}
+
+// sentByList reports whether headers carry a valid mark from this list.
+func (eng *Engine) sentByList(headers map[string][]string) bool {
+	list := normaliseEmail(eng.Config.ListAddress)
+	for _, value := range headers[loopHeader] {
+		fields := strings.Fields(value)
+		if len(fields) != 3 || fields[0] != list {
+			continue
+		}
+		var messageID string
+		if ids := headers["Message-Id"]; len(ids) > 0 {
+			messageID = ids[0]
+		}
+		want := loopSignature(eng.loopKey(), list, fields[1], messageID)
+		if hmac.Equal([]byte(fields[2]), []byte(want)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoopHeader(t *testing.T) {
+	eng := &Engine{Config: &Config{ListAddress: "list@example.com", TransactionKey: "installation key"}}
+	em := &Email{Email: &email.Email{Headers: textproto.MIMEHeader{}}}
+	assert.False(t, eng.sentByList(em.Headers))
+	assert.Nil(t, eng.markSent(em))
+	assert.Contains(t, em.Headers.Get("Message-Id"), "@example.com>")
+	assert.True(t, eng.sentByList(em.Headers))
+	// The mark doesn't carry over to other messages...
+	other := textproto.MIMEHeader{loopHeader: em.Headers[loopHeader], "Message-Id": {"<other@example.com>"}}
+	assert.False(t, eng.sentByList(other))
+	// ...or to other installations.
+	stranger := &Engine{Config: &Config{ListAddress: "list@example.com", TransactionKey: "another key"}}
+	assert.False(t, stranger.sentByList(em.Headers))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Largest token crypto.token will make, in bytes.
+const luaMaxTokenBytes = 1024
+
+// luaCryptoLoader is the "crypto" module, so scripts needn't make secrets with
+// math.random:
+// * crypto.token([bytes]) returns that many (default 16) random bytes from
+//     crypto/rand, hex encoded; good for transaction secrets.
+// * crypto.hmac(key, msg) returns the hex HMAC-SHA256 of msg.
+// * crypto.equal(a, b) compares two strings in constant time.
+func luaCryptoLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"token": func(L *lua.LState) int {
+			n := L.OptInt(1, 16)
+			if n < 1 || n > luaMaxTokenBytes {
+				L.ArgError(1, "token size out of range")
+				return 0
+			}
+			token, err := randomHex(n)
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+				return 0
+			}
+			L.Push(lua.LString(token))
+			return 1
+		},
+		"hmac": func(L *lua.LState) int {
+			mac := hmac.New(sha256.New, []byte(L.CheckString(1)))
+			mac.Write([]byte(L.CheckString(2)))
+			L.Push(lua.LString(hex.EncodeToString(mac.Sum(nil))))
+			return 1
+		},
+		"equal": func(L *lua.LState) int {
+			L.Push(lua.LBool(hmac.Equal([]byte(L.CheckString(1)), []byte(L.CheckString(2)))))
+			return 1
+		},
+	})
+	L.Push(mod)
+	return 1
+}
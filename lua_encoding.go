@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// qpEncode returns s quoted-printable encoded.
+func qpEncode(s string) (string, error) {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// qpDecode decodes quoted-printable s.
+func qpDecode(s string) (string, error) {
+	b, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(s)))
+	return string(b), err
+}
+
+// luaCodec makes a Lua function of a Go encoder or decoder, which returns the
+// result, or nil and an error.
+func luaCodec(fn func(string) (string, error)) lua.LGFunction {
+	return func(L *lua.LState) int {
+		out, err := fn(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(out))
+		return 1
+	}
+}
+
+func infallible(fn func([]byte) string) func(string) (string, error) {
+	return func(s string) (string, error) { return fn([]byte(s)), nil }
+}
+
+func decoding(fn func(string) ([]byte, error)) func(string) (string, error) {
+	return func(s string) (string, error) {
+		b, err := fn(s)
+		return string(b), err
+	}
+}
+
+// luaEncodingLoader is the "encoding" module. Decoders return nil and an
+// error for bad input.
+// * encoding.base64(s), encoding.unbase64(s); standard base64.
+// * encoding.base64url(s), encoding.unbase64url(s); URL-safe base64.
+// * encoding.hex(s), encoding.unhex(s).
+// * encoding.qp(s), encoding.unqp(s); quoted-printable, as in mail bodies.
+// * encoding.dataurl(mimetype, s) returns a base64 "data:" URL of s.
+func luaEncodingLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"base64":      luaCodec(infallible(base64.StdEncoding.EncodeToString)),
+		"unbase64":    luaCodec(decoding(base64.StdEncoding.DecodeString)),
+		"base64url":   luaCodec(infallible(base64.URLEncoding.EncodeToString)),
+		"unbase64url": luaCodec(decoding(base64.URLEncoding.DecodeString)),
+		"hex":         luaCodec(infallible(hex.EncodeToString)),
+		"unhex":       luaCodec(decoding(hex.DecodeString)),
+		"qp":          luaCodec(qpEncode),
+		"unqp":        luaCodec(qpDecode),
+		"dataurl": func(L *lua.LState) int {
+			mimetype := L.CheckString(1)
+			data := base64.StdEncoding.EncodeToString([]byte(L.CheckString(2)))
+			L.Push(lua.LString("data:" + mimetype + ";base64," + data))
+			return 1
+		},
+	})
+	L.Push(mod)
+	return 1
+}
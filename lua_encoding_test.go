@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotedPrintable(t *testing.T) {
+	encoded, err := qpEncode("Fáilte, a chara!")
+	assert.Nil(t, err)
+	assert.Equal(t, "F=C3=A1ilte, a chara!", encoded)
+	decoded, err := qpDecode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, "Fáilte, a chara!", decoded)
+}
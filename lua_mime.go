@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	"github.com/layeh/gopher-luar"
+	"github.com/yuin/gopher-lua"
+)
+
+// newBlankEmail returns an empty message from the given address, ready for
+// scripts to fill in.
+func newBlankEmail(from string) *Email {
+	em := &Email{Email: email.NewEmail(), inRecipientLists: make(map[string]struct{})}
+	em.setFrom(from)
+	return em
+}
+
+// setFrom sets From, and Sender to its normalised address.
+func (em *Email) setFrom(from string) {
+	em.From = from
+	em.Sender = ""
+	if addr, err := parseExpressiveEmail(from); err == nil {
+		em.Sender = normaliseEmail(addr)
+	}
+}
+
+// luaMimeLoader returns the "mime" module, for composing messages from
+// scratch. mime.new() returns a builder whose methods return it, to chain:
+// * :from(addr), :subject(s), :to(addr), :cc(addr), :bcc(addr)
+// * :text(s), :html(s); the plain and HTML bodies, sent as multipart/alternative.
+// * :header(key, value)
+// * :attachdata(filename, data[, mimetype]); the type is guessed by default.
+// * :attach(path[, filename[, mimetype]]) attaches a local file, and is only
+//     available where files may be read, i.e. not in the moderator sandbox.
+// * :email() returns the finished message, as scripts see incoming mail.
+func luaMimeLoader(allowFiles bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"new": func(L *lua.LState) int {
+				L.Push(newMimeBuilder(L, newBlankEmail(""), allowFiles))
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+func newMimeBuilder(L *lua.LState, em *Email, allowFiles bool) *lua.LTable {
+	builder := L.NewTable()
+	// Each method sets something from its string arguments (after self) and
+	// returns the builder.
+	setter := func(set func(args []string) error) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			var args []string
+			for i := 2; i <= L.GetTop(); i++ {
+				args = append(args, L.CheckString(i))
+			}
+			if err := set(args); err != nil {
+				L.RaiseError("%s", err.Error())
+				return 0
+			}
+			L.Push(builder)
+			return 1
+		})
+	}
+	arg := func(args []string, i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	methods := map[string]func(args []string) error{
+		"from":    func(args []string) error { em.setFrom(arg(args, 0)); return nil },
+		"subject": func(args []string) error { em.Subject = arg(args, 0); return nil },
+		"to":      func(args []string) error { em.AddToRecipient(arg(args, 0)); return nil },
+		"cc":      func(args []string) error { em.AddCcRecipient(arg(args, 0)); return nil },
+		"bcc":     func(args []string) error { em.AddBccRecipient(arg(args, 0)); return nil },
+		"text":    func(args []string) error { em.SetText(arg(args, 0)); return nil },
+		"html":    func(args []string) error { em.HTML = []byte(arg(args, 0)); return nil },
+		"header":  func(args []string) error { em.SetHeader(arg(args, 0), arg(args, 1)); return nil },
+		"attachdata": func(args []string) error {
+			_, err := em.Attach(strings.NewReader(arg(args, 1)), arg(args, 0), arg(args, 2))
+			return err
+		},
+	}
+	if allowFiles {
+		methods["attach"] = func(args []string) error {
+			f, err := os.Open(arg(args, 0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			name := arg(args, 1)
+			if name == "" {
+				name = filepath.Base(arg(args, 0))
+			}
+			_, err = em.Attach(f, name, arg(args, 2))
+			return err
+		}
+	}
+	for name, set := range methods {
+		builder.RawSetString(name, setter(set))
+	}
+	builder.RawSetString("email", L.NewFunction(func(L *lua.LState) int {
+		L.Push(luar.New(L, em))
+		return 1
+	}))
+	return builder
+}
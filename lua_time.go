@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Layouts the "time" module knows by name; others are taken as Go layouts.
+var luaTimeLayouts = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"rfc1123z": time.RFC1123Z,
+	"rfc822":   time.RFC822,
+	"rfc822z":  time.RFC822Z,
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04:05",
+	// As used in mail Date headers.
+	"mail": "Mon, 02 Jan 2006 15:04:05 -0700",
+}
+
+func luaTimeLayout(name string) string {
+	if layout, ok := luaTimeLayouts[strings.ToLower(name)]; ok {
+		return layout
+	}
+	return name
+}
+
+// luaTimeArg reads argument n as a time: Unix seconds, or a Go time.Time such
+// as a member's Joindate.
+func luaTimeArg(L *lua.LState, n int) time.Time {
+	if ud, ok := L.Get(n).(*lua.LUserData); ok {
+		if t, ok := ud.Value.(time.Time); ok {
+			return t
+		}
+		if t, ok := ud.Value.(*time.Time); ok {
+			return *t
+		}
+	}
+	secs := float64(L.CheckNumber(n))
+	return time.Unix(0, int64(secs*1e9))
+}
+
+// luaLocation reads an optional timezone name at n, e.g. "Europe/Dublin";
+// the default is UTC.
+func luaLocation(L *lua.LState, n int) *time.Location {
+	loc, err := time.LoadLocation(L.OptString(n, "UTC"))
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return loc
+}
+
+func luaUnix(t time.Time) lua.LNumber {
+	return lua.LNumber(float64(t.UnixNano()) / 1e9)
+}
+
+// luaTimeLoader is the "time" module. Times are Unix seconds, and functions
+// taking a time also accept Go times such as a member's Joindate:
+// * time.now() returns the current time.
+// * time.parse(layout, value[, zone]) returns a time, or nil and an error.
+//     layout is a Go layout or one of "rfc3339", "rfc1123", "rfc1123z",
+//     "rfc822", "rfc822z", "date", "datetime" or "mail"; zone is used when
+//     value doesn't give one (default "UTC").
+// * time.format(t, layout[, zone]) formats t in zone (default "UTC").
+// * time.date(t[, zone]) returns a table of year, month, day, hour, min, sec,
+//     wday (1 is Sunday) and yday, in zone.
+// * time.duration(s) returns the seconds in a Go duration like "1h30m".
+// * time.startofday(t[, zone]) returns midnight before t in zone.
+func luaTimeLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"now": func(L *lua.LState) int {
+			L.Push(luaUnix(time.Now()))
+			return 1
+		},
+		"parse": func(L *lua.LState) int {
+			layout := luaTimeLayout(L.CheckString(1))
+			t, err := time.ParseInLocation(layout, L.CheckString(2), luaLocation(L, 3))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(luaUnix(t))
+			return 1
+		},
+		"format": func(L *lua.LState) int {
+			t := luaTimeArg(L, 1)
+			layout := luaTimeLayout(L.CheckString(2))
+			L.Push(lua.LString(t.In(luaLocation(L, 3)).Format(layout)))
+			return 1
+		},
+		"date": func(L *lua.LState) int {
+			t := luaTimeArg(L, 1).In(luaLocation(L, 2))
+			date := L.NewTable()
+			date.RawSetString("year", lua.LNumber(t.Year()))
+			date.RawSetString("month", lua.LNumber(t.Month()))
+			date.RawSetString("day", lua.LNumber(t.Day()))
+			date.RawSetString("hour", lua.LNumber(t.Hour()))
+			date.RawSetString("min", lua.LNumber(t.Minute()))
+			date.RawSetString("sec", lua.LNumber(t.Second()))
+			date.RawSetString("wday", lua.LNumber(t.Weekday()+1))
+			date.RawSetString("yday", lua.LNumber(t.YearDay()))
+			L.Push(date)
+			return 1
+		},
+		"duration": func(L *lua.LState) int {
+			d, err := time.ParseDuration(L.CheckString(1))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(d.Seconds()))
+			return 1
+		},
+		"startofday": func(L *lua.LState) int {
+			t := luaTimeArg(L, 1).In(luaLocation(L, 2))
+			y, m, d := t.Date()
+			L.Push(luaUnix(time.Date(y, m, d, 0, 0, 0, 0, t.Location())))
+			return 1
+		},
+	})
+	L.Push(mod)
+	return 1
+}
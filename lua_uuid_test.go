@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUUID(t *testing.T) {
+	id, err := newUUID()
+	assert.Nil(t, err)
+	assert.Equal(t, 36, len(id))
+	assert.Equal(t, byte('4'), id[14])
+	assert.Contains(t, "89ab", string(id[19]))
+}
+
+func TestNewULID(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	a, err := newULID(now)
+	assert.Nil(t, err)
+	b, err := newULID(now.Add(time.Millisecond))
+	assert.Nil(t, err)
+	assert.Equal(t, 26, len(a))
+	assert.True(t, a < b)
+	// The first ten characters are the timestamp.
+	c, _ := newULID(now)
+	assert.Equal(t, a[:10], c[:10])
+	assert.Equal(t, "01APK58WG0", a[:10])
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
@@ -14,17 +23,113 @@ import (
 
 var (
 	app            = kingpin.New("listless", "A simple, lua-scripted discussion/mailing list driver over IMAP/SMTP")
+	quiet          = app.Flag("quiet", "Log only errors, e.g. when run from cron").Short('q').Bool()
 	loopMode       = app.Command("loop", "Run the mailing list from a lua configuration file.")
-	loopConfigfile = loopMode.Arg("configfile", "Location of config file.").Required().String()
+	loopConfigfile = loopMode.Arg("configfile", "Location of config file, or env: to read LISTLESS_ environment variables instead.").Required().String()
+	loopPIDFile    = loopMode.Flag("pidfile", "Write the process ID to this file while running, for init scripts").String()
+	loopService    = loopMode.Flag("service-name", "Name of the Windows service, when started as one").Hidden().Default("listless").String()
 
 	execMode       = app.Command("exec", "Execute a lua script in the context of a (separate) lua configuration file.")
 	execConfigfile = execMode.Arg("configfile", "Location of config file.").Required().String()
-	execScript     = execMode.Arg("script", "Location of lua script to execute.").Required().String()
+	execScript     = execMode.Arg("script", "Location of lua script to execute, or - to read it from stdin.").Required().String()
+	execSandbox    = execMode.Flag("sandbox", "Run the script as eventLoop (privileged) or a mail-triggered transaction (moderator) would be, to check it works there").Enum("privileged", "moderator")
+	execArgs       = execMode.Arg("args", "Arguments for the script, as its args table; an argument of - gives it stdin as the stdin string.").Strings()
+
+	benchMode           = app.Command("bench", "Measure throughput by handling synthetic mail against a copy of the database and a fake SMTP server")
+	benchConfigFile     = benchMode.Arg("configfile", "Location of config file").Required().String()
+	benchMessages       = benchMode.Flag("messages", "Number of messages to handle").Default("100").Int()
+	benchBodySize       = benchMode.Flag("body-size", "Size of each message body, in bytes").Default("2000").Int()
+	benchRecipients     = benchMode.Flag("recipients", "Extra Cc recipients on each message").Default("0").Int()
+	benchAttachments    = benchMode.Flag("attachments", "Fraction of messages with an attachment, 0 to 1").Default("0.1").Float64()
+	benchAttachmentSize = benchMode.Flag("attachment-size", "Size of each attachment, in bytes").Default("100000").Int()
+
+	healthMode       = app.Command("healthcheck", "Exit 0 if the running list's /healthz says it's fetching mail, for container health checks")
+	healthConfigFile = healthMode.Arg("configfile", "Location of config file, or env:").Required().String()
+	healthTimeout    = healthMode.Flag("timeout", "How long to wait for an answer").Default("10s").Duration()
+
+	serviceMode        = app.Command("service", "Run loop mode as a Windows service")
+	serviceInstallMode = serviceMode.Command("install", "Register loop mode with a config file as a service starting with Windows")
+	serviceIConfigFile = serviceInstallMode.Arg("configfile", "Location of config file").Required().String()
+	serviceIName       = serviceInstallMode.Flag("name", "Name of the service, and the event source it logs under").Default("listless").String()
+	serviceRemoveMode  = serviceMode.Command("remove", "Unregister the service")
+	serviceRName       = serviceRemoveMode.Flag("name", "Name of the service").Default("listless").String()
+
+	archiveMode        = app.Command("archive", "Manage the message archive")
+	archivePruneMode   = archiveMode.Command("prune", "Apply the configured archive retention limits now")
+	archivePConfigFile = archivePruneMode.Arg("configfile", "Location of config file").Required().String()
+	archivePYes        = archivePruneMode.Flag("yes", "Prune without asking").Bool()
+
+	anonMode        = app.Command("anon", "Handle abuse reports on an anonymous list")
+	anonRevealMode  = anonMode.Command("reveal", "Show who really sent an anonymised post")
+	anonRConfigFile = anonRevealMode.Arg("configfile", "Location of config file").Required().String()
+	anonRMessageID  = anonRevealMode.Arg("message-id", "Message-Id of the relayed post, e.g. <anon-...@host.com>").Required().String()
+
+	queueMode        = app.Command("queue", "Inspect and manage the outgoing queue")
+	queueListMode    = queueMode.Command("list", "List queued messages")
+	queueLConfigFile = queueListMode.Arg("configfile", "Location of config file").Required().String()
+	queueShowMode    = queueMode.Command("show", "Show a queued message in full")
+	queueSConfigFile = queueShowMode.Arg("configfile", "Location of config file").Required().String()
+	queueSID         = queueShowMode.Arg("id", "ID of the queued message, as given by 'queue list'").Required().String()
+	queueDropMode    = queueMode.Command("drop", "Remove a message from the queue without sending it")
+	queueDConfigFile = queueDropMode.Arg("configfile", "Location of config file").Required().String()
+	queueDID         = queueDropMode.Arg("id", "ID of the queued message").Required().String()
+	queueDYes        = queueDropMode.Flag("yes", "Drop without asking").Bool()
+	queueRetryMode   = queueMode.Command("retry", "Make a queued message due now, including failed ones")
+	queueRConfigFile = queueRetryMode.Arg("configfile", "Location of config file").Required().String()
+	queueRID         = queueRetryMode.Arg("id", "ID of the queued message").Required().String()
+	queueRNow        = queueRetryMode.Flag("now", "Send it now, rather than leaving it for the running list").Bool()
+
+	quarantineMode        = app.Command("quarantine", "Manage incoming messages that couldn't be parsed")
+	quarantineListMode    = quarantineMode.Command("list", "List quarantined messages and their parse errors")
+	quarantineLConfigFile = quarantineListMode.Arg("configfile", "Location of config file").Required().String()
+	quarantineExportMode  = quarantineMode.Command("export", "Write out the raw bytes of a quarantined message")
+	quarantineEConfigFile = quarantineExportMode.Arg("configfile", "Location of config file").Required().String()
+	quarantineEID         = quarantineExportMode.Arg("id", "ID of the quarantined message, as given by 'quarantine list'").Required().String()
+	quarantineEOutput     = quarantineExportMode.Flag("output", "File to write the message to, instead of standard output").String()
+	quarantineRetryMode   = quarantineMode.Command("retry", "Handle a quarantined message again, removing it from quarantine if it now parses")
+	quarantineRConfigFile = quarantineRetryMode.Arg("configfile", "Location of config file").Required().String()
+	quarantineRID         = quarantineRetryMode.Arg("id", "ID of the quarantined message").Required().String()
+	quarantineRFile       = quarantineRetryMode.Flag("file", "Use this (e.g. hand-repaired) file instead of the stored message").String()
+	quarantineDropMode    = quarantineMode.Command("drop", "Remove a message from quarantine")
+	quarantineDConfigFile = quarantineDropMode.Arg("configfile", "Location of config file").Required().String()
+	quarantineDID         = quarantineDropMode.Arg("id", "ID of the quarantined message").Required().String()
+	quarantineDYes        = quarantineDropMode.Flag("yes", "Drop without asking").Bool()
+
+	gdprMode        = app.Command("gdpr", "Handle data-protection requests")
+	gdprExportMode  = gdprMode.Command("export", "Export everything stored about an address as JSON")
+	gdprEConfigFile = gdprExportMode.Arg("configfile", "Location of config file").Required().String()
+	gdprEEmail      = gdprExportMode.Flag("email", "Address to export data for").Required().String()
+	gdprEOutput     = gdprExportMode.Flag("output", "File to write the export to, instead of standard output").String()
+
+	gdprEraseMode   = gdprMode.Command("erase", "Remove an address from the database, redacting it from the archive and logs")
+	gdprXConfigFile = gdprEraseMode.Arg("configfile", "Location of config file").Required().String()
+	gdprXEmail      = gdprEraseMode.Flag("email", "Address to erase").Required().String()
+	gdprXYes        = gdprEraseMode.Flag("yes", "Erase without asking").Bool()
+
+	allowMode         = app.Command("allow", "Manage addresses and domains that may post without being members")
+	allowListMode     = allowMode.Command("list", "List allowed senders")
+	allowLConfigFile  = allowListMode.Arg("configfile", "Location of config file").Required().String()
+	allowAddMode      = allowMode.Command("add", "Allow an address or domain to post")
+	allowAConfigFile  = allowAddMode.Arg("configfile", "Location of config file").Required().String()
+	allowAPattern     = allowAddMode.Arg("sender", "Address, or domain like @example.org").Required().String()
+	allowRemoveMode   = allowMode.Command("remove", "Stop allowing an address or domain to post")
+	allowRmConfigFile = allowRemoveMode.Arg("configfile", "Location of config file").Required().String()
+	allowRmPattern    = allowRemoveMode.Arg("sender", "Address, or domain like @example.org").Required().String()
+
+	completionMode  = app.Command("completion", "Print a shell completion script, e.g. for: source <(listless completion bash)")
+	completionShell = completionMode.Arg("shell", "bash, zsh or fish").Required().Enum("bash", "zsh", "fish")
 
 	subMode = app.Command("sub", "Without another command, print subscriber list")
 
 	subListMode    = subMode.Command("list", "List subscribers")
 	subLConfigFile = subListMode.Arg("configfile", "Location of config file.").Required().String()
+	subLFormat     = subListMode.Flag("format", "Output as csv, json (an array), jsonl (an object per line) or table").Default("csv").Enum("csv", "json", "jsonl", "table")
+	subLMods       = subListMode.Flag("moderators-only", "Only list moderators and owners").Bool()
+	subLCanPost    = subListMode.Flag("can-post", "Only list members who may post").Bool()
+	subLAfter      = subListMode.Flag("joined-after", "Only list members who joined after this date, as YYYY-MM-DD").String()
+	subLBefore     = subListMode.Flag("joined-before", "Only list members who joined before this date, as YYYY-MM-DD").String()
+	subLTags       = subListMode.Flag("tag", "Only list members with this role, custom field, or field=value (repeatable)").Strings()
+	subLName       = subListMode.Flag("name-contains", "Only list members whose name contains this, ignoring case").String()
 
 	subUpdateAction = subMode.Command("update", "Add or edit a subscriber")
 	subUConfigFile  = subUpdateAction.Arg("configfile", "Location of config file").Required().String()
@@ -32,28 +137,138 @@ var (
 	subUName        = subUpdateAction.Flag("name", "Name of subscriber to add or update details for. Required when adding.").String()
 	subUMod         = subUpdateAction.Flag("moderator", "Mark the new/updated user as a moderator").Bool()
 	subUPost        = subUpdateAction.Flag("can-post", "Indicate that the new/updated user may post to the list").Bool()
+	subURoles       = subUpdateAction.Flag("role", "Give the user a role: owner, moderator, poster, digest-only or readonly (repeatable)").Strings()
+	subUUnroles     = subUpdateAction.Flag("remove-role", "Take a role away from the user (repeatable)").Strings()
+	subUFields      = subUpdateAction.Flag("field", "Set a custom field, as name=value; an empty value removes it (repeatable)").Strings()
 
 	subRemoveAction = subMode.Command("remove", "Remove a subscriber")
 	subRConfigFile  = subRemoveAction.Arg("configfile", "Location of config file").Required().String()
-	subREmail       = subRemoveAction.Flag("email", "Email address of user to remove").Required().String()
+	subREmail       = subRemoveAction.Flag("email", "Email address of user to remove").String()
+	subRFile        = subRemoveAction.Flag("file", "File of addresses to remove, one per line, or - for stdin").String()
+	subRDryRun      = subRemoveAction.Flag("dry-run", "Only show which addresses are members and would be removed").Bool()
+	subRYes         = subRemoveAction.Flag("yes", "Remove without asking").Bool()
+
+	subSuspendAction = subMode.Command("suspend", "Stop a subscriber receiving mail and posting, keeping their record")
+	subSuConfigFile  = subSuspendAction.Arg("configfile", "Location of config file").Required().String()
+	subSuEmail       = subSuspendAction.Flag("email", "Email address of user to suspend").Required().String()
+
+	subResumeAction = subMode.Command("resume", "Let a suspended subscriber receive mail and post again")
+	subReConfigFile = subResumeAction.Arg("configfile", "Location of config file").Required().String()
+	subReEmail      = subResumeAction.Flag("email", "Email address of user to resume").Required().String()
+
+	subImportAction = subMode.Command("import", "Import the membership of an mlmmj, Majordomo or Google Groups list")
+	subIConfigFile  = subImportAction.Arg("configfile", "Location of config file").Required().String()
+	subIFormat      = subImportAction.Arg("format", "List software to import from: mlmmj, majordomo or googlegroups").Required().Enum("mlmmj", "majordomo", "googlegroups")
+	subIPath        = subImportAction.Arg("path", "mlmmj list directory, Majordomo list file, or Google Groups member CSV; - reads the last two from stdin").Required().String()
+
+	subLDAPAction   = subMode.Command("ldapsync", "Sync subscribers with the configured LDAP group once")
+	subLDConfigFile = subLDAPAction.Arg("configfile", "Location of config file").Required().String()
+
+	subCardDAVAction = subMode.Command("carddavsync", "Sync subscribers with the configured CardDAV address book once")
+	subCDConfigFile  = subCardDAVAction.Arg("configfile", "Location of config file").Required().String()
+
+	subStatsAction = subMode.Command("stats", "Show each subscriber's post count and last post")
+	subSConfigFile = subStatsAction.Arg("configfile", "Location of config file").Required().String()
+	subSSilentDays = subStatsAction.Flag("silent-days", "Only show subscribers who haven't posted for this many days").Int()
+
+	subReportAction = subMode.Command("report", "Print the traffic report for the last complete ReportInterval period")
+	subRpConfigFile = subReportAction.Arg("configfile", "Location of config file").Required().String()
+
+	subBouncesAction = subMode.Command("bounces", "Show bounce scores, or one subscriber's bounce history")
+	subBConfigFile   = subBouncesAction.Arg("configfile", "Location of config file").Required().String()
+	subBEmail        = subBouncesAction.Flag("email", "Show the bounce history of this address").String()
+	subBReset        = subBouncesAction.Flag("reset", "Clear the bounce history of the address given with --email").Bool()
+
+	subDedupeAction = subMode.Command("dedupe", "Find members who are probably the same person, and merge their records")
+	subDConfigFile  = subDedupeAction.Arg("configfile", "Location of config file").Required().String()
+	subDYes         = subDedupeAction.Flag("yes", "Merge every set into its earliest joiner without asking").Bool()
+	subDDryRun      = subDedupeAction.Flag("dry-run", "Only list the likely duplicates").Bool()
 )
 
 func main() {
+	cmd, err := app.Parse(os.Args[1:])
+	if err != nil {
+		exitWith(exitInvalid, "%v; try --help for ideas", err)
+	}
+	// Completion scripts are read by the shell, so mustn't have logs in, and
+	// health check output is kept by Docker, so mustn't log the settings.
+	if *quiet || cmd == completionMode.FullCommand() || cmd == healthMode.FullCommand() {
+		quietenLogs()
+	}
 	log15.Info("Welcome to Listless!", log15.Ctx{"context": "setup"})
-	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 	switch cmd {
 	case loopMode.FullCommand():
 		loopModeF()
 	case execMode.FullCommand():
 		execModeF()
+	case benchMode.FullCommand():
+		benchModeF()
+	case healthMode.FullCommand():
+		healthModeF()
+	case serviceInstallMode.FullCommand():
+		serviceInstallModeF()
+	case serviceRemoveMode.FullCommand():
+		serviceRemoveModeF()
+	case archivePruneMode.FullCommand():
+		archivePruneModeF()
+	case anonRevealMode.FullCommand():
+		anonRevealModeF()
+	case queueListMode.FullCommand():
+		queueListModeF()
+	case queueShowMode.FullCommand():
+		queueShowModeF()
+	case queueDropMode.FullCommand():
+		queueDropModeF()
+	case queueRetryMode.FullCommand():
+		queueRetryModeF()
+	case quarantineListMode.FullCommand():
+		quarantineListModeF()
+	case quarantineExportMode.FullCommand():
+		quarantineExportModeF()
+	case quarantineRetryMode.FullCommand():
+		quarantineRetryModeF()
+	case quarantineDropMode.FullCommand():
+		quarantineDropModeF()
+	case gdprExportMode.FullCommand():
+		gdprExportModeF()
+	case gdprEraseMode.FullCommand():
+		gdprEraseModeF()
+	case allowListMode.FullCommand():
+		allowListModeF()
+	case allowAddMode.FullCommand():
+		allowAddModeF()
+	case allowRemoveMode.FullCommand():
+		allowRemoveModeF()
+	case completionMode.FullCommand():
+		if err := writeCompletion(os.Stdout, *completionShell, completionNodes(app.Model())); err != nil {
+			fail(err)
+		}
 	case subUpdateAction.FullCommand():
 		subUpdateModeF()
 	case subRemoveAction.FullCommand():
 		subRemoveModeF()
+	case subSuspendAction.FullCommand():
+		subSuspendModeF(*subSuConfigFile, *subSuEmail, true)
+	case subResumeAction.FullCommand():
+		subSuspendModeF(*subReConfigFile, *subReEmail, false)
 	case subListMode.FullCommand():
 		subListModeF()
+	case subImportAction.FullCommand():
+		subImportModeF()
+	case subLDAPAction.FullCommand():
+		subLDAPModeF()
+	case subCardDAVAction.FullCommand():
+		subCardDAVModeF()
+	case subStatsAction.FullCommand():
+		subStatsModeF()
+	case subReportAction.FullCommand():
+		subReportModeF()
+	case subBouncesAction.FullCommand():
+		subBouncesModeF()
+	case subDedupeAction.FullCommand():
+		subDedupeModeF()
 	default:
-		log.Fatal("No valid command given. Try '--help' for ideas.")
+		exitWith(exitInvalid, "no valid command given; try --help for ideas")
 	}
 }
 
@@ -64,111 +279,926 @@ func subUpdateModeF() {
 	engine, err := NewEngine(config)
 	if err != nil {
 		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
-		log.Fatal(err)
+		failToStart(err)
 	}
+	defer engine.Close()
+	closeAtExit(engine)
 	email := normaliseEmail(*subUEmail)
 	if email == "" {
-		panic("Provided email address failed to normalise: " + *subUEmail)
+		exitWith(exitInvalid, "%q is not a usable email address", *subUEmail)
 	}
 	// Does user exist, or is user being added?
 	usrmeta, err := engine.DB.GetSubscriber(email)
 	switch err {
 	case nil:
-		{
-			// Edit mode
-			if usrmeta == nil {
-				panic("usrmeta is unexpectedly nil after getting a nil error from DB.GetSubscriber")
-			}
-			if subUName != nil && *subUName != "" {
-				usrmeta.Name = *subUName
-			}
-			if subUMod != nil {
-				usrmeta.Moderator = *subUMod
-			}
-			if subUPost != nil {
-				usrmeta.AllowedPost = *subUPost
-			}
-			engine.DB.UpdateSubscriber(email, usrmeta)
+		// Edit mode
+		if *subUName != "" {
+			usrmeta.Name = *subUName
 		}
+		usrmeta.Moderator = *subUMod
+		usrmeta.AllowedPost = *subUPost
 	case ErrMemberEntryNotFound:
-		{
-			// Add mode
-			name := ""
-			isMod := false
-			canPost := true
-			if subUName == nil {
-				panic("Require a name when adding a new member")
-			} else {
-				name = *subUName
-			}
-			if subUMod != nil {
-				isMod = *subUMod
-			}
-			if subUPost != nil {
-				canPost = *subUPost
-			}
-			usrmeta := engine.DB.CreateSubscriber(email, name, canPost, isMod)
-			engine.DB.UpdateSubscriber(email, usrmeta)
+		// Add mode
+		if *subUName == "" {
+			exitWith(exitInvalid, "%s is not a member yet; give a --name to add them", email)
 		}
+		usrmeta = engine.DB.CreateSubscriber(email, *subUName, *subUPost, *subUMod)
 	default:
-		{
-			panic(err)
+		exitWith(exitFailure, "couldn't read the record of %s: %v", email, err)
+	}
+	applyRoleFlags(usrmeta)
+	applyFieldFlags(usrmeta)
+	if err := engine.DB.UpdateSubscriber(email, usrmeta); err != nil {
+		exitWith(exitFailure, "couldn't save the record of %s: %v", email, err)
+	}
+}
+
+// applyRoleFlags applies the --role and --remove-role flags of "sub update".
+func applyRoleFlags(usrmeta *MemberMeta) {
+	for _, role := range *subURoles {
+		if err := usrmeta.AddRole(role); err != nil {
+			exitWith(exitInvalid, "unknown role %q; try owner, moderator, poster, digest-only or readonly", role)
+		}
+	}
+	for _, role := range *subUUnroles {
+		usrmeta.RemoveRole(role)
+	}
+}
+
+// applyFieldFlags applies the --field flags of "sub update".
+func applyFieldFlags(usrmeta *MemberMeta) {
+	for _, field := range *subUFields {
+		eq := strings.Index(field, "=")
+		if eq < 1 {
+			exitWith(exitInvalid, "--field expects name=value, got %q", field)
 		}
+		usrmeta.SetField(field[:eq], field[eq+1:])
 	}
 }
 
 func subRemoveModeF() {
 	// Indempotent for simplicity.
+	if (*subREmail == "") == (*subRFile == "") {
+		exitWith(exitInvalid, "give either --email or --file")
+	}
+	var emails []string
+	if *subRFile != "" {
+		emails = readAddressFile(*subRFile)
+	} else if email := normaliseEmail(*subREmail); email != "" {
+		emails = []string{email}
+	} else {
+		exitWith(exitInvalid, "%q is not a usable email address", *subREmail)
+	}
 	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
 	config := loadSettings(*subRConfigFile)
 	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
-	engine, err := NewEngine(config)
+	openEngine := NewEngine
+	if *subRDryRun {
+		openEngine = NewReadOnlyEngine
+	}
+	engine, err := openEngine(config)
 	if err != nil {
 		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
-		log.Fatal(err)
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if *subRDryRun || !*subRYes {
+		members := 0
+		for _, email := range emails {
+			switch _, err := engine.DB.GetSubscriber(email); err {
+			case nil:
+				fmt.Println("Would remove", email)
+				members++
+			case ErrMemberEntryNotFound:
+				fmt.Println("Not a member:", email)
+			default:
+				fail(err)
+			}
+		}
+		fmt.Printf("%d of %d addresses would be removed.\n", members, len(emails))
+		if *subRDryRun || members == 0 {
+			return
+		}
+		confirm(false, fmt.Sprintf("Remove %d members?", members))
 	}
-	email := normaliseEmail(*subREmail)
+	removed, err := engine.DB.DelSubscribers(emails)
+	if err != nil {
+		exitWith(exitFailure, "couldn't remove members, so none were: %v", err)
+	}
+	log15.Info("Removed members", log15.Ctx{"context": "db", "removed": len(removed), "notMembers": len(emails) - len(removed)})
+}
+
+// subSuspendModeF suspends or resumes a member, for "sub suspend" and "sub
+// resume".
+func subSuspendModeF(configFile, address string, suspend bool) {
+	email := normaliseEmail(address)
 	if email == "" {
-		panic("Provided email address failed to normalise: " + *subREmail)
+		exitWith(exitInvalid, "%q is not a usable email address", address)
 	}
-	err = engine.DB.DelSubscriber(email)
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(configFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
 	if err != nil {
-		panic(err)
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if err = engine.DB.SetSuspended(email, suspend); err == ErrMemberEntryNotFound {
+		exitWith(exitInvalid, "%s is not a member", email)
+	} else if err != nil {
+		fail(err)
 	}
+	log15.Info("Changed member's suspension", log15.Ctx{"context": "db", "email": email, "suspended": suspend})
 }
 
-func subListModeF() {
+// readAddressFile reads a file of addresses to act on, one per line, skipping
+// blank lines and # comments; a path of "-" reads stdin. If any address
+// doesn't normalise, it exits listing them, before anything is changed.
+func readAddressFile(path string) []string {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			exitWith(exitInvalid, "couldn't read address file: %v", err)
+		}
+		defer f.Close()
+	}
+	var emails, bad []string
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if email := normaliseEmail(line); email != "" {
+			emails = append(emails, email)
+		} else {
+			bad = append(bad, fmt.Sprintf("line %d: %q", n, line))
+		}
+	}
+	if err := lines.Err(); err != nil {
+		exitWith(exitFailure, "couldn't read address file: %v", err)
+	}
+	if len(bad) > 0 {
+		exitWith(exitInvalid, "unusable addresses in %s, so nothing was changed:\n  %s", path, strings.Join(bad, "\n  "))
+	}
+	return emails
+}
+
+func subImportModeF() {
 	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
-	config := loadSettings(*subLConfigFile)
+	config := loadSettings(*subIConfigFile)
 	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
 	engine, err := NewEngine(config)
 	if err != nil {
 		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
-		log.Fatal(err)
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	added, updated, err := engine.DB.ImportMembers(*subIFormat, *subIPath)
+	if err != nil {
+		log15.Error("Import failed", log15.Ctx{"context": "import", "added": added, "updated": updated, "error": err})
+		failPartly(err, added+updated > 0)
+	}
+	log15.Info("Import complete", log15.Ctx{"context": "import", "added": added, "updated": updated})
+}
+
+func subLDAPModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subLDConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	added, departed, err := engine.LDAPSync()
+	if err != nil {
+		log15.Error("LDAP sync failed", log15.Ctx{"context": "ldap", "error": err})
+		failPartly(err, added+departed > 0)
+	}
+	log15.Info("LDAP sync complete", log15.Ctx{"context": "ldap", "added": added, "departed": departed})
+}
+
+func subCardDAVModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subCDConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	added, departed, err := engine.CardDAVSync()
+	if err != nil {
+		log15.Error("CardDAV sync failed", log15.Ctx{"context": "carddav", "error": err})
+		failPartly(err, added+departed > 0)
+	}
+	log15.Info("CardDAV sync complete", log15.Ctx{"context": "carddav", "added": added, "departed": departed})
+}
+
+func subStatsModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subSConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
 	}
-	fmt.Println("Email,Name,Moderator,AllowedPost")
-	engine.DB.forEachSubscriber(func(email string, meta *MemberMeta) error {
-		fmt.Printf("%s,%s,%v,%v\n", email, meta.Name, meta.Moderator, meta.AllowedPost)
+	cutoff := time.Now().AddDate(0, 0, -*subSSilentDays)
+	fmt.Println("Email,Name,Joindate,Posts,LastPost")
+	err = engine.DB.forEachSubscriber(func(email string, meta *MemberMeta) error {
+		activity, err := engine.DB.MemberActivity(email)
+		if err != nil {
+			return err
+		}
+		// Members who never posted are silent since they joined.
+		lastSeen := activity.LastPost
+		if lastSeen.IsZero() {
+			lastSeen = meta.Joindate
+		}
+		if *subSSilentDays > 0 && lastSeen.After(cutoff) {
+			return nil
+		}
+		lastPost := ""
+		if !activity.LastPost.IsZero() {
+			lastPost = activity.LastPost.Format(time.RFC3339)
+		}
+		fmt.Printf("%s,%s,%s,%d,%s\n", email, meta.Name, meta.Joindate.Format(time.RFC3339), activity.Posts, lastPost)
 		return nil
 	})
+	if err != nil {
+		fail(err)
+	}
+}
+
+func benchModeF() {
+	log15.Info("Starting in bench mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*benchConfigFile)
+	result, err := runBench(config, benchOptions{
+		Messages:       *benchMessages,
+		BodySize:       *benchBodySize,
+		Recipients:     *benchRecipients,
+		Attachments:    *benchAttachments,
+		AttachmentSize: *benchAttachmentSize,
+	})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("Handled %d messages in %v (%.1f/s), %d errors\n",
+		result.Messages, result.Elapsed, float64(result.Messages)/result.Elapsed.Seconds(), result.Errors)
+	fmt.Printf("Latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(result.Latencies, 50), percentile(result.Latencies, 90), percentile(result.Latencies, 99), percentile(result.Latencies, 100))
+	fmt.Printf("Sent %d messages to %d recipients, %d bytes\n", result.Sent, result.Recipients, result.SentBytes)
+}
+
+func archivePruneModeF() {
+	log15.Info("Starting in archive mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*archivePConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if !engine.archiveRetention() {
+		exitWith(exitConfig, "no archive retention limits are configured")
+	}
+	if !*archivePYes {
+		prunable, err := engine.CountPrunable()
+		if err != nil {
+			fail(err)
+		}
+		if prunable == 0 {
+			fmt.Println("No archived messages are past the retention limits.")
+			return
+		}
+		confirm(false, fmt.Sprintf("Delete the %d oldest archived messages?", prunable))
+	}
+	removed, err := engine.PruneArchive()
+	if err != nil {
+		fail(err)
+	}
+	log15.Info("Pruned archive", log15.Ctx{"context": "db", "removed": removed})
+}
+
+func anonRevealModeF() {
+	log15.Info("Starting in anon mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*anonRConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	post, err := engine.DB.RevealAnonymousPost(*anonRMessageID)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("From: %s\nSender: %s\nSubject: %s\nOriginal Message-Id: %s\nRelayed: %s\n",
+		post.From, post.Sender, post.Subject, post.OriginalMessageID, post.Time.Format(time.RFC3339))
+}
+
+func queueListModeF() {
+	log15.Info("Starting in queue mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*queueLConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	queued, err := engine.DB.ListQueue()
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println("ID,Status,SendAt,Attempts,Sender,Subject")
+	for _, q := range queued {
+		fmt.Printf("%s,%s,%s,%d,%s,%q\n", q.ID, q.Status(), q.SendAt.Format(time.RFC3339), q.Attempts, q.Sender, q.Message.Subject)
+	}
+}
+
+func queueShowModeF() {
+	log15.Info("Starting in queue mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*queueSConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	q, err := engine.DB.GetQueued(*queueSID)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("ID: %s\nStatus: %s\nQueued: %s\nSendAt: %s\nAttempts: %d\n",
+		q.ID, q.Status(), q.Queued.Format(time.RFC3339), q.SendAt.Format(time.RFC3339), q.Attempts)
+	if q.LastError != "" {
+		fmt.Printf("LastError: %s\n", q.LastError)
+	}
+	fmt.Printf("Sender: %s\nFrom: %s\nSubject: %s\nTo: %s\nCc: %s\nBcc: %d recipients\n",
+		q.Sender, q.Message.From, q.Message.Subject, strings.Join(q.Message.To, ", "), strings.Join(q.Message.Cc, ", "), len(q.Message.Bcc))
+	for k, vs := range q.Message.Headers {
+		for _, v := range vs {
+			fmt.Printf("%s: %s\n", k, v)
+		}
+	}
+	fmt.Printf("\n%s\n", q.Message.Text)
+}
+
+func queueDropModeF() {
+	log15.Info("Starting in queue mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*queueDConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if !*queueDYes {
+		q, err := engine.DB.GetQueued(*queueDID)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("%s: %s, from %s, %q\n", q.ID, q.Status(), q.Sender, q.Message.Subject)
+		confirm(false, "Drop this message without sending it?")
+	}
+	if err = engine.DB.DropQueued(*queueDID); err != nil {
+		fail(err)
+	}
+	log15.Info("Dropped queued message", log15.Ctx{"context": "queue", "id": *queueDID})
+}
+
+func queueRetryModeF() {
+	log15.Info("Starting in queue mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*queueRConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	q, err := engine.DB.RetryQueued(*queueRID)
+	if err != nil {
+		fail(err)
+	}
+	if !*queueRNow {
+		log15.Info("Queued message is due now", log15.Ctx{"context": "queue", "id": q.ID})
+		return
+	}
+	if err = engine.sendQueued(q); err != nil {
+		fail(err)
+	}
+	log15.Info("Sent queued message", log15.Ctx{"context": "queue", "id": q.ID})
+}
+
+func quarantineListModeF() {
+	log15.Info("Starting in quarantine mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*quarantineLConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	quarantined, err := engine.DB.ListQuarantine()
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println("ID,Received,Bytes,Error")
+	for _, qm := range quarantined {
+		fmt.Printf("%s,%s,%d,%q\n", qm.ID, qm.Received.Format(time.RFC3339), len(qm.Raw), qm.Error)
+	}
+}
+
+func quarantineExportModeF() {
+	log15.Info("Starting in quarantine mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*quarantineEConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	qm, err := engine.DB.GetQuarantined(*quarantineEID)
+	if err != nil {
+		fail(err)
+	}
+	if *quarantineEOutput == "" {
+		os.Stdout.Write(qm.Raw)
+		return
+	}
+	if err = ioutil.WriteFile(*quarantineEOutput, qm.Raw, 0600); err != nil {
+		fail(err)
+	}
+}
+
+func quarantineRetryModeF() {
+	log15.Info("Starting in quarantine mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*quarantineRConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	var raw []byte
+	if *quarantineRFile != "" {
+		if raw, err = ioutil.ReadFile(*quarantineRFile); err != nil {
+			fail(err)
+		}
+	}
+	if err = engine.RetryQuarantined(*quarantineRID, raw); err != nil {
+		fail(err)
+	}
+	log15.Info("Handled quarantined message", log15.Ctx{"context": "quarantine", "id": *quarantineRID})
+}
+
+func quarantineDropModeF() {
+	log15.Info("Starting in quarantine mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*quarantineDConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if !*quarantineDYes {
+		qm, err := engine.DB.GetQuarantined(*quarantineDID)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("%s: received %s, %d bytes, %s\n", qm.ID, qm.Received.Format(time.RFC3339), len(qm.Raw), qm.Error)
+		confirm(false, "Drop this message for good?")
+	}
+	if err = engine.DB.DelQuarantined(*quarantineDID); err != nil {
+		fail(err)
+	}
+	log15.Info("Dropped quarantined message", log15.Ctx{"context": "quarantine", "id": *quarantineDID})
+}
+
+func gdprExportModeF() {
+	log15.Info("Starting in GDPR mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*gdprEConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	export, err := engine.DB.SubjectAccessExport(*gdprEEmail)
+	if err != nil {
+		fail(err)
+	}
+	exportJSON, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	if *gdprEOutput == "" {
+		fmt.Println(string(exportJSON))
+		return
+	}
+	if err = ioutil.WriteFile(*gdprEOutput, exportJSON, 0600); err != nil {
+		fail(err)
+	}
+	log15.Info("Wrote subject access export", log15.Ctx{"context": "gdpr", "email": export.Email, "file": *gdprEOutput})
+}
+
+func gdprEraseModeF() {
+	log15.Info("Starting in GDPR mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*gdprXConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	confirm(*gdprXYes, fmt.Sprintf("Erase %s from the members, archive and logs? This can't be undone.", *gdprXEmail))
+	token, err := engine.DB.EraseSubject(*gdprXEmail)
+	if err != nil {
+		fail(err)
+	}
+	// The token is printed but not logged with the address, which would undo the erasure.
+	log15.Info("Erased address", log15.Ctx{"context": "gdpr", "token": token})
+	fmt.Println(token)
+}
+
+func allowListModeF() {
+	log15.Info("Starting in allow mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*allowLConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	allowed, err := engine.DB.AllowedSenders()
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println("Sender,Added")
+	for _, as := range allowed {
+		fmt.Printf("%s,%s\n", as.Pattern, as.Added.Format(time.RFC3339))
+	}
+}
+
+func allowAddModeF() {
+	log15.Info("Starting in allow mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*allowAConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if err = engine.DB.AllowSender(*allowAPattern); err != nil {
+		fail(err)
+	}
+	log15.Info("Allowed sender", log15.Ctx{"context": "db", "sender": *allowAPattern})
+}
+
+func allowRemoveModeF() {
+	// Idempotent, like "sub remove".
+	log15.Info("Starting in allow mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*allowRmConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if err = engine.DB.DisallowSender(*allowRmPattern); err != nil {
+		fail(err)
+	}
+	log15.Info("Removed allowed sender", log15.Ctx{"context": "db", "sender": *allowRmPattern})
+}
+
+func subReportModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subRpConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	to := reportPeriodStart(config.ReportInterval, time.Now())
+	report, err := engine.BuildTrafficReport(previousReportPeriod(config.ReportInterval, to), to)
+	if err != nil {
+		fail(err)
+	}
+	text, err := engine.RenderTrafficReport(report)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Print(text)
+}
+
+func subBouncesModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subBConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	openEngine := NewReadOnlyEngine
+	if *subBReset {
+		openEngine = NewEngine
+	}
+	engine, err := openEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if *subBEmail == "" {
+		if *subBReset {
+			exitWith(exitInvalid, "--reset requires --email")
+		}
+		records, err := engine.DB.ListBounces()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("Email,Score,Events,LastBounce")
+		for _, record := range records {
+			last := ""
+			if len(record.Events) > 0 {
+				last = record.Events[len(record.Events)-1].Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%s,%v,%d,%s\n", record.Email, record.Score, len(record.Events), last)
+		}
+		return
+	}
+	if *subBReset {
+		if err := engine.DB.ResetBounces(*subBEmail); err != nil {
+			fail(err)
+		}
+		log15.Info("Bounce history cleared", log15.Ctx{"context": "bounce", "email": *subBEmail})
+		return
+	}
+	record, err := engine.DB.GetBounces(*subBEmail)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("%s: score %v (threshold %v)\n", record.Email, record.Score, config.BounceThreshold)
+	for _, event := range record.Events {
+		fmt.Printf("%s\t%s\t%s\n", event.Time.Format(time.RFC3339), event.Kind, event.Detail)
+	}
+}
+
+func subDedupeModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subDConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	openEngine := NewReadOnlyEngine
+	if !*subDDryRun {
+		openEngine = NewEngine
+	}
+	engine, err := openEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	groups, err := engine.DB.DuplicateMembers()
+	if err != nil {
+		fail(err)
+	}
+	input := bufio.NewReader(os.Stdin)
+	merged := 0
+	for _, group := range groups {
+		fmt.Println("Likely the same member:")
+		for i, addr := range group {
+			meta, err := engine.DB.GetSubscriber(addr)
+			if err != nil {
+				failPartly(err, merged > 0)
+			}
+			fmt.Printf("  %d) %s, %q, joined %s, roles %s\n", i+1, addr, meta.Name, meta.Joindate.Format("2006-01-02"), strings.Join(meta.Roles, " "))
+		}
+		if *subDDryRun {
+			continue
+		}
+		primary := 0
+		if !*subDYes {
+			fmt.Printf("Merge into which? [1-%d, Enter for 1, s to skip] ", len(group))
+			answer, err := input.ReadString('\n')
+			if err != nil && answer == "" {
+				failPartly(err, merged > 0)
+			}
+			answer = strings.TrimSpace(answer)
+			if answer == "s" {
+				continue
+			}
+			if answer != "" {
+				if primary, err = strconv.Atoi(answer); err != nil || primary < 1 || primary > len(group) {
+					fmt.Println("Not a choice; skipping.")
+					continue
+				}
+				primary--
+			}
+		}
+		others := append(append([]string(nil), group[:primary]...), group[primary+1:]...)
+		if err = engine.DB.MergeMembers(group[primary], others); err != nil {
+			failPartly(err, merged > 0)
+		}
+		log15.Info("Merged duplicate members", log15.Ctx{"context": "db", "primary": group[primary], "merged": strings.Join(others, ", ")})
+		merged++
+	}
+	fmt.Printf("%d sets of likely duplicates, %d merged.\n", len(groups), merged)
+}
+
+func subListModeF() {
+	log15.Info("Starting in subscriber mode", log15.Ctx{"context": "setup"})
+	config := loadSettings(*subLConfigFile)
+	log15.Info("Loading Engine", log15.Ctx{"context": "setup"})
+	engine, err := NewReadOnlyEngine(config)
+	if err != nil {
+		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
+		failToStart(err)
+	}
+	filter := &MemberFilter{
+		ModeratorsOnly: *subLMods,
+		CanPost:        *subLCanPost,
+		JoinedAfter:    parseDateFlag("--joined-after", *subLAfter),
+		JoinedBefore:   parseDateFlag("--joined-before", *subLBefore),
+		Tags:           *subLTags,
+		NameContains:   *subLName,
+	}
+	out, err := newMemberWriter(*subLFormat, os.Stdout)
+	if err != nil {
+		fail(err)
+	}
+	if err = engine.DB.forEachMatchingSubscriber(filter, out.Write); err != nil {
+		fail(err)
+	}
+	if err = out.Close(); err != nil {
+		fail(err)
+	}
 }
 
 func loopModeF() {
 	log15.Info("Starting in loop mode", log15.Ctx{"context": "setup"})
 	config := loadSettings(*loopConfigfile)
+	serviced := runningAsService()
+	if serviced && config.LogFile == "" && config.SyslogAddress == "" {
+		// A service's standard output goes nowhere, so log to the Event Log.
+		config.SyslogAddress, config.SyslogTag = "local", *loopService
+		if err := setupLogging(config); err != nil {
+			exitWith(exitConfig, "couldn't set up logging: %v", err)
+		}
+		if *quiet {
+			quietenLogs()
+		}
+	}
+	// Taken before the database is opened, which would wait for the other.
+	lock, err := lockInstance(config.Database)
+	if err == ErrAlreadyRunning {
+		exitWith(exitFailure, "another listless (PID %d) is already running with %s", lockHolder(config.Database), config.Database)
+	} else if err != nil {
+		exitWith(exitFailure, "couldn't take the instance lock: %v", err)
+	}
+	defer lock.release()
 	log15.Info("Loading Engine..", log15.Ctx{"context": "setup"})
 	engine, err := NewEngine(config)
 	if err != nil {
 		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
-		log.Fatal(err)
+		failToStart(err)
+	}
+	defer engine.Close()
+	closeAtExit(engine)
+	if *loopPIDFile != "" {
+		if err = writePIDFile(*loopPIDFile); err != nil {
+			exitWith(exitFailure, "couldn't write PID file: %v", err)
+		}
+		defer os.Remove(*loopPIDFile)
+	}
+	if !serviced {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			log15.Info("Received signal, finishing the current message", log15.Ctx{"context": "teardown", "signal": sig})
+			engine.Stop()
+		}()
+	}
+	if config.HTTPAddress != "" {
+		go func() {
+			err := engine.ListenAndServe()
+			log15.Error("HTTP server exited", log15.Ctx{"context": "http", "error": err})
+		}()
+	}
+	if config.AdminSocket != "" {
+		go func() {
+			err := engine.AdminListenAndServe()
+			log15.Error("Admin socket server exited", log15.Ctx{"context": "admin", "error": err})
+		}()
+	}
+	if config.NNTPAddress != "" {
+		go func() {
+			err := engine.NNTPListenAndServe()
+			log15.Error("NNTP server exited", log15.Ctx{"context": "nntp", "error": err})
+		}()
+	}
+	if config.MatrixRoomID != "" && len(config.MatrixUsers) > 0 {
+		go engine.MatrixSyncLoop(engine.Shutdown)
+	}
+	if config.LDAPURL != "" && config.LDAPGroupDN != "" {
+		go engine.LDAPSyncLoop(engine.Shutdown)
+	}
+	if config.Archive && engine.archiveRetention() {
+		go engine.ArchivePruneLoop(engine.Shutdown)
+	}
+	if config.ReportInterval != "" && len(config.ReportRecipients) > 0 {
+		go engine.ReportLoop(engine.Shutdown)
+	}
+	if config.CardDAVURL != "" {
+		go engine.CardDAVSyncLoop(engine.Shutdown)
+	}
+	go engine.QueueLoop(engine.Shutdown)
+	go engine.TransactionPurgeLoop(engine.Shutdown)
+	if config.OTLPEndpoint != "" {
+		go engine.TraceExportLoop(engine.Shutdown)
 	}
 	log15.Info("Starting event loop", log15.Ctx{"context": "setup"})
-	// Setup main loop, run forevs.
-	engine.DeliveryLoop(engine.Client, "INBOX", "", engine.Handler, "", "", engine.Shutdown)
+	if serviced {
+		// The Service Control Manager stops it, rather than a signal.
+		if err = runService(*loopService, engine); err != nil {
+			log15.Crit("Couldn't run as a service", log15.Ctx{"context": "setup", "error": err})
+		}
+	} else {
+		// Setup main loop, run forevs.
+		engine.Run()
+	}
 	//imapclient.DeliveryLoop(engine.Client, "INBOX", "", engine.Handler, "", "", engine.Shutdown)
 	log15.Info("Exited DeliveryLoop successfully, shutting down", log15.Ctx{"context": "teardown"})
 }
 
+func healthModeF() {
+	config := loadSettings(*healthConfigFile)
+	if config.HTTPAddress == "" {
+		exitWith(exitConfig, "the health check is served over HTTP, so needs HTTPAddress set")
+	}
+	host, port, err := net.SplitHostPort(config.HTTPAddress)
+	if err != nil {
+		exitWith(exitConfig, "bad HTTPAddress: %v", err)
+	}
+	// Ask the list in this container or host, whatever it listens on.
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	client := &http.Client{Timeout: *healthTimeout}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		exitWith(exitConnection, "couldn't reach the list: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		exitWith(exitFailure, "unhealthy: %s", strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+}
+
+func serviceInstallModeF() {
+	// Better to find a broken config file now than when Windows starts.
+	config := loadSettings(*serviceIConfigFile)
+	if err := installService(*serviceIName, *serviceIConfigFile); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Installed service %q for %s; start it with \"sc start %s\" or from Services.\n", *serviceIName, config.ListAddress, *serviceIName)
+}
+
+func serviceRemoveModeF() {
+	if err := removeService(*serviceRName); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Removed service %q.\n", *serviceRName)
+}
+
 func execModeF() {
 	log15.Info("Starting in exec mode", log15.Ctx{"context": "setup"})
 	config := loadSettings(*execConfigfile)
@@ -176,28 +1206,61 @@ func execModeF() {
 	engine, err := NewEngine(config)
 	if err != nil {
 		log15.Error("Failed to load Engine", log15.Ctx{"context": "setup", "error": err})
-		log.Fatal(err)
+		failToStart(err)
 	}
+	defer engine.Close()
+	closeAtExit(engine)
 	// Now execute the provided exec script once in the Engine, and quit.
 	log15.Info("Loading script for execution", log15.Ctx{"context": "setup", "script": *execScript})
-	scriptb, err := ioutil.ReadFile(*execScript)
+	var scriptb, stdin []byte
+	if *execScript == "-" {
+		scriptb, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		scriptb, err = ioutil.ReadFile(*execScript)
+	}
 	if err != nil {
 		log15.Error("Failed to load script", log15.Ctx{"context": "setup", "error": err})
-		log.Fatal(err)
+		fail(err)
+	}
+	for _, arg := range *execArgs {
+		if arg == "-" && *execScript != "-" {
+			if stdin, err = ioutil.ReadAll(os.Stdin); err != nil {
+				log15.Error("Failed to read stdin", log15.Ctx{"context": "setup", "error": err})
+				fail(err)
+			}
+			break
+		}
 	}
-	log15.Info("Executing script", log15.Ctx{"context": "setup", "script": *execScript})
-	err = engine.ExecOnce(string(scriptb))
+	log15.Info("Executing script", log15.Ctx{"context": "setup", "script": *execScript, "sandbox": *execSandbox, "args": len(*execArgs)})
+	err = engine.ExecOnce(string(scriptb), *execSandbox, *execArgs, stdin)
 	if err != nil {
 		log15.Error("Failed to execute script", log15.Ctx{"context": "setup", "error": err, "script": *execScript})
-		log.Fatal(err)
+		fail(err)
 	}
 }
 
 func loadSettings(configFile string) *Config {
-	log15.Info("Reading config file", log15.Ctx{"context": "setup", "configFile": configFile})
 	configL := lua.NewState()
-	configL.DoFile(configFile)
+	if configFile == envConfigFile {
+		log15.Info("Reading config from the environment", log15.Ctx{"context": "setup"})
+		settings, err := envSettings(os.Environ())
+		if err != nil {
+			exitWith(exitConfig, "couldn't read config from the environment: %v", err)
+		}
+		setEnvGlobals(configL, settings)
+	} else {
+		log15.Info("Reading config file", log15.Ctx{"context": "setup", "configFile": configFile})
+		if err := configL.DoFile(configFile); err != nil {
+			exitWith(exitConfig, "couldn't read config file: %v", err)
+		}
+	}
 	config := ConfigFromState(configL)
+	if err := setupLogging(config); err != nil {
+		exitWith(exitConfig, "couldn't set up logging: %v", err)
+	}
+	if *quiet {
+		quietenLogs()
+	}
 	log15.Info("Got config file, parsed into settings", log15.Ctx{"context": "setup", "configFile": configFile, "settings": config})
 	return config
 }
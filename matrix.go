@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Header set on mail that originated in the Matrix room, so that it isn't
+// mirrored straight back into the room once the list relays it.
+const matrixEventHeader = "X-Listless-Matrix-Event"
+
+var (
+	// ErrMatrixRequestFailed - Returned when the homeserver responds with a non-2xx status.
+	ErrMatrixRequestFailed = errors.New("Matrix homeserver request failed")
+
+	matrixTxnCounter int64
+)
+
+// matrixRequest makes an authenticated request to the configured homeserver's
+// client API and decodes any JSON response into out (if not nil).
+func (eng *Engine) matrixRequest(method, path string, query url.Values, body, out interface{}) error {
+	endpoint := strings.TrimRight(eng.Config.MatrixHomeserver, "/") + "/_matrix/client/r0" + path
+	if query != nil {
+		endpoint += "?" + query.Encode()
+	}
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+eng.Config.MatrixAccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", ErrMatrixRequestFailed, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// mirrorToMatrix posts a summary of a relayed message into the Matrix room.
+func (eng *Engine) mirrorToMatrix(em *Email, entry *ArchivedMessage) {
+	body := fmt.Sprintf("%s\nFrom: %s\n\n%s", em.Subject, em.From, strings.TrimSpace(em.GetText()))
+	if permalink := eng.ArchivePermalink(entry); permalink != "" {
+		body += "\n\n" + permalink
+	}
+	txnID := fmt.Sprintf("listless-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTxnCounter, 1))
+	path := "/rooms/" + url.PathEscape(eng.Config.MatrixRoomID) + "/send/m.room.message/" + txnID
+	err := eng.matrixRequest("PUT", path, nil, map[string]string{"msgtype": "m.text", "body": body}, nil)
+	if err != nil {
+		log15.Error("Error mirroring message to Matrix room", log15.Ctx{"context": "matrix", "error": err, "room": eng.Config.MatrixRoomID})
+		return
+	}
+	log15.Info("Mirrored message to Matrix room", log15.Ctx{"context": "matrix", "room": eng.Config.MatrixRoomID, "subject": em.Subject})
+}
+
+// The parts of a Matrix /sync response that the bridge cares about.
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []struct {
+					Type    string `json:"type"`
+					Sender  string `json:"sender"`
+					EventID string `json:"event_id"`
+					Content struct {
+						MsgType string `json:"msgtype"`
+						Body    string `json:"body"`
+					} `json:"content"`
+				} `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// matrixSubject makes a subject line out of the first line of a room message.
+func matrixSubject(body string) string {
+	subject := strings.TrimSpace(strings.SplitN(body, "\n", 2)[0])
+	if runes := []rune(subject); len(runes) > 60 {
+		subject = string(runes[:60]) + "…"
+	}
+	return subject
+}
+
+// MatrixSyncLoop long-polls the homeserver for new messages in the room and
+// posts those sent by users listed in MatrixUsers to the list, from their
+// mapped email address. Messages already in the room when the loop starts are
+// ignored. This blocks until closeCh is closed.
+func (eng *Engine) MatrixSyncLoop(closeCh <-chan struct{}) {
+	since := ""
+	filter := fmt.Sprintf(`{"room":{"rooms":[%q],"timeline":{"types":["m.room.message"]}}}`, eng.Config.MatrixRoomID)
+	for {
+		select {
+		case <-closeCh:
+			return
+		default:
+		}
+		query := url.Values{"filter": {filter}, "timeout": {"30000"}}
+		if since != "" {
+			query.Set("since", since)
+		}
+		var resp matrixSyncResponse
+		if err := eng.matrixRequest("GET", "/sync", query, nil, &resp); err != nil {
+			log15.Error("Error syncing with Matrix homeserver", log15.Ctx{"context": "matrix", "error": err})
+			<-time.After(time.Duration(eng.Config.PollFrequency) * time.Second)
+			continue
+		}
+		if since != "" {
+			for _, event := range resp.Rooms.Join[eng.Config.MatrixRoomID].Timeline.Events {
+				from, ok := eng.Config.MatrixUsers[event.Sender]
+				if !ok || event.Content.MsgType != "m.text" {
+					continue
+				}
+				err := eng.sendToList(from, matrixSubject(event.Content.Body), event.Content.Body, map[string]string{matrixEventHeader: event.EventID})
+				if err != nil {
+					log15.Error("Error posting Matrix message to list", log15.Ctx{"context": "matrix", "error": err, "sender": event.Sender})
+					continue
+				}
+				log15.Info("Posted Matrix message to list", log15.Ctx{"context": "matrix", "sender": event.Sender, "from": from})
+			}
+		}
+		since = resp.NextBatch
+	}
+}
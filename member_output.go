@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// memberColumns are the columns of sub list's csv and table formats. The
+// first six are those it has always printed, so scripts reading them by
+// position keep working.
+var memberColumns = []string{"Email", "Name", "Moderator", "AllowedPost", "Roles", "Fields",
+	"Joindate", "Delivery", "Language", "Source", "SourceID", "Departed", "Suspended"}
+
+// memberRow returns a member's record as memberColumns.
+func memberRow(email string, meta *MemberMeta) []string {
+	return []string{
+		email,
+		meta.Name,
+		strconv.FormatBool(meta.Moderator),
+		strconv.FormatBool(meta.AllowedPost),
+		strings.Join(meta.Roles, " "),
+		strings.Join(meta.fieldList(), " "),
+		meta.Joindate.Format(time.RFC3339),
+		meta.Delivery,
+		meta.Language,
+		meta.Source,
+		meta.SourceID,
+		strconv.FormatBool(meta.Departed),
+		strconv.FormatBool(meta.Suspended),
+	}
+}
+
+// memberWriter writes member records in one of sub list's formats. Close
+// must be called after the last record.
+type memberWriter interface {
+	Write(email string, meta *MemberMeta) error
+	Close() error
+}
+
+// newMemberWriter returns a memberWriter for format: csv, json, jsonl or
+// table.
+func newMemberWriter(format string, w io.Writer) (memberWriter, error) {
+	switch format {
+	case "", "csv":
+		return newCSVMemberWriter(w)
+	case "json":
+		return &jsonMemberWriter{w: w, array: true}, nil
+	case "jsonl":
+		return &jsonMemberWriter{w: w}, nil
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		_, err := fmt.Fprintln(tw, strings.Join(memberColumns, "\t"))
+		return &tableMemberWriter{tw}, err
+	}
+	return nil, fmt.Errorf("unknown format %q; use csv, json, jsonl or table", format)
+}
+
+type csvMemberWriter struct {
+	w *csv.Writer
+}
+
+func newCSVMemberWriter(w io.Writer) (*csvMemberWriter, error) {
+	cw := &csvMemberWriter{csv.NewWriter(w)}
+	return cw, cw.w.Write(memberColumns)
+}
+
+func (cw *csvMemberWriter) Write(email string, meta *MemberMeta) error {
+	return cw.w.Write(memberRow(email, meta))
+}
+
+func (cw *csvMemberWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// jsonMemberWriter writes each MemberMeta as a JSON object, either one per
+// line or as the elements of an array.
+type jsonMemberWriter struct {
+	w     io.Writer
+	array bool
+	n     int
+}
+
+func (jw *jsonMemberWriter) Write(email string, meta *MemberMeta) error {
+	// Records from before Email was stored lack it.
+	record := *meta
+	record.Email = email
+	b, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	sep := "\n"
+	if jw.array {
+		sep = ",\n"
+		if jw.n == 0 {
+			sep = "[\n"
+		}
+	}
+	if jw.array || jw.n > 0 {
+		if _, err = io.WriteString(jw.w, sep); err != nil {
+			return err
+		}
+	}
+	jw.n++
+	_, err = jw.w.Write(b)
+	return err
+}
+
+func (jw *jsonMemberWriter) Close() error {
+	end := "\n"
+	if jw.array {
+		end = "\n]\n"
+		if jw.n == 0 {
+			end = "[]\n"
+		}
+	} else if jw.n == 0 {
+		return nil
+	}
+	_, err := io.WriteString(jw.w, end)
+	return err
+}
+
+type tableMemberWriter struct {
+	tw *tabwriter.Writer
+}
+
+func (tw *tableMemberWriter) Write(email string, meta *MemberMeta) error {
+	_, err := fmt.Fprintln(tw.tw, strings.Join(memberRow(email, meta), "\t"))
+	return err
+}
+
+func (tw *tableMemberWriter) Close() error {
+	return tw.tw.Flush()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberWriter(t *testing.T) {
+	joined := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	alice := &MemberMeta{Name: "Alice, Jr.", Joindate: joined, AllowedPost: true, Custom: map[string]string{"number": "7"}}
+	bob := &MemberMeta{Name: "Bob", Joindate: joined, Moderator: true}
+	write := func(format string) string {
+		var buf bytes.Buffer
+		w, err := newMemberWriter(format, &buf)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Write("alice@example.org", alice))
+		assert.NoError(t, w.Write("bob@example.org", bob))
+		assert.NoError(t, w.Close())
+		return buf.String()
+	}
+
+	lines := strings.Split(write("csv"), "\n")
+	assert.Equal(t, "Email,Name,Moderator,AllowedPost,Roles,Fields,Joindate,Delivery,Language,Source,SourceID,Departed,Suspended", lines[0])
+	assert.Equal(t, `alice@example.org,"Alice, Jr.",false,true,,number=7,2016-05-01T12:00:00Z,,,,,false,false`, lines[1])
+
+	var all []MemberMeta
+	assert.NoError(t, json.Unmarshal([]byte(write("json")), &all))
+	assert.Len(t, all, 2)
+	assert.Equal(t, "alice@example.org", all[0].Email)
+	assert.Equal(t, "7", all[0].GetField("number"))
+	assert.True(t, all[1].Moderator)
+
+	lines = strings.Split(strings.TrimSpace(write("jsonl")), "\n")
+	assert.Len(t, lines, 2)
+	var one MemberMeta
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &one))
+	assert.Equal(t, "bob@example.org", one.Email)
+	assert.True(t, one.Joindate.Equal(joined))
+
+	var empty bytes.Buffer
+	w, _ := newMemberWriter("json", &empty)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "[]\n", empty.String())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"strconv"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrMessageTooLarge - Returned for incoming messages over MaxMessageMB, which
+// are quarantined with only their headers.
+var ErrMessageTooLarge = errors.New("Message is larger than MaxMessageMB")
+
+// Longest header block kept of an oversized message.
+const maxHeaderBlockBytes = 256 << 10
+
+// maxMessageBytes is MaxMessageMB in bytes, or 0 for no limit.
+func (eng *Engine) maxMessageBytes() int64 {
+	return int64(eng.Config.MaxMessageMB) << 20
+}
+
+// readHeaderBlock returns a message's header block, up to and including the
+// blank line that ends it, without reading the body.
+func readHeaderBlock(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxHeaderBlockBytes))
+	var headers bytes.Buffer
+	for {
+		line, err := br.ReadBytes('\n')
+		headers.Write(line)
+		if err == io.EOF {
+			return headers.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return headers.Bytes(), nil
+		}
+	}
+}
+
+// quarantineOversize quarantines a message over MaxMessageMB with only its
+// headers, so the body is never parsed or stored, and tells the admin.
+func (eng *Engine) quarantineOversize(r io.ReadSeeker, size int64) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	headers, err := readHeaderBlock(r)
+	if err != nil {
+		return err
+	}
+	ctx := log15.Ctx{"context": "imap", "bytes": size, "limitMB": eng.Config.MaxMessageMB}
+	if msg, err := mail.ReadMessage(bytes.NewReader(headers)); err == nil {
+		ctx["from"] = msg.Header.Get("From")
+		ctx["subject"] = msg.Header.Get("Subject")
+	}
+	log15.Warn("Received email over size limit", ctx)
+	qm, err := eng.DB.QuarantineHeaders(headers, ErrMessageTooLarge)
+	if err != nil {
+		log15.Error("Error quarantining oversized email", log15.Ctx{"context": "db", "error": err})
+	} else {
+		log15.Info("Quarantined headers of oversized email", log15.Ctx{"context": "db", "id": qm.ID})
+	}
+	eng.notifyAdmin("Incoming message of over "+strconv.FormatInt(size>>20, 10)+"MB was refused", ErrMessageTooLarge, headers)
+	return ErrMessageTooLarge
+}
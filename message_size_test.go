@@ -0,0 +1,15 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadHeaderBlock(t *testing.T) {
+	msg := "From: a@example.com\r\nSubject: Big\r\n\r\nbody\r\n"
+	headers, err := readHeaderBlock(strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, "From: a@example.com\r\nSubject: Big\r\n\r\n", string(headers))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// stageTimings is the time a message spent in each stage of handling.
+type stageTimings struct {
+	// Waiting on the mail server since the cycle began or the last message
+	// was handled; zero for messages that didn't come from a fetch loop.
+	fetch time.Duration
+	parse time.Duration
+	// Running eventLoop.
+	lua time.Duration
+	// Handing the message, and any digests or notices, to the Transport.
+	send time.Duration
+}
+
+func (t *stageTimings) total() time.Duration {
+	return t.fetch + t.parse + t.lua + t.send
+}
+
+func (t *stageTimings) add(o *stageTimings) {
+	t.fetch += o.fetch
+	t.parse += o.parse
+	t.lua += o.lua
+	t.send += o.send
+}
+
+func (t *stageTimings) logCtx() log15.Ctx {
+	return log15.Ctx{"fetch": t.fetch, "parse": t.parse, "lua": t.lua, "send": t.send, "total": t.total()}
+}
+
+// deliveryMetrics sums stage timings over each fetch cycle.
+type deliveryMetrics struct {
+	mu       sync.Mutex
+	since    time.Time
+	messages int
+	cycle    stageTimings
+}
+
+// beginCycle starts timing a fetch cycle.
+func (m *deliveryMetrics) beginCycle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.since = time.Now()
+	m.messages = 0
+	m.cycle = stageTimings{}
+}
+
+// endCycle returns the cycle's summed timings and how many messages they
+// cover.
+func (m *deliveryMetrics) endCycle() (stageTimings, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.since = time.Time{}
+	return m.cycle, m.messages
+}
+
+// messageArrived starts timing a message, charging the wait since the last
+// one to fetching it.
+func (m *deliveryMetrics) messageArrived() *stageTimings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := new(stageTimings)
+	if !m.since.IsZero() {
+		t.fetch = time.Since(m.since)
+	}
+	return t
+}
+
+// messageDone adds a message's timings to the cycle.
+func (m *deliveryMetrics) messageDone(t *stageTimings) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.since.IsZero() {
+		return
+	}
+	m.cycle.add(t)
+	m.messages++
+	m.since = time.Now()
+}
+
+// finishTimings logs how long a message took in each stage, as a warning if
+// it took longer than SlowMessageSeconds.
+func (eng *Engine) finishTimings(t *stageTimings) {
+	eng.metrics.messageDone(t)
+	ctx := t.logCtx()
+	ctx["context"] = "metrics"
+	slow := time.Duration(eng.Config.SlowMessageSeconds * float64(time.Second))
+	if slow > 0 && t.total() >= slow {
+		log15.Warn("Slow message", ctx)
+		return
+	}
+	log15.Info("Message timings", ctx)
+}
+
+// logCycleTimings logs the summed timings of a fetch cycle.
+func (eng *Engine) logCycleTimings(fetcher string) {
+	totals, n := eng.metrics.endCycle()
+	if n == 0 {
+		return
+	}
+	ctx := totals.logCtx()
+	ctx["context"] = fetcher
+	ctx["messages"] = n
+	log15.Info("Delivery cycle timings", ctx)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryMetrics(t *testing.T) {
+	m := new(deliveryMetrics)
+	// Messages handled outside a fetch cycle have no fetch time, and aren't
+	// counted.
+	outside := m.messageArrived()
+	assert.Equal(t, time.Duration(0), outside.fetch)
+	m.messageDone(outside)
+
+	m.beginCycle()
+	for i := 0; i < 2; i++ {
+		timings := m.messageArrived()
+		timings.lua = time.Second
+		timings.send = 2 * time.Second
+		m.messageDone(timings)
+	}
+	totals, n := m.endCycle()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 2*time.Second, totals.lua)
+	assert.True(t, totals.total() >= 6*time.Second)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jordan-wright/email"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrHeldBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrHeldBucketNotFound = errors.New("Held message bucket not found")
+
+	// ErrHeldMessageNotFound - Returned when a held message has already been
+	// released or rejected, or never existed.
+	ErrHeldMessageNotFound = errors.New("No held message with that ID")
+
+	// ErrModerationNeedsURL - Returned when a message is held but there is no
+	// PublicURL to build approval links with.
+	ErrModerationNeedsURL = errors.New("Holding messages for moderation needs HTTPAddress and PublicURL to be set")
+
+	// ErrNoModerators - Returned when a message is held but no moderator
+	// receives mail, so nobody could release it.
+	ErrNoModerators = errors.New("Holding messages for moderation needs a moderator who receives mail")
+)
+
+// Transactions created for held messages use this ScriptName and ScriptHook,
+// which no Lua script can have, so they are handled by listless itself.
+const (
+	moderationScriptName = "listless"
+	moderationScriptHook = "moderate"
+)
+
+// HeldMessage is a post kept back by Email.Hold until Quorum moderators
+// release it, or one rejects it. Message is the post as eventLoop left it,
+// including recipients.
+type HeldMessage struct {
+	ID      string
+	Message *email.Email
+	Sender  string
+	Subject string
+	Reason  string
+	Held    time.Time
+	Expires time.Time
+	SendAt  time.Time
+	// Moderators who have approved release so far.
+	Quorum    int
+	Approvals []string
+	// Hashed secrets of each moderator's approval transaction, removed once
+	// the message is dealt with.
+	Transactions map[string]string
+}
+
+// hasApproved reports whether a moderator has already approved the message.
+func (held *HeldMessage) hasApproved(moderator string) bool {
+	for _, approver := range held.Approvals {
+		if approver == moderator {
+			return true
+		}
+	}
+	return false
+}
+
+// putHeld stores or replaces a held message.
+func (db *ListlessDB) putHeld(held *HeldMessage) error {
+	heldb, err := json.Marshal(held)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		heldBucket := tx.Bucket([]byte(heldBucketName))
+		if heldBucket == nil {
+			return ErrHeldBucketNotFound
+		}
+		return heldBucket.Put([]byte(held.ID), heldb)
+	})
+}
+
+// GetHeld returns a held message by ID.
+func (db *ListlessDB) GetHeld(id string) (*HeldMessage, error) {
+	held := new(HeldMessage)
+	err := db.View(func(tx *bolt.Tx) error {
+		heldBucket := tx.Bucket([]byte(heldBucketName))
+		if heldBucket == nil {
+			return ErrHeldBucketNotFound
+		}
+		heldb := heldBucket.Get([]byte(id))
+		if heldb == nil {
+			return ErrHeldMessageNotFound
+		}
+		return json.Unmarshal(heldb, held)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+// updateHeld changes a held message with edit and, if edit says so, removes
+// it, all in one transaction, so that moderators acting at once can't lose
+// each other's approvals or both act on the message. It returns the message
+// as edited, and whether this call removed it. The approval transactions
+// stay until delHeldTransactions, so the links still work if the message
+// has to be put back.
+func (db *ListlessDB) updateHeld(id string, edit func(held *HeldMessage) (remove bool)) (*HeldMessage, bool, error) {
+	held := new(HeldMessage)
+	var removed bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		heldBucket := tx.Bucket([]byte(heldBucketName))
+		if heldBucket == nil {
+			return ErrHeldBucketNotFound
+		}
+		heldb := heldBucket.Get([]byte(id))
+		if heldb == nil {
+			return ErrHeldMessageNotFound
+		}
+		if err := json.Unmarshal(heldb, held); err != nil {
+			return err
+		}
+		if removed = edit(held); removed {
+			return heldBucket.Delete([]byte(id))
+		}
+		heldb, err := json.Marshal(held)
+		if err != nil {
+			return err
+		}
+		return heldBucket.Put([]byte(id), heldb)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return held, removed, nil
+}
+
+// delHeldTransactions removes the approval transactions of a held message
+// that has been dealt with.
+func (db *ListlessDB) delHeldTransactions(held *HeldMessage) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		transBucket := tx.Bucket([]byte(transactionBucketName))
+		if transBucket == nil {
+			return ErrTransactionBucketNotFound
+		}
+		for _, hash := range held.Transactions {
+			sHash, err := hex.DecodeString(hash)
+			if err != nil {
+				return err
+			}
+			if err = transBucket.Delete(sHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeExpiredHeld discards held messages whose approval links have expired,
+// with their transactions, logging each as withheld, so unmoderated posts
+// don't stay in the database for ever.
+func (db *ListlessDB) PurgeExpiredHeld() (removed int, err error) {
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		heldBucket := tx.Bucket([]byte(heldBucketName))
+		if heldBucket == nil {
+			return ErrHeldBucketNotFound
+		}
+		// Deleting while iterating skips keys, so collect them first.
+		var expired []*HeldMessage
+		err := heldBucket.ForEach(func(k, v []byte) error {
+			held := new(HeldMessage)
+			if err := json.Unmarshal(v, held); err != nil {
+				return err
+			}
+			if !held.Expires.IsZero() && held.Expires.Before(now) {
+				expired = append(expired, held)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, held := range expired {
+			if err := deleteHeld(tx, held); err != nil {
+				return err
+			}
+			if err := logEvent(tx, EventWithheld, held.Sender); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// deleteHeld removes a held message and its approval transactions.
+func deleteHeld(tx *bolt.Tx, held *HeldMessage) error {
+	transBucket := tx.Bucket([]byte(transactionBucketName))
+	if transBucket == nil {
+		return ErrTransactionBucketNotFound
+	}
+	for _, hash := range held.Transactions {
+		sHash, err := hex.DecodeString(hash)
+		if err != nil {
+			return err
+		}
+		if err = transBucket.Delete(sHash); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(heldBucketName)).Delete([]byte(held.ID))
+}
+
+// delTransactionHash removes a transaction by the hex of its hashed secret.
+func (db *ListlessDB) delTransactionHash(hash string) error {
+	sHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(transactionBucketName)).Delete(sHash)
+	})
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// issueModerationLink registers a new approval transaction for a moderator,
+// replacing any they had, and returns its link.
+func (eng *Engine) issueModerationLink(held *HeldMessage, moderator string) (string, error) {
+	secret, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	err = eng.DB.PutTransaction(secret, &MailTransaction{
+		ScriptName: moderationScriptName,
+		ScriptHook: moderationScriptHook,
+		RefCode:    held.ID,
+		Permitted:  []string{moderator},
+		Expires:    held.Expires,
+	})
+	if err != nil {
+		return "", err
+	}
+	if old, ok := held.Transactions[moderator]; ok {
+		if err = eng.DB.delTransactionHash(old); err != nil {
+			return "", err
+		}
+	}
+	held.Transactions[moderator] = hex.EncodeToString(eng.DB.hashSecret(secret))
+	return eng.moderationURL(secret), nil
+}
+
+// moderationURL returns the approval page for a moderation secret.
+func (eng *Engine) moderationURL(secret string) string {
+	return strings.TrimRight(eng.Config.PublicURL, "/") + "/moderation/" + secret
+}
+
+// holdMessage stores a message that eventLoop asked to Hold, and mails each
+// moderator a link of their own to release or reject it. Each link is backed
+// by a MailTransaction permitting only that moderator. The message needs
+// ModerationQuorum approvals, or all moderators' if there are fewer. Held
+// messages nobody deals with are purged once they expire.
+func (eng *Engine) holdMessage(em *Email) error {
+	if eng.Config.PublicURL == "" || eng.Config.HTTPAddress == "" {
+		log15.Error("Message held, but approval links can't be served", log15.Ctx{"context": "moderation", "error": ErrModerationNeedsURL})
+		return ErrModerationNeedsURL
+	}
+	moderators := eng.DB.goGetAllSubscribers(true)
+	if len(moderators) == 0 {
+		log15.Error("Message held, but there is nobody to release it", log15.Ctx{"context": "moderation", "error": ErrNoModerators, "sender": em.Sender})
+		return ErrNoModerators
+	}
+	id, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	held := &HeldMessage{
+		ID:           id,
+		Message:      em.Email,
+		Sender:       em.Sender,
+		Subject:      em.Subject,
+		Reason:       em.holdReason,
+		Held:         now,
+		SendAt:       em.sendAt,
+		Expires:      now.Add(time.Duration(eng.Config.HoldExpiryHours) * time.Hour),
+		Transactions: make(map[string]string),
+	}
+	held.Quorum = eng.Config.ModerationQuorum
+	if held.Quorum < 1 {
+		held.Quorum = 1
+	}
+	if held.Quorum > len(moderators) {
+		held.Quorum = len(moderators)
+	}
+	links := make(map[string]string)
+	for _, moderator := range moderators {
+		if links[moderator], err = eng.issueModerationLink(held, moderator); err != nil {
+			return err
+		}
+	}
+	if err = eng.DB.putHeld(held); err != nil {
+		return err
+	}
+	log15.Info("Held message for moderation", log15.Ctx{"context": "moderation", "id": id, "sender": em.Sender, "reason": em.holdReason, "moderators": len(links), "quorum": held.Quorum})
+	for moderator, link := range links {
+		if err = eng.notifyModerator(moderator, link, held); err != nil {
+			log15.Error("Error sending approval link to moderator", log15.Ctx{"context": "moderation", "moderator": moderator, "error": err})
+		}
+	}
+	return nil
+}
+
+// notifyModerator mails a moderator their approval link for a held message.
+func (eng *Engine) notifyModerator(moderator, link string, held *HeldMessage) error {
+	subject, body, err := eng.renderNotice("moderation", moderator, map[string]interface{}{
+		"Sender":    held.Sender,
+		"Subject":   held.Subject,
+		"Reason":    held.Reason,
+		"Approvals": len(held.Approvals),
+		"Quorum":    held.Quorum,
+		"Link":      link,
+		"Expires":   held.Expires.Format("2 Jan 2006 15:04 MST"),
+	})
+	if err != nil {
+		return err
+	}
+	e := email.NewEmail()
+	e.From = eng.fromAddress("moderation")
+	e.To = []string{moderator}
+	e.Subject = subject
+	e.Text = []byte(body)
+	em := WrapEmail(e)
+	if err = eng.markSent(em); err != nil {
+		return err
+	}
+	return eng.deliver(context.Background(), em)
+}
+
+// ApproveHeld records a moderator's approval of a held message, releasing it
+// once the quorum is met. Until then, the moderators yet to approve are mailed
+// fresh links with the tally so far.
+func (eng *Engine) ApproveHeld(id, moderator string) (released bool, err error) {
+	held, released, err := eng.DB.updateHeld(id, func(held *HeldMessage) bool {
+		if !held.hasApproved(moderator) {
+			held.Approvals = append(held.Approvals, moderator)
+		}
+		return len(held.Approvals) >= held.Quorum
+	})
+	if err != nil {
+		return false, err
+	}
+	if released {
+		return true, eng.releaseHeld(held, moderator)
+	}
+	log15.Info("Held message approved, awaiting quorum", log15.Ctx{"context": "moderation", "id": id, "moderator": moderator, "approvals": len(held.Approvals), "quorum": held.Quorum})
+	links := make(map[string]string)
+	for remaining := range held.Transactions {
+		if held.hasApproved(remaining) {
+			continue
+		}
+		if links[remaining], err = eng.issueModerationLink(held, remaining); err != nil {
+			return false, err
+		}
+	}
+	issued := &HeldMessage{Transactions: make(map[string]string)}
+	for remaining := range links {
+		issued.Transactions[remaining] = held.Transactions[remaining]
+	}
+	// Only the links change, so approvals given meanwhile aren't lost.
+	_, _, err = eng.DB.updateHeld(id, func(current *HeldMessage) bool {
+		for remaining, hash := range issued.Transactions {
+			current.Transactions[remaining] = hash
+		}
+		return false
+	})
+	if err == ErrHeldMessageNotFound {
+		// Dealt with meanwhile, so the new links are no use.
+		return false, eng.DB.delHeldTransactions(issued)
+	} else if err != nil {
+		return false, err
+	}
+	for remaining, link := range links {
+		if err = eng.notifyModerator(remaining, link, held); err != nil {
+			log15.Error("Error sending approval link to moderator", log15.Ctx{"context": "moderation", "moderator": remaining, "error": err})
+		}
+	}
+	return false, nil
+}
+
+// ReleaseHeld sends a held message on to the list as eventLoop left it,
+// regardless of quorum. If eventLoop set a SendAt time that's still to come,
+// it is queued instead.
+func (eng *Engine) ReleaseHeld(id, moderator string) error {
+	held, _, err := eng.DB.updateHeld(id, func(*HeldMessage) bool { return true })
+	if err != nil {
+		return err
+	}
+	return eng.releaseHeld(held, moderator)
+}
+
+// releaseHeld sends on a held message this caller has removed. If that
+// fails, the message is put back to be released again.
+func (eng *Engine) releaseHeld(held *HeldMessage, moderator string) error {
+	em := WrapEmail(held.Message)
+	em.Sender = held.Sender
+	em.sendAt = held.SendAt
+	if err := eng.dispatch(context.Background(), em); err != nil {
+		if putErr := eng.DB.putHeld(held); putErr != nil {
+			log15.Crit("Error putting back a held message that couldn't be sent", log15.Ctx{"context": "moderation", "id": held.ID, "error": putErr})
+		}
+		return err
+	}
+	log15.Info("Held message released", log15.Ctx{"context": "moderation", "id": held.ID, "moderator": moderator})
+	return eng.DB.delHeldTransactions(held)
+}
+
+// RejectHeld discards a held message. One rejection is enough, whatever the
+// quorum for release.
+func (eng *Engine) RejectHeld(id, moderator string) error {
+	held, _, err := eng.DB.updateHeld(id, func(*HeldMessage) bool { return true })
+	if err != nil {
+		return err
+	}
+	log15.Info("Held message rejected", log15.Ctx{"context": "moderation", "id": id, "moderator": moderator})
+	if err = eng.DB.delHeldTransactions(held); err != nil {
+		return err
+	}
+	return eng.DB.LogEvent(EventWithheld, held.Sender)
+}
+
+var moderationPage = template.Must(template.New("moderation").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Moderation: {{.ListAddress}}</title></head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>{{else}}
+<h1>Held message</h1>
+<dl>
+<dt>From</dt><dd>{{.Held.Sender}}</dd>
+<dt>Subject</dt><dd>{{.Held.Subject}}</dd>
+<dt>Reason</dt><dd>{{.Held.Reason}}</dd>
+<dt>Held</dt><dd>{{.Held.Held.Format "2 Jan 2006 15:04 MST"}}</dd>
+<dt>Approvals</dt><dd>{{len .Held.Approvals}} of {{.Held.Quorum}} needed{{if .Approved}}, including yours{{end}}</dd>
+</dl>
+<pre>{{printf "%s" .Held.Message.Text}}</pre>
+<form method="post">
+{{if .NeedToken}}<p><label>Moderation token <input type="password" name="token"></label></p>{{end}}
+<button type="submit" name="action" value="release">Release</button>
+<button type="submit" name="action" value="reject">Reject</button>
+</form>{{end}}
+</body></html>
+`))
+
+type moderationPageData struct {
+	ListAddress string
+	Held        *HeldMessage
+	NeedToken   bool
+	Approved    bool
+	Message     string
+}
+
+// serveModeration handles approval links for held messages. GET shows the
+// message with a form, so that link scanners and prefetching can't act on it;
+// POST releases or rejects it. If ModerationToken is set, the form must carry it.
+func (eng *Engine) serveModeration(w http.ResponseWriter, r *http.Request) {
+	data := moderationPageData{ListAddress: eng.Config.ListAddress, NeedToken: eng.Config.ModerationToken != ""}
+	render := func(status int, message string) {
+		data.Message = message
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := moderationPage.Execute(w, data); err != nil {
+			log15.Error("Error rendering moderation page", log15.Ctx{"context": "http", "error": err})
+		}
+	}
+	secret := strings.TrimPrefix(r.URL.Path, "/moderation/")
+	trans, err := eng.DB.GetTransaction(secret)
+	if err != nil || trans.ScriptName != moderationScriptName || trans.ScriptHook != moderationScriptHook || len(trans.Permitted) == 0 {
+		render(http.StatusNotFound, "This link is not valid, or the message has already been dealt with.")
+		return
+	}
+	if trans.isExpired() {
+		render(http.StatusGone, "This link has expired.")
+		return
+	}
+	moderator := trans.Permitted[0]
+	if data.Held, err = eng.DB.GetHeld(trans.RefCode); err != nil {
+		render(http.StatusNotFound, "This message has already been dealt with.")
+		return
+	}
+	data.Approved = data.Held.hasApproved(moderator)
+	switch r.Method {
+	case "GET":
+		render(http.StatusOK, "")
+	case "POST":
+		if data.NeedToken && subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(eng.Config.ModerationToken)) != 1 {
+			render(http.StatusForbidden, "Incorrect moderation token.")
+			return
+		}
+		var done string
+		switch r.PostFormValue("action") {
+		case "release":
+			var released bool
+			released, err = eng.ApproveHeld(trans.RefCode, moderator)
+			done = "released"
+			if !released {
+				done = "approved; it will be released once enough moderators agree"
+			}
+		case "reject":
+			err, done = eng.RejectHeld(trans.RefCode, moderator), "rejected"
+		default:
+			render(http.StatusBadRequest, "Unknown action.")
+			return
+		}
+		if err != nil {
+			log15.Error("Error acting on held message", log15.Ctx{"context": "moderation", "id": trans.RefCode, "error": err})
+			render(http.StatusInternalServerError, "Something went wrong; see the list's logs.")
+			return
+		}
+		render(http.StatusOK, "Done: the message was "+done+".")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
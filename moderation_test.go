@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+// moderationTestEngine returns an engine with two moderators and a subscriber,
+// sending with the fake Transport.
+func moderationTestEngine(t *testing.T) (*Engine, func()) {
+	dir, err := ioutil.TempDir("", "listless-moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase(path.Join(dir, "moderation.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	eng := &Engine{DB: db, Config: &Config{
+		ListAddress:      "list@example.org",
+		PublicURL:        "https://lists.example.org",
+		HTTPAddress:      "127.0.0.1:0",
+		Transport:        "fake",
+		TransactionKey:   "moderation-test",
+		ModerationQuorum: 2,
+		HoldExpiryHours:  72,
+		TrimQuotes:       -1,
+	}}
+	if err = eng.setupTransport(); err != nil {
+		t.Fatal(err)
+	}
+	for addr, moderator := range map[string]bool{"m1@example.org": true, "m2@example.org": true, "sub@example.org": false} {
+		assert.NoError(t, db.UpdateSubscriber(addr, db.CreateSubscriber(addr, "", true, moderator)))
+	}
+	return eng, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// holdTestPost holds a post to the list and returns its ID.
+func holdTestPost(t *testing.T, eng *Engine) string {
+	e := email.NewEmail()
+	e.From = "poster@example.com"
+	e.To = []string{"list@example.org"}
+	e.Subject = "Held"
+	e.Text = []byte("Please let this through.")
+	em := WrapEmail(e)
+	em.AddRecipient("sub@example.org")
+	em.Hold("test")
+	if err := eng.holdMessage(em); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	eng.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(heldBucketName)).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	if len(ids) != 1 {
+		t.Fatalf("expected one held message, found %d", len(ids))
+	}
+	return ids[0]
+}
+
+func TestHoldApproveRelease(t *testing.T) {
+	eng, done := moderationTestEngine(t)
+	defer done()
+	id := holdTestPost(t, eng)
+	assert.Len(t, eng.fake.messages(), 2, "each moderator is sent a link")
+	eng.fake.clear()
+
+	// One approval short of the quorum, the other moderator gets a new link.
+	released, err := eng.ApproveHeld(id, "m1@example.org")
+	assert.NoError(t, err)
+	assert.False(t, released)
+	sent := eng.fake.messages()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, []string{"m2@example.org"}, sent[0].To)
+	}
+	eng.fake.clear()
+
+	released, err = eng.ApproveHeld(id, "m2@example.org")
+	assert.NoError(t, err)
+	assert.True(t, released)
+	sent = eng.fake.messages()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, []string{"sub@example.org"}, sent[0].To)
+	}
+	_, err = eng.DB.GetHeld(id)
+	assert.Equal(t, ErrHeldMessageNotFound, err)
+}
+
+func TestHoldReject(t *testing.T) {
+	eng, done := moderationTestEngine(t)
+	defer done()
+	id := holdTestPost(t, eng)
+	held, err := eng.DB.GetHeld(id)
+	assert.NoError(t, err)
+	eng.fake.clear()
+
+	assert.NoError(t, eng.RejectHeld(id, "m1@example.org"))
+	assert.Empty(t, eng.fake.messages())
+	_, err = eng.DB.GetHeld(id)
+	assert.Equal(t, ErrHeldMessageNotFound, err)
+	// The other moderator's link no longer works.
+	assert.Len(t, held.Transactions, 2)
+	_, err = eng.ApproveHeld(id, "m2@example.org")
+	assert.Equal(t, ErrHeldMessageNotFound, err)
+}
+
+func TestHoldNeedsModerators(t *testing.T) {
+	eng, done := moderationTestEngine(t)
+	defer done()
+	for _, addr := range []string{"m1@example.org", "m2@example.org"} {
+		assert.NoError(t, eng.DB.DelSubscriber(addr))
+	}
+	e := email.NewEmail()
+	e.From = "poster@example.com"
+	e.To = []string{"list@example.org"}
+	assert.Equal(t, ErrNoModerators, eng.holdMessage(WrapEmail(e)))
+}
+
+func TestPurgeExpiredHeld(t *testing.T) {
+	eng, done := moderationTestEngine(t)
+	defer done()
+	id := holdTestPost(t, eng)
+	removed, err := eng.DB.PurgeExpiredHeld()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// Backdate the expiry, as if nobody had acted in time.
+	held, err := eng.DB.GetHeld(id)
+	assert.NoError(t, err)
+	held.Expires = time.Now().Add(-time.Hour)
+	assert.NoError(t, eng.DB.putHeld(held))
+	removed, err = eng.DB.PurgeExpiredHeld()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = eng.DB.GetHeld(id)
+	assert.Equal(t, ErrHeldMessageNotFound, err)
+}
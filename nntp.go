@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// NNTPGroupName returns the configured newsgroup name, or one derived from the
+// list address: "some_list@host.com" becomes "host.com.some_list".
+func (eng *Engine) NNTPGroupName() string {
+	if eng.Config.NNTPGroup != "" {
+		return eng.Config.NNTPGroup
+	}
+	bits := strings.SplitN(strings.ToLower(eng.Config.ListAddress), "@", 2)
+	if len(bits) != 2 {
+		return bits[0]
+	}
+	return bits[1] + "." + bits[0]
+}
+
+// NNTPListenAndServe runs a minimal, read-mostly NNTP server exposing the
+// archive as a single newsgroup. If NNTPPosting is enabled, posted articles are
+// fed to Handler exactly as though they had arrived over IMAP, so the usual
+// eventLoop decides whether they are relayed. This blocks.
+func (eng *Engine) NNTPListenAndServe() error {
+	ln, err := net.Listen("tcp", eng.Config.NNTPAddress)
+	if err != nil {
+		return err
+	}
+	log15.Info("Starting NNTP server", log15.Ctx{"context": "nntp", "address": eng.Config.NNTPAddress, "group": eng.NNTPGroupName()})
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go eng.serveNNTP(conn)
+	}
+}
+
+// nntpSession holds the state of one NNTP client connection.
+type nntpSession struct {
+	eng      *Engine
+	conn     *textproto.Conn
+	selected bool
+	current  uint64
+}
+
+func (eng *Engine) serveNNTP(c net.Conn) {
+	s := &nntpSession{eng: eng, conn: textproto.NewConn(c)}
+	defer s.conn.Close()
+	if eng.Config.NNTPPosting {
+		s.conn.PrintfLine("200 listless NNTP service ready, posting allowed")
+	} else {
+		s.conn.PrintfLine("201 listless NNTP service ready, posting prohibited")
+	}
+	for {
+		line, err := s.conn.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			s.conn.PrintfLine("500 Unknown command")
+			continue
+		}
+		cmd, args := strings.ToUpper(fields[0]), fields[1:]
+		if cmd == "QUIT" {
+			s.conn.PrintfLine("205 Bye")
+			return
+		}
+		if err := s.dispatch(cmd, args); err != nil {
+			log15.Error("Error handling NNTP command", log15.Ctx{"context": "nntp", "command": cmd, "error": err})
+			return
+		}
+	}
+}
+
+func (s *nntpSession) dispatch(cmd string, args []string) error {
+	switch cmd {
+	case "CAPABILITIES":
+		caps := []string{"VERSION 2", "READER", "OVER", "LIST ACTIVE NEWSGROUPS"}
+		if s.eng.Config.NNTPPosting {
+			caps = append(caps, "POST")
+		}
+		return s.dotResponse("101 Capability list:", caps)
+	case "MODE":
+		if s.eng.Config.NNTPPosting {
+			return s.conn.PrintfLine("200 Posting allowed")
+		}
+		return s.conn.PrintfLine("201 Posting prohibited")
+	case "DATE":
+		return s.conn.PrintfLine("111 %s", time.Now().UTC().Format("20060102150405"))
+	case "LIST":
+		return s.list(args)
+	case "GROUP", "LISTGROUP":
+		return s.group(cmd, args)
+	case "ARTICLE", "HEAD", "BODY", "STAT":
+		return s.article(cmd, args)
+	case "NEXT", "LAST":
+		return s.step(cmd)
+	case "OVER", "XOVER":
+		return s.over(args)
+	case "POST":
+		return s.post()
+	default:
+		return s.conn.PrintfLine("500 Unknown command")
+	}
+}
+
+// dotResponse writes a status line followed by a dot-terminated block of lines.
+func (s *nntpSession) dotResponse(status string, lines []string) error {
+	if err := s.conn.PrintfLine("%s", status); err != nil {
+		return err
+	}
+	w := s.conn.DotWriter()
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	return w.Close()
+}
+
+func (s *nntpSession) list(args []string) error {
+	keyword := "ACTIVE"
+	if len(args) > 0 {
+		keyword = strings.ToUpper(args[0])
+	}
+	switch keyword {
+	case "ACTIVE":
+		_, low, high, err := s.eng.DB.ArchiveBounds()
+		if err != nil {
+			return err
+		}
+		flag := "n"
+		if s.eng.Config.NNTPPosting {
+			flag = "y"
+		}
+		return s.dotResponse("215 List of newsgroups follows", []string{fmt.Sprintf("%s %d %d %s", s.eng.NNTPGroupName(), high, low, flag)})
+	case "NEWSGROUPS":
+		return s.dotResponse("215 List of newsgroups follows", []string{s.eng.NNTPGroupName() + "\tMailing list " + s.eng.Config.ListAddress})
+	default:
+		return s.conn.PrintfLine("501 Unsupported LIST keyword")
+	}
+}
+
+func (s *nntpSession) group(cmd string, args []string) error {
+	if len(args) > 0 && args[0] != s.eng.NNTPGroupName() {
+		return s.conn.PrintfLine("411 No such newsgroup")
+	}
+	if len(args) == 0 && (cmd == "GROUP" || !s.selected) {
+		return s.conn.PrintfLine("412 No newsgroup selected")
+	}
+	count, low, high, err := s.eng.DB.ArchiveBounds()
+	if err != nil {
+		return err
+	}
+	s.selected = true
+	s.current = low
+	status := fmt.Sprintf("211 %d %d %d %s", count, low, high, s.eng.NNTPGroupName())
+	if cmd == "GROUP" {
+		return s.conn.PrintfLine("%s", status)
+	}
+	entries, err := s.eng.DB.ArchivedMessagesBetween(low, high)
+	if err != nil {
+		return err
+	}
+	numbers := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		numbers = append(numbers, strconv.FormatUint(articleNumber(entry), 10))
+	}
+	return s.dotResponse(status+" list follows", numbers)
+}
+
+// articleNumber parses an archive ID as an article number.
+func articleNumber(entry *ArchivedMessage) uint64 {
+	n, _ := strconv.ParseUint(entry.ID, 10, 64)
+	return n
+}
+
+// nntpMessageID returns the stored Message-Id of an entry, or a stable
+// one constructed from the archive ID and the list's domain.
+func (eng *Engine) nntpMessageID(entry *ArchivedMessage) string {
+	if entry.MessageID != "" {
+		return entry.MessageID
+	}
+	return "<archive-" + entry.ID + "@" + eng.listDomain() + ">"
+}
+
+// findArticle resolves an ARTICLE/HEAD/BODY/STAT argument: an article number,
+// a message-id, or (if absent) the currently selected article.
+func (s *nntpSession) findArticle(args []string) (*ArchivedMessage, error) {
+	if len(args) > 0 && strings.HasPrefix(args[0], "<") {
+		count, low, high, err := s.eng.DB.ArchiveBounds()
+		if err != nil || count == 0 {
+			return nil, err
+		}
+		entries, err := s.eng.DB.ArchivedMessagesBetween(low, high)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if s.eng.nntpMessageID(entry) == args[0] {
+				return entry, nil
+			}
+		}
+		return nil, nil
+	}
+	n := s.current
+	if len(args) > 0 {
+		parsed, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, nil
+		}
+		n = parsed
+	}
+	entry, err := s.eng.DB.GetArchivedMessage(archiveID(n))
+	if err == ErrArchiveEntryNotFound {
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (s *nntpSession) article(cmd string, args []string) error {
+	if len(args) == 0 && !s.selected {
+		return s.conn.PrintfLine("412 No newsgroup selected")
+	}
+	entry, err := s.findArticle(args)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		if len(args) > 0 && strings.HasPrefix(args[0], "<") {
+			return s.conn.PrintfLine("430 No such article")
+		}
+		return s.conn.PrintfLine("423 No such article number")
+	}
+	entry = s.eng.publicEntry(entry)
+	n := articleNumber(entry)
+	if len(args) == 0 || !strings.HasPrefix(args[0], "<") {
+		s.current = n
+	}
+	msgid := s.eng.nntpMessageID(entry)
+	headers := []string{
+		"Path: listless",
+		"From: " + entry.From,
+		"Newsgroups: " + s.eng.NNTPGroupName(),
+		"Subject: " + entry.Subject,
+		"Date: " + entry.Date.Format(time.RFC1123Z),
+		"Message-ID: " + msgid,
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.Split(strings.TrimRight(strings.Replace(entry.Text, "\r\n", "\n", -1), "\n"), "\n")
+	switch cmd {
+	case "STAT":
+		return s.conn.PrintfLine("223 %d %s", n, msgid)
+	case "HEAD":
+		return s.dotResponse(fmt.Sprintf("221 %d %s", n, msgid), headers)
+	case "BODY":
+		return s.dotResponse(fmt.Sprintf("222 %d %s", n, msgid), body)
+	default:
+		return s.dotResponse(fmt.Sprintf("220 %d %s", n, msgid), append(append(headers, ""), body...))
+	}
+}
+
+func (s *nntpSession) step(cmd string) error {
+	if !s.selected {
+		return s.conn.PrintfLine("412 No newsgroup selected")
+	}
+	_, low, high, err := s.eng.DB.ArchiveBounds()
+	if err != nil {
+		return err
+	}
+	var entries []*ArchivedMessage
+	if cmd == "NEXT" && s.current < high {
+		entries, err = s.eng.DB.ArchivedMessagesBetween(s.current+1, high)
+	} else if cmd == "LAST" && s.current > low {
+		entries, err = s.eng.DB.ArchivedMessagesBetween(low, s.current-1)
+		if len(entries) > 0 {
+			entries = entries[len(entries)-1:]
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		if cmd == "NEXT" {
+			return s.conn.PrintfLine("421 No next article")
+		}
+		return s.conn.PrintfLine("422 No previous article")
+	}
+	s.current = articleNumber(entries[0])
+	return s.conn.PrintfLine("223 %d %s", s.current, s.eng.nntpMessageID(entries[0]))
+}
+
+// overField makes a value safe for a tab-separated overview line.
+func overField(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+func (s *nntpSession) over(args []string) error {
+	if !s.selected {
+		return s.conn.PrintfLine("412 No newsgroup selected")
+	}
+	low, high := s.current, s.current
+	if len(args) > 0 {
+		bits := strings.SplitN(args[0], "-", 2)
+		var err error
+		if low, err = strconv.ParseUint(bits[0], 10, 64); err != nil {
+			return s.conn.PrintfLine("501 Syntax error in range")
+		}
+		high = low
+		if len(bits) == 2 {
+			if bits[1] == "" {
+				_, _, high, err = s.eng.DB.ArchiveBounds()
+				if err != nil {
+					return err
+				}
+			} else if high, err = strconv.ParseUint(bits[1], 10, 64); err != nil {
+				return s.conn.PrintfLine("501 Syntax error in range")
+			}
+		}
+	}
+	entries, err := s.eng.DB.ArchivedMessagesBetween(low, high)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return s.conn.PrintfLine("423 No articles in that range")
+	}
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = s.eng.publicEntry(entry)
+		lines = append(lines, strings.Join([]string{
+			strconv.FormatUint(articleNumber(entry), 10),
+			overField(entry.Subject),
+			overField(entry.From),
+			entry.Date.Format(time.RFC1123Z),
+			overField(s.eng.nntpMessageID(entry)),
+			"",
+			strconv.Itoa(len(entry.Text)),
+			strconv.Itoa(strings.Count(entry.Text, "\n")),
+		}, "\t"))
+	}
+	return s.dotResponse("224 Overview information follows", lines)
+}
+
+// post reads an article and passes it through the usual Handler pipeline, so
+// eventLoop (and any moderation it does) sees it as ordinary incoming mail.
+// Handler waits for any message the fetch loop is handling. Articles over
+// MaxMessageMB are refused.
+func (s *nntpSession) post() error {
+	if !s.eng.Config.NNTPPosting {
+		return s.conn.PrintfLine("440 Posting not permitted")
+	}
+	if err := s.conn.PrintfLine("340 Send article to be posted"); err != nil {
+		return err
+	}
+	dot := s.conn.DotReader()
+	max := s.eng.maxMessageBytes()
+	r := io.Reader(dot)
+	if max > 0 {
+		r = io.LimitReader(dot, max+1)
+	}
+	article, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if max > 0 && int64(len(article)) > max {
+		// Read the rest without keeping it, to get back to the commands.
+		if _, err = io.Copy(ioutil.Discard, dot); err != nil {
+			return err
+		}
+		log15.Warn("Refused an oversized article posted over NNTP", log15.Ctx{"context": "nntp", "maxMB": s.eng.Config.MaxMessageMB})
+		return s.conn.PrintfLine("441 Article too large")
+	}
+	if err := s.eng.Handler(bytes.NewReader(article), 0, nil); err != nil {
+		log15.Error("Error handling article posted over NNTP", log15.Ctx{"context": "nntp", "error": err})
+		return s.conn.PrintfLine("441 Posting failed")
+	}
+	return s.conn.PrintfLine("240 Article received OK")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/smtp"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrUnknownOAuthProvider - Returned when OAuthProvider isn't a known preset and no OAuthTokenURL is given.
+	ErrUnknownOAuthProvider = errors.New("Unknown OAuthProvider; set OAuthTokenURL instead")
+
+	// Token endpoints for the OAuthProvider presets.
+	oauthTokenURLs = map[string]string{
+		"google":    "https://oauth2.googleapis.com/token",
+		"microsoft": "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+	}
+)
+
+// newOAuthTokenSource returns a token source which refreshes access tokens as
+// needed from the configured refresh token, or nil if OAuth isn't configured.
+// The Engine keeps one of these, so everything authenticating as the list
+// account shares a token and its refreshes.
+func newOAuthTokenSource(cfg *Config) (oauth2.TokenSource, error) {
+	if cfg.OAuthRefreshToken == "" {
+		return nil, nil
+	}
+	tokenURL := cfg.OAuthTokenURL
+	if tokenURL == "" {
+		var ok bool
+		if tokenURL, ok = oauthTokenURLs[cfg.OAuthProvider]; !ok {
+			return nil, ErrUnknownOAuthProvider
+		}
+	}
+	conf := &oauth2.Config{
+		ClientID:     cfg.OAuthClientID,
+		ClientSecret: cfg.OAuthClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+	}
+	return conf.TokenSource(oauth2.NoContext, &oauth2.Token{RefreshToken: cfg.OAuthRefreshToken}), nil
+}
+
+// xoauth2Auth is an smtp.Auth for the SASL XOAUTH2 mechanism used by Gmail
+// and Outlook.com/Office365.
+type xoauth2Auth struct {
+	username string
+	tokens   oauth2.TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	tok, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + tok.AccessToken + "\x01\x01"), nil
+}
+
+// Next answers a failure challenge (a JSON error description) with an empty
+// response, as the mechanism requires, so the server sends its final error.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
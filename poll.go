@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// pollBackoff chooses how long a fetch loop waits before polling again: from
+// PollMinFrequency after a cycle that delivered mail, doubling with each idle
+// cycle up to PollFrequency. Each wait is varied by up to PollJitter either
+// way, so lists sharing a provider drift apart rather than polling in step.
+type pollBackoff struct {
+	min, max time.Duration
+	jitter   float64
+	current  time.Duration
+	rnd      *rand.Rand
+}
+
+func newPollBackoff(cfg *Config) *pollBackoff {
+	max := time.Duration(cfg.PollFrequency) * time.Second
+	min := time.Duration(cfg.PollMinFrequency) * time.Second
+	if min <= 0 || min > max {
+		min = max
+	}
+	return &pollBackoff{
+		min:     min,
+		max:     max,
+		jitter:  cfg.PollJitter,
+		current: min,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the wait after a cycle, which delivered mail or didn't.
+func (p *pollBackoff) next(delivered bool) time.Duration {
+	if delivered {
+		p.current = p.min
+	} else if p.current < p.max {
+		p.current *= 2
+		if p.current > p.max {
+			p.current = p.max
+		}
+	}
+	return p.jittered(p.current)
+}
+
+// failed returns the wait after a failed cycle: the longest, so a struggling
+// server isn't pressed.
+func (p *pollBackoff) failed() time.Duration {
+	p.current = p.max
+	return p.jittered(p.max)
+}
+
+func (p *pollBackoff) jittered(d time.Duration) time.Duration {
+	if p.jitter <= 0 {
+		return d
+	}
+	return d + time.Duration((p.rnd.Float64()*2-1)*p.jitter*float64(d))
+}
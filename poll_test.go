@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollBackoff(t *testing.T) {
+	p := newPollBackoff(&Config{PollFrequency: 60, PollMinFrequency: 5})
+	assert.Equal(t, 10*time.Second, p.next(false))
+	assert.Equal(t, 20*time.Second, p.next(false))
+	assert.Equal(t, 40*time.Second, p.next(false))
+	assert.Equal(t, 60*time.Second, p.next(false))
+	assert.Equal(t, 60*time.Second, p.next(false))
+	assert.Equal(t, 5*time.Second, p.next(true))
+	assert.Equal(t, 60*time.Second, p.failed())
+
+	// A minimum above PollFrequency is ignored.
+	p = newPollBackoff(&Config{PollFrequency: 30, PollMinFrequency: 90})
+	assert.Equal(t, 30*time.Second, p.next(true))
+
+	p = newPollBackoff(&Config{PollFrequency: 60, PollMinFrequency: 60, PollJitter: 0.2})
+	for i := 0; i < 20; i++ {
+		wait := p.next(false)
+		assert.True(t, wait >= 48*time.Second && wait <= 72*time.Second)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/boltdb/bolt"
+	"github.com/tgulacsi/imapclient"
+)
+
+var (
+	// ErrPOP3 - Returned when a POP3 server answers a command with -ERR.
+	ErrPOP3 = errors.New("POP3 server error")
+
+	// ErrPOP3BucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrPOP3BucketNotFound = errors.New("POP3 bucket not found")
+)
+
+// pop3Conn is a minimal POP3 (RFC1939) client, covering what fetching needs.
+type pop3Conn struct {
+	*textproto.Conn
+}
+
+// dialPOP3 connects to a POP3 server, over TLS if useTLS is set, and reads
+// its greeting.
+func dialPOP3(addr string, useTLS bool) (*pop3Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &pop3Conn{textproto.NewConn(conn)}
+	if _, err = c.response(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// response reads a status line, returning the text after "+OK".
+func (c *pop3Conn) response() (string, error) {
+	line, err := c.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(line[3:]), nil
+	}
+	return "", errors.New(ErrPOP3.Error() + ": " + line)
+}
+
+// cmd sends a command and reads its status line.
+func (c *pop3Conn) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// login authenticates with USER and PASS.
+func (c *pop3Conn) login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", password)
+	return err
+}
+
+// uidl returns the unique ID of each message by message number, in order.
+func (c *pop3Conn) uidl() (nums []int, uids map[int]string, err error) {
+	if _, err = c.cmd("UIDL"); err != nil {
+		return nil, nil, err
+	}
+	lines, err := c.ReadDotLines()
+	if err != nil {
+		return nil, nil, err
+	}
+	uids = make(map[int]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		num, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+		uids[num] = fields[1]
+	}
+	return nums, uids, nil
+}
+
+// retr fetches a message into a spool.
+func (c *pop3Conn) retr(num int, into *spool) error {
+	if _, err := c.cmd("RETR %d", num); err != nil {
+		return err
+	}
+	_, err := io.Copy(into, c.DotReader())
+	return err
+}
+
+// dele marks a message for deletion when the session ends with QUIT.
+func (c *pop3Conn) dele(num int) error {
+	_, err := c.cmd("DELE %d", num)
+	return err
+}
+
+// quit ends the session, committing deletions, and closes the connection.
+func (c *pop3Conn) quit() error {
+	_, err := c.cmd("QUIT")
+	c.Close()
+	return err
+}
+
+// pop3SeenUIDLs returns the UIDLs of messages already fetched.
+func (db *ListlessDB) pop3SeenUIDLs() (map[string]bool, error) {
+	seen := make(map[string]bool)
+	err := db.View(func(tx *bolt.Tx) error {
+		pop3 := tx.Bucket([]byte(pop3BucketName))
+		if pop3 == nil {
+			return ErrPOP3BucketNotFound
+		}
+		return pop3.ForEach(func(k, v []byte) error {
+			seen[string(k)] = true
+			return nil
+		})
+	})
+	return seen, err
+}
+
+// pop3UpdateUIDLs records newly fetched UIDLs and forgets those no longer on
+// the server, so the record doesn't grow forever.
+func (db *ListlessDB) pop3UpdateUIDLs(fetched []string, onServer map[string]bool) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		pop3 := tx.Bucket([]byte(pop3BucketName))
+		if pop3 == nil {
+			return ErrPOP3BucketNotFound
+		}
+		var gone [][]byte
+		pop3.ForEach(func(k, v []byte) error {
+			if !onServer[string(k)] {
+				gone = append(gone, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range gone {
+			if err := pop3.Delete(k); err != nil {
+				return err
+			}
+		}
+		now := []byte(time.Now().UTC().Format(time.RFC3339))
+		for _, uid := range fetched {
+			if err := pop3.Put([]byte(uid), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pop3DeliverAll fetches every message not fetched before and passes it to
+// deliver, like one DeliveryLoop cycle. Messages are recorded by UIDL whether
+// or not delivery succeeds, so a bad message isn't retried forever, and
+// delivered messages are deleted from the server if POP3Delete is set. If ctx
+// ends, the rest are left for next time.
+func (eng *Engine) pop3DeliverAll(ctx context.Context, deliver imapclient.DeliverFunc) (int, error) {
+	addr := net.JoinHostPort(eng.Config.POP3Host, strconv.Itoa(eng.Config.POP3Port))
+	c, err := dialPOP3(addr, eng.Config.POP3TLS)
+	if err != nil {
+		return 0, err
+	}
+	if err = c.login(eng.Config.IMAPUsername, eng.Config.IMAPPassword); err != nil {
+		c.Close()
+		return 0, err
+	}
+	nums, uids, err := c.uidl()
+	if err != nil {
+		c.Close()
+		return 0, err
+	}
+	seen, err := eng.DB.pop3SeenUIDLs()
+	if err != nil {
+		c.Close()
+		return 0, err
+	}
+	var (
+		n        int
+		fetched  []string
+		onServer = make(map[string]bool, len(uids))
+	)
+	body := eng.newSpool()
+	defer body.Close()
+	for _, num := range nums {
+		uid := uids[num]
+		onServer[uid] = true
+		if seen[uid] || ctx.Err() != nil {
+			continue
+		}
+		body.Close()
+		err := c.retr(num, body)
+		var r io.ReadSeeker
+		if err == nil {
+			r, err = body.Reader()
+		}
+		if err != nil {
+			log15.Error("Error fetching POP3 message", log15.Ctx{"context": "pop3", "uidl": uid, "error": err})
+			break
+		}
+		fetched = append(fetched, uid)
+		if err := deliver(r, 0, nil); err != nil {
+			log15.Error("Error delivering POP3 message, leaving it on the server", log15.Ctx{"context": "pop3", "uidl": uid, "error": err})
+			continue
+		}
+		n++
+		if eng.Config.POP3Delete {
+			if err := c.dele(num); err != nil {
+				log15.Error("Error deleting POP3 message", log15.Ctx{"context": "pop3", "uidl": uid, "error": err})
+			}
+		}
+	}
+	// Record progress before QUIT, so a failed QUIT can't cause redelivery.
+	if err := eng.DB.pop3UpdateUIDLs(fetched, onServer); err != nil {
+		c.Close()
+		return n, err
+	}
+	return n, c.quit()
+}
+
+// POP3DeliveryLoop is DeliveryLoop for POP3-only mailboxes: it fetches new
+// messages, polling as often as DeliveryLoop, until ctx ends.
+func (eng *Engine) POP3DeliveryLoop(ctx context.Context, deliver imapclient.DeliverFunc) {
+	backoff := newPollBackoff(eng.Config)
+	for {
+		eng.metrics.beginCycle()
+		n, err := eng.pop3DeliverAll(ctx, deliver)
+		eng.logCycleTimings("pop3")
+		eng.recordFetchResult(err)
+		if err != nil {
+			log15.Error("Error during POP3 delivery cycle", log15.Ctx{"context": "pop3", "deliveries": n, "error": err})
+		} else {
+			log15.Info("POP3 delivery cycle complete", log15.Ctx{"context": "pop3", "delivered": n})
+		}
+		wait := backoff.failed()
+		if err == nil {
+			wait = backoff.next(n > 0)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
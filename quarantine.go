@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jordan-wright/email"
+)
+
+var (
+	// ErrQuarantineBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrQuarantineBucketNotFound = errors.New("Quarantine bucket not found")
+
+	// ErrQuarantinedMessageNotFound - Returned when no quarantined message has the given ID.
+	ErrQuarantinedMessageNotFound = errors.New("No quarantined message with that ID")
+
+	// ErrQuarantinedHeadersOnly - Returned when retrying a message whose body wasn't kept.
+	ErrQuarantinedHeadersOnly = errors.New("Only the headers of this message were kept; retry with a file of the whole message")
+)
+
+// QuarantinedMessage is an incoming message that couldn't be parsed or
+// handled, kept with the error so it can be examined, exported or retried.
+type QuarantinedMessage struct {
+	ID       string
+	Received time.Time
+	Error    string
+	Raw      []byte
+	// Only the headers were kept, as the message was over MaxMessageMB.
+	HeadersOnly bool `json:",omitempty"`
+}
+
+// Quarantine stores the raw bytes of a message that failed to parse.
+func (db *ListlessDB) Quarantine(raw []byte, parseErr error) (*QuarantinedMessage, error) {
+	return db.quarantine(&QuarantinedMessage{
+		Received: time.Now().UTC(),
+		Error:    parseErr.Error(),
+		Raw:      raw,
+	})
+}
+
+// QuarantineHeaders stores the headers of a message refused unparsed, such
+// as one over MaxMessageMB.
+func (db *ListlessDB) QuarantineHeaders(headers []byte, refusal error) (*QuarantinedMessage, error) {
+	return db.quarantine(&QuarantinedMessage{
+		Received:    time.Now().UTC(),
+		Error:       refusal.Error(),
+		Raw:         headers,
+		HeadersOnly: true,
+	})
+}
+
+func (db *ListlessDB) quarantine(qm *QuarantinedMessage) (*QuarantinedMessage, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket([]byte(quarantineBucketName))
+		if quarantine == nil {
+			return ErrQuarantineBucketNotFound
+		}
+		seq, err := quarantine.NextSequence()
+		if err != nil {
+			return err
+		}
+		qm.ID = archiveID(seq)
+		qmb, err := json.Marshal(qm)
+		if err != nil {
+			return err
+		}
+		return quarantine.Put([]byte(qm.ID), qmb)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qm, nil
+}
+
+// ListQuarantine returns the quarantined messages, oldest first.
+func (db *ListlessDB) ListQuarantine() (quarantined []*QuarantinedMessage, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket([]byte(quarantineBucketName))
+		if quarantine == nil {
+			return ErrQuarantineBucketNotFound
+		}
+		return quarantine.ForEach(func(k, v []byte) error {
+			qm := new(QuarantinedMessage)
+			if err := json.Unmarshal(v, qm); err != nil {
+				return err
+			}
+			quarantined = append(quarantined, qm)
+			return nil
+		})
+	})
+	return quarantined, err
+}
+
+// GetQuarantined returns a quarantined message by ID.
+func (db *ListlessDB) GetQuarantined(id string) (*QuarantinedMessage, error) {
+	qm := new(QuarantinedMessage)
+	err := db.View(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket([]byte(quarantineBucketName))
+		if quarantine == nil {
+			return ErrQuarantineBucketNotFound
+		}
+		qmb := quarantine.Get([]byte(id))
+		if qmb == nil {
+			return ErrQuarantinedMessageNotFound
+		}
+		return json.Unmarshal(qmb, qm)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qm, nil
+}
+
+// DelQuarantined removes a quarantined message.
+func (db *ListlessDB) DelQuarantined(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket([]byte(quarantineBucketName))
+		if quarantine == nil {
+			return ErrQuarantineBucketNotFound
+		}
+		if quarantine.Get([]byte(id)) == nil {
+			return ErrQuarantinedMessageNotFound
+		}
+		return quarantine.Delete([]byte(id))
+	})
+}
+
+// RetryQuarantined passes a quarantined message through Handler again, for
+// when a parser fix has made it readable. If raw is not nil it is used
+// instead of the stored message, so a hand-edited export can be retried. The
+// message is removed from quarantine once handled; if it still won't parse,
+// it stays put and isn't quarantined a second time.
+func (eng *Engine) RetryQuarantined(id string, raw []byte) error {
+	qm, err := eng.DB.GetQuarantined(id)
+	if err != nil {
+		return err
+	}
+	if raw != nil {
+		qm.Raw = raw
+	} else if qm.HeadersOnly {
+		return ErrQuarantinedHeadersOnly
+	}
+	if _, err = email.NewEmailFromReader(bytes.NewReader(qm.Raw)); err != nil {
+		return err
+	}
+	if err = eng.Handler(bytes.NewReader(qm.Raw), 0, nil); err != nil {
+		return err
+	}
+	return eng.DB.DelQuarantined(id)
+}
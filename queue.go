@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jordan-wright/email"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrQueueBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrQueueBucketNotFound = errors.New("Outgoing queue bucket not found")
+
+	// ErrQueuedMessageNotFound - Returned when no queued message has the given ID.
+	ErrQueuedMessageNotFound = errors.New("No queued message with that ID")
+)
+
+const (
+	// How often QueueLoop looks for messages due to be sent.
+	queuePollInterval = time.Minute
+	// Sending is retried with increasing delays, and then given up on until
+	// retried by hand.
+	queueMaxAttempts = 5
+	queueRetryDelay  = 10 * time.Minute
+)
+
+// QueuedMessage is a post waiting in the outgoing queue, usually because
+// eventLoop asked for it to be sent later with Email.SendAt. Message is the
+// post as eventLoop left it; it is relayed like any other post when due.
+type QueuedMessage struct {
+	ID        string
+	Message   *email.Email
+	Sender    string
+	Queued    time.Time
+	SendAt    time.Time
+	Attempts  int
+	LastError string
+	// Sent by a script with sendmail, so delivered as it is, not relayed.
+	Direct bool
+}
+
+// Failed reports whether sending has been given up on.
+func (q *QueuedMessage) Failed() bool {
+	return q.Attempts >= queueMaxAttempts
+}
+
+// enqueue adds a message to the outgoing queue, assigning its ID.
+func (db *ListlessDB) enqueue(q *QueuedMessage) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucketName))
+		if queue == nil {
+			return ErrQueueBucketNotFound
+		}
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+		q.ID = archiveID(seq)
+		qb, err := json.Marshal(q)
+		if err != nil {
+			return err
+		}
+		return queue.Put([]byte(q.ID), qb)
+	})
+}
+
+// putQueued replaces a queued message.
+func (db *ListlessDB) putQueued(q *QueuedMessage) error {
+	qb, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucketName))
+		if queue == nil {
+			return ErrQueueBucketNotFound
+		}
+		return queue.Put([]byte(q.ID), qb)
+	})
+}
+
+// ListQueue returns the messages in the outgoing queue, oldest first.
+func (db *ListlessDB) ListQueue() (queued []*QueuedMessage, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucketName))
+		if queue == nil {
+			return ErrQueueBucketNotFound
+		}
+		return queue.ForEach(func(k, v []byte) error {
+			q := new(QueuedMessage)
+			if err := json.Unmarshal(v, q); err != nil {
+				return err
+			}
+			queued = append(queued, q)
+			return nil
+		})
+	})
+	return queued, err
+}
+
+// GetQueued returns a queued message by ID.
+func (db *ListlessDB) GetQueued(id string) (*QueuedMessage, error) {
+	q := new(QueuedMessage)
+	err := db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucketName))
+		if queue == nil {
+			return ErrQueueBucketNotFound
+		}
+		qb := queue.Get([]byte(id))
+		if qb == nil {
+			return ErrQueuedMessageNotFound
+		}
+		return json.Unmarshal(qb, q)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// delQueued removes a message from the outgoing queue. No error if absent.
+func (db *ListlessDB) delQueued(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucketName))
+		if queue == nil {
+			return ErrQueueBucketNotFound
+		}
+		return queue.Delete([]byte(id))
+	})
+}
+
+// DropQueued removes a message from the outgoing queue without sending it.
+func (db *ListlessDB) DropQueued(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucketName))
+		if queue == nil {
+			return ErrQueueBucketNotFound
+		}
+		if queue.Get([]byte(id)) == nil {
+			return ErrQueuedMessageNotFound
+		}
+		return queue.Delete([]byte(id))
+	})
+}
+
+// RetryQueued makes a queued message due now with a fresh set of attempts,
+// including one that has been given up on.
+func (db *ListlessDB) RetryQueued(id string) (*QueuedMessage, error) {
+	q, err := db.GetQueued(id)
+	if err != nil {
+		return nil, err
+	}
+	q.Attempts = 0
+	q.LastError = ""
+	q.SendAt = time.Now().UTC()
+	return q, db.putQueued(q)
+}
+
+// Status describes a queued message for listings: "waiting", "retrying" or
+// "failed".
+func (q *QueuedMessage) Status() string {
+	switch {
+	case q.Failed():
+		return "failed"
+	case q.Attempts > 0:
+		return "retrying"
+	}
+	return "waiting"
+}
+
+// dispatch relays a message that eventLoop approved, or queues it if it was
+// given a future time with Email.SendAt.
+func (eng *Engine) dispatch(ctx context.Context, em *Email) error {
+	if !em.sendAt.After(time.Now()) {
+		return eng.relay(ctx, em)
+	}
+	// Each attempt relays the message as queued, so it needs its Message-Id
+	// now for them all to share one archive entry.
+	if err := eng.setMessageID(em); err != nil {
+		return err
+	}
+	q := &QueuedMessage{
+		Message: em.Email,
+		Sender:  em.Sender,
+		Queued:  time.Now().UTC(),
+		SendAt:  em.sendAt.UTC(),
+	}
+	if err := eng.DB.enqueue(q); err != nil {
+		return err
+	}
+	log15.Info("Queued message for later sending", log15.Ctx{"context": "queue", "id": q.ID, "sender": q.Sender, "sendAt": q.SendAt})
+	return nil
+}
+
+// sendQueued relays a queued message, removing it from the queue if that
+// succeeds or scheduling another attempt if not.
+func (eng *Engine) sendQueued(q *QueuedMessage) error {
+	em := WrapEmail(q.Message)
+	em.Sender = q.Sender
+	em.span = eng.tracer.startSpan("queue.send")
+	em.span.set("queue.id", q.ID)
+	var relayErr error
+	if q.Direct {
+		relayErr = eng.deliver(eng.ctx, em)
+	} else {
+		relayErr = eng.relay(eng.ctx, em)
+	}
+	em.span.finish(relayErr)
+	if relayErr == nil {
+		return eng.DB.delQueued(q.ID)
+	}
+	// Reload the message as queued, as relay changes it on the way out.
+	q, err := eng.DB.GetQueued(q.ID)
+	if err != nil {
+		return err
+	}
+	q.Attempts++
+	q.LastError = relayErr.Error()
+	q.SendAt = time.Now().UTC().Add(time.Duration(q.Attempts) * queueRetryDelay)
+	if perr := eng.DB.putQueued(q); perr != nil {
+		log15.Error("Error updating queued message", log15.Ctx{"context": "queue", "id": q.ID, "error": perr})
+	}
+	if q.Failed() {
+		context := messageContext(em)
+		context["queue_id"] = q.ID
+		context["attempts"] = strconv.Itoa(q.Attempts)
+		go eng.reportError(reportDelivery, relayErr, context)
+	}
+	return relayErr
+}
+
+// QueueLoop sends queued messages as they fall due, until closeCh is closed.
+func (eng *Engine) QueueLoop(closeCh <-chan struct{}) {
+	for {
+		queued, err := eng.DB.ListQueue()
+		if err != nil {
+			log15.Error("Error reading outgoing queue", log15.Ctx{"context": "queue", "error": err})
+		}
+		now := time.Now()
+		for _, q := range queued {
+			if q.Failed() || q.SendAt.After(now) {
+				continue
+			}
+			if err = eng.sendQueued(q); err != nil {
+				log15.Error("Error sending queued message", log15.Ctx{"context": "queue", "id": q.ID, "attempts": q.Attempts, "error": err})
+			} else {
+				log15.Info("Sent queued message", log15.Ctx{"context": "queue", "id": q.ID})
+			}
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
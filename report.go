@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/jordan-wright/email"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrUnknownReportInterval - Returned when ReportInterval isn't "weekly" or "monthly".
+	ErrUnknownReportInterval = errors.New("Unknown report interval; use \"weekly\" or \"monthly\"")
+
+	// ErrReportBucketNotFound - Returned when a database lookup fails at the bucket level.
+	ErrReportBucketNotFound = errors.New("Report bucket not found")
+)
+
+// How many posters are listed in TrafficReport.TopPosters.
+const reportTopPosters = 10
+
+// defaultReportTemplate is used unless ReportTemplate names a template file.
+const defaultReportTemplate = `Traffic report for {{.ListAddress}}
+{{.From.Format "2 Jan 2006"}} to {{.To.Format "2 Jan 2006"}}
+
+Messages relayed: {{.Posts}} from {{.Posters}} members
+Messages withheld by eventLoop: {{.Withheld}}
+Bounces and complaints: {{.Bounces}}
+Subscribers: {{.Subscribers}} ({{len .Joined}} joined, {{len .Left}} left)
+{{if .TopPosters}}
+Top posters:
+{{range .TopPosters}}  {{.Posts}}	{{.Email}}
+{{end}}{{end}}{{if .Joined}}
+Joined:
+{{range .Joined}}  {{.}}
+{{end}}{{end}}{{if .Left}}
+Left:
+{{range .Left}}  {{.}}
+{{end}}{{end}}`
+
+// PosterCount is a member's number of posts in a TrafficReport.
+type PosterCount struct {
+	Email string
+	Posts int
+}
+
+// byPosts sorts PosterCounts by descending posts, then by address.
+type byPosts []PosterCount
+
+func (p byPosts) Len() int      { return len(p) }
+func (p byPosts) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPosts) Less(i, j int) bool {
+	if p[i].Posts != p[j].Posts {
+		return p[i].Posts > p[j].Posts
+	}
+	return p[i].Email < p[j].Email
+}
+
+// TrafficReport summarises the list's activity over a period; it is the data
+// given to the report template.
+type TrafficReport struct {
+	ListAddress string
+	From, To    time.Time
+	Posts       int
+	Posters     int
+	TopPosters  []PosterCount
+	Withheld    int
+	Bounces     int
+	Joined      []string
+	Left        []string
+	Subscribers int
+}
+
+// reportPeriodStart returns the start of the reporting period containing t:
+// the preceding Monday for weekly reports, or the first of the month.
+func reportPeriodStart(interval string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == "monthly" {
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// previousReportPeriod returns the start of the period before the one
+// beginning at start.
+func previousReportPeriod(interval string, start time.Time) time.Time {
+	if interval == "monthly" {
+		return start.AddDate(0, -1, 0)
+	}
+	return start.AddDate(0, 0, -7)
+}
+
+// BuildTrafficReport summarises the event log over [from, to).
+func (eng *Engine) BuildTrafficReport(from, to time.Time) (*TrafficReport, error) {
+	events, err := eng.DB.EventsBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := &TrafficReport{ListAddress: eng.Config.ListAddress, From: from, To: to}
+	posts := make(map[string]int)
+	for _, event := range events {
+		switch event.Kind {
+		case EventPost:
+			report.Posts++
+			posts[event.Email]++
+		case EventWithheld:
+			report.Withheld++
+		case EventBounce:
+			report.Bounces++
+		case EventJoin:
+			report.Joined = append(report.Joined, event.Email)
+		case EventLeave:
+			report.Left = append(report.Left, event.Email)
+		}
+	}
+	report.Posters = len(posts)
+	for email, n := range posts {
+		report.TopPosters = append(report.TopPosters, PosterCount{Email: email, Posts: n})
+	}
+	sort.Sort(byPosts(report.TopPosters))
+	if len(report.TopPosters) > reportTopPosters {
+		report.TopPosters = report.TopPosters[:reportTopPosters]
+	}
+	report.Subscribers = len(eng.DB.goGetAllSubscribers(false))
+	return report, nil
+}
+
+// RenderTrafficReport renders a report with ReportTemplate, or the default
+// template if that isn't set.
+func (eng *Engine) RenderTrafficReport(report *TrafficReport) (string, error) {
+	text := defaultReportTemplate
+	if eng.Config.ReportTemplate != "" {
+		custom, err := ioutil.ReadFile(eng.Config.ReportTemplate)
+		if err != nil {
+			return "", err
+		}
+		text = string(custom)
+	}
+	tmpl, err := template.New("report").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, report); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sendTrafficReport builds, renders and mails the report for [from, to) to
+// ReportRecipients.
+func (eng *Engine) sendTrafficReport(from, to time.Time) error {
+	report, err := eng.BuildTrafficReport(from, to)
+	if err != nil {
+		return err
+	}
+	text, err := eng.RenderTrafficReport(report)
+	if err != nil {
+		return err
+	}
+	e := email.NewEmail()
+	e.From = eng.fromAddress("reports")
+	e.Subject = "Traffic report for " + eng.Config.ListAddress + ", " + from.Format("2 Jan") + " to " + to.Format("2 Jan 2006")
+	e.Text = []byte(text)
+	em := WrapEmail(e)
+	for _, recipient := range eng.Config.ReportRecipients {
+		em.AddToRecipient(recipient)
+	}
+	if err = eng.markSent(em); err != nil {
+		return err
+	}
+	return eng.deliver(context.Background(), em)
+}
+
+// lastReportPeriod returns the start of the last period reported on, or the
+// zero time if no report has been sent.
+func (db *ListlessDB) lastReportPeriod() (last time.Time, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		reports := tx.Bucket([]byte(reportBucketName))
+		if reports == nil {
+			return ErrReportBucketNotFound
+		}
+		if lastb := reports.Get([]byte("last")); lastb != nil {
+			return last.UnmarshalText(lastb)
+		}
+		return nil
+	})
+	return last, err
+}
+
+// setLastReportPeriod records the start of the last period reported on.
+func (db *ListlessDB) setLastReportPeriod(last time.Time) error {
+	lastb, err := last.MarshalText()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		reports := tx.Bucket([]byte(reportBucketName))
+		if reports == nil {
+			return ErrReportBucketNotFound
+		}
+		return reports.Put([]byte("last"), lastb)
+	})
+}
+
+// ReportLoop mails a traffic report to ReportRecipients at the start of each
+// ReportInterval period, covering the period just ended, until closeCh is
+// closed. Events older than a year are pruned as it goes. The first period
+// after reports are enabled is only partly logged, so it isn't reported.
+func (eng *Engine) ReportLoop(closeCh <-chan struct{}) {
+	interval := eng.Config.ReportInterval
+	for {
+		current := reportPeriodStart(interval, time.Now())
+		last, err := eng.DB.lastReportPeriod()
+		switch {
+		case err != nil:
+			log15.Error("Error reading last report date", log15.Ctx{"context": "report", "error": err})
+		case last.IsZero():
+			err = eng.DB.setLastReportPeriod(current)
+		case last.Before(current):
+			previous := previousReportPeriod(interval, current)
+			if err = eng.sendTrafficReport(previous, current); err == nil {
+				log15.Info("Sent traffic report", log15.Ctx{"context": "report", "from": previous, "to": current})
+				err = eng.DB.setLastReportPeriod(current)
+			}
+		}
+		if err != nil {
+			log15.Error("Error sending traffic report", log15.Ctx{"context": "report", "error": err})
+		}
+		if err := eng.DB.PruneEvents(time.Now().AddDate(-1, 0, 0)); err != nil {
+			log15.Error("Error pruning event log", log15.Ctx{"context": "report", "error": err})
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
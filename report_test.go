@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportPeriods(t *testing.T) {
+	// A Thursday.
+	now := time.Date(2016, 6, 16, 15, 4, 5, 0, time.UTC)
+	week := reportPeriodStart("weekly", now)
+	assert.Equal(t, time.Date(2016, 6, 13, 0, 0, 0, 0, time.UTC), week)
+	assert.Equal(t, week, reportPeriodStart("weekly", week))
+	assert.Equal(t, time.Date(2016, 6, 6, 0, 0, 0, 0, time.UTC), previousReportPeriod("weekly", week))
+	month := reportPeriodStart("monthly", now)
+	assert.Equal(t, time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC), month)
+	assert.Equal(t, time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC), previousReportPeriod("monthly", month))
+}
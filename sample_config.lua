@@ -6,16 +6,181 @@
 -- "SMTPassword".
 ListAddress = "some_list@host.com"  -- Should be provided for correct operation!
 DeliverScript = "./default_eventloop.lua"  -- Needs to be provided in "loop" mode to handle incoming mail.
+AdminAddress = ""  -- If set, gets a copy of any message that fails to parse or makes eventLoop fail, with the error.
+LogLevel      = "info"  -- Or "debug", "warn", "error", "crit".
+LogLevels     = {}  -- Per-context overrides, e.g. {lua = "debug", imap = "warn"}.
+LogFormat     = ""  -- "terminal", "logfmt" or "json"; defaults to terminal, or logfmt in LogFile.
+LogFile       = ""  -- e.g. "/var/log/listless/some_list.log"; logs go to the terminal if unset.
+LogMaxSizeMB  = 10  -- Start a new log file at this size...
+LogMaxAgeDays = 0   -- ...or age in days (0 for no limit),
+LogKeep       = 5   -- keeping this many old ones.
+SyslogAddress  = ""  -- "local", or "udp://loghost:514" / "tcp://loghost:514" for remote syslog; on Windows, "local" is the Event Log.
+SyslogFacility = "daemon"
+SyslogTag      = "listless"
+OTLPEndpoint = ""  -- e.g. "http://localhost:4318", to trace each message's handling with OpenTelemetry.
+OTLPHeaders  = {}
+SlowMessageSeconds = 30  -- Log a warning with stage timings for messages taking this long.
+SentryDSN    = ""  -- e.g. "https://key@sentry.io/42"; reports panics, eventLoop errors and undeliverable queued mail.
+ErrorWebhook = ""  -- URL to POST the same reports to as JSON.
+-- Alerts go to AlertRecipients (or AdminAddress) and AlertWebhooks, when
+-- sending keeps failing or the inbox can't be reached.
+AlertRecipients = {}
+AlertWebhooks   = {}  -- Slack or Discord incoming webhook URLs.
+AlertSMTPFailures      = 5   -- Failed sends within the window below; 0 disables.
+AlertSMTPWindowMinutes = 10
+AlertIMAPDownMinutes   = 15  -- 0 disables.
+AlertCooldownMinutes   = 60
+-- Database methods scripts may call can be tuned per sandbox, e.g. LuaModeratorDeny = {"DelSubscriber"}.
+LuaPrivilegedAllow = {}
+LuaPrivilegedDeny  = {}
+LuaModeratorAllow  = {}  -- e.g. {"GetAllSubscribers"}
+LuaModeratorDeny   = {}
+LuaKVStoreAllow    = {}
+LuaKVStoreDeny     = {}
+-- Scripts that transactions (database:RegisterTransaction) call, by name. A path
+-- runs in the moderator sandbox; use a table to choose, e.g.
+-- Scripts = {subscribe = "scripts/subscribe.lua", purge = {path = "scripts/purge.lua", sandbox = "privileged"}}
+Scripts = {}
+TransactionKVStore = ""  -- e.g. "{script}": delete the KV entry keyed by a transaction's RefCode once it's used or expires.
+TransactionKey     = ""  -- e.g. from "openssl rand -hex 32"; if unset, a random key kept in the database is used. Setting or changing it voids pending transactions and moderation links.
+TransactionScan    = "subject"  -- Or "body" to also search the first lines of replies, or "off".
+-- To keep a CRM or chat in step with membership, name a script from Scripts
+-- defining changed(database, change), and/or URLs to POST each change to as JSON.
+ChangeScript   = ""  -- e.g. "crmsync"
+ChangeWebhooks = {}
+ChangeKVStores = {}  -- KV stores whose changes are reported too.
 Database      = "./some_list.db"  -- Created if doesn't exist.
-MessageFrequency = 0 -- Seconds between each message during a poll over inbox
-PollFrequency = 30  -- Seconds to wait once inbox is empty before polling again.
+AdminSocket   = ""  -- e.g. "./some_list.sock", so "sub list" etc. work while "loop" runs.
+RosterCache   = true  -- Keep recipient lists in memory between membership changes.
+MessageFrequency = 0 -- Least seconds between relaying one post and the next
+SendRateLimit = 0  -- Most messages per minute scripts may send with sendmail(); 0 for no limit.
+PollFrequency = 30  -- Most seconds to wait once inbox is empty before polling again.
+PollMinFrequency = 5  -- Seconds to wait after finding mail; doubles while idle, up to PollFrequency.
+PollJitter = 0.2  -- Vary each wait randomly by up to this fraction.
+ProcessTimeout = 120  -- Seconds before a message's eventLoop and sending are abandoned and it is quarantined.
 Constants = {SubjectTag = "[laundrylist]"}  -- Anything put in here is available in eventLoop. Only supports String->String values.
+-- SubjectTag = "[laundrylist]"  -- If set, the engine itself tags outgoing subjects and collapses "Re: Re:" chains.
+Language    = "en"  -- For the list's notices (moderation, welcome, confirm, rejected, held); members may set their own.
+TemplateDir = ""  -- Notice templates overriding the built-in ones, e.g. "welcome.body.fr.tmpl".
+TrimQuotes = -1  -- e.g. 5 to drop signatures and quotes of quotes, and cut quoted runs to 5 lines; -1 is off.
+HTMLSanitisePolicy = "noimages"  -- One of "off", "ugc", "noimages" (also strips tracking images), "strict" (strips all markup).
+AnonymousPosting = false  -- Relay posts as "Anonymous <list address>"; "listless anon reveal" finds the real sender.
+AnonymousName    = "Anonymous"
+AnonymousPseudonyms = false  -- Give each anonymous sender a lasting pseudonym like "Swift Otter" instead.
+Archive       = true  -- Keep a copy of every relayed message in the database.
+ArchiveURL    = "https://lists.host.com/some_list"  -- Optional; if set, relayed mail gets an "Archived-At" permalink header.
+ArchiveFooter = false  -- Also append the permalink to the bottom of relayed messages.
+ArchiveObfuscation = "off"  -- Or "words" (user at host dot com) or "hide", for addresses in feeds, NNTP and ActivityPub.
+ArchiveRetentionDays = 0  -- Prune archived messages older than this; 0 keeps them forever.
+ArchiveMaxMessages   = 0  -- Keep at most this many archived messages; 0 for no limit.
+ArchiveMaxBytes      = 0  -- Keep at most this much archived mail, e.g. 500000000; 0 for no limit.
+HTTPAddress   = "127.0.0.1:8025"  -- Optional; serves /feed.rss and /feed.atom of archived posts.
+FeedItems     = 20
+FeedFullBody  = false  -- Whole posts in feeds, rather than excerpts.
+PublicURL     = "https://lists.host.com"  -- Where the HTTP server is reachable from outside.
+ActivityPub   = false  -- Let fediverse users follow the list as some_list@host.com; needs Archive, HTTPAddress and PublicURL.
+-- Messages held with message:Hold("reason") in eventLoop are kept until a
+-- moderator follows the link mailed to them; needs HTTPAddress and PublicURL.
+HoldExpiryHours = 72
+ModerationToken = ""  -- If set, moderators must also enter this to release or reject.
+ModerationQuorum = 1  -- Distinct moderator approvals needed to release; one rejection discards.
+SenderPolicy = "open"  -- Or "reject"/"hold" posts from non-members (and members not AllowedPost) before eventLoop runs.
+NNTPAddress   = ""  -- e.g. "127.0.0.1:1119" to let newsreaders browse the archive.
+NNTPPosting   = false  -- If true, NNTP posts are passed to eventLoop just like incoming mail.
+-- Matrix bridge; relayed posts are mirrored into the room, and messages from
+-- the users in MatrixUsers are posted to the list from their mapped address.
+MatrixHomeserver  = ""  -- e.g. "https://matrix.org"
+MatrixAccessToken = ""
+MatrixRoomID      = ""  -- e.g. "!abcdefg:matrix.org"
+MatrixUsers       = {}  -- e.g. {["@usienne:matrix.org"] = "user@domain.tld"}
+Webhooks          = {}  -- Slack/Discord incoming webhook URLs to notify of each relayed post.
+-- LDAP/Active Directory sync; in loop mode, members of LDAPGroupDN are added
+-- to the list, and members who leave the group are flagged as "Departed" and
+-- no longer receive mail.
+LDAPURL          = ""  -- e.g. "ldaps://ldap.host.com"
+LDAPStartTLS     = false  -- Use StartTLS on plain ldap:// connections.
+LDAPBindDN       = ""  -- e.g. "cn=listless,ou=services,dc=host,dc=com"
+LDAPBindPassword = ""
+LDAPGroupDN      = ""  -- e.g. "cn=staff,ou=groups,dc=host,dc=com"
+LDAPAttributes   = {Member = "member", Email = "mail", Name = "cn"}  -- e.g. Name = "displayName" for AD.
+LDAPSyncInterval = 60  -- Minutes
+-- CardDAV address book sync (e.g. Nextcloud contacts); works like LDAP sync.
+CardDAVURL          = ""  -- e.g. "https://cloud.host.com/remote.php/dav/addressbooks/users/admin/contacts/"
+CardDAVUsername     = ""
+CardDAVPassword     = ""  -- An app password is recommended.
+CardDAVGroup        = ""  -- Contacts group to sync, or "" for the whole address book.
+CardDAVSyncInterval = 60  -- Minutes
+-- SCIM provisioning; identity providers (Okta, Entra ID) can add and remove
+-- subscribers at HTTPAddress/scim/v2/Users. Use a long random token, and only
+-- expose the HTTP server over HTTPS.
+SCIMToken = ""
 -- Account options:
 IMAPHost      = "mail.1984.is"  -- Recommended!
 IMAPUsername  = "some_list@host.com"  -- Some hosts use only "some_list" as username, 1984hosting.com uses full address.
 IMAPPassword  = "StupidPassword1"  -- Not recommended!
 IMAPPort      = 143
+-- For shared mailboxes: only unseen mail is fetched, and these narrow it down.
+IMAPSearchSubject = ""  -- Only fetch messages whose subject contains this.
+IMAPToListOnly    = false  -- Leave mail not addressed to ListAddress in the mailbox.
+IMAPSince         = ""  -- e.g. "2016-06-01"; leave older mail alone.
+IMAPBatchSize     = 50  -- Most messages fetched per poll; a full batch is followed by another poll at once.
+MaxMessageMB      = 25  -- Larger messages are refused and only their headers quarantined; 0 for no limit.
+SpoolThresholdKB  = 1024  -- Larger messages are fetched to a temporary file rather than into memory.
+SpoolDir          = ""  -- Where those go; "" for the system's temporary directory.
+IMAPInbox       = "INBOX"
+IMAPDoneFolder  = ""  -- e.g. "Lists/Done"; if set, delivered mail is moved here rather than deleted.
+IMAPErrorFolder = ""  -- e.g. "Lists/Failed"; if set, mail that fails delivery is moved here.
+IMAPNamespace   = "auto"  -- Folder prefix like "INBOX." (Courier); "auto" asks the server, "" for none.
+Fetcher       = "imap"  -- Or "jmap", e.g. for Fastmail (new mail is pushed where supported), or "pop3", or "fake" for testing.
+JMAPSessionURL = ""  -- e.g. "https://api.fastmail.com/jmap/session"
+JMAPToken      = ""  -- API token; if empty, IMAPUsername/IMAPPassword are used.
+POP3Host       = ""  -- Defaults to IMAPHost; POP3 also logs in with IMAPUsername/IMAPPassword.
+POP3Port       = 995
+POP3TLS        = true
+POP3Delete     = true  -- Delete messages once delivered; they are tracked by UIDL either way.
 SMTPUsername  = IMAPUsername
 SMTPPassword   = IMAPPassword
 SMTPHost      = IMAPHost
 SMTPPort      = 465
+-- Other addresses to send as; scripts pick one with listless.NewEmail("announce", subject).
+-- "moderation", "alerts" and "reports" identities send those system messages.
+Identities = {
+  -- announce = {Address = "announce@host.com", Name = "List announcements"},
+  -- moderation = {Address = "moderation@host.com", SMTPUsername = "moderation@host.com", SMTPPassword = ""},
+}
+-- OAuth2 (e.g. smtp.gmail.com or smtp.office365.com); if OAuthRefreshToken is
+-- set, SMTP uses XOAUTH2 instead of SMTPPassword. Obtain the refresh token
+-- with the provider's OAuth consent flow for the list account.
+OAuthProvider     = ""  -- "google" or "microsoft", or set OAuthTokenURL.
+OAuthClientID     = ""
+OAuthClientSecret = ""
+OAuthRefreshToken = ""
+-- How to send mail: "smtp", "gmail" to use the Gmail API (needs the OAuth
+-- settings above, with the https://www.googleapis.com/auth/gmail.send scope),
+-- "graph" to use Microsoft Graph (needs OAuthClientID/OAuthClientSecret of
+-- an app registration with the Mail.Send application permission), "ses"
+-- to use Amazon SES, or "mailgun" or "sendgrid" to use their HTTP APIs.
+Transport = "smtp"
+GraphTenantID = ""  -- Microsoft 365 tenant ID or domain, for Transport = "graph".
+SESRegion          = ""  -- e.g. "eu-west-1", for Transport = "ses".
+SESAccessKeyID     = ""  -- Leave empty to use the environment or an IAM role.
+SESSecretAccessKey = ""
+SESConfigurationSet = ""
+-- Subscribe an SNS topic receiving SES bounces/complaints to
+-- <PublicURL>/ses/notifications?token=<SESNotificationToken>.
+SESNotificationToken = ""
+MailgunDomain  = ""  -- e.g. "mg.host.com", for Transport = "mailgun".
+MailgunAPIKey  = ""
+MailgunRegion  = ""  -- "eu" for Mailgun's EU region.
+SendGridAPIKey = ""  -- For Transport = "sendgrid".
+-- For testing: Transport = "fake" sends nothing, and Fetcher = "fake" reads .eml
+-- files from FakeInbox. Exec scripts then get a "fakemail" table with
+-- receive(raw), sent() and clear().
+FakeInbox  = "./fake-inbox"
+FakeOutbox = ""  -- If set, mail "sent" with Transport = "fake" is written here.
+BounceAddress   = ""  -- e.g. "list-bounces@host.com"; envelope sender, so bounces skip the list INBOX.
+BounceThreshold = 0  -- Stop mail to members with this bounce score (hard bounce = 1, soft = 0.25); 0 only records.
+-- Traffic reports for list owners; preview one with "listless sub report my_config.lua".
+ReportInterval   = ""  -- "weekly" or "monthly"
+ReportRecipients = {}  -- e.g. {"owner@host.com"}
+ReportTemplate   = ""  -- Optional Go text/template file; see TrafficReport in report.go for fields.
@@ -27,5 +27,11 @@ database:UpdateSubscriber(usienne.Email, usienne)
 -- Did it work?
 print("Usienne is a mod:", database:IsModerator(usienne.Email)) -- "true"
 
+-- Moderator and AllowedPost are shorthand for roles; members can also be
+-- "owner", "poster", "digest-only" or "readonly":
+usienne:AddRole("owner")
+database:UpdateSubscriber(usienne.Email, usienne)
+print("Usienne is an owner:", database:HasRole(usienne.Email, "owner")) -- "true"
+
 -- Turns out she's sick of all the spam:
 database:DelSubscriber("user@domain.tld")
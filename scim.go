@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// scimSource is the MemberMeta.Source of members provisioned over SCIM; their
+// SourceID is the SCIM resource id.
+const scimSource = "scim"
+
+// scimAdoptedSource is the Source of members added by hand before an identity
+// provider took them over. Deprovisioning hands them back rather than
+// deleting them, as SCIM didn't create them.
+const scimAdoptedSource = "scim-adopted"
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType = "application/scim+json"
+)
+
+var (
+	// ErrSCIMNoEmail - Returned when a provisioned user has no usable email address.
+	ErrSCIMNoEmail = errors.New("SCIM user has no valid email address")
+
+	// ErrSCIMEmailTaken - Returned when a provisioned user's new address is already a member's.
+	ErrSCIMEmailTaken = errors.New("Email address already subscribed")
+
+	// Identity providers look users up with filters like `userName eq "x"`;
+	// that is the only filter supported.
+	scimFilterPattern = regexp.MustCompile(`(?i)^\s*(userName|emails\.value|emails)\s+eq\s+"([^"]*)"\s*$`)
+)
+
+// scimUser is the SCIM 2.0 representation of a member.
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Name        *scimName   `json:"name,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// email returns the address to subscribe for a provisioned user: the userName
+// if it is an email address, else the primary (or first) email.
+func (u *scimUser) email() string {
+	if email := normaliseEmail(u.UserName); email != "" {
+		return email
+	}
+	for _, e := range u.Emails {
+		if e.Primary {
+			return normaliseEmail(e.Value)
+		}
+	}
+	if len(u.Emails) > 0 {
+		return normaliseEmail(u.Emails[0].Value)
+	}
+	return ""
+}
+
+// name returns the best display name given for a provisioned user.
+func (u *scimUser) name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	if u.Name == nil {
+		return ""
+	}
+	if u.Name.Formatted != "" {
+		return u.Name.Formatted
+	}
+	return strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+}
+
+// scimUserFromMember renders a member as a SCIM User.
+func (eng *Engine) scimUserFromMember(meta *MemberMeta) *scimUser {
+	active := !meta.Suspended
+	return &scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          meta.SourceID,
+		UserName:    meta.Email,
+		DisplayName: meta.Name,
+		Emails:      []scimEmail{{Value: meta.Email, Primary: true}},
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      meta.Joindate,
+			Location:     strings.TrimRight(eng.Config.PublicURL, "/") + "/scim/v2/Users/" + meta.SourceID,
+		},
+	}
+}
+
+// scimMembers returns the members provisioned over SCIM.
+func (db *ListlessDB) scimMembers() ([]*MemberMeta, error) {
+	var members []*MemberMeta
+	err := db.forEachSubscriber(func(email string, meta *MemberMeta) error {
+		if meta.Source == scimSource || meta.Source == scimAdoptedSource {
+			members = append(members, meta)
+		}
+		return nil
+	})
+	return members, err
+}
+
+// scimMember finds a SCIM-provisioned member by resource id.
+func (db *ListlessDB) scimMember(id string) (*MemberMeta, error) {
+	members, err := db.scimMembers()
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range members {
+		if meta.SourceID == id {
+			return meta, nil
+		}
+	}
+	return nil, ErrMemberEntryNotFound
+}
+
+// moveSCIMMember moves a provisioned member to a new address in a single
+// transaction, so a failure can't leave them at neither.
+func (db *ListlessDB) moveSCIMMember(oldemail string, meta *MemberMeta) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(memberBucketName))
+		if members == nil {
+			return ErrMemberBucketNotFound
+		}
+		if members.Get([]byte(meta.Email)) != nil {
+			return ErrSCIMEmailTaken
+		}
+		if err := db.delSubscriber(tx, oldemail); err != nil {
+			return err
+		}
+		return db.putSubscriber(tx, meta.Email, meta)
+	})
+}
+
+// deprovisionSCIMMember deletes a member SCIM created, or hands one it
+// adopted back to manual management.
+func (db *ListlessDB) deprovisionSCIMMember(meta *MemberMeta) error {
+	if meta.Source == scimSource {
+		return db.DelSubscriber(meta.Email)
+	}
+	meta.Source, meta.SourceID = "", ""
+	return db.UpdateSubscriber(meta.Email, meta)
+}
+
+// newSCIMID returns a random SCIM resource id.
+func newSCIMID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeSCIMError writes a SCIM error response.
+func writeSCIMError(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	})
+}
+
+// writeSCIM writes a SCIM resource with the given status.
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveSCIMUsers handles the /scim/v2/Users collection and its members, for
+// identity providers provisioning subscribers. Requests must carry the
+// configured SCIMToken as a bearer token.
+func (eng *Engine) serveSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(eng.Config.SCIMToken)) != 1 {
+		writeSCIMError(w, http.StatusUnauthorized, "Invalid bearer token")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scim/v2/Users"), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		eng.scimListUsers(w, r)
+	case id == "" && r.Method == "POST":
+		eng.scimCreateUser(w, r)
+	case id != "" && r.Method == "GET":
+		meta, err := eng.DB.scimMember(id)
+		if err != nil {
+			writeSCIMError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		writeSCIM(w, http.StatusOK, eng.scimUserFromMember(meta))
+	case id != "" && (r.Method == "PUT" || r.Method == "PATCH"):
+		eng.scimUpdateUser(w, r, id)
+	case id != "" && r.Method == "DELETE":
+		meta, err := eng.DB.scimMember(id)
+		if err != nil {
+			writeSCIMError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		if err := eng.DB.deprovisionSCIMMember(meta); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log15.Info("Deprovisioned member over SCIM", log15.Ctx{"context": "scim", "email": meta.Email, "deleted": meta.Source == scimSource})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// scimListUsers lists provisioned members, optionally filtered by userName,
+// paginated by the 1-based startIndex and count parameters.
+func (eng *Engine) scimListUsers(w http.ResponseWriter, r *http.Request) {
+	members, err := eng.DB.scimMembers()
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		m := scimFilterPattern.FindStringSubmatch(filter)
+		if m == nil {
+			writeSCIMError(w, http.StatusBadRequest, "Unsupported filter")
+			return
+		}
+		wanted := normaliseEmail(m[2])
+		var filtered []*MemberMeta
+		for _, meta := range members {
+			if meta.Email == wanted {
+				filtered = append(filtered, meta)
+			}
+		}
+		members = filtered
+	}
+	total := len(members)
+	start, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 {
+		count = total
+	}
+	if start-1 < len(members) {
+		members = members[start-1:]
+	} else {
+		members = nil
+	}
+	if count < len(members) {
+		members = members[:count]
+	}
+	resources := make([]*scimUser, 0, len(members))
+	for _, meta := range members {
+		resources = append(resources, eng.scimUserFromMember(meta))
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   start,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// scimCreateUser provisions a member. An existing member added by hand is
+// adopted rather than refused, so lists that predate SCIM can be handed over
+// to an identity provider; members another sync manages are refused.
+func (eng *Engine) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var u scimUser
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	email := u.email()
+	if email == "" {
+		writeSCIMError(w, http.StatusBadRequest, ErrSCIMNoEmail.Error())
+		return
+	}
+	meta, err := eng.DB.GetSubscriber(email)
+	switch err {
+	case nil:
+		if meta.Source != "" {
+			writeSCIMError(w, http.StatusConflict, "User already exists")
+			return
+		}
+		if u.name() != "" {
+			meta.Name = u.name()
+		}
+		meta.Source = scimAdoptedSource
+	case ErrMemberEntryNotFound:
+		meta = eng.DB.CreateSubscriber(email, u.name(), true, false)
+		meta.Source = scimSource
+	default:
+		writeSCIMError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if meta.SourceID, err = newSCIMID(); err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	meta.Suspended = u.Active != nil && !*u.Active
+	if err := eng.DB.UpdateSubscriber(email, meta); err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log15.Info("Provisioned member over SCIM", log15.Ctx{"context": "scim", "email": email})
+	writeSCIM(w, http.StatusCreated, eng.scimUserFromMember(meta))
+}
+
+// scimPatch is a SCIM PatchOp request; only "replace" (and "add") of active,
+// userName and displayName are supported, which covers what identity
+// providers send when people join, change address or leave.
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// apply updates u with the patch's operations.
+func (p *scimPatch) apply(u *scimUser) error {
+	for _, op := range p.Operations {
+		if strings.EqualFold(op.Op, "remove") {
+			continue
+		}
+		if op.Path == "" {
+			// Value is a partial resource.
+			if err := json.Unmarshal(op.Value, u); err != nil {
+				return err
+			}
+			continue
+		}
+		var err error
+		switch strings.ToLower(op.Path) {
+		case "active":
+			err = json.Unmarshal(op.Value, &u.Active)
+		case "username":
+			err = json.Unmarshal(op.Value, &u.UserName)
+		case "displayname":
+			err = json.Unmarshal(op.Value, &u.DisplayName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scimUpdateUser handles PUT (replace) and PATCH for a provisioned member.
+// Setting active to false suspends the member, which stops delivery and
+// posting while keeping their record for reactivation.
+func (eng *Engine) scimUpdateUser(w http.ResponseWriter, r *http.Request, id string) {
+	meta, err := eng.DB.scimMember(id)
+	if err != nil {
+		writeSCIMError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	u := eng.scimUserFromMember(meta)
+	if r.Method == "PUT" {
+		u = &scimUser{}
+		err = json.NewDecoder(r.Body).Decode(u)
+	} else {
+		var patch scimPatch
+		if err = json.NewDecoder(r.Body).Decode(&patch); err == nil {
+			err = patch.apply(u)
+		}
+	}
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	email := u.email()
+	if email == "" {
+		writeSCIMError(w, http.StatusBadRequest, ErrSCIMNoEmail.Error())
+		return
+	}
+	oldemail := meta.Email
+	meta.Email = email
+	if name := u.name(); name != "" {
+		meta.Name = name
+	}
+	meta.Suspended = u.Active != nil && !*u.Active
+	if email != oldemail {
+		err = eng.DB.moveSCIMMember(oldemail, meta)
+	} else {
+		err = eng.DB.UpdateSubscriber(email, meta)
+	}
+	switch err {
+	case nil:
+	case ErrSCIMEmailTaken:
+		writeSCIMError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		writeSCIMError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log15.Info("Updated member over SCIM", log15.Ctx{"context": "scim", "email": email, "active": !meta.Suspended})
+	writeSCIM(w, http.StatusOK, eng.scimUserFromMember(meta))
+}
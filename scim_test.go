@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scimTestEngine(t *testing.T) (*Engine, func()) {
+	dir, err := ioutil.TempDir("", "listless-scim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase(path.Join(dir, "scim.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	eng := &Engine{DB: db, Config: &Config{SCIMToken: "secret", PublicURL: "https://lists.example.org"}}
+	return eng, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// scimRequest sends a SCIM request to eng and decodes any User it returns.
+func scimRequest(eng *Engine, method, target, body string) (int, *scimUser) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	eng.serveSCIMUsers(w, r)
+	u := new(scimUser)
+	if json.Unmarshal(w.Body.Bytes(), u) != nil || u.ID == "" {
+		u = nil
+	}
+	return w.Code, u
+}
+
+func TestSCIMUserLifecycle(t *testing.T) {
+	eng, done := scimTestEngine(t)
+	defer done()
+
+	code, u := scimRequest(eng, "POST", "/scim/v2/Users", `{"userName": "Ann@Example.com", "displayName": "Ann"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	if !assert.NotNil(t, u) {
+		return
+	}
+	meta, err := eng.DB.GetSubscriber("ann@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, scimSource, meta.Source)
+	assert.Equal(t, u.ID, meta.SourceID)
+	code, _ = scimRequest(eng, "POST", "/scim/v2/Users", `{"userName": "ann@example.com"}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	// Deactivating suspends, and reactivating resumes.
+	code, u = scimRequest(eng, "PATCH", "/scim/v2/Users/"+u.ID, `{"Operations": [{"op": "replace", "path": "active", "value": false}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	meta, _ = eng.DB.GetSubscriber("ann@example.com")
+	assert.True(t, meta.Suspended)
+	assert.False(t, meta.Departed)
+	code, u = scimRequest(eng, "PATCH", "/scim/v2/Users/"+u.ID, `{"Operations": [{"op": "replace", "path": "active", "value": true}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	meta, _ = eng.DB.GetSubscriber("ann@example.com")
+	assert.False(t, meta.Suspended)
+
+	// An address change moves the member, keeping their record.
+	joined := meta.Joindate
+	code, u = scimRequest(eng, "PATCH", "/scim/v2/Users/"+u.ID, `{"Operations": [{"op": "replace", "path": "userName", "value": "ann@example.net"}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	_, err = eng.DB.GetSubscriber("ann@example.com")
+	assert.Equal(t, ErrMemberEntryNotFound, err)
+	meta, err = eng.DB.GetSubscriber("ann@example.net")
+	assert.NoError(t, err)
+	assert.Equal(t, "Ann", meta.Name)
+	assert.True(t, joined.Equal(meta.Joindate))
+
+	// Moving onto another member's address is refused, leaving both alone.
+	other := eng.DB.CreateSubscriber("bob@example.net", "Bob", true, false)
+	assert.NoError(t, eng.DB.UpdateSubscriber("bob@example.net", other))
+	code, _ = scimRequest(eng, "PATCH", "/scim/v2/Users/"+u.ID, `{"Operations": [{"op": "replace", "path": "userName", "value": "bob@example.net"}]}`)
+	assert.Equal(t, http.StatusConflict, code)
+	_, err = eng.DB.GetSubscriber("ann@example.net")
+	assert.NoError(t, err)
+
+	code, _ = scimRequest(eng, "DELETE", "/scim/v2/Users/"+u.ID, "")
+	assert.Equal(t, http.StatusNoContent, code)
+	_, err = eng.DB.GetSubscriber("ann@example.net")
+	assert.Equal(t, ErrMemberEntryNotFound, err)
+	code, _ = scimRequest(eng, "GET", "/scim/v2/Users/"+u.ID, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSCIMAdoptedMember(t *testing.T) {
+	eng, done := scimTestEngine(t)
+	defer done()
+	manual := eng.DB.CreateSubscriber("carol@example.com", "Carol", true, true)
+	assert.NoError(t, eng.DB.UpdateSubscriber("carol@example.com", manual))
+	synced := eng.DB.CreateSubscriber("dave@example.com", "Dave", true, false)
+	synced.Source, synced.SourceID = "ldap", "uid=dave"
+	assert.NoError(t, eng.DB.UpdateSubscriber("dave@example.com", synced))
+
+	// Members another sync manages aren't taken over.
+	code, _ := scimRequest(eng, "POST", "/scim/v2/Users", `{"userName": "dave@example.com"}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	// Members added by hand are adopted, and handed back on deletion.
+	code, u := scimRequest(eng, "POST", "/scim/v2/Users", `{"userName": "carol@example.com"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	if !assert.NotNil(t, u) {
+		return
+	}
+	code, _ = scimRequest(eng, "DELETE", "/scim/v2/Users/"+u.ID, "")
+	assert.Equal(t, http.StatusNoContent, code)
+	meta, err := eng.DB.GetSubscriber("carol@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "", meta.Source)
+	assert.Equal(t, "", meta.SourceID)
+	assert.True(t, meta.Moderator)
+}
+
+func TestSCIMRequiresToken(t *testing.T) {
+	eng := &Engine{Config: &Config{SCIMToken: "secret"}}
+	r := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	r.Header.Set("Authorization", "Bearer guess")
+	w := httptest.NewRecorder()
+	eng.serveSCIMUsers(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/layeh/gopher-luar"
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrUnknownScript - Returned when a ScriptName isn't in the Scripts table.
+	ErrUnknownScript = errors.New("No such script in the Scripts table")
+	// ErrUnknownHook - Returned when a script has no function named by ScriptHook.
+	ErrUnknownHook = errors.New("Script has no such hook function")
+	// ErrNoScriptRunner - Returned when transactions are triggered on a database
+	// not opened by an Engine, which has nothing to run their scripts with.
+	ErrNoScriptRunner = errors.New("Database has no engine to run transaction scripts")
+	// ErrHookErrNotStringOrNil - Returned when a hook's error value isn't a string or nil.
+	ErrHookErrNotStringOrNil = errors.New("'error' value returned from script hook is neither string nor nil type")
+)
+
+// ScriptEntry is a script named in the Scripts table of the config, and the
+// sandbox it runs in: "moderator" (the default) or "privileged".
+type ScriptEntry struct {
+	Path    string
+	Sandbox string
+}
+
+// scriptTableOrEmpty reads the Scripts table, whose values are either a path
+// or a table with "path" and "sandbox" fields.
+func scriptTableOrEmpty(l lua.LValue) map[string]ScriptEntry {
+	scripts := make(map[string]ScriptEntry)
+	table, ok := l.(*lua.LTable)
+	if !ok {
+		return scripts
+	}
+	table.ForEach(func(key, val lua.LValue) {
+		entry := ScriptEntry{Sandbox: "moderator"}
+		if fields, ok := val.(*lua.LTable); ok {
+			entry.Path = stringOrNothing(fields.RawGetString("path"))
+			if sandbox := stringOrNothing(fields.RawGetString("sandbox")); sandbox != "" {
+				entry.Sandbox = sandbox
+			}
+		} else {
+			entry.Path = val.String()
+		}
+		scripts[key.String()] = entry
+	})
+	return scripts
+}
+
+// checkScripts ensures each registered script names a known sandbox.
+func checkScripts(scripts map[string]ScriptEntry) error {
+	for _, entry := range scripts {
+		if entry.Sandbox != "moderator" && entry.Sandbox != "privileged" {
+			return ErrUnknownSandbox
+		}
+	}
+	return nil
+}
+
+// TransactionPurgeLoop forgets expired transactions and held messages hourly
+// until closeCh is closed.
+func (eng *Engine) TransactionPurgeLoop(closeCh <-chan struct{}) {
+	for {
+		removed, err := eng.DB.PurgeExpiredTransactions()
+		if err != nil {
+			log15.Error("Error purging expired transactions", log15.Ctx{"context": "db", "error": err})
+		} else if removed > 0 {
+			log15.Info("Purged expired transactions", log15.Ctx{"context": "db", "removed": removed})
+		}
+		removed, err = eng.DB.PurgeExpiredHeld()
+		if err != nil {
+			log15.Error("Error purging expired held messages", log15.Ctx{"context": "moderation", "error": err})
+		} else if removed > 0 {
+			log15.Info("Purged expired held messages", log15.Ctx{"context": "moderation", "removed": removed})
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// sandbox returns a Lua state at the given level, with config and database
+// set, and a function to call when finished with it.
+func (eng *Engine) sandbox(level string) (*lua.LState, func(), error) {
+	switch level {
+	case "privileged":
+		L := eng.PrivilegedSandbox()
+		L.SetGlobal("config", luar.New(L, eng.Config))
+		L.SetGlobal("database", luar.New(L, eng.DB.PrivilegedDBWrapper()))
+		return L, func() {}, nil
+	case "moderator":
+		L, err := eng.ModeratorSandbox()
+		if err != nil {
+			return nil, nil, err
+		}
+		return L, L.Close, nil
+	}
+	return nil, nil, ErrUnknownSandbox
+}
+
+// loadScriptHook loads the named script in its sandbox and returns its hook
+// function, and a function to call when finished with them.
+func (eng *Engine) loadScriptHook(name, hook string) (*lua.LState, *lua.LFunction, func(), error) {
+	entry, ok := eng.Config.Scripts[name]
+	if !ok {
+		return nil, nil, nil, ErrUnknownScript
+	}
+	L, done, err := eng.sandbox(entry.Sandbox)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	log15.Info("Running script hook", log15.Ctx{"context": "lua", "script": name, "hook": hook, "sandbox": entry.Sandbox})
+	if err = L.DoFile(entry.Path); err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	fn, ok := L.GetGlobal(hook).(*lua.LFunction)
+	if !ok {
+		done()
+		return nil, nil, nil, ErrUnknownHook
+	}
+	return L, fn, done, nil
+}
+
+// runScriptHook loads the named script in its sandbox and calls its hook
+// function with the database, the message and refcode. The hook returns a
+// string or nil, and an error string or nil.
+func (eng *Engine) runScriptHook(name, hook string, em *Email, refcode string) (string, error) {
+	L, fn, done, err := eng.loadScriptHook(name, hook)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	err = L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, L.GetGlobal("database"), luar.New(L, em), lua.LString(refcode))
+	if err != nil {
+		return "", err
+	}
+	ret, errmsg := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if errmsg.Type() == lua.LTString {
+		err = errors.New(errmsg.String())
+	} else if errmsg.Type() != lua.LTNil {
+		return "", ErrHookErrNotStringOrNil
+	}
+	if ret.Type() == lua.LTNil {
+		return "", err
+	}
+	return ret.String(), err
+}
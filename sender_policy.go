@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrUnknownSenderPolicy - Returned when SenderPolicy isn't a known setting.
+var ErrUnknownSenderPolicy = errors.New("Unknown SenderPolicy; use \"open\", \"reject\" or \"hold\"")
+
+// senderPolicyReason is the hold reason shown to moderators for posts held
+// by SenderPolicy.
+const senderPolicyReason = "Sender is not a member allowed to post"
+
+// isAutomated reports whether a message looks machine-sent, so shouldn't be
+// answered: autoresponders, bounces and other lists' mail.
+func isAutomated(headers textproto.MIMEHeader) bool {
+	if auto := strings.ToLower(strings.TrimSpace(headers.Get("Auto-Submitted"))); auto != "" && auto != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(headers.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return headers.Get("List-Id") != "" || strings.TrimSpace(headers.Get("Return-Path")) == "<>"
+}
+
+// senderAllowed reports whether sender is a member allowed to post, or an
+// allowed sender (see AllowSender).
+func (eng *Engine) senderAllowed(sender string) bool {
+	member, err := eng.DB.memberFor(sender)
+	if err == ErrMemberEntryNotFound {
+		return eng.DB.IsAllowedSender(sender)
+	} else if err != nil {
+		log15.Error("Error looking up sender for SenderPolicy", log15.Ctx{"context": "db", "sender": sender, "error": err})
+		return false
+	}
+	return member.mayPost()
+}
+
+// applySenderPolicy rejects or holds a post from a sender who may not post,
+// according to SenderPolicy, before eventLoop sees it. It reports whether it
+// dealt with the message, so the caller should stop there.
+func (eng *Engine) applySenderPolicy(em *Email) (bool, error) {
+	policy := eng.Config.SenderPolicy
+	if policy != "reject" && policy != "hold" {
+		return false, nil
+	}
+	if eng.senderAllowed(em.Sender) {
+		return false, nil
+	}
+	log15.Info("Sender may not post, applying SenderPolicy", log15.Ctx{"context": "imap", "sender": em.Sender, "policy": policy})
+	if policy == "reject" {
+		if err := eng.DB.LogEvent(EventWithheld, em.Sender); err != nil {
+			log15.Error("Error logging withheld message", log15.Ctx{"context": "db", "error": err})
+		}
+		eng.notifySender("rejected", em)
+		return true, nil
+	}
+	em.holdReason = senderPolicyReason
+	if err := eng.holdMessage(em); err != nil {
+		return true, err
+	}
+	eng.notifySender("held", em)
+	return true, nil
+}
+
+// notifySender tells the sender of em what became of it with a notice, unless
+// em was automated. Failures are only logged.
+func (eng *Engine) notifySender(notice string, em *Email) {
+	if isAutomated(em.Headers) {
+		log15.Info("Not notifying sender of automated message", log15.Ctx{"context": "smtp", "sender": em.Sender, "notice": notice})
+		return
+	}
+	subject, body, err := eng.renderNotice(notice, em.Sender, map[string]interface{}{
+		"Sender":  em.Sender,
+		"Subject": em.Subject,
+	})
+	if err != nil {
+		log15.Error("Error rendering notice to sender", log15.Ctx{"context": "smtp", "notice": notice, "error": err})
+		return
+	}
+	e := email.NewEmail()
+	e.From = eng.fromAddress("moderation")
+	e.To = []string{em.Sender}
+	e.Subject = subject
+	e.Text = []byte(body)
+	if id := em.GetHeader("Message-Id"); id != "" {
+		e.Headers.Set("In-Reply-To", id)
+	}
+	e.Headers.Set("Auto-Submitted", "auto-replied")
+	notification := WrapEmail(e)
+	if err = eng.markSent(notification); err == nil {
+		err = eng.deliver(context.Background(), notification)
+	}
+	if err != nil {
+		log15.Error("Error sending notice to sender", log15.Ctx{"context": "smtp", "notice": notice, "sender": em.Sender, "error": err})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAutomated(t *testing.T) {
+	h := textproto.MIMEHeader{}
+	assert.False(t, isAutomated(h))
+	h.Set("Auto-Submitted", "no")
+	assert.False(t, isAutomated(h))
+	h.Set("Auto-Submitted", "auto-replied")
+	assert.True(t, isAutomated(h))
+	assert.True(t, isAutomated(textproto.MIMEHeader{"Precedence": {"Bulk"}}))
+	assert.True(t, isAutomated(textproto.MIMEHeader{"List-Id": {"<other.example.com>"}}))
+	assert.True(t, isAutomated(textproto.MIMEHeader{"Return-Path": {"<>"}}))
+}
+
+func TestAllowedSenderKey(t *testing.T) {
+	key, err := allowedSenderKey("Partner.ORG")
+	assert.NoError(t, err)
+	assert.Equal(t, "@partner.org", key)
+	key, err = allowedSenderKey("@partner.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "@partner.org", key)
+	key, err = allowedSenderKey("Tickets@Example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "tickets@example.com", key)
+	_, err = allowedSenderKey("localhost")
+	assert.Equal(t, ErrInvalidSenderPattern, err)
+	_, err = allowedSenderKey("")
+	assert.Equal(t, ErrInvalidSenderPattern, err)
+}
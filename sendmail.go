@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/layeh/gopher-luar"
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrNoRecipients - Returned when a script sends a message addressed to no one.
+var ErrNoRecipients = errors.New("Message has no recipients")
+
+// sendLimiter spaces out mail that scripts send, allowing perMinute messages
+// in any minute; later ones are queued for when there's room.
+type sendLimiter struct {
+	perMinute int
+	mu        sync.Mutex
+	// Send times of the last perMinute messages, oldest first.
+	recent []time.Time
+}
+
+// reserve books a send slot at or after now, returning its time.
+func (sl *sendLimiter) reserve(now time.Time) time.Time {
+	if sl == nil || sl.perMinute <= 0 {
+		return now
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	at := now
+	if len(sl.recent) >= sl.perMinute {
+		if free := sl.recent[len(sl.recent)-sl.perMinute].Add(time.Minute); free.After(at) {
+			at = free
+		}
+	}
+	sl.recent = append(sl.recent, at)
+	if len(sl.recent) > sl.perMinute {
+		sl.recent = sl.recent[len(sl.recent)-sl.perMinute:]
+	}
+	return at
+}
+
+// relayPacer keeps relayed posts at least gap apart, so a drained burst of
+// mail doesn't hit the Transport all at once.
+type relayPacer struct {
+	gap  time.Duration
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the next post may be relayed, or ctx ends.
+func (rp *relayPacer) wait(ctx context.Context) error {
+	if rp == nil || rp.gap <= 0 {
+		return nil
+	}
+	rp.mu.Lock()
+	now := time.Now()
+	at := rp.next
+	if at.Before(now) {
+		at = now
+	}
+	rp.next = at.Add(rp.gap)
+	rp.mu.Unlock()
+	select {
+	case <-time.After(at.Sub(now)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sendmail sends a message a script made, rather than relaying a post: it
+// goes straight to its recipients, from the list address if it has no From.
+// It waits in the outgoing queue if SendAt was used, or if scripts have sent
+// more than SendRateLimit messages in the last minute.
+func (eng *Engine) Sendmail(em *Email) error {
+	if em.From == "" {
+		em.setFrom(eng.Config.ListAddress)
+	}
+	if len(em.To)+len(em.Cc)+len(em.Bcc) == 0 {
+		return ErrNoRecipients
+	}
+	// Mark it as ours, so it isn't handled as a post if it comes back.
+	if err := eng.markSent(em); err != nil {
+		return err
+	}
+	at := eng.sendLimit.reserve(time.Now())
+	if em.sendAt.After(at) {
+		at = em.sendAt
+	}
+	if !at.After(time.Now()) {
+		log15.Info("Sending script message", log15.Ctx{"context": "smtp", "from": em.From, "subject": em.Subject})
+		return eng.deliver(context.Background(), em)
+	}
+	q := &QueuedMessage{
+		Message: em.Email,
+		Sender:  em.Sender,
+		Queued:  time.Now().UTC(),
+		SendAt:  at.UTC(),
+		Direct:  true,
+	}
+	if err := eng.DB.enqueue(q); err != nil {
+		return err
+	}
+	log15.Info("Queued script message", log15.Ctx{"context": "queue", "id": q.ID, "sendAt": q.SendAt})
+	return nil
+}
+
+// setMailGlobals gives a script state what it needs to originate mail:
+// * listless.NewEmail(from, subject) returns a new, empty message; from may
+//     be an address, the name of one of the Identities, or "" for the list
+//     address.
+// * listless.NewNotice(notice, recipient, data) returns one of the list's
+//     notices, e.g. "welcome" or "confirm", addressed to recipient and in
+//     their language, with data (a table) given to its template. On failure
+//     it returns nil and an error.
+// * listless.Identity(name) returns the From address of a named identity, or
+//     the list address if there's no such identity.
+// * sendmail(message) sends it (see Engine.Sendmail), returning nil or an
+//     error string.
+func (eng *Engine) setMailGlobals(L *lua.LState) {
+	L.SetGlobal("listless", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"NewEmail": func(L *lua.LState) int {
+			from := L.OptString(1, "")
+			if _, ok := eng.Config.Identities[from]; ok || from == "" {
+				from = eng.fromAddress(from)
+			}
+			em := newBlankEmail(from)
+			em.Subject = L.OptString(2, "")
+			L.Push(luar.New(L, em))
+			return 1
+		},
+		"NewNotice": func(L *lua.LState) int {
+			notice, recipient := L.CheckString(1), L.CheckString(2)
+			data := make(map[string]interface{})
+			for k, v := range stringMapOrEmpty(L.Get(3)) {
+				data[k] = v
+			}
+			subject, body, err := eng.renderNotice(notice, recipient, data)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			em := newBlankEmail(eng.Config.ListAddress)
+			em.Subject = subject
+			em.SetText(body)
+			em.AddToRecipient(recipient)
+			L.Push(luar.New(L, em))
+			return 1
+		},
+		"Identity": func(L *lua.LState) int {
+			L.Push(lua.LString(eng.fromAddress(L.CheckString(1))))
+			return 1
+		},
+	}))
+	L.SetGlobal("sendmail", L.NewFunction(func(L *lua.LState) int {
+		em, ok := L.CheckUserData(1).Value.(*Email)
+		if !ok {
+			L.ArgError(1, "expected an email")
+			return 0
+		}
+		if err := eng.Sendmail(em); err != nil {
+			L.Push(lua.LString(err.Error()))
+			return 1
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+}
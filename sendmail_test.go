@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendLimiter(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	var unlimited *sendLimiter
+	assert.Equal(t, now, unlimited.reserve(now))
+	sl := &sendLimiter{perMinute: 2}
+	assert.Equal(t, now, sl.reserve(now))
+	assert.Equal(t, now, sl.reserve(now))
+	// The third waits for the first to be a minute old, the fourth for the second.
+	assert.Equal(t, now.Add(time.Minute), sl.reserve(now))
+	assert.Equal(t, now.Add(time.Minute), sl.reserve(now.Add(time.Second)))
+	assert.Equal(t, now.Add(2*time.Minute), sl.reserve(now.Add(time.Second)))
+	// Once quiet, sends go straight away again.
+	later := now.Add(time.Hour)
+	assert.Equal(t, later, sl.reserve(later))
+}
+
+func TestSendGivesUpWithContext(t *testing.T) {
+	eng := &Engine{Config: &Config{Transport: "fake"}, fake: new(fakeOutbox)}
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, eng.send(ctx, nil, "a@example.com", []string{"b@example.com"}, []byte("hi")))
+	assert.Len(t, eng.fake.messages(), 1)
+	cancel()
+	assert.Equal(t, context.Canceled, eng.send(ctx, nil, "a@example.com", []string{"b@example.com"}, []byte("hi")))
+	assert.Len(t, eng.fake.messages(), 1)
+}
+
+func TestRelayPacer(t *testing.T) {
+	rp := &relayPacer{gap: time.Hour}
+	assert.Nil(t, rp.wait(context.Background()))
+	// The next post must wait an hour, unless its context ends first.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, rp.wait(ctx))
+}
@@ -0,0 +1,11 @@
+package main
+
+import "errors"
+
+var (
+	// ErrServiceUnsupported - Returned by the service commands other than on Windows.
+	ErrServiceUnsupported = errors.New("Services are only supported on Windows; use your init system elsewhere")
+
+	// ErrServiceExists - Returned when installing a service whose name is taken.
+	ErrServiceExists = errors.New("A service of that name is already installed; remove it first, or choose another --name")
+)
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// runningAsService is always false here; init systems run loop mode as it is.
+func runningAsService() bool {
+	return false
+}
+
+func installService(name, configFile string) error {
+	return ErrServiceUnsupported
+}
+
+func removeService(name string) error {
+	return ErrServiceUnsupported
+}
+
+func runService(name string, engine *Engine) error {
+	return ErrServiceUnsupported
+}
@@ -0,0 +1,115 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// runningAsService reports whether the Service Control Manager started us.
+func runningAsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// installService registers loop mode with configFile as a service starting
+// with Windows, and name as an event source for it to log under.
+func installService(name, configFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// The service starts in the system directory, so needs the full path.
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return ErrServiceExists
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "Listless (" + name + ")",
+		Description: "Runs the mailing list configured in " + configFile,
+		StartType:   mgr.StartAutomatic,
+	}, "loop", configFile, "--service-name", name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+// removeService unregisters a service and its event source. A running
+// service is removed once it stops.
+func removeService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(name)
+}
+
+// runService runs the engine's event loop until the Service Control Manager
+// asks it to stop, as a signal would otherwise.
+func runService(name string, engine *Engine) error {
+	return svc.Run(name, &listService{engine})
+}
+
+type listService struct {
+	engine *Engine
+}
+
+func (ls *listService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		ls.engine.Run()
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			// Stopping unasked is a failure, so that recovery actions apply.
+			log15.Error("Event loop exited unexpectedly", log15.Ctx{"context": "teardown"})
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log15.Info("Service stopping, finishing the current message", log15.Ctx{"context": "teardown"})
+				status <- svc.Status{State: svc.StopPending}
+				ls.engine.Stop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spool holds an incoming message as it is fetched: in memory up to
+// threshold bytes, and in a temporary file in dir beyond that, so a large
+// attachment costs disk rather than memory until the message is parsed. It
+// keeps only the first max+1 bytes, so Handler can tell a message was over
+// MaxMessageMB, discarding the rest while counting it. A max or threshold of
+// zero or less means no limit or no spooling.
+type spool struct {
+	max, threshold int64
+	dir            string
+	// Not embedded, as bytes.Buffer's ReadFrom would let io.Copy past Write.
+	mem  bytes.Buffer
+	file *os.File
+	kept int64
+	size int64
+}
+
+// newSpool returns a spool for the configured MaxMessageMB, SpoolThresholdKB
+// and SpoolDir.
+func (eng *Engine) newSpool() *spool {
+	return &spool{
+		max:       eng.maxMessageBytes(),
+		threshold: int64(eng.Config.SpoolThresholdKB) << 10,
+		dir:       eng.Config.SpoolDir,
+	}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	keep := p
+	if s.max > 0 {
+		room := s.max + 1 - s.kept
+		if room <= 0 {
+			return len(p), nil
+		}
+		if int64(len(keep)) > room {
+			keep = keep[:room]
+		}
+	}
+	if s.file == nil && s.threshold > 0 && s.kept+int64(len(keep)) > s.threshold {
+		f, err := ioutil.TempFile(s.dir, "listless-spool")
+		if err != nil {
+			return 0, err
+		}
+		if _, err = f.Write(s.mem.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.mem.Reset()
+		s.file = f
+	}
+	if s.file != nil {
+		if _, err := s.file.Write(keep); err != nil {
+			return 0, err
+		}
+	} else {
+		s.mem.Write(keep)
+	}
+	s.kept += int64(len(keep))
+	return len(p), nil
+}
+
+// Reader returns what was kept, from the start. It is only valid until the
+// spool is closed.
+func (s *spool) Reader() (io.ReadSeeker, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.mem.Bytes()), nil
+	}
+	_, err := s.file.Seek(0, io.SeekStart)
+	return s.file, err
+}
+
+// Close empties the spool, removing any temporary file. The spool may then be
+// used for another message.
+func (s *spool) Close() error {
+	s.mem.Reset()
+	s.kept, s.size = 0, 0
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	s.file.Close()
+	s.file = nil
+	return os.Remove(name)
+}
+
+// spoolMessage reads r to the end into a new spool.
+func (eng *Engine) spoolMessage(r io.Reader) (*spool, error) {
+	s := eng.newSpool()
+	if _, err := io.Copy(s, r); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readSpool(t *testing.T, s *spool) string {
+	r, err := s.Reader()
+	assert.Nil(t, err)
+	kept, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	return string(kept)
+}
+
+func TestSpool(t *testing.T) {
+	// Small messages stay in memory, and only max+1 bytes are kept.
+	s := &spool{max: 4, threshold: 100}
+	_, err := io.Copy(s, strings.NewReader("0123456789"))
+	assert.Nil(t, err)
+	assert.Nil(t, s.file)
+	assert.Equal(t, "01234", readSpool(t, s))
+	assert.Equal(t, int64(10), s.size)
+
+	// Larger ones go to a file, which Close removes.
+	s = &spool{threshold: 4, dir: os.TempDir()}
+	io.Copy(s, strings.NewReader("01"))
+	io.Copy(s, strings.NewReader("23456789"))
+	assert.NotNil(t, s.file)
+	name := s.file.Name()
+	assert.Equal(t, "0123456789", readSpool(t, s))
+	assert.Nil(t, s.Close())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+
+	// A closed spool can be used again.
+	io.Copy(s, strings.NewReader("ab"))
+	assert.Equal(t, "ab", readSpool(t, s))
+}
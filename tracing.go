@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	// How often finished spans are exported.
+	traceExportInterval = 5 * time.Second
+	// Spans beyond this many awaiting export are dropped.
+	traceBufferLimit = 4096
+)
+
+// tracer collects spans of the delivery pipeline and exports them over
+// OTLP/HTTP, as JSON, to OTLPEndpoint. A nil *tracer, and the nil spans it
+// starts, do nothing, so callers needn't check whether tracing is on.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	list     string
+	mu       sync.Mutex
+	finished []*span
+}
+
+// span is one timed step of handling a message, e.g. running eventLoop.
+type span struct {
+	tracer   *tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+func newTracer(cfg *Config) *tracer {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	return &tracer{endpoint: strings.TrimRight(cfg.OTLPEndpoint, "/"), headers: cfg.OTLPHeaders, list: cfg.ListAddress}
+}
+
+// startSpan begins a new trace.
+func (t *tracer) startSpan(name string) *span {
+	if t == nil {
+		return nil
+	}
+	traceID, _ := randomHex(16)
+	spanID, _ := randomHex(8)
+	return &span{tracer: t, traceID: traceID, spanID: spanID, name: name, start: time.Now(), attrs: make(map[string]string)}
+}
+
+// child begins a span within this one.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	spanID, _ := randomHex(8)
+	return &span{tracer: s.tracer, traceID: s.traceID, spanID: spanID, parentID: s.spanID, name: name, start: time.Now(), attrs: make(map[string]string)}
+}
+
+// set records an attribute of the span.
+func (s *span) set(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// finish ends the span, marking it failed if err isn't nil, and queues it
+// for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.finished) < traceBufferLimit {
+		t.finished = append(t.finished, s)
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var out []otlpAttribute
+	for k, v := range attrs {
+		out = append(out, otlpAttribute{Key: k, Value: otlpValue{v}})
+	}
+	return out
+}
+
+// otlpTraces renders spans as an OTLP ExportTraceServiceRequest.
+func (t *tracer) otlpTraces(spans []*span) map[string]interface{} {
+	var out []otlpSpan
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // Internal
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: 1}, // Ok
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		out = append(out, o)
+	}
+	resource := otlpAttributes(map[string]string{"service.name": "listless", "listless.list": t.list})
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "listless"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+// export sends the finished spans to the collector.
+func (t *tracer) export() error {
+	t.mu.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(t.otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+	return postJSON(t.endpoint+"/v1/traces", body, t.headers)
+}
+
+// TraceExportLoop exports finished spans every few seconds, and once more
+// when closeCh is closed.
+func (eng *Engine) TraceExportLoop(closeCh <-chan struct{}) {
+	for {
+		select {
+		case <-closeCh:
+			if err := eng.tracer.export(); err != nil {
+				log15.Error("Error exporting traces", log15.Ctx{"context": "trace", "error": err})
+			}
+			return
+		case <-time.After(traceExportInterval):
+		}
+		if err := eng.tracer.export(); err != nil {
+			log15.Error("Error exporting traces", log15.Ctx{"context": "trace", "error": err})
+		}
+	}
+}
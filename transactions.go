@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ErrUnknownTransactionScan - Returned when TransactionScan isn't a known setting.
+var ErrUnknownTransactionScan = errors.New("Unknown TransactionScan; use \"subject\", \"body\" or \"off\"")
+
+const (
+	// Shorter words aren't taken for transaction secrets, to spare lookups.
+	minSecretLength = 16
+	// How many lines of the body are searched with TransactionScan = "body".
+	transactionScanLines = 5
+)
+
+// secretCandidates returns the words of text that could be transaction
+// secrets: runs of letters, digits, '-' and '_' of at least minSecretLength.
+func secretCandidates(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	})
+	var (
+		out  []string
+		seen = make(map[string]struct{})
+	)
+	for _, w := range words {
+		if _, dup := seen[w]; dup || len(w) < minSecretLength {
+			continue
+		}
+		seen[w] = struct{}{}
+		out = append(out, w)
+	}
+	return out
+}
+
+// scanText returns the text searched for transaction secrets: the subject
+// and, with TransactionScan = "body", the first few unquoted body lines.
+func (eng *Engine) scanText(em *Email) string {
+	text := em.Subject
+	if eng.Config.TransactionScan != "body" {
+		return text
+	}
+	lines := 0
+	for _, line := range strings.Split(em.GetText(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ">") {
+			continue
+		}
+		text += "\n" + line
+		if lines++; lines == transactionScanLines {
+			break
+		}
+	}
+	return text
+}
+
+// triggerFromMail looks for a registered transaction secret in an incoming
+// message and triggers the first one found, so confirmation replies work
+// without eventLoop looking for them. It reports whether a transaction was
+// triggered, in which case the message isn't passed to eventLoop.
+func (eng *Engine) triggerFromMail(em *Email) bool {
+	if eng.Config.TransactionScan == "off" {
+		return false
+	}
+	for _, secret := range secretCandidates(eng.scanText(em)) {
+		if !eng.DB.HasTransaction(secret) {
+			continue
+		}
+		ret, refcode, err := eng.DB.TriggerTransaction(secret, em)
+		if err != nil {
+			log15.Error("Error triggering transaction from incoming mail", log15.Ctx{"context": "lua", "sender": em.Sender, "refcode": refcode, "error": err})
+			continue
+		}
+		log15.Info("Triggered transaction from incoming mail", log15.Ctx{"context": "lua", "sender": em.Sender, "refcode": refcode, "result": ret})
+		return true
+	}
+	return false
+}
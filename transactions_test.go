@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretCandidates(t *testing.T) {
+	subject := "Re: Confirm your subscription [3f9a0c2e5b7d41a8c6e2f0b9d4a7c1e3] (3f9a0c2e5b7d41a8c6e2f0b9d4a7c1e3)"
+	assert.Equal(t, []string{"3f9a0c2e5b7d41a8c6e2f0b9d4a7c1e3"}, secretCandidates(subject))
+	assert.Equal(t, []string{"01APK58WG0ABCDEFGHJKMNPQRS", "a_long-token_value"}, secretCandidates("id:01APK58WG0ABCDEFGHJKMNPQRS, a_long-token_value."))
+	assert.Nil(t, secretCandidates("Short words only: no tokens here"))
+}
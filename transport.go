@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	// ErrUnknownTransport - Returned when the Transport option isn't a known backend.
+	ErrUnknownTransport = errors.New("Unknown Transport; expected smtp, gmail, graph, ses, mailgun or sendgrid")
+
+	// ErrTransportNeedsRegion - Returned when the ses Transport is chosen without SESRegion.
+	ErrTransportNeedsRegion = errors.New("Transport requires SESRegion")
+
+	// ErrTransportNeedsAPIKey - Returned when an API transport is chosen without its API key.
+	ErrTransportNeedsAPIKey = errors.New("Transport requires an API key (and MailgunDomain, for mailgun)")
+
+	// ErrTransportNeedsOAuth - Returned when an API transport is chosen without OAuth configuration.
+	ErrTransportNeedsOAuth = errors.New("Transport requires OAuth configuration")
+
+	// ErrTransportRequestFailed - Returned when a mail API rejects a message.
+	ErrTransportRequestFailed = errors.New("Mail API request failed")
+)
+
+// setupTransport validates the configured Transport and prepares any
+// credentials it needs.
+func (eng *Engine) setupTransport() error {
+	switch eng.Config.Transport {
+	case "", "smtp":
+		return nil
+	case "fake":
+		eng.fake = &fakeOutbox{dir: eng.Config.FakeOutbox}
+		if eng.fake.dir != "" {
+			return os.MkdirAll(eng.fake.dir, 0700)
+		}
+		return nil
+	case "gmail":
+		if eng.oauthTokens == nil {
+			return ErrTransportNeedsOAuth
+		}
+		return nil
+	case "graph":
+		if eng.Config.GraphTenantID == "" || eng.Config.OAuthClientID == "" || eng.Config.OAuthClientSecret == "" {
+			return ErrTransportNeedsOAuth
+		}
+		eng.graphTokens = newGraphTokenSource(eng.Config)
+		return nil
+	case "ses":
+		if eng.Config.SESRegion == "" {
+			return ErrTransportNeedsRegion
+		}
+		var err error
+		eng.ses, err = newSESClient(eng.Config)
+		return err
+	case "mailgun":
+		if eng.Config.MailgunAPIKey == "" || eng.Config.MailgunDomain == "" {
+			return ErrTransportNeedsAPIKey
+		}
+		return nil
+	case "sendgrid":
+		if eng.Config.SendGridAPIKey == "" {
+			return ErrTransportNeedsAPIKey
+		}
+		return nil
+	}
+	return ErrUnknownTransport
+}
+
+// deliver sends an email to its recipients, less excludeEmails, using the
+// configured Transport, giving up if ctx ends first. Failures count towards
+// the SMTP alert threshold, whatever the transport.
+func (eng *Engine) deliver(ctx context.Context, em *Email, excludeEmails ...string) error {
+	from, to, raw, err := em.envelope(excludeEmails...)
+	if err != nil {
+		return err
+	}
+	sendSpan := em.span.child("send")
+	sendSpan.set("send.transport", eng.Config.Transport)
+	sendSpan.set("send.recipients", strconv.Itoa(len(to)))
+	sendStart := time.Now()
+	err = eng.send(ctx, em, from, to, raw)
+	if em.timings != nil {
+		em.timings.send += time.Since(sendStart)
+	}
+	sendSpan.finish(err)
+	if ctx.Err() == nil {
+		// Giving up isn't the Transport's fault.
+		eng.recordSMTPResult(err)
+	}
+	return err
+}
+
+// send hands a message to the configured Transport, returning ctx's error if
+// ctx ends first. None of the transports can be interrupted, so an abandoned
+// send carries on in the background and may yet succeed.
+func (eng *Engine) send(ctx context.Context, em *Email, from string, to []string, raw []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- eng.sendNow(em, from, to, raw) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		log15.Warn("Gave up waiting for Transport", log15.Ctx{"context": "smtp", "transport": eng.Config.Transport, "error": ctx.Err()})
+		return ctx.Err()
+	}
+}
+
+// sendNow hands a message to the configured Transport.
+func (eng *Engine) sendNow(em *Email, from string, to []string, raw []byte) error {
+	switch eng.Config.Transport {
+	case "", "smtp":
+		if sent, err := eng.sendAsIdentity(from, eng.envelopeSender(from), to, raw); sent {
+			return err
+		}
+		return smtp.SendMail(eng.Config.smtpAddr, eng.smtpAuth(), eng.envelopeSender(from), to, raw)
+	case "gmail":
+		return eng.sendGmail(to, raw)
+	case "graph":
+		return eng.sendGraph(to, raw)
+	case "ses":
+		return eng.sendSES(from, to, raw)
+	case "mailgun":
+		return eng.sendMailgun(to, raw)
+	case "sendgrid":
+		return eng.sendSendGrid(em, to)
+	case "fake":
+		return eng.fake.send(eng.envelopeSender(from), to, raw)
+	}
+	return ErrUnknownTransport
+}
+
+// envelopeSender returns the SMTP envelope sender (Return-Path) for mail from
+// the given address: BounceAddress if set, so bounces don't land in the list
+// INBOX. The HTTP API transports choose their own.
+func (eng *Engine) envelopeSender(from string) string {
+	if eng.Config.BounceAddress != "" {
+		return eng.Config.BounceAddress
+	}
+	return from
+}
+
+// withBccHeader prepends a Bcc header listing the envelope recipients to a raw
+// message, for APIs that take recipients from the headers rather than an
+// envelope. Such APIs strip the header before delivery.
+func withBccHeader(raw []byte, to []string) []byte {
+	return append([]byte("Bcc: "+strings.Join(to, ", ")+"\r\n"), raw...)
+}
+
+// checkAPIResponse returns an error including the status and the start of
+// the response body if resp isn't a 2xx response.
+func checkAPIResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%w: %s: %s", ErrTransportRequestFailed, resp.Status, bytes.TrimSpace(body))
+}
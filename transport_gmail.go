@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+const gmailSendURL = "https://gmail.googleapis.com/upload/gmail/v1/users/me/messages/send?uploadType=media"
+
+// sendGmail submits a raw message through the Gmail API's users.messages.send
+// as the OAuth-authenticated account, which needs the gmail.send scope.
+// Gmail delivers to every address in the To, Cc and Bcc headers, so the list
+// address may receive a copy; the signed loop header stops the copy
+// being relayed again.
+func (eng *Engine) sendGmail(to []string, raw []byte) error {
+	req, err := http.NewRequest("POST", gmailSendURL, bytes.NewReader(withBccHeader(raw, to)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	resp, err := oauth2.NewClient(oauth2.NoContext, eng.oauthTokens).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkAPIResponse(resp)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	graphTokenURL = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	graphSendURL  = "https://graph.microsoft.com/v1.0/users/%s/sendMail"
+)
+
+// newGraphTokenSource returns app-only (client credential) tokens for
+// Microsoft Graph; the app registration needs the Mail.Send application
+// permission.
+func newGraphTokenSource(cfg *Config) oauth2.TokenSource {
+	conf := &clientcredentials.Config{
+		ClientID:     cfg.OAuthClientID,
+		ClientSecret: cfg.OAuthClientSecret,
+		TokenURL:     fmt.Sprintf(graphTokenURL, url.PathEscape(cfg.GraphTenantID)),
+		Scopes:       []string{"https://graph.microsoft.com/.default"},
+	}
+	return conf.TokenSource(oauth2.NoContext)
+}
+
+// sendGraph submits a raw message through Microsoft Graph's sendMail as the
+// list address's mailbox. Like the Gmail API, Graph takes recipients from the
+// message headers.
+func (eng *Engine) sendGraph(to []string, raw []byte) error {
+	endpoint := fmt.Sprintf(graphSendURL, url.PathEscape(eng.Config.ListAddress))
+	body := base64.StdEncoding.EncodeToString(withBccHeader(raw, to))
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := oauth2.NewClient(oauth2.NoContext, eng.graphTokens).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkAPIResponse(resp)
+}
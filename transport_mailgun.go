@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+const mailgunSendURL = "https://%s/v3/%s/messages.mime"
+
+// sendMailgun submits a raw message through Mailgun's messages.mime endpoint,
+// which takes the envelope recipients separately from the message.
+func (eng *Engine) sendMailgun(to []string, raw []byte) error {
+	host := "api.mailgun.net"
+	if eng.Config.MailgunRegion == "eu" {
+		host = "api.eu.mailgun.net"
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, rcpt := range to {
+		if err := form.WriteField("to", rcpt); err != nil {
+			return err
+		}
+	}
+	part, err := form.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	if _, err = part.Write(raw); err != nil {
+		return err
+	}
+	if err = form.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf(mailgunSendURL, host, url.PathEscape(eng.Config.MailgunDomain)), &body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", eng.Config.MailgunAPIKey)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkAPIResponse(resp)
+}
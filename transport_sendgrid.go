@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+const (
+	sendGridSendURL = "https://api.sendgrid.com/v3/mail/send"
+	// SendGrid accepts at most 1000 personalizations per request.
+	sendGridMaxPersonalizations = 1000
+)
+
+// Headers SendGrid sets itself, or takes from other fields of the request.
+var sendGridReservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Subject": true, "Reply-To": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true, "Mime-Version": true,
+	"Date": true, "Message-Id": true, "Received": true, "Dkim-Signature": true,
+	"Return-Path": true, "Sender": true, "X-Sg-Id": true, "X-Sg-Eid": true,
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content  string `json:"content"`
+	Type     string `json:"type,omitempty"`
+	Filename string `json:"filename"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+// parseSendGridAddress converts an RFC5322 address to SendGrid's form.
+func parseSendGridAddress(addr string) (sendGridAddress, error) {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return sendGridAddress{}, err
+	}
+	return sendGridAddress{Email: parsed.Address, Name: parsed.Name}, nil
+}
+
+// sendGridMessageFor converts an email to a SendGrid v3 mail/send request,
+// minus personalizations. SendGrid has no raw MIME endpoint, so the message
+// is rebuilt from its parts; headers SendGrid reserves are dropped.
+func sendGridMessageFor(em *Email) (*sendGridMessage, error) {
+	from, err := parseSendGridAddress(em.From)
+	if err != nil {
+		return nil, err
+	}
+	msg := &sendGridMessage{From: from, Subject: em.Subject, Headers: make(map[string]string)}
+	if replyTo := em.Headers.Get("Reply-To"); replyTo != "" {
+		if addr, err := parseSendGridAddress(replyTo); err == nil {
+			msg.ReplyTo = &addr
+		}
+	}
+	if len(em.Text) > 0 {
+		msg.Content = append(msg.Content, sendGridContent{Type: "text/plain", Value: string(em.Text)})
+	}
+	if len(em.HTML) > 0 {
+		msg.Content = append(msg.Content, sendGridContent{Type: "text/html", Value: string(em.HTML)})
+	}
+	if len(msg.Content) == 0 {
+		// SendGrid requires some content.
+		msg.Content = append(msg.Content, sendGridContent{Type: "text/plain", Value: " "})
+	}
+	for name, values := range em.Headers {
+		if sendGridReservedHeaders[name] || len(values) == 0 {
+			continue
+		}
+		msg.Headers[name] = strings.Join(values, ", ")
+	}
+	for _, a := range em.Attachments {
+		msg.Attachments = append(msg.Attachments, sendGridAttachment{
+			Content:  base64.StdEncoding.EncodeToString(a.Content),
+			Type:     a.Header.Get("Content-Type"),
+			Filename: a.Filename,
+		})
+	}
+	return msg, nil
+}
+
+// sendSendGrid submits an email through SendGrid's v3 API, with a
+// personalization (and so a separate copy) for each recipient.
+func (eng *Engine) sendSendGrid(em *Email, to []string) error {
+	msg, err := sendGridMessageFor(em)
+	if err != nil {
+		return err
+	}
+	for len(to) > 0 {
+		batch := to
+		if len(batch) > sendGridMaxPersonalizations {
+			batch = batch[:sendGridMaxPersonalizations]
+		}
+		to = to[len(batch):]
+		msg.Personalizations = msg.Personalizations[:0]
+		for _, rcpt := range batch {
+			msg.Personalizations = append(msg.Personalizations, sendGridPersonalization{To: []sendGridAddress{{Email: rcpt}}})
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", sendGridSendURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+eng.Config.SendGridAPIKey)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		err = checkAPIResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
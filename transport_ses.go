@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sesv2"
+)
+
+// SES accepts at most 50 recipients per message.
+const sesMaxRecipients = 50
+
+// newSESClient returns an SES v2 client for SESRegion. With no SESAccessKeyID
+// the SDK's default credential chain is used, which covers environment
+// variables and EC2/ECS IAM roles.
+func newSESClient(cfg *Config) (*sesv2.SESV2, error) {
+	awsConfig := aws.NewConfig().WithRegion(cfg.SESRegion)
+	if cfg.SESAccessKeyID != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(cfg.SESAccessKeyID, cfg.SESSecretAccessKey, ""))
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return sesv2.New(sess), nil
+}
+
+// sendSES submits a raw message through SES, in batches of recipients as SES
+// limits recipients per message.
+func (eng *Engine) sendSES(from string, to []string, raw []byte) error {
+	for len(to) > 0 {
+		batch := to
+		if len(batch) > sesMaxRecipients {
+			batch = batch[:sesMaxRecipients]
+		}
+		to = to[len(batch):]
+		input := &sesv2.SendEmailInput{
+			FromEmailAddress: aws.String(from),
+			Destination:      &sesv2.Destination{BccAddresses: aws.StringSlice(batch)},
+			Content:          &sesv2.EmailContent{Raw: &sesv2.RawMessage{Data: raw}},
+		}
+		if eng.Config.SESConfigurationSet != "" {
+			input.ConfigurationSetName = aws.String(eng.Config.SESConfigurationSet)
+		}
+		if _, err := eng.ses.SendEmail(input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The parts of an SNS HTTP(S) delivery that matter here.
+type snsMessage struct {
+	Type         string
+	Message      string
+	SubscribeURL string
+}
+
+// The parts of an SES bounce/complaint notification (or event, when published
+// through a configuration set) that matter here.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// serveSESNotifications receives SES bounce and complaint notifications from
+// an SNS topic subscribed to /ses/notifications?token=SESNotificationToken,
+// confirming the subscription when SNS asks, and records each bounced or
+// complaining recipient with handleBounce.
+func (eng *Engine) serveSESNotifications(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(eng.Config.SESNotificationToken)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var msg snsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		u, err := url.Parse(msg.SubscribeURL)
+		if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Host, ".amazonaws.com") {
+			http.Error(w, "Bad SubscribeURL", http.StatusBadRequest)
+			return
+		}
+		resp, err := http.Get(msg.SubscribeURL)
+		if err != nil {
+			log15.Error("Error confirming SNS subscription", log15.Ctx{"context": "ses", "error": err})
+			http.Error(w, "Error confirming subscription", http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		log15.Info("Confirmed SNS subscription for SES notifications", log15.Ctx{"context": "ses"})
+	case "Notification":
+		var n sesNotification
+		if err := json.Unmarshal([]byte(msg.Message), &n); err != nil {
+			http.Error(w, "Bad notification", http.StatusBadRequest)
+			return
+		}
+		eng.recordSESNotification(&n)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// recordSESNotification maps an SES notification onto bounce events:
+// permanent bounces are hard, other bounces soft.
+func (eng *Engine) recordSESNotification(n *sesNotification) {
+	kind := n.NotificationType
+	if kind == "" {
+		kind = n.EventType
+	}
+	switch kind {
+	case "Bounce":
+		bounceKind := BounceSoft
+		if n.Bounce.BounceType == "Permanent" {
+			bounceKind = BounceHard
+		}
+		for _, rcpt := range n.Bounce.BouncedRecipients {
+			eng.handleBounce(rcpt.EmailAddress, bounceKind, rcpt.DiagnosticCode)
+		}
+	case "Complaint":
+		for _, rcpt := range n.Complaint.ComplainedRecipients {
+			eng.handleBounce(rcpt.EmailAddress, BounceComplaint, n.Complaint.ComplaintFeedbackType)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Length, in characters, of the excerpt posted to chat webhooks.
+const webhookExcerptLength = 300
+
+// webhookSummary renders a short, chat-friendly summary of a relayed message.
+func (eng *Engine) webhookSummary(em *Email, entry *ArchivedMessage) string {
+	author := em.Sender
+	if parsed, err := mail.ParseAddress(em.From); err == nil && parsed.Name != "" {
+		author = parsed.Name
+	}
+	excerpt := []rune(strings.TrimSpace(em.GetText()))
+	if len(excerpt) > webhookExcerptLength {
+		excerpt = append(excerpt[:webhookExcerptLength], '…')
+	}
+	summary := fmt.Sprintf("*%s* posted to %s: *%s*\n%s", author, eng.Config.ListAddress, em.Subject, string(excerpt))
+	if permalink := eng.ArchivePermalink(entry); permalink != "" {
+		summary += "\n" + permalink
+	}
+	return summary
+}
+
+// webhookPayload builds the JSON body for an incoming webhook URL. Discord
+// webhooks expect a "content" field, Slack (and most Slack-compatible chat
+// services, e.g. Mattermost and Rocket.Chat) expect "text".
+func webhookPayload(hookURL, summary string) map[string]string {
+	if strings.Contains(hookURL, "discord.com/") || strings.Contains(hookURL, "discordapp.com/") {
+		return map[string]string{"content": summary}
+	}
+	return map[string]string{"text": summary}
+}
+
+// mirrorToWebhooks POSTs a summary of a relayed message to each configured
+// chat webhook.
+func (eng *Engine) mirrorToWebhooks(em *Email, entry *ArchivedMessage) {
+	summary := eng.webhookSummary(em, entry)
+	for _, hookURL := range eng.Config.Webhooks {
+		body, err := json.Marshal(webhookPayload(hookURL, summary))
+		if err != nil {
+			log15.Error("Error encoding webhook payload", log15.Ctx{"context": "webhook", "error": err})
+			return
+		}
+		resp, err := http.Post(hookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log15.Error("Error posting to webhook", log15.Ctx{"context": "webhook", "error": err})
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			log15.Error("Webhook rejected message summary", log15.Ctx{"context": "webhook", "status": resp.Status})
+			continue
+		}
+		log15.Info("Posted message summary to webhook", log15.Ctx{"context": "webhook", "subject": em.Subject})
+	}
+}